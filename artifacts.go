@@ -0,0 +1,165 @@
+package superpose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// DimensionArtifact is a package compiled in a dimension. See
+// [Superpose.DimensionArtifacts].
+type DimensionArtifact struct {
+	// PkgPath is the original package path.
+	PkgPath string `json:"pkgPath"`
+	// Dimension is the dimension name.
+	Dimension string `json:"dimension"`
+	// DimensionPkgPath is the package path in the dimension. See
+	// [Superpose.DimensionPackagePath].
+	DimensionPkgPath string `json:"dimensionPkgPath"`
+	// PkgActionID is the action ID of the original package, i.e. the first part
+	// of its build ID.
+	PkgActionID []byte `json:"pkgActionID"`
+	// ActionID is the action ID of the package in the dimension. It is derived
+	// from the original action ID, the dimension, and [Config.Version].
+	ActionID []byte `json:"actionID"`
+	// File is the compiled package in the build cache, or empty if it is not
+	// cached.
+	File string `json:"file,omitempty"`
+	// IncludeDependencyPackages are the packages transformers included when the
+	// package was compiled, or empty if it is not cached.
+	IncludeDependencyPackages []string `json:"includeDependencyPackages,omitempty"`
+}
+
+// DimensionArtifacts returns the artifact for every package matching the given
+// package patterns in every dimension that applies to it, sorted by package
+// then dimension. This can be used outside of a build, e.g. by deploy
+// pipelines or debuggers, to find and verify the compiled dimension packages.
+//
+// Action IDs are those of the build, which include the toolexec's version, so
+// this must be run from the same toolexec executable via [RunMain] with the
+// "artifacts" command which writes the artifacts as JSON, e.g.
+// "superpose-mytool -buildtags mytag artifacts ./...". The packages are listed
+// with the executable as the toolexec, which builds any that are not yet
+// built. The artifacts are only found with the same build tags and overlay as
+// the build.
+func (s *Superpose) DimensionArtifacts(ctx context.Context, pkgPatterns ...string) ([]*DimensionArtifact, error) {
+	if !s.runningToolexec {
+		return nil, fmt.Errorf("dimension artifacts can only be found from the toolexec executable via RunMain")
+	}
+	if err := s.ensureFactoryTransformers(); err != nil {
+		return nil, err
+	}
+	toolexec, err := s.toolexecCommandLine()
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"list", "-f", "{{.ImportPath}}|{{.BuildID}}", "-export", "-toolexec", toolexec},
+		s.goListFlags()...)
+	pkgActionIDs, err := listPkgActionIDs(ctx, append(args, pkgPatterns...))
+	if err != nil {
+		return nil, err
+	}
+	pkgPaths := sortedKeys(pkgActionIDs)
+	dimApplies := make(map[string][]bool, len(s.Config.Transformers))
+	for _, dim := range s.Dimensions() {
+		if dimApplies[dim], err = s.appliesToPackages(ctx, dim, pkgPaths); err != nil {
+			return nil, fmt.Errorf("failed determining which packages dimension %v applies to: %w", dim, err)
+		}
+	}
+	var artifacts []*DimensionArtifact
+	for i, pkgPath := range pkgPaths {
+		for _, dim := range s.Dimensions() {
+			if !dimApplies[dim][i] {
+				continue
+			}
+			artifact, err := s.cachedDimensionArtifact(pkgPath, dim, pkgActionIDs[pkgPath])
+			if err != nil {
+				return nil, err
+			}
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	return artifacts, nil
+}
+
+// Outside of RunMain, transformers from factories have not been created yet, so
+// they are created with their default options
+func (s *Superpose) ensureFactoryTransformers() error {
+	for dim := range s.Config.TransformerFactories {
+		if _, ok := s.Config.Transformers[dim]; !ok {
+			return s.createFactoryTransformers("", nil)
+		}
+	}
+	return nil
+}
+
+// Not being in the cache is not an error, the file and dependency packages are
+// just left empty
+func (s *Superpose) cachedDimensionArtifact(pkgPath, dim string, pkgActionID []byte) (*DimensionArtifact, error) {
+	cache, err := s.buildCache()
+	if err != nil {
+		return nil, err
+	}
+	artifact := &DimensionArtifact{
+		PkgPath:          pkgPath,
+		Dimension:        dim,
+		DimensionPkgPath: s.DimensionPackagePath(pkgPath, dim),
+		PkgActionID:      pkgActionID,
+		ActionID:         s.dimPkgActionID(pkgActionID, dim),
+	}
+	// The package is not complete without its metadata
+	if file, _, err := cache.GetFile(s.buildActionIDToCacheActionID(artifact.ActionID)); err == nil {
+		if metadata, err := s.getDimPkgMetadata(artifact.ActionID); err == nil {
+			artifact.File = file
+			artifact.IncludeDependencyPackages = metadata.IncludeDependencyPackages
+		}
+	}
+	return artifact, nil
+}
+
+func (s *Superpose) writeDimensionArtifacts(ctx context.Context, w io.Writer, pkgPatterns []string) error {
+	artifacts, err := s.DimensionArtifacts(ctx, pkgPatterns...)
+	if err != nil {
+		return err
+	}
+	// Always an array, even if empty
+	if artifacts == nil {
+		artifacts = []*DimensionArtifact{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(artifacts)
+}
+
+// Runs "go" with the given list args whose format must be
+// "{{.ImportPath}}|{{.BuildID}}" and returns the action IDs keyed by package
+// path
+func listPkgActionIDs(ctx context.Context, args []string) (map[string][]byte, error) {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	// Only stdout has the list, the toolexec may log to stderr
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing packages: %w. Output: %s", err, stderr.Bytes())
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	pkgActionIDs := make(map[string][]byte, len(lines))
+	for _, line := range lines {
+		pkgPath, buildID, ok := strings.Cut(line, "|")
+		if !ok {
+			return nil, fmt.Errorf("invalid list line: %v", line)
+		} else if buildID == "" {
+			// Packages without a build ID, e.g. those that failed, have no action ID
+			continue
+		}
+		if pkgActionIDs[pkgPath], err = parseBuildIDActionID(buildID); err != nil {
+			return nil, fmt.Errorf("invalid list line %v: %w", line, err)
+		}
+	}
+	return pkgActionIDs, nil
+}
@@ -0,0 +1,135 @@
+package superpose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Fails if a dimension is not referenced in the binary being linked or a
+// package is compiled in a dimension but not imported from a package that
+// references it. See [Config.AuditDimensionUsage].
+func (s *Superpose) auditDimensionUsage(
+	ctx context.Context,
+	origPkgPaths []string,
+	dimApplies map[string][]bool,
+) error {
+	// Only packages a dimension applies to can reference it or be in it
+	applied := make(map[string]map[string]bool, len(dimApplies))
+	listPaths := map[string]struct{}{}
+	// Test files are only compiled for the package under test of a test binary
+	testOf := strings.TrimSuffix(s.pkgPath, ".test")
+	if testOf == s.pkgPath {
+		testOf = ""
+	}
+	for _, dim := range s.Dimensions() {
+		applied[dim] = map[string]bool{}
+		for i, origPkgPath := range origPkgPaths {
+			if !dimApplies[dim][i] {
+				continue
+			}
+			applied[dim][origPkgPath] = true
+			// The external test package can only be listed via the package it tests
+			if testOf != "" && origPkgPath == testOf+"_test" {
+				listPaths[testOf] = struct{}{}
+			} else {
+				listPaths[origPkgPath] = struct{}{}
+			}
+		}
+	}
+	if len(listPaths) == 0 {
+		return s.reportDimensionUsage(applied, nil, nil)
+	}
+
+	// List the packages for their files and imports
+	args := append([]string{"list", "-e", "-json=ImportPath,Name,Dir,GoFiles,CgoFiles,TestGoFiles,XTestGoFiles," +
+		"Imports,TestImports,XTestImports"}, s.goListFlags()...)
+	args = append(args, sortedKeys(listPaths)...)
+	cmd := exec.CommandContext(ctx, "go", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed listing packages: %w. Output: %s", err, stderr.Bytes())
+	}
+	dims := make(map[string]bool, len(applied))
+	for dim := range applied {
+		dims[dim] = true
+	}
+	var refs []*ManifestReference
+	imports := map[string][]string{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var pkg struct {
+			ImportPath, Name, Dir                        string
+			GoFiles, CgoFiles, TestGoFiles, XTestGoFiles []string
+			Imports, TestImports, XTestImports           []string
+		}
+		if err := dec.Decode(&pkg); err != nil {
+			return fmt.Errorf("failed decoding package list: %w", err)
+		}
+		files := append(pkg.GoFiles, pkg.CgoFiles...)
+		imports[pkg.ImportPath] = pkg.Imports
+		if pkg.ImportPath == testOf {
+			files = append(append(files, pkg.TestGoFiles...), pkg.XTestGoFiles...)
+			imports[pkg.ImportPath] = append(imports[pkg.ImportPath], pkg.TestImports...)
+			imports[pkg.ImportPath+"_test"] = pkg.XTestImports
+		}
+		for _, file := range files {
+			fileRefs, err := scanFileDimensionRefs(filepath.Join(pkg.Dir, file), pkg.ImportPath, pkg.Name, dims)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, fileRefs...)
+		}
+	}
+	return s.reportDimensionUsage(applied, refs, imports)
+}
+
+func (s *Superpose) reportDimensionUsage(
+	applied map[string]map[string]bool,
+	refs []*ManifestReference,
+	imports map[string][]string,
+) error {
+	var problems []string
+	for _, dim := range s.Dimensions() {
+		// Walk the imports in the dimension from each package that references it
+		reached := map[string]bool{}
+		var toVisit []string
+		for _, ref := range refs {
+			if ref.Dimension == dim && applied[dim][ref.PkgPath] && !reached[ref.PkgPath] {
+				reached[ref.PkgPath] = true
+				toVisit = append(toVisit, ref.PkgPath)
+			}
+		}
+		if len(toVisit) == 0 {
+			problems = append(problems,
+				fmt.Sprintf("dimension %v is not referenced by any bridge function var or <in> bool var", dim))
+			continue
+		}
+		for len(toVisit) > 0 {
+			pkgPath := toVisit[len(toVisit)-1]
+			toVisit = toVisit[:len(toVisit)-1]
+			for _, importPath := range imports[pkgPath] {
+				if applied[dim][importPath] && !reached[importPath] {
+					reached[importPath] = true
+					toVisit = append(toVisit, importPath)
+				}
+			}
+		}
+		for _, pkgPath := range sortedKeys(applied[dim]) {
+			if !reached[pkgPath] {
+				problems = append(problems, fmt.Sprintf("package %v is compiled in dimension %v, "+
+					"but not imported in the dimension by any package referencing it", pkgPath, dim))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("dimension usage audit of %v failed:\n\t%v", s.pkgPath, strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
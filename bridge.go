@@ -8,122 +8,249 @@ import (
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type bridgeFile struct {
 	fileName   string
 	dimPkgRefs dimPkgRefs
+	// True if any bridge function values are converted with the crossdim package
+	usesCrossDim bool
+	// Copies of Go files with static initializers for bridge vars keyed by the
+	// original, and the -trimpath rewrites from each copy to what the original
+	// would be rewritten to
+	patchedGoFiles   map[string]string
+	trimPathRewrites []string
 }
 
-// May return nil file which means no dimensions referenced
-func (s *Superpose) buildBridgeFile(ctx context.Context) (*bridgeFile, error) {
+const crossDimPkg = "github.com/cretz/superpose/crossdim"
+
+// Bridge is generated Go source that sets the bridge function vars of a package
+// to the functions they reference in other dimensions. See
+// [Superpose.GenerateBridge].
+type Bridge struct {
+	// PkgName is the name of the package.
+	PkgName string
+
+	// Source is the source of a Go file for the package with an init function
+	// that sets the vars, if any are not set by Patches. The file imports the
+	// dimension packages of the references, so they must be resolvable wherever
+	// the file is compiled.
+	Source []byte
+
+	// Patches are to the given files to set vars with static initializers
+	// instead of in Source when [Config.StaticBridge] is set. Apply them with
+	// [ApplyPatches]. Like Source, they import the dimension packages.
+	Patches []*Patch
+
+	// References are the bridge function vars set by Source, in the order of the
+	// files and then their declarations.
+	References []*BridgeReference
+
+	// UsesCrossDim is true if any function values are converted across
+	// dimensions with the crossdim package, in which case the package must
+	// import it.
+	UsesCrossDim bool
+}
+
+// BridgeReference is a bridge function var set by a [Bridge].
+type BridgeReference struct {
+	// Var is the name of the var.
+	Var string
+	// Dimension is the dimension referenced.
+	Dimension string
+	// Func is the name of the bridge function referenced.
+	Func string
+	// DimensionPkgPath is the path of the package in the dimension that the
+	// function is from.
+	DimensionPkgPath string
+	// Converted is true if the function value is converted with the crossdim
+	// package because its signature references types that are different in the
+	// dimension.
+	Converted bool
+	// Static is true if the var is set by a static initializer from
+	// [Bridge.Patches] instead of by Source. See [Config.StaticBridge].
+	Static bool
+}
+
+// GenerateBridge generates the bridge for the given files of the package with
+// the given path. The files must be parsed with comments. This is what the
+// toolexec executable compiles with each package that references dimensions,
+// so tools can generate the same wiring outside of a build, e.g. for code
+// generation or editor stubs. For an external test package, the package path
+// has the "_test" suffix. Nil is returned if no files reference a dimension of
+// the transformers.
+//
+// Only references are validated. The package is not type checked and "<in>"
+// bool vars are ignored since they are patched instead.
+func (s *Superpose) GenerateBridge(
+	ctx context.Context,
+	pkgPath string,
+	fset *token.FileSet,
+	files []*ast.File,
+) (*Bridge, error) {
 	// Get dimensions from every file
-	builder := &bridgeFileBuilder{
-		bridgeFile: bridgeFile{dimPkgRefs: dimPkgRefs{}},
-		imports:    map[string]string{},
-	}
-	for goFile := range s.flags.goFileIndexes {
-		if ok, err := s.buildInitStatements(ctx, builder, goFile); err != nil {
-			return nil, fmt.Errorf("failed building init statements for file %v: %w", goFile, err)
-		} else if !ok {
-			// Bail because of parsing issues
-			return nil, nil
+	builder := &bridgeBuilder{pkgPath: pkgPath, imports: map[string]string{}}
+	for _, file := range files {
+		if err := s.addBridgeStatements(ctx, builder, fset, file); err != nil {
+			return nil, fmt.Errorf("failed building bridge for file %v: %w", fset.Position(file.Package).Filename, err)
 		}
 	}
 
-	// If there were no references, no bridge file
-	if len(builder.dimPkgRefs) == 0 {
+	// If there were no references, no bridge
+	if len(builder.References) == 0 {
 		return nil, nil
 	}
 
-	// Build code for the file. We accept neither the import order nor the init
-	// statement order is deterministic.
-	code := "package " + builder.pkgName + "\n\n"
-	for importPath, alias := range builder.imports {
-		code += fmt.Sprintf("import %v %q\n", alias, importPath)
+	// Build code for the file. Imports are sorted, so the code is the same every
+	// time for the same files.
+	code := "package " + builder.PkgName + "\n\n"
+	for _, importPath := range sortedKeys(builder.imports) {
+		code += fmt.Sprintf("import %v %q\n", builder.imports[importPath], importPath)
 	}
-	code += "\nfunc init() {\n"
-	for _, stmt := range builder.initStatements {
-		code += "\t" + stmt + "\n"
+	if len(builder.initStatements) > 0 {
+		code += "\nfunc init() {\n"
+		for _, stmt := range builder.initStatements {
+			code += "\t" + stmt + "\n"
+		}
+		code += "}\n"
 	}
-	code += "}\n"
+	builder.Source = []byte(code)
+	return &builder.Bridge, nil
+}
 
-	// Write to a temp file
+// May return nil file which means no dimensions referenced
+func (s *Superpose) buildBridgeFile(ctx context.Context) (*bridgeFile, error) {
+	// To save some perf, only files that appear to reference a dimension anywhere
+	// are parsed
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, goFile := range sortedKeys(s.flags.goFileIndexes) {
+		b, err := os.ReadFile(goFile)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, dim := range s.Dimensions() {
+			if bytes.Contains(b, []byte("//"+dim+":")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		file, err := parser.ParseFile(fset, goFile, b, parser.AllErrors|parser.ParseComments)
+		// If there's an error parsing or the package differs, we are going to bail
+		// because the compiler will report a better error later
+		if err != nil {
+			s.Debugf("Ignoring %v, failed parsing: %v", goFile, err)
+			return nil, nil
+		} else if len(files) > 0 && file.Name.Name != files[0].Name.Name {
+			s.Debugf("Ignoring %v, package %v different than expected %v", goFile, file.Name.Name, files[0].Name.Name)
+			return nil, nil
+		}
+		files = append(files, file)
+	}
+	bridge, err := s.GenerateBridge(ctx, s.pkgPath, fset, files)
+	if bridge == nil || err != nil {
+		return nil, err
+	}
+	file := &bridgeFile{dimPkgRefs: dimPkgRefs{}, usesCrossDim: bridge.UsesCrossDim}
+	for _, ref := range bridge.References {
+		file.dimPkgRefs.addRef(s.pkgPath, ref.Dimension)
+	}
 	tmpDir, err := s.UseTempDir()
 	if err != nil {
 		return nil, err
 	}
+
+	// Write patched copies of files with static initializers. The compiler should
+	// record them the same way it would the originals.
+	if len(bridge.Patches) > 0 {
+		patched, err := ApplyPatches(fset, bridge.Patches)
+		if err != nil {
+			return nil, fmt.Errorf("failed patching static bridge vars: %w", err)
+		}
+		file.patchedGoFiles = make(map[string]string, len(patched))
+		for _, goFile := range sortedKeys(patched) {
+			patchedDir, err := os.MkdirTemp(tmpDir, "bridge-src-")
+			if err != nil {
+				return nil, err
+			}
+			patchedFile := filepath.Join(patchedDir, filepath.Base(goFile))
+			s.Debugf("Writing static bridge vars of %v to %v:\n%s\n", goFile, patchedFile, patched[goFile])
+			if err := os.WriteFile(patchedFile, patched[goFile], 0644); err != nil {
+				return nil, err
+			}
+			file.patchedGoFiles[goFile] = patchedFile
+			file.trimPathRewrites = append(file.trimPathRewrites,
+				patchedFile+"=>"+applyTrimPath(goFile, s.flags.args[s.flags.trimPathIndex]))
+		}
+	}
+
+	// Write to a temp file
 	f, err := os.CreateTemp(tmpDir, "superpose-*.go")
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	builder.fileName = f.Name()
-	s.Debugf("Writing the following bridge code to %v:\n%s\n", f.Name(), code)
-	if _, err := f.Write([]byte(code)); err != nil {
+	file.fileName = f.Name()
+	s.Debugf("Writing the following bridge code to %v:\n%s\n", f.Name(), bridge.Source)
+	if _, err := f.Write(bridge.Source); err != nil {
 		return nil, err
 	}
-	return &builder.bridgeFile, nil
+	return file, nil
 }
 
-type bridgeFileBuilder struct {
-	bridgeFile
+type bridgeBuilder struct {
+	Bridge
+	pkgPath        string
 	imports        map[string]string
 	initStatements []string
-	// Lazily populated on first file seen
-	pkgName string
 }
 
-// Returns false with no error if we should bail because of parsing issues
-func (s *Superpose) buildInitStatements(
+func (s *Superpose) addBridgeStatements(
 	ctx context.Context,
-	builder *bridgeFileBuilder,
-	goFile string,
-) (ok bool, err error) {
-	// We load the file ahead of time here since we may manip later
-	b, err := os.ReadFile(goFile)
-	if err != nil {
-		return false, err
-	}
-	// To save some perf, we're gonna look for the dimension comments anywhere in
-	// file
+	builder *bridgeBuilder,
+	fset *token.FileSet,
+	file *ast.File,
+) error {
+	// Find a dimension referenced in a comment, skipping the file if none
 	var foundDim string
-	for dim := range s.Config.Transformers {
-		if bytes.Contains(b, []byte("//"+dim+":")) {
-			foundDim = dim
-			break
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			for _, dim := range s.Dimensions() {
+				if foundDim == "" && strings.HasPrefix(comment.Text, "//"+dim+":") {
+					foundDim = dim
+				}
+			}
 		}
 	}
 	if foundDim == "" {
-		return true, nil
-	}
-
-	// Parse so we can check dim references
-	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, goFile, b, parser.AllErrors|parser.ParseComments)
-	// If there's an error parsing, we are going to ignore it because downstream
-	// will show the error later
-	if err != nil {
-		s.Debugf("Ignoring %v, failed parsing: %v", goFile, err)
-		return false, nil
+		return nil
 	}
 
-	// If the package is _test, fail. Otherwise, check/store package name
-	if strings.HasSuffix(file.Name.Name, "_test") {
-		return false, fmt.Errorf("cannot have dimensions in test files, found %v dimension in %v", foundDim, goFile)
-	} else if builder.pkgName == "" {
-		builder.pkgName = file.Name.Name
-	} else if builder.pkgName != file.Name.Name {
-		// Just ignore this, the actual compiler will report a better error
-		s.Debugf("Ignoring %v, package %v different than expected %v", goFile, file.Name.Name, builder.pkgName)
-		return false, nil
+	// If the package is _test but not an external test package, fail. Otherwise,
+	// check/store package name.
+	if strings.HasSuffix(file.Name.Name, "_test") && !strings.HasSuffix(builder.pkgPath, "_test") {
+		return fmt.Errorf("cannot have dimensions in test files, found %v dimension", foundDim)
+	} else if builder.PkgName == "" {
+		builder.PkgName = file.Name.Name
+	} else if builder.PkgName != file.Name.Name {
+		return fmt.Errorf("package %v different than expected %v", file.Name.Name, builder.PkgName)
 	}
 
 	// Check each top-level var decl for dimension reference and build up
-	// statements
-	anyStatements := false
+	// statements. Static initializers import dimension packages into the file
+	// itself.
+	anyStatements, anyInVars := false, false
+	staticImports := map[string]string{}
 	for _, decl := range file.Decls {
 		// Only var decl
 		decl, _ := decl.(*ast.GenDecl)
@@ -131,42 +258,40 @@ func (s *Superpose) buildInitStatements(
 			continue
 		}
 		for _, spec := range decl.Specs {
-			// Only vars w/ comments
+			// Only vars w/ dim:ref comments
 			spec, _ := spec.(*ast.ValueSpec)
-			if spec == nil || spec.Comment == nil || len(spec.Comment.List) != 1 {
+			dim, ref, ok := dimensionRef(spec)
+			if !ok {
 				continue
 			}
-			// Parse dim:ref
-			pieces := strings.SplitN(spec.Comment.List[0].Text, ":", 2)
-			if len(pieces) != 2 {
-				continue
-			}
-			dim, ref := strings.TrimPrefix(pieces[0], "//"), pieces[1]
 			t := s.Config.Transformers[dim]
 			// If no transformer or only "<in>", does not apply to us
-			if t == nil || ref == "<in>" {
+			if t == nil {
+				continue
+			} else if ref == "<in>" {
+				anyInVars = true
 				continue
 			}
 			// The transformer cannot be ignoring this package
 			applies, err := t.AppliesToPackage(
 				&TransformContext{Context: ctx, Superpose: s, Dimension: dim},
-				s.pkgPath,
+				builder.pkgPath,
 			)
 			if err != nil {
-				return false, err
+				return &TransformError{PkgPath: builder.pkgPath, Dimension: dim, Err: err}
 			} else if !applies {
-				return false, fmt.Errorf("dimension %v referenced in package %v, but it is not applied", dim, s.pkgPath)
+				return fmt.Errorf("dimension %v referenced in package %v, but it is not applied", dim, builder.pkgPath)
 			}
 
 			// Validate the var decl
 			if len(spec.Names) != 1 {
-				return false, fmt.Errorf("dimension func vars can only have a single identifier")
+				return fmt.Errorf("dimension func vars can only have a single identifier")
 			}
 			funcType, _ := spec.Type.(*ast.FuncType)
 			if funcType == nil {
-				return false, fmt.Errorf("var %v is not typed with a func", spec.Names[0].Name)
+				return fmt.Errorf("var %v is not typed with a func", spec.Names[0].Name)
 			} else if len(spec.Values) != 0 {
-				return false, fmt.Errorf("var %v cannot have default", spec.Names[0].Name)
+				return fmt.Errorf("var %v cannot have default", spec.Names[0].Name)
 			}
 
 			// Find function in same file that is being referenced
@@ -179,41 +304,95 @@ func (s *Superpose) buildInitStatements(
 				}
 			}
 			if funcDecl == nil {
-				return false, fmt.Errorf("unable to find func decl %v", ref)
+				return fmt.Errorf("unable to find func decl %v", ref)
 			} else if !funcDecl.Name.IsExported() {
-				return false, fmt.Errorf("referenced dimension bridge function %v is not exported", ref)
+				return fmt.Errorf("referenced dimension bridge function %v is not exported", ref)
 			}
 
 			// Confirm the signatures are identical (param names and everything). Just
 			// do a string print of the types to confirm.
 			var expected, actual strings.Builder
 			if err := printer.Fprint(&expected, fset, funcType); err != nil {
-				return false, err
+				return err
 			} else if err := printer.Fprint(&actual, fset, funcDecl.Type); err != nil {
-				return false, err
+				return err
 			} else if expected.String() != actual.String() {
-				return false, fmt.Errorf("expected var %v to have type %v, instead had %v",
+				return fmt.Errorf("expected var %v to have type %v, instead had %v",
 					spec.Names[0].Name, expected.String(), actual.String())
 			}
 
-			// Now confirmed, add init statement
-			s.Debugf("Setting var %v to function reference of %v in dimension %v", spec.Names[0].Name, ref, dim)
-			builder.dimPkgRefs.addRef(s.pkgPath, dim)
-			importAlias := builder.importAlias(s.DimensionPackagePath(s.pkgPath, dim))
-			builder.initStatements = append(builder.initStatements,
-				fmt.Sprintf("%v = %v.%v", spec.Names[0].Name, importAlias, ref))
+			// Now confirmed, add init statement. If the signature references types
+			// that are different in the dimension, the function has to be wrapped to
+			// convert values across.
+			bridgeRef := &BridgeReference{
+				Var:              spec.Names[0].Name,
+				Dimension:        dim,
+				Func:             ref,
+				DimensionPkgPath: s.DimensionPackagePath(builder.pkgPath, dim),
+			}
+			if bridgeRef.Converted, err = s.funcTypeNeedsConversion(ctx, dim, file, funcType); err != nil {
+				return err
+			} else if bridgeRef.Converted {
+				s.Debugf("Setting var %v to converting function reference of %v in dimension %v",
+					spec.Names[0].Name, ref, dim)
+				builder.UsesCrossDim = true
+				importAlias := builder.importAlias(bridgeRef.DimensionPkgPath)
+				builder.initStatements = append(builder.initStatements, fmt.Sprintf("%v.MustBridge(&%v, %v.%v)",
+					builder.importAlias(crossDimPkg), spec.Names[0].Name, importAlias, ref))
+			} else if s.Config.StaticBridge {
+				s.Debugf("Statically initializing var %v to function reference of %v in dimension %v",
+					spec.Names[0].Name, ref, dim)
+				bridgeRef.Static = true
+				importAlias := staticImports[bridgeRef.DimensionPkgPath]
+				if importAlias == "" {
+					importAlias = fmt.Sprintf("__superpose_bridge%v", len(staticImports)+1)
+					staticImports[bridgeRef.DimensionPkgPath] = importAlias
+				}
+				builder.Patches = append(builder.Patches, &Patch{
+					Range: Range{Pos: spec.Type.End()},
+					Str:   fmt.Sprintf(" = %v.%v", importAlias, ref),
+				})
+			} else {
+				importAlias := builder.importAlias(bridgeRef.DimensionPkgPath)
+				s.Debugf("Setting var %v to function reference of %v in dimension %v", spec.Names[0].Name, ref, dim)
+				builder.initStatements = append(builder.initStatements,
+					fmt.Sprintf("%v = %v.%v", spec.Names[0].Name, importAlias, ref))
+			}
+			builder.References = append(builder.References, bridgeRef)
 			anyStatements = true
 		}
 	}
 
-	// We expected at least one
-	if !anyStatements {
-		return false, fmt.Errorf("no proper dimension references found, though %v referenced", foundDim)
+	// Imports go on the same line as the package clause to keep line numbers
+	if len(staticImports) > 0 {
+		var imports strings.Builder
+		for _, importPath := range sortedKeys(staticImports) {
+			fmt.Fprintf(&imports, "; import %v %q", staticImports[importPath], importPath)
+		}
+		builder.Patches = append(builder.Patches, &Patch{Range: Range{Pos: file.Name.End()}, Str: imports.String()})
+	}
+
+	// We expected at least one, though files may only have "<in>" vars
+	if !anyStatements && !anyInVars {
+		return fmt.Errorf("no proper dimension references found, though %v referenced", foundDim)
 	}
-	return true, nil
+	return nil
 }
 
-func (b *bridgeFileBuilder) importAlias(importPath string) string {
+// Gives the dimension and reference of a var spec's "//dim:ref" comment, if it
+// has one. The dimension may not be a known one.
+func dimensionRef(spec *ast.ValueSpec) (dim, ref string, ok bool) {
+	if spec == nil || spec.Comment == nil || len(spec.Comment.List) != 1 {
+		return "", "", false
+	}
+	pieces := strings.SplitN(spec.Comment.List[0].Text, ":", 2)
+	if len(pieces) != 2 {
+		return "", "", false
+	}
+	return strings.TrimPrefix(pieces[0], "//"), pieces[1], true
+}
+
+func (b *bridgeBuilder) importAlias(importPath string) string {
 	alias := b.imports[importPath]
 	if alias == "" {
 		alias = fmt.Sprintf("import%v", len(b.imports)+1)
@@ -221,3 +400,68 @@ func (b *bridgeFileBuilder) importAlias(importPath string) string {
 	}
 	return alias
 }
+
+// Without type information, this conservatively assumes any named type that is
+// not predeclared or known to be from a package the dimension does not apply to
+// may be different in the dimension.
+func (s *Superpose) funcTypeNeedsConversion(
+	ctx context.Context,
+	dim string,
+	file *ast.File,
+	funcType *ast.FuncType,
+) (needsConversion bool, err error) {
+	tctx := &TransformContext{Context: ctx, Superpose: s, Dimension: dim}
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		if needsConversion || err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.Field:
+			// Names of params, results, fields, and methods are not types
+			ast.Inspect(n.Type, visit)
+			return false
+		case *ast.SelectorExpr:
+			// Qualified identifiers only need conversion if the package may be
+			// transformed
+			if pkgIdent, _ := n.X.(*ast.Ident); pkgIdent != nil {
+				needsConversion = true
+				if pkgPath := importPathByName(file, pkgIdent.Name); pkgPath != "" {
+					var applies bool
+					if applies, err = s.Config.Transformers[dim].AppliesToPackage(tctx, pkgPath); err != nil {
+						err = &TransformError{PkgPath: pkgPath, Dimension: dim, Err: err}
+					}
+					needsConversion = applies
+				}
+			}
+			return false
+		case *ast.Ident:
+			// Anything but predeclared types are declared in this package which is
+			// transformed
+			_, predeclared := types.Universe.Lookup(n.Name).(*types.TypeName)
+			needsConversion = !predeclared
+		}
+		return true
+	}
+	ast.Inspect(funcType, visit)
+	return
+}
+
+// Returns the import path for the name, or empty if unknown. Without type
+// information, unaliased imports are assumed to be named after the last path
+// element.
+func importPathByName(file *ast.File, name string) string {
+	for _, mport := range file.Imports {
+		pkgPath, err := strconv.Unquote(mport.Path.Value)
+		if err != nil {
+			continue
+		} else if mport.Name != nil {
+			if mport.Name.Name == name {
+				return pkgPath
+			}
+		} else if path.Base(pkgPath) == name {
+			return pkgPath
+		}
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+// Package buildinfo reports which dimensions were linked into the running
+// binary.
+//
+// When Superpose links a binary that imports this package, it records the
+// config version and the dimensions each package was compiled in. Deployed
+// services can use [Read] to report exactly which transformed code they
+// contain. Binaries built without Superpose have no info.
+package buildinfo
+
+import "encoding/json"
+
+// Set by Superpose with the linker's -X flag, so the name and type must not
+// change.
+var encoded string
+
+// Info is the info Superpose recorded when linking the binary.
+type Info struct {
+	// Version is the version of the toolexec executable from its config,
+	// including any hashes of flags and options appended to it.
+	Version string `json:"version"`
+	// Dimensions are the sorted dimensions with at least one package in the
+	// binary.
+	Dimensions []string `json:"dimensions,omitempty"`
+	// Packages are the sorted dimensions each package was compiled in, keyed by
+	// the original package path. Packages not compiled in any dimension are not
+	// present.
+	Packages map[string][]string `json:"packages,omitempty"`
+}
+
+// Read returns the info Superpose recorded when linking the binary. The
+// boolean is false if the binary was not linked by Superpose.
+func Read() (info *Info, ok bool) {
+	if encoded == "" {
+		return nil, false
+	}
+	info = &Info{}
+	if err := json.Unmarshal([]byte(encoded), info); err != nil {
+		return nil, false
+	}
+	return info, true
+}
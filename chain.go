@@ -0,0 +1,187 @@
+package superpose
+
+import (
+	"fmt"
+	"io"
+)
+
+// ChainTransformer runs several transformers in order as a single dimension's
+// transformer, so independent rewrites can be combined in one dimension instead
+// of written as one transformer. Create with [ChainTransformers].
+//
+// It applies to a package if any of its transformers do, and only those that
+// apply transform the package. Their results are merged, so their patches and
+// replacements still cannot overlap and their added files cannot share names.
+// It implements every optional transformer interface regardless of which its
+// transformers implement.
+type ChainTransformer struct {
+	transformers []Transformer
+}
+
+var (
+	_ BatchTransformer         = &ChainTransformer{}
+	_ CopyOnlyTransformer      = &ChainTransformer{}
+	_ CachedPackageTransformer = &ChainTransformer{}
+	_ io.Closer                = &ChainTransformer{}
+)
+
+// ChainTransformers creates a [ChainTransformer] running the given
+// transformers in order.
+func ChainTransformers(transformers ...Transformer) *ChainTransformer {
+	return &ChainTransformer{transformers: transformers}
+}
+
+// AppliesToPackage implements [Transformer.AppliesToPackage].
+func (c *ChainTransformer) AppliesToPackage(ctx *TransformContext, pkgPath string) (bool, error) {
+	for i, t := range c.transformers {
+		if applies, err := t.AppliesToPackage(ctx, pkgPath); err != nil {
+			return false, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if applies {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AppliesToPackages implements [BatchTransformer.AppliesToPackages], checking
+// in a single call for each transformer that is also a [BatchTransformer].
+func (c *ChainTransformer) AppliesToPackages(ctx *TransformContext, pkgPaths []string) ([]bool, error) {
+	applies := make([]bool, len(pkgPaths))
+	for i, t := range c.transformers {
+		batch, ok := t.(BatchTransformer)
+		if !ok {
+			for j, pkgPath := range pkgPaths {
+				if applies[j] {
+					continue
+				}
+				var err error
+				if applies[j], err = t.AppliesToPackage(ctx, pkgPath); err != nil {
+					return nil, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+				}
+			}
+			continue
+		}
+		batchApplies, err := batch.AppliesToPackages(ctx, pkgPaths)
+		if err != nil {
+			return nil, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if len(batchApplies) != len(pkgPaths) {
+			return nil, fmt.Errorf("transformer #%v of chain gave %v results for %v packages",
+				i+1, len(batchApplies), len(pkgPaths))
+		}
+		for j, batchApplied := range batchApplies {
+			applies[j] = applies[j] || batchApplied
+		}
+	}
+	return applies, nil
+}
+
+// CopyOnly implements [CopyOnlyTransformer.CopyOnly]. The package is only
+// copy-only if every transformer that applies to it is a [CopyOnlyTransformer]
+// that says it is.
+func (c *ChainTransformer) CopyOnly(ctx *TransformContext, pkgPath string) (bool, error) {
+	for i, t := range c.transformers {
+		if applies, err := t.AppliesToPackage(ctx, pkgPath); err != nil {
+			return false, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if !applies {
+			continue
+		}
+		copyOnlyTransformer, ok := t.(CopyOnlyTransformer)
+		if !ok {
+			return false, nil
+		}
+		if copyOnly, err := copyOnlyTransformer.CopyOnly(ctx, pkgPath); err != nil {
+			return false, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if !copyOnly {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// OnCachedPackage implements [CachedPackageTransformer.OnCachedPackage],
+// calling it on each transformer that applies to the package and is a
+// [CachedPackageTransformer].
+func (c *ChainTransformer) OnCachedPackage(ctx *TransformContext, pkgPath, archiveFile string) error {
+	for i, t := range c.transformers {
+		cachedTransformer, ok := t.(CachedPackageTransformer)
+		if !ok {
+			continue
+		}
+		if applies, err := t.AppliesToPackage(ctx, pkgPath); err != nil {
+			return fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if !applies {
+			continue
+		}
+		if err := cachedTransformer.OnCachedPackage(ctx, pkgPath, archiveFile); err != nil {
+			return fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Transform implements [Transformer.Transform], merging the results of the
+// transformers that apply to the package.
+func (c *ChainTransformer) Transform(ctx *TransformContext, pkg *TransformPackage) (*TransformResult, error) {
+	res := &TransformResult{}
+	for i, t := range c.transformers {
+		if applies, err := t.AppliesToPackage(ctx, pkg.PkgPath); err != nil {
+			return nil, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if !applies {
+			continue
+		}
+		tRes, err := t.Transform(ctx, pkg)
+		if err != nil {
+			return nil, fmt.Errorf("transformer #%v of chain failed: %w", i+1, err)
+		} else if tRes == nil {
+			continue
+		}
+		res.Patches = append(res.Patches, tRes.Patches...)
+		res.Replacements = append(res.Replacements, tRes.Replacements...)
+		res.OffsetPatches = append(res.OffsetPatches, tRes.OffsetPatches...)
+		for name, b := range tRes.AddFiles {
+			if _, ok := res.AddFiles[name]; ok {
+				return nil, fmt.Errorf("transformer #%v of chain added file %v already added", i+1, name)
+			} else if res.AddFiles == nil {
+				res.AddFiles = map[string][]byte{}
+			}
+			res.AddFiles[name] = b
+		}
+		for file, b := range tRes.ReplaceFiles {
+			if _, ok := res.ReplaceFiles[file]; ok {
+				return nil, fmt.Errorf("transformer #%v of chain replaced file %v already replaced", i+1, file)
+			} else if res.ReplaceFiles == nil {
+				res.ReplaceFiles = map[string][]byte{}
+			}
+			res.ReplaceFiles[file] = b
+		}
+		for file := range tRes.ExcludeFiles {
+			if res.ExcludeFiles == nil {
+				res.ExcludeFiles = map[string]struct{}{}
+			}
+			res.ExcludeFiles[file] = struct{}{}
+		}
+		for depPkg := range tRes.IncludeDependencyPackages {
+			if res.IncludeDependencyPackages == nil {
+				res.IncludeDependencyPackages = map[string]struct{}{}
+			}
+			res.IncludeDependencyPackages[depPkg] = struct{}{}
+		}
+		res.AddLineDirectives = res.AddLineDirectives || tRes.AddLineDirectives
+		res.LogPatchedFiles = res.LogPatchedFiles || tRes.LogPatchedFiles
+	}
+	return res, nil
+}
+
+// Close implements [io.Closer], closing every transformer that is also an
+// [io.Closer] and returning the first error.
+func (c *ChainTransformer) Close() error {
+	var firstErr error
+	for i, t := range c.transformers {
+		if closer, ok := t.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("transformer #%v of chain failed closing: %w", i+1, err)
+			}
+		}
+	}
+	return firstErr
+}
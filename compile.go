@@ -1,36 +1,58 @@
 package superpose
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/parser"
+	"go/scanner"
 	"go/token"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
+	"golang.org/x/exp/slices"
 	"golang.org/x/tools/go/packages"
 )
 
+// Load mode for packages given to transformers
+const transformLoadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedImports | packages.NeedTypes | packages.NeedTypesSizes |
+	packages.NeedSyntax | packages.NeedTypesInfo
+
 func (s *Superpose) compileDimensions(ctx context.Context) error {
 	// Collect transformers that apply to this package
 	transformers := make(map[string]Transformer, len(s.Config.Transformers))
-	for dim, t := range s.Config.Transformers {
+	for _, dim := range s.Dimensions() {
+		t := s.Config.Transformers[dim]
 		tctx := &TransformContext{Context: ctx, Superpose: s, Dimension: dim}
 		// Confirm it applies to this package
 		if applies, err := t.AppliesToPackage(tctx, s.pkgPath); err != nil {
-			return err
+			return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
 		} else if !applies {
 			continue
 		}
 
 		// Only add the transformer if cache is disabled or there is an error
 		// getting the cached file (meaning it is not in cache or other issue)
-		if !s.Config.ForceTransform {
+		// Cached packages are compiled again when writing source since they have
+		// none in the cache
+		if !s.Config.ForceTransform && s.Config.SourceOutputDir == "" {
 			if file, fileCheckErr := s.dimDepPkgFile(s.pkgPath, dim); fileCheckErr == nil {
 				s.Debugf("Skipping compiling %v in dimension %v, already cached at %v", s.pkgPath, dim, file)
+				s.summarizef("cached in dimension %v", dim)
+				if cachedTransformer, ok := t.(CachedPackageTransformer); ok {
+					if err := cachedTransformer.OnCachedPackage(tctx, s.pkgPath, file); err != nil {
+						return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
+					}
+				}
 				continue
 			}
 		}
@@ -41,76 +63,107 @@ func (s *Superpose) compileDimensions(ctx context.Context) error {
 	if len(transformers) == 0 {
 		return nil
 	}
-
-	// Load the packages
-	packagesLogf := s.Debugf
-	if !s.Config.Verbose {
-		packagesLogf = nil
-	}
-	var buildFlags []string
-	if s.buildTags != "" {
-		buildFlags = append(buildFlags, "-tags", s.buildTags)
-	}
-	pkgs, err := packages.Load(
-		&packages.Config{
-			Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
-				packages.NeedImports | packages.NeedTypes | packages.NeedTypesSizes |
-				packages.NeedSyntax | packages.NeedTypesInfo,
-			Logf:       packagesLogf,
-			Tests:      s.pkgForTest,
-			BuildFlags: buildFlags,
-		},
-		s.pkgPath,
-	)
-	if err != nil || len(pkgs) == 0 {
-		return err
+	// Without the overlay, "go list" gives different action IDs than the build,
+	// so the dimension packages could not be found when linking
+	if len(s.flags.overlay) > 0 && s.overlayFile == "" {
+		return fmt.Errorf("package %v has files replaced by the go command's -overlay, "+
+			"so the overlay file must also be given to toolexec as -overlay", s.pkgPath)
 	}
 
-	// Retain only the packages that match our expected path, doing sanity checks
-	// along the way
-	n := 0
-	for _, pkg := range pkgs {
-		// We'll debug-print any errors encountered, but we won't fail the build,
-		// we'll let the downstream Go compiler give those errors
-		if len(pkg.Errors) > 0 {
-			for i, err := range pkg.Errors {
-				s.Debugf("Failed loading package %v, error #%v: %v", s.pkgPath, i+1, err)
+	// Compile for copy-only dimensions without loading the package
+	for _, dim := range sortedKeys(transformers) {
+		tctx, err := s.compileTransformContext(ctx, dim)
+		if err != nil {
+			return err
+		}
+		if copyOnly, err := s.copyOnly(tctx); err != nil {
+			return err
+		} else if copyOnly {
+			if err := s.compileCopy(tctx); err != nil {
+				return fmt.Errorf("compilation of %v in copy-only dimension %v failed: %w", s.pkgPath, dim, err)
 			}
-			return nil
-		} else if len(pkg.CompiledGoFiles) != len(pkg.Syntax) {
-			// Sanity check to confirm files are same as compiled set
-			return fmt.Errorf("package %v has %v compiled Go files, but only %v parsed",
-				pkg.PkgPath, len(pkg.CompiledGoFiles), len(pkg.Syntax))
-		} else if pkg.Fset != pkgs[0].Fset {
-			// Sanity check to confirm the same fileset is used across all
-			return fmt.Errorf("fileset pointers differ across packages unexpectedly")
+			delete(transformers, dim)
 		}
+	}
 
-		// Keep all that match the path. This can be multiple in same-package test
-		// case situations.
-		if pkg.PkgPath == s.pkgPath {
-			pkgs[n] = pkg
-			n++
+	// Load the packages once per set of build tags and environment the
+	// dimensions use
+	pkgsByLoadKey := map[string][]*packages.Package{}
+	for _, dim := range sortedKeys(transformers) {
+		loadKey := s.dimensionLoadKey(dim)
+		if _, loaded := pkgsByLoadKey[loadKey]; loaded {
+			continue
 		}
-	}
-	pkgs = pkgs[:n]
-	if len(pkgs) == 0 {
-		return fmt.Errorf("package %v not found", s.pkgPath)
+		pkgs, err := s.loadTransformPackages(ctx, s.DimensionBuildTags(dim), s.Config.DimensionEnv[dim])
+		if err != nil {
+			return err
+		}
+		pkgsByLoadKey[loadKey] = pkgs
 	}
 
 	// Perform transformation and compilation for each dimension
-	for dim, transformer := range s.Config.Transformers {
-		tctx := &TransformContext{Context: ctx, Superpose: s, Dimension: dim}
+	for _, dim := range sortedKeys(transformers) {
+		transformer := transformers[dim]
+		tctx, err := s.compileTransformContext(ctx, dim)
+		if err != nil {
+			return err
+		}
+		// If there were load errors, we let the downstream Go compiler give them
+		pkgs := pkgsByLoadKey[s.dimensionLoadKey(dim)]
+		if len(pkgs) == 0 {
+			continue
+		}
 
 		// 1:1 with packages
 		results := make([]*TransformResult, len(pkgs))
 		resultDimPkgRefs := dimPkgRefs{}
 		for i, pkg := range pkgs {
 			// Collect user-defined patches
-			results[i], err = transformer.Transform(tctx, &TransformPackage{pkg})
+			var syntaxHashes [][]byte
+			if s.Config.CheckPackageMutation {
+				syntaxHashes = s.hashPackageSyntax(pkg)
+			}
+			pkgCtx := tctx
+			if s.Config.Hermetic {
+				pkgCtx = &TransformContext{}
+				*pkgCtx = *tctx
+				pkgCtx.hermetic = newHermeticScope(pkg)
+			}
+			overlay, err := s.flags.overlayContents()
 			if err != nil {
-				return fmt.Errorf("failed transforming %v to dimension %v: %w", s.pkgPath, dim, err)
+				return err
+			}
+			results[i], err = s.transformWithTimeout(pkgCtx, transformer, &TransformPackage{
+				Package:        pkg,
+				LangVersion:    s.flags.lang,
+				GoVersion:      s.flags.goVersion,
+				ExternalTestOf: s.pkgTestOf,
+				overlay:        overlay,
+			})
+			// Violations fail the transform even if the transformer ignored them
+			if pkgCtx.hermetic != nil {
+				if hermeticErr := pkgCtx.hermetic.err(); hermeticErr != nil {
+					err = hermeticErr
+				}
+			}
+			if err != nil {
+				return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
+			}
+			if syntaxHashes != nil {
+				if err := s.checkPackageSyntax(pkg, syntaxHashes); err != nil {
+					return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
+				}
+			}
+			replacementPatches, err := results[i].replacementPatches(pkg.Fset)
+			if err != nil {
+				return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
+			}
+			results[i].Patches = append(results[i].Patches, replacementPatches...)
+			offsetPatches, err := results[i].offsetPatches(pkg.Fset)
+			if err != nil {
+				return &TransformError{PkgPath: s.pkgPath, Dimension: dim, Err: err}
 			}
+			results[i].Patches = append(results[i].Patches, offsetPatches...)
 
 			// Patch imports
 			importPatches, dimPkgRefs, err := s.transformImports(tctx, pkg)
@@ -133,17 +186,200 @@ func (s *Superpose) compileDimensions(ctx context.Context) error {
 					return err
 				}
 			}
+
+			// Fail early with a clear error if the transformer touched what we patch
+			if err := checkManagedPatches(pkg.Fset, results[i].Patches); err != nil {
+				return fmt.Errorf("failed transforming %v to dimension %v: %w", s.pkgPath, dim, err)
+			}
 		}
 
 		// Compile the patches. Even if there aren't any, we need to perform the
 		// compilation.
-		if err := s.compilePatches(tctx, pkgs, results, resultDimPkgRefs); err != nil {
+		if err := s.compilePatches(tctx, pkgs, results, resultDimPkgRefs, false); err != nil {
 			return fmt.Errorf("compilation of patches to %v in dimension %v failed: %w", s.pkgPath, dim, err)
 		}
 	}
 	return nil
 }
 
+// Whether the transformer has no patches for the package, which is ignored if
+// the files must be reselected since that needs the package loaded
+func (s *Superpose) copyOnly(ctx *TransformContext) (bool, error) {
+	transformer, ok := s.Config.Transformers[ctx.Dimension].(CopyOnlyTransformer)
+	if !ok || s.dimensionReselectsGoFiles(ctx.Dimension) {
+		return false, nil
+	}
+	copyOnly, err := transformer.CopyOnly(ctx, s.pkgPath)
+	if err != nil {
+		return false, &TransformError{PkgPath: s.pkgPath, Dimension: ctx.Dimension, Err: err}
+	}
+	return copyOnly, nil
+}
+
+// Context for compiling the package in the dimension, which includes the output
+// files
+func (s *Superpose) compileTransformContext(ctx context.Context, dim string) (*TransformContext, error) {
+	tmpDir, err := s.UseTempDir()
+	if err != nil {
+		return nil, err
+	}
+	return &TransformContext{
+		Context:             ctx,
+		Superpose:           s,
+		Dimension:           dim,
+		OutputFile:          s.flags.args[s.flags.outputIndex],
+		DimensionOutputFile: filepath.Join(tmpDir, dim+"_pkg_.a"),
+	}, nil
+}
+
+// Compiles the package in a copy-only dimension from the Go files of the build.
+// The files are only parsed, not loaded and type checked, which is enough to
+// find imports and "<in>" bool vars.
+func (s *Superpose) compileCopy(ctx *TransformContext) error {
+	overlay, err := s.flags.overlayContents()
+	if err != nil {
+		return err
+	}
+	// Like loaded packages, files are named by the original file even if the
+	// compile args have its replacement
+	origFiles := make(map[string]string, len(s.flags.overlay))
+	for origFile, replacement := range s.flags.overlay {
+		origFiles[replacement] = origFile
+	}
+	goFiles := sortedKeys(s.flags.goFileIndexes)
+	sort.Slice(goFiles, func(i, j int) bool {
+		return s.flags.goFileIndexes[goFiles[i]] < s.flags.goFileIndexes[goFiles[j]]
+	})
+	pkg := &packages.Package{PkgPath: s.pkgPath, Fset: token.NewFileSet()}
+	for _, goFile := range goFiles {
+		if origFile, ok := origFiles[goFile]; ok {
+			goFile = origFile
+		}
+		b, err := readFile(goFile, overlay)
+		if err != nil {
+			return err
+		}
+		file, err := parser.ParseFile(pkg.Fset, goFile, b, parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("failed parsing %v: %w", goFile, err)
+		}
+		pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, goFile)
+		pkg.Syntax = append(pkg.Syntax, file)
+	}
+
+	// Unaliased imports cannot be patched without knowing the package names, so
+	// the imports are mapped to their dimension packages in the import cfg
+	// instead
+	pkgRefs := dimPkgRefs{}
+	for _, file := range pkg.Syntax {
+		for _, mport := range file.Imports {
+			if pkgPath, err := strconv.Unquote(mport.Path.Value); err != nil {
+				return err
+			} else if applies, err := s.Config.Transformers[ctx.Dimension].AppliesToPackage(ctx, pkgPath); err != nil {
+				return &TransformError{PkgPath: pkgPath, Dimension: ctx.Dimension, Err: err}
+			} else if applies {
+				pkgRefs.addRef(pkgPath, ctx.Dimension)
+			}
+		}
+	}
+
+	// Patch "<in>" bool vars
+	boolVarPatches, err := s.transformInBoolVars(ctx, pkg)
+	if err != nil {
+		return err
+	}
+	return s.compilePatches(ctx, []*packages.Package{pkg}, []*TransformResult{{Patches: boolVarPatches}}, pkgRefs, true)
+}
+
+// Key for how packages are loaded for the dimension
+func (s *Superpose) dimensionLoadKey(dim string) string {
+	return strings.Join(append([]string{s.DimensionBuildTags(dim)}, s.Config.DimensionEnv[dim]...), "\n")
+}
+
+// Whether the packages for the dimension are loaded differently than the build,
+// meaning the Go files may differ
+func (s *Superpose) dimensionReselectsGoFiles(dim string) bool {
+	return s.DimensionBuildTags(dim) != s.buildTags || len(s.Config.DimensionEnv[dim]) > 0
+}
+
+// Loads the packages matching the package being compiled using the given build
+// tags and additional environment. Returns no packages if there are load
+// errors.
+func (s *Superpose) loadTransformPackages(
+	ctx context.Context,
+	buildTags string,
+	env []string,
+) ([]*packages.Package, error) {
+	packagesLogf := s.Debugf
+	if !s.Config.Verbose {
+		packagesLogf = nil
+	}
+	var buildFlags []string
+	if buildTags != "" {
+		buildFlags = append(buildFlags, "-tags", buildTags)
+	}
+	// Later values take precedence
+	var loadEnv []string
+	if len(env) > 0 {
+		loadEnv = append(os.Environ(), env...)
+	}
+	// Load through the go command's overlay, if any, so the replaced files are
+	// what is transformed
+	overlay, err := s.flags.overlayContents()
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := packages.Load(
+		&packages.Config{
+			Context:    ctx,
+			Env:        loadEnv,
+			Mode:       transformLoadMode,
+			Logf:       packagesLogf,
+			Tests:      s.pkgForTest,
+			BuildFlags: buildFlags,
+			Overlay:    overlay,
+		},
+		s.pkgLoadPath(),
+	)
+	if err != nil || len(pkgs) == 0 {
+		return nil, err
+	}
+
+	// Retain only the packages that match our expected path, doing sanity checks
+	// along the way
+	n := 0
+	for _, pkg := range pkgs {
+		// We'll debug-print any errors encountered, but we won't fail the build,
+		// we'll let the downstream Go compiler give those errors
+		if len(pkg.Errors) > 0 {
+			for i, err := range pkg.Errors {
+				s.Debugf("Failed loading package %v, error #%v: %v", s.pkgPath, i+1, err)
+			}
+			return nil, nil
+		} else if len(pkg.CompiledGoFiles) != len(pkg.Syntax) {
+			// Sanity check to confirm files are same as compiled set
+			return nil, fmt.Errorf("package %v has %v compiled Go files, but only %v parsed",
+				pkg.PkgPath, len(pkg.CompiledGoFiles), len(pkg.Syntax))
+		} else if pkg.Fset != pkgs[0].Fset {
+			// Sanity check to confirm the same fileset is used across all
+			return nil, fmt.Errorf("fileset pointers differ across packages unexpectedly")
+		}
+
+		// Keep all that match the path. This can be multiple in same-package test
+		// case situations. For an external test package, this is only that package
+		// out of those loaded for the package under test.
+		if pkg.PkgPath == s.pkgPath {
+			pkgs[n] = pkg
+			n++
+		}
+	}
+	pkgs = pkgs[:n]
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("package %v not found", s.pkgPath)
+	}
+	return pkgs, nil
+}
+
 func (s *Superpose) transformImports(
 	ctx *TransformContext,
 	pkg *packages.Package,
@@ -155,7 +391,7 @@ func (s *Superpose) transformImports(
 			if pkgPath, err := strconv.Unquote(mport.Path.Value); err != nil {
 				return nil, nil, err
 			} else if applies, err := s.Config.Transformers[ctx.Dimension].AppliesToPackage(ctx, pkgPath); err != nil {
-				return nil, nil, err
+				return nil, nil, &TransformError{PkgPath: pkgPath, Dimension: ctx.Dimension, Err: err}
 			} else if applies {
 				// Replace the import path but leave the alias. If the alias is not
 				// present, explicitly set to what the package name was.
@@ -169,8 +405,9 @@ func (s *Superpose) transformImports(
 				}
 				// Set patch and dimension package reference
 				patches = append(patches, &Patch{
-					Range: RangeOf(mport),
-					Str:   fmt.Sprintf("%v %q", alias, s.DimensionPackagePath(pkgPath, ctx.Dimension)),
+					Range:   RangeOf(mport),
+					Str:     fmt.Sprintf("%v %q", alias, s.DimensionPackagePath(pkgPath, ctx.Dimension)),
+					managed: fmt.Sprintf("the import of %q at %v", pkgPath, pkg.Fset.Position(mport.Pos())),
 				})
 				pkgRefs.addRef(pkgPath, ctx.Dimension)
 			}
@@ -207,7 +444,11 @@ func (s *Superpose) transformInBoolVars(ctx *TransformContext, pkg *packages.Pac
 					return nil, fmt.Errorf("dimension in bool var %v must not have a value already", spec.Names[0].Name)
 				}
 				// Add a patch to set it to true after the end of the bool part
-				patches = append(patches, &Patch{Range: Range{Pos: spec.Type.End()}, Str: " = true"})
+				patches = append(patches, &Patch{
+					Range:   Range{Pos: spec.Type.End()},
+					Str:     " = true",
+					managed: fmt.Sprintf("the %v bool var %v", expectedComment, spec.Names[0].Name),
+				})
 			}
 		}
 	}
@@ -224,6 +465,9 @@ func (s *Superpose) addLineDirectives(
 	seenFiles := map[string]bool{}
 	var lineDirectives []*Patch
 	for _, patch := range transformed.Patches {
+		// Transformer patches that change the line count are followed by a line
+		// directive when applied, since only then is the text known
+		patch.restoreLine = patch.managed == ""
 		// Get the file for the patch and ensure not already seen
 		fileToken := pkg.Fset.File(patch.Range.Pos)
 		if fileToken == nil {
@@ -247,19 +491,91 @@ func (s *Superpose) addLineDirectives(
 
 		// Add the line directive to the end of the package
 		lineDirectives = append(lineDirectives, &Patch{
-			Range: Range{Pos: file.Package},
-			Str:   fmt.Sprintf("/*line %v:%v*/", fileToken.Name(), pkg.Fset.Position(file.Package).Line),
+			Range:   Range{Pos: file.Package},
+			Str:     fmt.Sprintf("/*line %v:%v*/", fileToken.Name(), pkg.Fset.Position(file.Package).Line),
+			managed: fmt.Sprintf("the line directive before the package clause of %v", fileToken.Name()),
 		})
 	}
 	transformed.Patches = append(transformed.Patches, lineDirectives...)
 	return nil
 }
 
+// Fingerprints each file of the package syntax, see
+// [Config.CheckPackageMutation]. Every node is hashed with its type and its
+// non-node fields, e.g. positions, names, and tokens, and the walk marks where
+// children end, so replaced, added, removed, or altered nodes all change it.
+func (s *Superpose) hashPackageSyntax(pkg *packages.Package) [][]byte {
+	hashes := make([][]byte, len(pkg.Syntax))
+	for i, file := range pkg.Syntax {
+		s.hash.Reset()
+		ast.Inspect(file, func(n ast.Node) bool {
+			if n == nil {
+				s.hash.Write([]byte{0})
+				return false
+			}
+			v := reflect.ValueOf(n).Elem()
+			fmt.Fprintf(s.hash, "\x01%T", n)
+			for j := 0; j < v.NumField(); j++ {
+				switch field := v.Field(j); field.Kind() {
+				case reflect.String:
+					fmt.Fprintf(s.hash, "|%q", field.String())
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					fmt.Fprintf(s.hash, "|%v", field.Int())
+				case reflect.Bool:
+					fmt.Fprintf(s.hash, "|%v", field.Bool())
+				}
+			}
+			return true
+		})
+		hashes[i] = s.hash.Sum(nil)
+	}
+	return hashes
+}
+
+func (s *Superpose) checkPackageSyntax(pkg *packages.Package, hashes [][]byte) error {
+	if len(pkg.Syntax) != len(hashes) {
+		return fmt.Errorf("%w: had %v syntax files, now %v", ErrPackageMutated, len(hashes), len(pkg.Syntax))
+	}
+	for i, hash := range s.hashPackageSyntax(pkg) {
+		if !bytes.Equal(hash, hashes[i]) {
+			return fmt.Errorf("%w: syntax of %v changed, transformers must patch or replace nodes instead",
+				ErrPackageMutated, pkg.CompiledGoFiles[i])
+		}
+	}
+	return nil
+}
+
+// Confirms no transformer patch overlaps a patch added by Superpose. Otherwise
+// applying them would only fail with a generic overlap error.
+func checkManagedPatches(fset *token.FileSet, patches []*Patch) error {
+	var managed []*Patch
+	for _, patch := range patches {
+		if patch.managed != "" {
+			managed = append(managed, patch)
+		}
+	}
+	for _, patch := range patches {
+		if patch.managed != "" {
+			continue
+		}
+		for _, managedPatch := range managed {
+			if patch.Range.Overlaps(&managedPatch.Range) {
+				return fmt.Errorf("patch at %v overlaps %v which is patched by superpose, transformers must not patch it",
+					fset.Position(patch.Range.Pos), managedPatch.managed)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Superpose) compilePatches(
 	ctx *TransformContext,
 	pkgs []*packages.Package,
 	transformed []*TransformResult,
 	dimPkgRefs dimPkgRefs,
+	// If true, imports of the original packages are mapped to the dimension
+	// packages instead of patched
+	mapImports bool,
 ) error {
 	// Copy the args
 	args := make([]string, len(s.flags.args))
@@ -270,41 +586,120 @@ func (s *Superpose) compilePatches(
 	if err != nil {
 		return err
 	}
+	// Original files may be anywhere including the read-only module cache, so
+	// patched files are never written next to them. Instead they are written with
+	// the same name into a temp dir per original dir.
+	patchedDirs := map[string]string{}
+	// Keyed by original file, value is patched file
+	patchedFiles := map[string]string{}
+	// The Go files are reselected if the dimension loads packages differently
+	reselectGoFiles := s.dimensionReselectsGoFiles(ctx.Dimension)
+	var trimPathRewrites []string
+	patchedDirFor := func(origDir string) (string, error) {
+		if patchedDir := patchedDirs[origDir]; patchedDir != "" {
+			return patchedDir, nil
+		}
+		patchedDir, err := os.MkdirTemp(tmpDir, ctx.Dimension+"-src-")
+		if err != nil {
+			return "", err
+		}
+		patchedDirs[origDir] = patchedDir
+		// The compiler should record the patched files the same way it would the
+		// original files, so we rewrite the patched dir to whatever the original
+		// dir would be rewritten to
+		trimPathRewrites = append(trimPathRewrites,
+			patchedDir+"=>"+applyTrimPath(origDir, args[s.flags.trimPathIndex]))
+		return patchedDir, nil
+	}
+	excludedFiles, err := s.excludedFiles(pkgs, transformed)
+	if err != nil {
+		return err
+	}
+	replacedFiles, replacedImports, err := s.replacedFiles(ctx, pkgs, transformed, excludedFiles)
+	if err != nil {
+		return err
+	}
 	for i, pkg := range pkgs {
-		patchedFileBytes, err := ApplyPatches(pkg.Fset, transformed[i].Patches)
+		overlay, err := s.flags.overlayContents()
+		if err != nil {
+			return err
+		}
+		patchedFileBytes, appliedPatches, err := applyPatches(pkg.Fset, transformed[i].Patches, overlay)
 		if err != nil {
 			return err
 		}
-		for origFile, newBytes := range patchedFileBytes {
-			tmpFile, err := os.CreateTemp(tmpDir, "*-"+filepath.Base(origFile))
+		// Replaced files are compiled as given in place of the patched file
+		for file, b := range replacedFiles {
+			if slices.Contains(pkg.CompiledGoFiles, file) {
+				patchedFileBytes[file] = b
+				delete(appliedPatches, file)
+			}
+		}
+		if err := s.checkPatchedSyntax(ctx, pkg, patchedFileBytes, appliedPatches); err != nil {
+			return err
+		}
+		for _, origFile := range sortedKeys(patchedFileBytes) {
+			// Excluded files may still have been patched, e.g. their imports
+			if excludedFiles[origFile] {
+				continue
+			}
+			fileIndex, inArgs := s.flags.goFileIndex(origFile)
+			if !inArgs && !reselectGoFiles {
+				if !slices.Contains(pkg.GoFiles, origFile) {
+					return fmt.Errorf("cannot patch %v since the go command generates it during the build, "+
+						"see TransformFile.GoFile", origFile)
+				}
+				// The go command may compile a file it generates in place of the
+				// source file, e.g. a copy instrumented for coverage. That file is
+				// compiled as given, unpatched.
+				s.Debugf("Not patching %v in dimension %v since the go command compiles another file in its place",
+					origFile, ctx.Dimension)
+				continue
+			}
+			newBytes := patchedFileBytes[origFile]
+			// The dir must be spelled like the compile args for the -trimpath rewrite
+			patchedDir, err := patchedDirFor(filepath.Dir(s.flags.argSpelling(origFile)))
 			if err != nil {
 				return err
 			}
+			patchedFile := filepath.Join(patchedDir, filepath.Base(origFile))
 			if s.Config.Verbose && transformed[i].LogPatchedFiles {
 				s.Debugf("In dimension %v, patched %v to:\n%s", ctx.Dimension, origFile, newBytes)
 			}
-			_, err = tmpFile.Write(newBytes)
-			if closeErr := tmpFile.Close(); closeErr != nil && err == nil {
-				err = closeErr
-			}
-			if err != nil {
+			if err := os.WriteFile(patchedFile, newBytes, 0666); err != nil {
 				return err
 			}
 			// Update arg
-			fileIndex, ok := s.flags.goFileIndexes[origFile]
-			if !ok {
-				return fmt.Errorf("cannot find expected file %v in compile args", origFile)
+			patchedFiles[origFile] = patchedFile
+			if inArgs {
+				args[fileIndex] = patchedFile
 			}
-			args[fileIndex] = tmpFile.Name()
 		}
 	}
 
+	// Add new files after the build's Go files
+	addedFiles, addedImports, err := s.writeAddedFiles(ctx, pkgs, transformed, excludedFiles, patchedDirFor)
+	if err != nil {
+		return err
+	}
+	for pkgPath, applies := range replacedImports {
+		addedImports[pkgPath] = applies
+	}
+	args = append(args, addedFiles...)
+
+	// Put our rewrites before the existing ones since the first match is used
+	if len(trimPathRewrites) > 0 {
+		if args[s.flags.trimPathIndex] != "" {
+			trimPathRewrites = append(trimPathRewrites, args[s.flags.trimPathIndex])
+		}
+		args[s.flags.trimPathIndex] = strings.Join(trimPathRewrites, ";")
+	}
+
 	// Update -p to the dimension package ref
 	args[s.flags.pkgIndex] = s.DimensionPackagePath(s.pkgPath, ctx.Dimension)
 
 	// Update -o to a temp file that we'll put in cache later
-	// TODO(cretz): Update trim path?
-	args[s.flags.outputIndex] = filepath.Join(tmpDir, ctx.Dimension+"_pkg_.a")
+	args[s.flags.outputIndex] = ctx.DimensionOutputFile
 
 	// Create a subkey of the action ID then create a new build ID that is
 	// sub-action ID + "/" + sub-action ID. We use a subkey because the cached
@@ -326,18 +721,51 @@ func (s *Superpose) compilePatches(
 		return fmt.Errorf("failed loading import cfg for compile: %w", err)
 	} else if err := importCfg.updateDimPkgRefs(dimPkgRefs, true); err != nil {
 		return fmt.Errorf("failed replacing dim package refs in compile import cfg: %w", err)
+	} else if dimPkgPath := args[s.flags.pkgIndex]; dimPkgPath == s.pkgPath || importCfg.hasPkgFile(dimPkgPath) {
+		return fmt.Errorf("package path %v of %v in dimension %v collides with another package",
+			dimPkgPath, s.pkgPath, ctx.Dimension)
+	}
+	// Unpatched imports still reference the original packages
+	if mapImports {
+		for _, origPkg := range sortedKeys(dimPkgRefs[ctx.Dimension]) {
+			importCfg.addImportMap(origPkg, s.DimensionPackagePath(origPkg, ctx.Dimension))
+		}
+	}
+	// Imports of added or replaced files that the dimension applies to are
+	// mapped to the dimension packages already referenced by the package, since
+	// the original files have had their imports of them patched
+	for _, origPkg := range sortedKeys(addedImports) {
+		if !addedImports[origPkg] {
+			continue
+		} else if _, ok := dimPkgRefs[ctx.Dimension][origPkg]; !ok {
+			return fmt.Errorf("added or replaced file imports %v which is in dimension %v but not imported by %v",
+				origPkg, ctx.Dimension, s.pkgPath)
+		}
+		importCfg.addImportMap(origPkg, s.DimensionPackagePath(origPkg, ctx.Dimension))
 	}
-	// Also include dependent packages
+	// Also include dependent packages, which includes other imports of added
+	// files
 	seenDependentPackages := map[string]bool{}
 	var metadata dimPkgMetadata
+	depPkgSets := make([]map[string]struct{}, 0, len(transformed)+1)
 	for _, transformedRes := range transformed {
-		for depPkg := range transformedRes.IncludeDependencyPackages {
+		depPkgSets = append(depPkgSets, transformedRes.IncludeDependencyPackages)
+	}
+	addedDepPkgs := map[string]struct{}{}
+	for pkgPath, applies := range addedImports {
+		if !applies {
+			addedDepPkgs[pkgPath] = struct{}{}
+		}
+	}
+	depPkgSets = append(depPkgSets, addedDepPkgs)
+	for _, depPkgs := range depPkgSets {
+		for _, depPkg := range sortedKeys(depPkgs) {
 			if seenDependentPackages[depPkg] {
 				continue
 			}
 			seenDependentPackages[depPkg] = true
 			// Include in import config
-			if err := importCfg.includePkg(depPkg); err != nil {
+			if err := importCfg.includePkg(ctx, depPkg); err != nil {
 				return fmt.Errorf("failed including dependent package %v in dimension %v: %w", depPkg, ctx.Dimension, err)
 			}
 			// Include in metadata
@@ -349,15 +777,47 @@ func (s *Superpose) compilePatches(
 		return fmt.Errorf("failed creating compile import cfg: %w", err)
 	}
 
+	// Replace or remove the Go files last since it changes arg indexes
+	if reselectGoFiles {
+		if args, err = s.reselectGoFiles(ctx, pkgs, args, patchedFiles, excludedFiles); err != nil {
+			return err
+		}
+	} else if len(excludedFiles) > 0 {
+		if args, err = s.removeExcludedFiles(args, excludedFiles); err != nil {
+			return err
+		}
+	}
+
 	// Run compile
+	if args, err = s.hookToolCommand(ctx.Dimension, args); err != nil {
+		return err
+	}
 	s.Debugf("Running compile for dimension %v on package %v with args: %v", ctx.Dimension, s.pkgPath, args)
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
+	release, err := s.acquireCompileSlot(ctx)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = s.toolStdout()
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	release()
+	if err != nil {
 		return err
 	}
 
+	// Write the source if requested, the Go files are last in the args
+	if s.Config.SourceOutputDir != "" {
+		goFilesStart := len(args)
+		for goFilesStart > 1 && strings.HasSuffix(args[goFilesStart-1], ".go") {
+			goFilesStart--
+		}
+		err := s.writeDimensionSource(ctx, args[goFilesStart:], sortedKeys(dimPkgRefs[ctx.Dimension]))
+		if err != nil {
+			return fmt.Errorf("failed writing source of %v in dimension %v: %w", s.pkgPath, ctx.Dimension, err)
+		}
+	}
+
 	// Copy the file to cache
 	// TODO(cretz): Go source assumes seek for os.Open here, but we do not. That
 	// means we have to copy everything into memory which is bad. Is there a
@@ -374,6 +834,400 @@ func (s *Superpose) compilePatches(
 		return err
 	}
 
-	// Also put metadata in cache
-	return s.setDimPkgMetadata(actionID, &metadata)
+	// Put metadata in cache last since it marks the package as complete
+	if err := s.setDimPkgMetadata(actionID, &metadata); err != nil {
+		return err
+	}
+
+	// Record the artifact for the tool invocation
+	pkgActionIDs, err := s.depPkgActionIDs()
+	if err != nil {
+		return err
+	}
+	artifact, err := s.cachedDimensionArtifact(s.pkgPath, ctx.Dimension, pkgActionIDs[s.pkgPath])
+	if err != nil {
+		return err
+	}
+	s.compiledArtifacts = append(s.compiledArtifacts, artifact)
+	s.summarizef("compiled in dimension %v", ctx.Dimension)
+	return nil
+}
+
+// Confirms patches do not add syntax newer than the language version of the
+// package. The compiler would also fail, but the error would be for the
+// original file with no mention of the transformer.
+func (s *Superpose) checkPatchedSyntax(
+	ctx *TransformContext,
+	pkg *packages.Package,
+	patched map[string][]byte,
+	applied map[string][]*appliedPatch,
+) error {
+	// Syntax errors are given for the patches that likely caused them instead of
+	// from the compiler for the patched temp files
+	var diags Diagnostics
+	byTransformer := false
+	for i, goFile := range pkg.CompiledGoFiles {
+		b, ok := patched[goFile]
+		if !ok {
+			continue
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), goFile, b, parser.SkipObjectResolution); err != nil {
+			var errs scanner.ErrorList
+			if !errors.As(err, &errs) {
+				return fmt.Errorf("failed parsing patched %v: %w", goFile, err)
+			}
+			for _, err := range errs {
+				diag, patch := patchSyntaxDiagnostic(pkg.Fset, applied[goFile], b, err)
+				diags = append(diags, diag)
+				byTransformer = byTransformer || (patch != nil && patch.managed == "")
+			}
+			continue
+		}
+		if s.flags.lang == "" {
+			continue
+		}
+		if syntax := newerPatchedSyntax(s.flags.lang, pkg.Syntax[i], goFile, b); syntax != nil {
+			return fmt.Errorf("transformer for dimension %v added %v to %v which require go1.%v, "+
+				"but the package's language version is %v", ctx.Dimension, syntax.desc, goFile, syntax.minor,
+				fileLangVersion(s.flags.lang, pkg.Syntax[i]))
+		}
+	}
+	if len(diags) == 0 {
+		return nil
+	} else if byTransformer {
+		return &TransformError{PkgPath: s.pkgPath, Dimension: ctx.Dimension, Err: diags}
+	}
+	return fmt.Errorf("patched files of %v in dimension %v are invalid: %w", s.pkgPath, ctx.Dimension, diags)
+}
+
+// Gives the diagnostic for a syntax error in the patched file, positioned at
+// the patch that likely caused it if any, and that patch
+func patchSyntaxDiagnostic(
+	fset *token.FileSet,
+	applied []*appliedPatch,
+	patched []byte,
+	err *scanner.Error,
+) (*Diagnostic, *Patch) {
+	// The error position may be adjusted by line directives, but the offset is
+	// always into the patched file
+	patchedLine := bytes.Count(patched[:err.Pos.Offset], []byte("\n")) + 1
+	a := patchAtOffset(applied, err.Pos.Offset)
+	if a == nil {
+		return &Diagnostic{
+			Position: err.Pos,
+			Message:  fmt.Sprintf("invalid syntax at line %v of the patched file: %v", patchedLine, err.Msg),
+		}, nil
+	}
+	str := a.str
+	if len(str) > 60 {
+		str = str[:57] + "..."
+	}
+	desc := "patch"
+	if a.patch.managed != "" {
+		desc = "superpose patch of " + a.patch.managed
+	}
+	return &Diagnostic{
+		Position: fset.Position(a.patch.Range.Pos),
+		Message: fmt.Sprintf("invalid syntax at line %v of the patched file after %v with %q: %v",
+			patchedLine, desc, str, err.Msg),
+	}, a.patch
+}
+
+// Collects the files the transformers exclude, confirming each is a compiled
+// Go file of the package it was transformed from
+func (s *Superpose) excludedFiles(pkgs []*packages.Package, transformed []*TransformResult) (map[string]bool, error) {
+	var excludedFiles map[string]bool
+	for i, pkg := range pkgs {
+		for _, file := range sortedKeys(transformed[i].ExcludeFiles) {
+			if !slices.Contains(pkg.CompiledGoFiles, file) {
+				return nil, fmt.Errorf("cannot exclude %v since it is not a compiled Go file of %v", file, s.pkgPath)
+			} else if excludedFiles == nil {
+				excludedFiles = map[string]bool{}
+			}
+			excludedFiles[file] = true
+		}
+	}
+	return excludedFiles, nil
+}
+
+// Removes the excluded files of the build's Go files from the args
+func (s *Superpose) removeExcludedFiles(args []string, excludedFiles map[string]bool) ([]string, error) {
+	removeIndexes := make(map[int]bool, len(excludedFiles))
+	for _, file := range sortedKeys(excludedFiles) {
+		index, ok := s.flags.goFileIndex(file)
+		if !ok {
+			return nil, fmt.Errorf("cannot exclude %v since the go command generates it during the build", file)
+		}
+		removeIndexes[index] = true
+	}
+	newArgs := make([]string, 0, len(args)-len(removeIndexes))
+	for i, arg := range args {
+		if !removeIndexes[i] {
+			newArgs = append(newArgs, arg)
+		}
+	}
+	return newArgs, nil
+}
+
+// Writes the files added by the transformers into the patched dir of each
+// package's dir, returning the written files and the imports of them that are
+// not imported by the package already, keyed by import path with whether the
+// dimension applies to it
+func (s *Superpose) writeAddedFiles(
+	ctx *TransformContext,
+	pkgs []*packages.Package,
+	transformed []*TransformResult,
+	excludedFiles map[string]bool,
+	patchedDirFor func(origDir string) (string, error),
+) (files []string, imports map[string]bool, err error) {
+	imports = map[string]bool{}
+	// Test packages share files with their non-test package, so the same file
+	// may be added for each
+	added := map[string][]byte{}
+	for i, pkg := range pkgs {
+		if len(transformed[i].AddFiles) == 0 {
+			continue
+		}
+		// Names cannot be any of the package's own, even those not compiled, but
+		// can replace excluded files
+		pkgNames := map[string]bool{}
+		var pkgFiles []string
+		for _, files := range [][]string{pkg.GoFiles, pkg.CompiledGoFiles, pkg.OtherFiles, pkg.IgnoredFiles} {
+			for _, file := range files {
+				if !excludedFiles[file] {
+					pkgNames[filepath.Base(file)] = true
+				}
+			}
+			pkgFiles = append(pkgFiles, files...)
+		}
+		if len(pkgFiles) == 0 {
+			return nil, nil, fmt.Errorf("cannot add files to %v since it has no files", s.pkgPath)
+		}
+		patchedDir, err := patchedDirFor(filepath.Dir(s.flags.argSpelling(pkgFiles[0])))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range sortedKeys(transformed[i].AddFiles) {
+			b := transformed[i].AddFiles[name]
+			if filepath.Base(name) != name || !strings.HasSuffix(name, ".go") {
+				return nil, nil, fmt.Errorf("added file name %q must be a file name ending in .go", name)
+			} else if pkgNames[name] {
+				return nil, nil, fmt.Errorf("added file %v already exists in %v", name, s.pkgPath)
+			} else if prev, ok := added[name]; ok {
+				if !bytes.Equal(prev, b) {
+					return nil, nil, fmt.Errorf("added file %v differs between variants of %v", name, s.pkgPath)
+				}
+				continue
+			}
+			added[name] = b
+			if err := s.collectGivenFileImports(ctx, pkg, "added file "+name, b, imports); err != nil {
+				return nil, nil, err
+			}
+			if s.Config.Verbose && transformed[i].LogPatchedFiles {
+				s.Debugf("In dimension %v, added %v to %v:\n%s", ctx.Dimension, name, s.pkgPath, b)
+			}
+			addedFile := filepath.Join(patchedDir, name)
+			if err := os.WriteFile(addedFile, b, 0666); err != nil {
+				return nil, nil, err
+			}
+			files = append(files, addedFile)
+		}
+	}
+	return files, imports, nil
+}
+
+// Collects the files the transformers replace, confirming each is a compiled Go
+// file of the package it was transformed from that is not excluded or patched
+// by the transformer. Also gives the imports of them like writeAddedFiles.
+func (s *Superpose) replacedFiles(
+	ctx *TransformContext,
+	pkgs []*packages.Package,
+	transformed []*TransformResult,
+	excludedFiles map[string]bool,
+) (files map[string][]byte, imports map[string]bool, err error) {
+	for i, pkg := range pkgs {
+		if len(transformed[i].ReplaceFiles) == 0 {
+			continue
+		}
+		for _, file := range sortedKeys(transformed[i].ReplaceFiles) {
+			b := transformed[i].ReplaceFiles[file]
+			if !slices.Contains(pkg.CompiledGoFiles, file) {
+				return nil, nil, fmt.Errorf("cannot replace %v since it is not a compiled Go file of %v", file, s.pkgPath)
+			} else if excludedFiles[file] {
+				return nil, nil, fmt.Errorf("cannot replace %v since it is also excluded", file)
+			}
+			// The replacement has no positions to patch, so the transformer must not
+			// patch the file. Patches by Superpose are dropped.
+			for _, patch := range transformed[i].Patches {
+				if patchFile := pkg.Fset.File(patch.Range.Pos); patch.managed == "" && patchFile != nil &&
+					patchFile.Name() == file {
+					return nil, nil, fmt.Errorf("patch at %v is in %v which is replaced, transformers must not patch it",
+						pkg.Fset.Position(patch.Range.Pos), file)
+				}
+			}
+			// Test packages share files with their non-test package, so the same file
+			// may be replaced for each
+			if prev, ok := files[file]; ok {
+				if !bytes.Equal(prev, b) {
+					return nil, nil, fmt.Errorf("replaced file %v differs between variants of %v", file, s.pkgPath)
+				}
+				continue
+			} else if files == nil {
+				files, imports = map[string][]byte{}, map[string]bool{}
+			}
+			files[file] = b
+			if err := s.collectGivenFileImports(ctx, pkg, "replaced file "+file, b, imports); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return files, imports, nil
+}
+
+// Collects the imports of a file given by a transformer, i.e. an added or
+// replaced file, that are not imported by the package already, keyed by import
+// path with whether the dimension applies to it
+func (s *Superpose) collectGivenFileImports(
+	ctx *TransformContext,
+	pkg *packages.Package,
+	desc string,
+	b []byte,
+	imports map[string]bool,
+) error {
+	file, err := parser.ParseFile(token.NewFileSet(), desc, b, parser.ImportsOnly)
+	if err != nil {
+		return fmt.Errorf("failed parsing %v: %w", desc, err)
+	} else if file.Name.Name != pkg.Name {
+		return fmt.Errorf("%v has package %v, expected %v", desc, file.Name.Name, pkg.Name)
+	}
+	for _, mport := range file.Imports {
+		pkgPath, err := strconv.Unquote(mport.Path.Value)
+		if err != nil {
+			return err
+		} else if pkgPath == "C" {
+			return fmt.Errorf("%v uses cgo which is unsupported", desc)
+		} else if pkgPath == "unsafe" {
+			continue
+		}
+		applies, err := s.Config.Transformers[ctx.Dimension].AppliesToPackage(ctx, pkgPath)
+		if err != nil {
+			return &TransformError{PkgPath: pkgPath, Dimension: ctx.Dimension, Err: err}
+		} else if applies || pkg.Imports[pkgPath] == nil {
+			imports[pkgPath] = applies
+		}
+	}
+	return nil
+}
+
+// Replaces the Go files in the compile args with those of the packages, which
+// were loaded with different build tags or environment than the build, using
+// the patched files where present
+func (s *Superpose) reselectGoFiles(
+	ctx *TransformContext,
+	pkgs []*packages.Package,
+	args []string,
+	patchedFiles map[string]string,
+	excludedFiles map[string]bool,
+) ([]string, error) {
+	// Collect the files, confirming the package can be compiled from Go files
+	// alone. Test packages share files with their non-test package.
+	var goFiles []string
+	seenGoFiles := map[string]bool{}
+	for _, pkg := range pkgs {
+		uncompiledGoFiles := make(map[string]bool, len(pkg.GoFiles))
+		for _, file := range pkg.GoFiles {
+			uncompiledGoFiles[file] = true
+		}
+		for _, file := range pkg.CompiledGoFiles {
+			if !uncompiledGoFiles[file] {
+				return nil, fmt.Errorf("package %v uses cgo in the dimension which is unsupported",
+					s.pkgPath)
+			} else if !seenGoFiles[file] && !excludedFiles[file] {
+				seenGoFiles[file] = true
+				goFiles = append(goFiles, file)
+			}
+		}
+		for _, file := range pkg.OtherFiles {
+			if strings.HasSuffix(file, ".s") {
+				return nil, fmt.Errorf("package %v has assembly in the dimension which is unsupported",
+					s.pkgPath)
+			}
+		}
+	}
+
+	// Remove the build's Go files and the assembly-only flags since the
+	// dimension has no assembly
+	goFileIndexes := make(map[int]bool, len(s.flags.goFileIndexes))
+	for _, index := range s.flags.goFileIndexes {
+		goFileIndexes[index] = true
+	}
+	newArgs := make([]string, 0, len(args)+len(goFiles))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-symabis" || args[i] == "-asmhdr" {
+			i++
+		} else if !goFileIndexes[i] {
+			newArgs = append(newArgs, args[i])
+		}
+	}
+
+	// Add the dimension's Go files
+	for _, file := range goFiles {
+		if patchedFile := patchedFiles[file]; patchedFile != "" {
+			file = patchedFile
+		} else if replacement, ok := s.flags.overlayReplacement(file); ok {
+			file = replacement
+		}
+		newArgs = append(newArgs, file)
+	}
+	s.Debugf("Reselected %v Go files for package %v in dimension %v with build tags %q and environment %v",
+		len(goFiles), s.pkgPath, ctx.Dimension, s.DimensionBuildTags(ctx.Dimension),
+		s.Config.DimensionEnv[ctx.Dimension])
+	return newArgs, nil
+}
+
+// Applies the first matching rewrite of the semicolon-delimited -trimpath
+// rewrites to the path the same way the compiler does. If none match, the path
+// is returned as is.
+func applyTrimPath(path, rewrites string) string {
+	for _, rewrite := range strings.Split(rewrites, ";") {
+		prefix, replace := rewrite, ""
+		if i := strings.LastIndex(rewrite, "=>"); i >= 0 {
+			prefix, replace = rewrite[:i], rewrite[i+len("=>"):]
+		}
+		if prefix == "" || !hasPathPrefix(path, prefix) {
+			continue
+		} else if len(path) == len(prefix) {
+			return replace
+		} else if replace == "" {
+			return path[len(prefix)+1:]
+		}
+		return replace + path[len(prefix):]
+	}
+	return path
+}
+
+// Case-insensitive and slash-insensitive path prefix check like the compiler
+func hasPathPrefix(s, prefix string) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		cs, cp := s[i], prefix[i]
+		if 'A' <= cs && cs <= 'Z' {
+			cs += 'a' - 'A'
+		}
+		if 'A' <= cp && cp <= 'Z' {
+			cp += 'a' - 'A'
+		}
+		if cs == '\\' {
+			cs = '/'
+		}
+		if cp == '\\' {
+			cp = '/'
+		}
+		if cs != cp {
+			return false
+		}
+	}
+	return len(s) == len(prefix) || s[len(prefix)] == '/' || s[len(prefix)] == '\\'
 }
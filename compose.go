@@ -0,0 +1,154 @@
+package superpose
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// What a toolexec executable gives for the "describe" command, see
+// [Config.ComposedToolexecs]
+type composedDescription struct {
+	Version            string              `json:"version"`
+	Dimensions         []string            `json:"dimensions"`
+	DimensionBuildTags map[string][]string `json:"dimensionBuildTags,omitempty"`
+	DimensionEnv       map[string][]string `json:"dimensionEnv,omitempty"`
+}
+
+func (s *Superpose) writeComposedDescription(w io.Writer) error {
+	desc := &composedDescription{Version: s.Config.Version, Dimensions: s.Dimensions()}
+	for _, dim := range desc.Dimensions {
+		if tags := s.Config.DimensionBuildTags[dim]; len(tags) > 0 {
+			if desc.DimensionBuildTags == nil {
+				desc.DimensionBuildTags = map[string][]string{}
+			}
+			desc.DimensionBuildTags[dim] = tags
+		}
+		if env := s.Config.DimensionEnv[dim]; len(env) > 0 {
+			if desc.DimensionEnv == nil {
+				desc.DimensionEnv = map[string][]string{}
+			}
+			desc.DimensionEnv[dim] = env
+		}
+	}
+	return json.NewEncoder(w).Encode(desc)
+}
+
+// Adds the dimensions of each composed toolexec as subprocess transformers and
+// appends their versions to ours
+func (s *Superpose) composeToolexecs(ctx context.Context) error {
+	if len(s.Config.ComposedToolexecs) == 0 {
+		return nil
+	}
+	// Copy the maps since they may be shared with the caller
+	transformers := make(map[string]Transformer, len(s.Config.Transformers))
+	for dim, t := range s.Config.Transformers {
+		transformers[dim] = t
+	}
+	buildTags := make(map[string][]string, len(s.Config.DimensionBuildTags))
+	for dim, tags := range s.Config.DimensionBuildTags {
+		buildTags[dim] = tags
+	}
+	env := make(map[string][]string, len(s.Config.DimensionEnv))
+	for dim, kvs := range s.Config.DimensionEnv {
+		env[dim] = kvs
+	}
+	versions := make([]string, 0, len(s.Config.ComposedToolexecs))
+	for _, command := range s.Config.ComposedToolexecs {
+		if len(command) == 0 {
+			return fmt.Errorf("composed toolexec command required")
+		}
+		desc, err := describeComposedToolexec(ctx, command)
+		if err != nil {
+			return err
+		}
+		s.Debugf("Composing toolexec %v with dimensions %v", command[0], desc.Dimensions)
+		t := NewSubprocessTransformer(append(append([]string(nil), command...), "serve")...)
+		for _, dim := range desc.Dimensions {
+			if _, ok := transformers[dim]; ok {
+				return fmt.Errorf("dimension %v of composed toolexec %v is already a dimension", dim, command[0])
+			}
+			transformers[dim] = t
+			if tags := desc.DimensionBuildTags[dim]; len(tags) > 0 {
+				buildTags[dim] = tags
+			}
+			if kvs := desc.DimensionEnv[dim]; len(kvs) > 0 {
+				env[dim] = kvs
+			}
+		}
+		versions = append(versions, desc.Version)
+	}
+	s.Config.Transformers, s.Config.DimensionBuildTags, s.Config.DimensionEnv = transformers, buildTags, env
+
+	// The composed versions are part of ours since their transformers change the
+	// transformed code
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	s.hash.Reset()
+	s.hash.Write(b)
+	s.Config.Version += "/" + base64.RawURLEncoding.EncodeToString(s.hash.Sum(nil)[:15])
+	return nil
+}
+
+func describeComposedToolexec(ctx context.Context, command []string) (*composedDescription, error) {
+	args := append(append([]string(nil), command[1:]...), "describe")
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed describing composed toolexec %v: %w. Output: %s", command[0], err, stderr.Bytes())
+	}
+	var desc composedDescription
+	if err := json.Unmarshal(b, &desc); err != nil {
+		return nil, fmt.Errorf("failed parsing description of composed toolexec %v: %w", command[0], err)
+	}
+	return &desc, nil
+}
+
+// Serves the transformers of this executable for the "serve" command
+type composedServer struct{ s *Superpose }
+
+var _ Transformer = &composedServer{}
+
+func (c *composedServer) AppliesToPackage(ctx *TransformContext, pkgPath string) (bool, error) {
+	t, ctx, err := c.transformer(ctx)
+	if err != nil {
+		return false, err
+	}
+	return t.AppliesToPackage(ctx, pkgPath)
+}
+
+func (c *composedServer) Transform(ctx *TransformContext, pkg *TransformPackage) (*TransformResult, error) {
+	t, ctx, err := c.transformer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.Transform(ctx, pkg)
+}
+
+// The context given only has a Superpose with what was in the request, so this
+// gives a copy of the context with ours, updated from the request, instead. This
+// way transformers can still use flag values and config.
+func (c *composedServer) transformer(ctx *TransformContext) (Transformer, *TransformContext, error) {
+	t := c.s.Config.Transformers[ctx.Dimension]
+	if t == nil {
+		return nil, nil, fmt.Errorf("unknown dimension %v", ctx.Dimension)
+	}
+	c.s.buildTags, c.s.pkgForTest = ctx.Superpose.buildTags, ctx.Superpose.pkgForTest
+	if ctx.Superpose.Config.Verbose {
+		c.s.Config.Verbose = true
+	}
+	if ctx.Superpose.Config.Hermetic {
+		c.s.Config.Hermetic = true
+	}
+	ctxCopy := *ctx
+	ctxCopy.Superpose = c.s
+	return t, &ctxCopy, nil
+}
@@ -0,0 +1,312 @@
+// Package crossdim converts values between dimensions.
+//
+// Types in transformed packages are different types in each dimension, so a
+// value of one cannot be used as the other. This package converts values by
+// copying them into the equivalent type of the other dimension. Types are
+// equivalent if they are the same type, or they have the same name and their
+// package paths are the same except for the dimension suffix, or they are
+// unnamed types of the same kind whose parts are equivalent.
+//
+// Bridge functions whose signatures use types from transformed packages are
+// wrapped with [MustBridge] automatically. Any package with such bridge
+// functions must import this package, even if only with a blank import.
+package crossdim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// Convert converts the given value to the equivalent value of type T. The
+// value is deep copied except for values whose type is the same in both
+// dimensions, interface values whose dynamic type already implements the
+// target interface, and function values which are wrapped like [Bridge].
+//
+// Pointers to the same value are converted to pointers to the same new value,
+// so cyclic data structures are supported. Values reachable through unexported
+// fields are converted too.
+func Convert[T any](v any) (T, error) {
+	var ret T
+	typ := reflect.TypeOf(&ret).Elem()
+	if v == nil {
+		// Only allowed if the target can be nil
+		switch typ.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+			return ret, nil
+		}
+		return ret, fmt.Errorf("cannot convert nil to %v", typ)
+	}
+	val, err := newConverter().convert(reflect.ValueOf(v), typ)
+	if err != nil {
+		return ret, err
+	}
+	reflect.ValueOf(&ret).Elem().Set(val)
+	return ret, nil
+}
+
+// Bridge sets the function pointed to by dst to a function that converts its
+// arguments to the types of fn, calls fn, and converts the results back. The
+// functions must have equivalent signatures. If a conversion fails during a
+// call, the call panics.
+func Bridge(dst any, fn any) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Pointer || dstVal.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("expected pointer to function, got %T", dst)
+	}
+	fnVal := reflect.ValueOf(fn)
+	if fnVal.Kind() != reflect.Func {
+		return fmt.Errorf("expected function, got %T", fn)
+	}
+	if err := equivalent(dstVal.Elem().Type(), fnVal.Type(), map[[2]reflect.Type]bool{}); err != nil {
+		return err
+	}
+	dstVal.Elem().Set(bridgeFunc(fnVal, dstVal.Elem().Type()))
+	return nil
+}
+
+// MustBridge is [Bridge] that panics on error.
+func MustBridge(dst any, fn any) {
+	if err := Bridge(dst, fn); err != nil {
+		panic(err)
+	}
+}
+
+// Returns a function of the given type that converts and calls fn
+func bridgeFunc(fn reflect.Value, typ reflect.Type) reflect.Value {
+	// Identical types need no conversion
+	if fn.Type() == typ {
+		return fn
+	}
+	return reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		fnType := fn.Type()
+		c := newConverter()
+		for i, arg := range args {
+			var err error
+			if args[i], err = c.convert(arg, fnType.In(i)); err != nil {
+				panic(fmt.Errorf("failed converting argument %v: %w", i, err))
+			}
+		}
+		var results []reflect.Value
+		if fnType.IsVariadic() {
+			results = fn.CallSlice(args)
+		} else {
+			results = fn.Call(args)
+		}
+		c = newConverter()
+		for i, result := range results {
+			var err error
+			if results[i], err = c.convert(result, typ.Out(i)); err != nil {
+				panic(fmt.Errorf("failed converting result %v: %w", i, err))
+			}
+		}
+		return results
+	})
+}
+
+// Checks whether the types are equivalent. Seen is for recursive types.
+func equivalent(a, b reflect.Type, seen map[[2]reflect.Type]bool) error {
+	if a == b || seen[[2]reflect.Type{a, b}] {
+		return nil
+	}
+	seen[[2]reflect.Type{a, b}] = true
+	if a.Kind() != b.Kind() {
+		return fmt.Errorf("%v and %v are different kinds", a, b)
+	} else if a.Name() != b.Name() || !pkgPathsEquivalent(a.PkgPath(), b.PkgPath()) {
+		return fmt.Errorf("%v and %v are not the same type", a, b)
+	}
+	switch a.Kind() {
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return fmt.Errorf("%v and %v have different lengths", a, b)
+		}
+		return equivalent(a.Elem(), b.Elem(), seen)
+	case reflect.Chan:
+		// Channels are shared, so they must be the same type
+		return fmt.Errorf("%v and %v are different channel types", a, b)
+	case reflect.Func:
+		if a.NumIn() != b.NumIn() || a.NumOut() != b.NumOut() || a.IsVariadic() != b.IsVariadic() {
+			return fmt.Errorf("%v and %v have different signatures", a, b)
+		}
+		for i := 0; i < a.NumIn(); i++ {
+			if err := equivalent(a.In(i), b.In(i), seen); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < a.NumOut(); i++ {
+			if err := equivalent(a.Out(i), b.Out(i), seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if err := equivalent(a.Key(), b.Key(), seen); err != nil {
+			return err
+		}
+		return equivalent(a.Elem(), b.Elem(), seen)
+	case reflect.Pointer, reflect.Slice:
+		return equivalent(a.Elem(), b.Elem(), seen)
+	case reflect.Struct:
+		if a.NumField() != b.NumField() {
+			return fmt.Errorf("%v and %v have different fields", a, b)
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if a.Field(i).Name != b.Field(i).Name {
+				return fmt.Errorf("%v and %v have different fields", a, b)
+			} else if err := equivalent(a.Field(i).Type, b.Field(i).Type, seen); err != nil {
+				return err
+			}
+		}
+	}
+	// Interfaces are checked by value during conversion
+	return nil
+}
+
+// Whether the package paths are the same or one is the other in a dimension
+func pkgPathsEquivalent(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"__") || strings.HasPrefix(b, a+"__")
+}
+
+type converter struct {
+	// Keyed by the source pointer and target type
+	pointers map[pointerKey]reflect.Value
+	// Results of equivalent checks keyed by source and target type
+	checked map[[2]reflect.Type]error
+}
+
+type pointerKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func newConverter() *converter {
+	return &converter{pointers: map[pointerKey]reflect.Value{}, checked: map[[2]reflect.Type]error{}}
+}
+
+func (c *converter) equivalent(a, b reflect.Type) error {
+	err, ok := c.checked[[2]reflect.Type{a, b}]
+	if !ok {
+		err = equivalent(a, b, map[[2]reflect.Type]bool{})
+		c.checked[[2]reflect.Type{a, b}] = err
+	}
+	return err
+}
+
+func (c *converter) convert(v reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	// Interfaces are converted as their dynamic value
+	if v.Kind() == reflect.Interface && typ.Kind() != reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("cannot convert nil %v to %v", v.Type(), typ)
+		}
+		v = v.Elem()
+	}
+	// Identical types need no conversion
+	if v.Type() == typ {
+		return v, nil
+	}
+	if typ.Kind() != reflect.Interface {
+		if err := c.equivalent(v.Type(), typ); err != nil {
+			return reflect.Value{}, fmt.Errorf("cannot convert %v to %v: %w", v.Type(), typ, err)
+		}
+	}
+	ret := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			elem, err := c.convert(v.Index(i), typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			ret.Index(i).Set(elem)
+		}
+	case reflect.Func:
+		if !v.IsNil() {
+			ret.Set(bridgeFunc(v, typ))
+		}
+	case reflect.Interface:
+		if v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				break
+			}
+			v = v.Elem()
+		}
+		// We can only keep values whose type implements the interface in this
+		// dimension since we cannot know what other type to convert to
+		if !v.Type().Implements(typ) {
+			return reflect.Value{}, fmt.Errorf("cannot convert %v to %v, it does not implement the interface", v.Type(), typ)
+		}
+		ret.Set(v)
+	case reflect.Map:
+		if v.IsNil() {
+			break
+		}
+		ret.Set(reflect.MakeMapWithSize(typ, v.Len()))
+		for iter := v.MapRange(); iter.Next(); {
+			key, err := c.convert(iter.Key(), typ.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			elem, err := c.convert(iter.Value(), typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			ret.SetMapIndex(key, elem)
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			break
+		}
+		key := pointerKey{ptr: v.Pointer(), typ: typ}
+		if existing, ok := c.pointers[key]; ok {
+			return existing, nil
+		}
+		ret.Set(reflect.New(typ.Elem()))
+		// Store before converting the element for cycles
+		c.pointers[key] = ret
+		elem, err := c.convert(v.Elem(), typ.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ret.Elem().Set(elem)
+	case reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+		ret.Set(reflect.MakeSlice(typ, v.Len(), v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			elem, err := c.convert(v.Index(i), typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			ret.Index(i).Set(elem)
+		}
+	case reflect.Struct:
+		// Unexported fields can only be accessed with an addressable value
+		if !v.CanAddr() {
+			addressable := reflect.New(v.Type()).Elem()
+			addressable.Set(v)
+			v = addressable
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			field, err := c.convert(exposed(v.Field(i)), typ.Field(i).Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("failed converting field %v: %w", typ.Field(i).Name, err)
+			}
+			exposed(ret.Field(i)).Set(field)
+		}
+	default:
+		// Basic kinds and channels
+		ret.Set(v.Convert(typ))
+	}
+	return ret, nil
+}
+
+// Returns the field value with unexported restrictions removed. Both types are
+// compiled from the same source, so this is no less safe than the code that
+// can already access the field.
+func exposed(field reflect.Value) reflect.Value {
+	if field.CanSet() {
+		return field
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
@@ -0,0 +1,214 @@
+package superpose
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// DecoratedPackage is the syntax of a [TransformPackage] as [dst] files, which
+// keep comments and spacing attached to the nodes they belong to. Unlike the
+// package's syntax, the files can be restructured freely, e.g. by moving,
+// wrapping, or removing nodes, and comments move with their nodes. See
+// [TransformPackage.Decorate].
+type DecoratedPackage struct {
+	// Files are the decorated files, 1:1 with the package's Syntax.
+	Files []*dst.File
+
+	// Decorator maps between nodes of the package's syntax and of Files, e.g.
+	// Decorator.Dst.Nodes gives the decorated node for a node of the syntax
+	// found with type information.
+	Decorator *decorator.Decorator
+
+	fset    *token.FileSet
+	syntax  []*ast.File
+	sources [][]byte
+}
+
+// Decorate gives the package's syntax decorated as [dst] files. Once changed,
+// [DecoratedPackage.Patches] re-prints them into patches to return in
+// [TransformResult.Patches]. Each call decorates the files again, so changes
+// to the files of one call are not seen by another.
+func (p *TransformPackage) Decorate() (*DecoratedPackage, error) {
+	d := &DecoratedPackage{
+		Decorator: decorator.NewDecorator(p.Fset),
+		fset:      p.Fset,
+		syntax:    p.Syntax,
+		sources:   make([][]byte, len(p.Syntax)),
+	}
+	for i, file := range p.Syntax {
+		name := p.Fset.File(file.Pos()).Name()
+		var err error
+		if d.sources[i], err = readFile(name, p.overlay); err != nil {
+			return nil, err
+		}
+		dstFile, err := d.Decorator.DecorateFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed decorating %v: %w", name, err)
+		}
+		d.Files = append(d.Files, dstFile)
+	}
+	return d, nil
+}
+
+// Patches re-prints the decorated files and gives a patch for each run of lines
+// that differs from the original file. Files are printed formatted like gofmt,
+// so a file that is not formatted may have lines patched that were not changed.
+// Patches cannot overlap, so lines changed here cannot be patched otherwise,
+// including lines with imports of packages the dimension applies to or with
+// "<in>" bool vars which Superpose patches itself. Set
+// [TransformResult.AddLineDirectives] so code after changed lines keeps its
+// original position.
+func (d *DecoratedPackage) Patches() ([]*Patch, error) {
+	var patches []*Patch
+	for i, file := range d.Files {
+		tokFile := d.fset.File(d.syntax[i].Pos())
+		var buf bytes.Buffer
+		if err := decorator.NewRestorer().Fprint(&buf, file); err != nil {
+			return nil, fmt.Errorf("failed printing decorated %v: %w", tokFile.Name(), err)
+		} else if bytes.Equal(buf.Bytes(), d.sources[i]) {
+			continue
+		}
+		origLines, origOffsets := splitLines(d.sources[i])
+		printedLines, _ := splitLines(buf.Bytes())
+		for _, hunk := range diffLines(origLines, printedLines) {
+			// Text of the patch is a template if it has "{{"
+			str := strings.Join(printedLines[hunk.printedStart:hunk.printedEnd], "")
+			str = strings.ReplaceAll(str, "{{", `{{"{{"}}`)
+			patch := &Patch{Range: Range{Pos: tokFile.Pos(origOffsets[hunk.origStart])}, Str: str}
+			if hunk.origEnd > hunk.origStart {
+				patch.Range.End = tokFile.Pos(origOffsets[hunk.origEnd])
+			}
+			patches = append(patches, patch)
+		}
+	}
+	return patches, nil
+}
+
+// Gives the lines with their line endings and the offset each starts at, plus
+// the offset of the end
+func splitLines(b []byte) (lines []string, offsets []int) {
+	for offset := 0; offset < len(b); {
+		end := bytes.IndexByte(b[offset:], '\n') + 1
+		if end == 0 {
+			end = len(b) - offset
+		}
+		lines = append(lines, string(b[offset:offset+end]))
+		offsets = append(offsets, offset)
+		offset += end
+	}
+	return lines, append(offsets, len(b))
+}
+
+// Lines origStart to origEnd of the original replaced with lines printedStart
+// to printedEnd of the printed
+type lineHunk struct {
+	origStart, origEnd       int
+	printedStart, printedEnd int
+}
+
+// Past this many differences, the rest of the lines in between the common
+// prefix and suffix are given as a single hunk
+const maxLineDiffs = 1000
+
+// Gives the runs of lines that differ using the greedy algorithm of Myers' "An
+// O(ND) Difference Algorithm and Its Variations"
+func diffLines(orig, printed []string) []lineHunk {
+	// Trim the common prefix and suffix first since changes are usually few
+	prefix := 0
+	for prefix < len(orig) && prefix < len(printed) && orig[prefix] == printed[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(orig)-prefix && suffix < len(printed)-prefix &&
+		orig[len(orig)-1-suffix] == printed[len(printed)-1-suffix] {
+		suffix++
+	}
+	a, b := orig[prefix:len(orig)-suffix], printed[prefix:len(printed)-suffix]
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+
+	// Find the furthest reaching path per diagonal k for each number of
+	// differences d, keeping the paths before each step to walk back through.
+	// Diagonal k of the paths before step d is at index k+d+1 of its trace.
+	n, m := len(a), len(b)
+	center := n + m + 1
+	v := make([]int, 2*center+1)
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && d <= maxLineDiffs && !found; d++ {
+		trace = append(trace, append([]int(nil), v[center-d-1:center+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[center+k-1] < v[center+k+1]) {
+				x = v[center+k+1]
+			} else {
+				x = v[center+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[center+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return []lineHunk{{prefix, prefix + n, prefix, prefix + m}}
+	}
+
+	// Walk back marking which lines of each are unchanged
+	origSame, printedSame := make([]bool, n), make([]bool, m)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d+1] < prev[k+1+d+1]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d+1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			origSame[x], printedSame[y] = true, true
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		origSame[x], printedSame[y] = true, true
+	}
+
+	// Collect the runs between unchanged lines
+	var hunks []lineHunk
+	for i, j := 0, 0; i < n || j < m; {
+		if i < n && j < m && origSame[i] && printedSame[j] {
+			i++
+			j++
+			continue
+		}
+		hunk := lineHunk{origStart: prefix + i, printedStart: prefix + j}
+		for i < n && !origSame[i] {
+			i++
+		}
+		for j < m && !printedSame[j] {
+			j++
+		}
+		hunk.origEnd, hunk.printedEnd = prefix+i, prefix+j
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
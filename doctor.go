@@ -0,0 +1,209 @@
+package superpose
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Oldest Go minor version supported, which is the first to set
+// TOOLEXEC_IMPORTPATH
+const minGoMinorVersion = 19
+
+type doctorCheck struct {
+	name string
+	// Returns a detail to show on success
+	run func() (string, error)
+	fix string
+}
+
+// Doctor checks that the environment is able to build with this Superpose tool
+// and writes the result of each check to w, with a suggested fix for each that
+// fails. Any packages given are checked to be buildable the way those in
+// [TransformResult.IncludeDependencyPackages] are built, which builds them if
+// they are not built yet. An error is returned if any check fails.
+//
+// [RunMain] runs this when the tool is run directly with "doctor" and optional
+// packages as arguments instead of by Go, e.g.
+// "superpose-mytool doctor example.com/mypkg".
+func (s *Superpose) Doctor(ctx context.Context, w io.Writer, includePkgs ...string) error {
+	checks := []doctorCheck{
+		{
+			name: "Go version",
+			run:  checkGoVersion,
+			fix:  fmt.Sprintf("Install Go 1.%v or newer and make sure it is the first go on the PATH", minGoMinorVersion),
+		},
+		{
+			name: "Build cache directory",
+			run:  s.checkBuildCacheDir,
+			fix:  "Make the directory writable or set Config.BuildCacheDir to a writable directory",
+		},
+		{
+			name: "Transformer content ID",
+			run:  LoadCurrentExeContentID,
+			fix: "Build the tool with \"go build\" instead of running it with \"go run\" so it has a build ID, " +
+				"or use a Config.Version that does not depend on it",
+		},
+		{
+			name: "Toolchain tools",
+			run:  s.checkToolchainTools,
+			fix: "Use the gc toolchain, or set Config.ToolNameFunc to give the Go tool name of each tool if the " +
+				"toolchain's tools are named differently",
+		},
+		{
+			name: "Toolexec version handshake",
+			run:  s.checkToolexecVersion,
+			fix: "Give \"-toolexec\" the absolute path of the built tool, quoted if it has spaces, " +
+				"and make sure no other toolexec wraps it",
+		},
+	}
+	for _, pkg := range includePkgs {
+		pkg := pkg
+		checks = append(checks, doctorCheck{
+			name: "Dependency package " + pkg,
+			run:  func() (string, error) { return s.pkgFile(ctx, pkg) },
+			fix: "Make sure the package is in a module required by the go.mod of the code being built and that " +
+				"\"go build " + pkg + "\" succeeds",
+		})
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Details and errors may have trailing newlines from command output
+		if detail, err := check.run(); err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL  %v: %v\n      Fix: %v\n", check.name, strings.TrimSpace(err.Error()), check.fix)
+		} else {
+			fmt.Fprintf(w, "ok    %v: %v\n", check.name, strings.TrimSpace(detail))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func checkGoVersion() (string, error) {
+	b, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed running go: %w", err)
+	}
+	version := strings.TrimSpace(string(b))
+	// Development versions are like "devel go1.23-abcdef Mon Jan 1 ..." and are
+	// assumed new enough
+	if strings.HasPrefix(version, "devel ") {
+		return version, nil
+	}
+	// Release versions are like "go1.22.3" or "go1.23rc1"
+	minor := strings.TrimPrefix(version, "go1.")
+	if end := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+		minor = minor[:end]
+	}
+	if n, err := strconv.Atoi(minor); err != nil || !strings.HasPrefix(version, "go1.") {
+		return "", fmt.Errorf("unrecognized version %q", version)
+	} else if n < minGoMinorVersion {
+		return "", fmt.Errorf("version %v is older than go1.%v", version, minGoMinorVersion)
+	}
+	return version, nil
+}
+
+func (s *Superpose) checkBuildCacheDir() (string, error) {
+	cacheDir, err := s.buildCacheDir()
+	if err != nil {
+		return "", err
+	} else if err := os.MkdirAll(cacheDir, 0777); err != nil {
+		return "", fmt.Errorf("failed creating %v: %w", cacheDir, err)
+	}
+	f, err := os.CreateTemp(cacheDir, "doctor-")
+	if err != nil {
+		return "", fmt.Errorf("failed writing to %v: %w", cacheDir, err)
+	}
+	f.Close()
+	return cacheDir, os.Remove(f.Name())
+}
+
+// Finds the gc tools of the toolchain by their tool name, keyed by name, and
+// gives the tool directory
+func (s *Superpose) toolchainTools() (map[string]string, string, error) {
+	b, err := exec.Command("go", "env", "GOTOOLDIR").Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed running go: %w", err)
+	}
+	toolDir := strings.TrimSpace(string(b))
+	entries, err := os.ReadDir(toolDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed reading tool directory: %w", err)
+	}
+	tools := map[string]string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			toolPath := filepath.Join(toolDir, entry.Name())
+			tools[s.toolName(toolPath)] = toolPath
+		}
+	}
+	return tools, toolDir, nil
+}
+
+func (s *Superpose) checkToolchainTools() (string, error) {
+	tools, toolDir, err := s.toolchainTools()
+	if err != nil {
+		return "", err
+	}
+	for _, tool := range []string{"compile", "link"} {
+		if tools[tool] == "" {
+			return "", fmt.Errorf("no %v tool in %v", tool, toolDir)
+		}
+	}
+	return tools["compile"] + ", " + tools["link"], nil
+}
+
+// Runs this executable the way Go does with -toolexec before building to get
+// the compiler version
+func (s *Superpose) checkToolexecVersion() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed getting executable: %w", err)
+	}
+	tools, toolDir, err := s.toolchainTools()
+	if err != nil {
+		return "", err
+	}
+	compilePath := tools["compile"]
+	if compilePath == "" {
+		return "", fmt.Errorf("no compile tool in %v", toolDir)
+	}
+	// Pass along the toolexec flags given before the doctor command, if any
+	var args []string
+	for i, arg := range s.origCLIArgs {
+		if arg == "doctor" {
+			args = append(args, s.origCLIArgs[:i]...)
+			break
+		}
+	}
+	cmd := exec.Command(exePath, append(args, compilePath, "-V=full")...)
+	// Go does not set the import path for the version check
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "TOOLEXEC_IMPORTPATH=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v -V=full failed: %w, output: %s", exePath, err, out)
+	}
+	line := strings.TrimSpace(string(out))
+	if !strings.Contains(line, "+superpose buildID=") {
+		return "", fmt.Errorf("unexpected %v -V=full output: %v", exePath, line)
+	} else if strings.ContainsAny(exePath, " \t") {
+		return "", fmt.Errorf("executable path %q has spaces and must be quoted in -toolexec", exePath)
+	}
+	return line, nil
+}
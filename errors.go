@@ -0,0 +1,109 @@
+package superpose
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// ErrNotToolexec is returned by [Superpose.RunMain] and [Superpose.PrepareTool]
+// when the arguments are not those Go gives a toolexec, i.e. there is no tool
+// after the toolexec flags.
+var ErrNotToolexec = errors.New("no tool name found, not run as toolexec")
+
+// ErrUnsupportedTool is wrapped by the error when the compile or link tool is
+// not from the gc toolchain, i.e. it does not report its version the way the gc
+// tools do.
+var ErrUnsupportedTool = errors.New("unsupported tool")
+
+// ErrNotCached is wrapped by the error when a package compiled in a dimension
+// is needed but is not in the build cache, e.g. when the cache was trimmed or
+// its directory changed between compiling and linking.
+var ErrNotCached = errors.New("not in build cache")
+
+// ErrPackageMutated is wrapped by the [TransformError] when a transformer
+// mutated the syntax of the package it was given. This is only checked if
+// [Config.CheckPackageMutation] is set.
+var ErrPackageMutated = errors.New("transformer mutated the package")
+
+// ErrTransformTimeout is wrapped by the [TransformError] when a transformer did
+// not return from [Transformer.Transform] within [Config.TransformTimeout].
+var ErrTransformTimeout = errors.New("transformer timed out")
+
+// ErrHermeticViolation is wrapped by the [TransformError] when a transformer
+// accessed a file or the network that [Config.Hermetic] does not allow.
+var ErrHermeticViolation = errors.New("hermetic mode violation")
+
+// TransformError is the error when a transformer fails, i.e. when a call to a
+// [Transformer] method or one of its optional interfaces returns an error.
+// Errors from Superpose itself, e.g. from the environment, are never this type.
+type TransformError struct {
+	// PkgPath is the package the transformer was called for. This is empty for
+	// calls for many packages, i.e. [BatchTransformer.AppliesToPackages].
+	PkgPath string
+	// Dimension is the dimension of the transformer.
+	Dimension string
+	// Err is the error returned by the transformer.
+	Err error
+}
+
+func (e *TransformError) Error() string {
+	if e.PkgPath == "" {
+		return fmt.Sprintf("transformer for dimension %v failed: %v", e.Dimension, e.Err)
+	}
+	return fmt.Sprintf("transformer for dimension %v failed for package %v: %v", e.Dimension, e.PkgPath, e.Err)
+}
+
+// Unwrap returns the error returned by the transformer.
+func (e *TransformError) Unwrap() error { return e.Err }
+
+// Diagnostic is a single problem a transformer found in the package it was
+// given. See [Diagnostics].
+type Diagnostic struct {
+	// Position is where the problem is, usually from the package's
+	// [token.FileSet.Position]. This is left out of the message if not valid.
+	Position token.Position
+	// Message describes the problem.
+	Message string
+}
+
+func (d *Diagnostic) String() string {
+	if !d.Position.IsValid() {
+		return d.Message
+	}
+	return fmt.Sprintf("%v: %v", d.Position, d.Message)
+}
+
+// Diagnostics is an error a transformer can return from
+// [Transformer.Transform] to report every problem it found at once instead of
+// only the first, so the compile fails with all of them and their positions.
+// Return it with [Diagnostics.Err] so an empty set is not an error.
+type Diagnostics []*Diagnostic
+
+// Addf adds a diagnostic at the given position with the message formatted from
+// the format and args.
+func (d *Diagnostics) Addf(pos token.Position, format string, args ...interface{}) {
+	*d = append(*d, &Diagnostic{Position: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns the diagnostics as an error or nil if there are none.
+func (d Diagnostics) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	return d
+}
+
+func (d Diagnostics) Error() string {
+	if len(d) == 1 {
+		return d[0].String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v problems:", len(d))
+	for _, diag := range d {
+		b.WriteString("\n\t")
+		b.WriteString(diag.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+var shoutGreet func() string //shout:Greet
+var traceGreet func() string //trace:Greet
+
+func main() {
+	fmt.Println(Greet())
+	fmt.Println(shoutGreet())
+	fmt.Println(traceGreet())
+}
+
+func Greet() string {
+	return "hello, world"
+}
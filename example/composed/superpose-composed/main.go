@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/example/composed/transformers/shout"
+	"github.com/cretz/superpose/example/composed/transformers/trace"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version: superpose.MustLoadCurrentExeContentID(),
+			// Transformers from libraries are created with options once flags are
+			// parsed
+			TransformerFactories: map[string]superpose.TransformerFactory{
+				"shout": shout.New,
+				"trace": trace.New,
+			},
+			// These defaults can be replaced with the "-config" file or flags like
+			// "-trace.packages"
+			TransformerOptions: map[string]superpose.TransformerOptions{
+				"shout": {Packages: []string{"github.com/cretz/superpose/example/composed"}},
+				"trace": {Packages: []string{"github.com/cretz/superpose/example/composed"}},
+			},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
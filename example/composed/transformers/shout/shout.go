@@ -0,0 +1,64 @@
+// Package shout is a transformer library that uppercases string literals.
+//
+// Supported features:
+//
+//   - "exclaim" - Also appends "!" to every string literal
+package shout
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// New creates a shout transformer that applies to the packages in the options.
+// This is a superpose.TransformerFactory.
+func New(options superpose.TransformerOptions) (superpose.Transformer, error) {
+	return &transformer{options: options}, nil
+}
+
+type transformer struct {
+	options superpose.TransformerOptions
+}
+
+func (t *transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return t.options.MatchesPackage(pkgPath), nil
+}
+
+func (t *transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	res := &superpose.TransformResult{LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ImportSpec:
+				// Import paths are string literals too
+				return false
+			case *ast.BasicLit:
+				if n.Kind != token.STRING {
+					return true
+				}
+				s, err := strconv.Unquote(n.Value)
+				if err != nil {
+					return true
+				}
+				s = strings.ToUpper(s)
+				if t.options.Features["exclaim"] {
+					s += "!"
+				}
+				// Quoting never adds lines, so line numbers are unchanged
+				res.Patches = append(res.Patches, &superpose.Patch{
+					Range: superpose.RangeOf(n),
+					Str:   strconv.Quote(s),
+				})
+			}
+			return true
+		})
+	}
+	return res, nil
+}
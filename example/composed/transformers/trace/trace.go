@@ -0,0 +1,51 @@
+// Package trace is a transformer library that prints to stderr on every
+// function entry.
+//
+// Supported features:
+//
+//   - "exit" - Also prints on every function exit
+package trace
+
+import (
+	"fmt"
+	"go/ast"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+// New creates a trace transformer that applies to the packages in the options.
+// This is a superpose.TransformerFactory.
+func New(options superpose.TransformerOptions) (superpose.Transformer, error) {
+	return &transformer{options: options}, nil
+}
+
+type transformer struct {
+	options superpose.TransformerOptions
+}
+
+func (t *transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return t.options.MatchesPackage(pkgPath), nil
+}
+
+func (t *transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	res := &superpose.TransformResult{LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Body == nil {
+				continue
+			}
+			// We use the println builtin so no imports are needed
+			stmts := fmt.Sprintf("println(\"enter\", %q)", decl.Name.Name)
+			if t.options.Features["exit"] {
+				stmts += fmt.Sprintf("; defer println(\"exit\", %q)", decl.Name.Name)
+			}
+			res.Patches = append(res.Patches, recipes.PrependStatements(decl.Body, stmts))
+		}
+	}
+	return res, nil
+}
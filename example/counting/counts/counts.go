@@ -0,0 +1,103 @@
+// Package counts holds the counters used by the counting dimension.
+//
+// This package is shared between the dimension and non-dimension code, so
+// counts from the dimension can be read outside of it.
+package counts
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Site is where something is counted.
+type Site struct {
+	// Kind is "call" for function entries or "make", "new", or "append" for
+	// those built-in calls.
+	Kind string
+	// Func is the full name of the function. Function literals are named after
+	// their enclosing function with a ".func<N>" suffix.
+	Func string
+	// Pos is the file and line of the function or built-in call.
+	Pos string
+}
+
+// Counter is the counter for a single site.
+type Counter struct {
+	Site
+	count uint64
+}
+
+// Inc increments the counter.
+func (c *Counter) Inc() { atomic.AddUint64(&c.count, 1) }
+
+// Count returns the current count.
+func (c *Counter) Count() uint64 { return atomic.LoadUint64(&c.count) }
+
+var (
+	counters     []*Counter
+	countersLock sync.Mutex
+)
+
+// Register creates counters for the given sites. The counting dimension calls
+// this once per file with every site in the file.
+func Register(sites ...Site) []*Counter {
+	ret := make([]*Counter, len(sites))
+	for i, site := range sites {
+		ret[i] = &Counter{Site: site}
+	}
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	counters = append(counters, ret...)
+	return ret
+}
+
+// Alloc increments the counter and returns the given value. The counting
+// dimension wraps every make, new, and append call with this.
+func Alloc[T any](c *Counter, v T) T {
+	c.Inc()
+	return v
+}
+
+// SiteCount is the count at a site at the time of [Snapshot].
+type SiteCount struct {
+	Site
+	Count uint64
+}
+
+// Snapshot returns the current counts for all sites with a non-zero count
+// sorted by count descending.
+func Snapshot() []SiteCount {
+	countersLock.Lock()
+	var ret []SiteCount
+	for _, c := range counters {
+		if count := c.Count(); count > 0 {
+			ret = append(ret, SiteCount{Site: c.Site, Count: count})
+		}
+	}
+	countersLock.Unlock()
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Count > ret[j].Count })
+	return ret
+}
+
+// Reset sets all counts to zero.
+func Reset() {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	for _, c := range counters {
+		atomic.StoreUint64(&c.count, 0)
+	}
+}
+
+// Dump writes all non-zero counts to the given writer sorted by count
+// descending.
+func Dump(w io.Writer) error {
+	for _, c := range Snapshot() {
+		if _, err := fmt.Fprintf(w, "%8d %-6v %v (%v)\n", c.Count, c.Kind, c.Func, c.Pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
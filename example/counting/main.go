@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose/example/counting/counts"
+)
+
+const text = `the quick brown fox jumps over the lazy dog
+the dog barks and the fox runs
+a quick brown dog jumps over a lazy fox`
+
+type wordCount struct {
+	word  string
+	count int
+}
+
+// TopWords returns the most frequent words in the text.
+func TopWords(n int) []string {
+	freq := make(map[string]int)
+	for _, line := range strings.Split(text, "\n") {
+		for _, word := range strings.Fields(line) {
+			freq[word]++
+		}
+	}
+	var words []wordCount
+	for word, count := range freq {
+		words = append(words, wordCount{word, count})
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if words[i].count != words[j].count {
+			return words[i].count > words[j].count
+		}
+		return words[i].word < words[j].word
+	})
+	top := make([]string, 0, n)
+	for _, w := range words[:n] {
+		top = append(top, format(w))
+	}
+	return top
+}
+
+func format(w wordCount) string {
+	return fmt.Sprintf("%v (%v)", w.word, w.count)
+}
+
+var topWordsCounted func(n int) []string //counting:TopWords
+
+func main() {
+	fmt.Println("Top words:", TopWords(3))
+	fmt.Println("Top words counted:", topWordsCounted(3))
+	fmt.Println("Counts:")
+	if err := counts.Dump(os.Stdout); err != nil {
+		panic(err)
+	}
+}
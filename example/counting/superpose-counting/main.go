@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"counting": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// Any of our packages but the counts package itself which we want shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/counting") &&
+		!strings.Contains(pkgPath, "counts"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	for i, file := range pkg.Syntax {
+		t := &transformCounts{pkg: pkg, res: res, countersVar: fmt.Sprintf("__counters%v", i)}
+		for _, decl := range file.Decls {
+			if funcDecl, _ := decl.(*ast.FuncDecl); funcDecl != nil && funcDecl.Body != nil {
+				t.transformFunc(funcDecl)
+			}
+		}
+		if len(t.sites) == 0 {
+			continue
+		}
+		// Add our import and our counters at the very end of the file
+		if err := res.AddImport(ctx, file, countsPkg, "__counts"); err != nil {
+			return nil, err
+		}
+		res.Patches = append(res.Patches, &superpose.Patch{
+			Range: superpose.Range{Pos: file.End()},
+			Str:   fmt.Sprintf("; var %v = __counts.Register(%v)", t.countersVar, strings.Join(t.sites, ", ")),
+		})
+	}
+	return res, nil
+}
+
+const countsPkg = "github.com/cretz/superpose/example/counting/counts"
+
+type transformCounts struct {
+	pkg         *superpose.TransformPackage
+	res         *superpose.TransformResult
+	countersVar string
+	// Site literals in counter index order
+	sites []string
+}
+
+// Built-in calls that are counted as allocations
+var allocBuiltins = map[string]bool{"make": true, "new": true, "append": true}
+
+// We add "__counters<N>[<index>].Inc();" to the start of every function body
+// and change every "make(...)", "new(...)", and "append(...)" to
+// "__counts.Alloc(__counters<N>[<index>], make(...))", all without altering
+// line numbers.
+func (t *transformCounts) transformFunc(decl *ast.FuncDecl) {
+	funcObj, _ := t.pkg.TypesInfo.ObjectOf(decl.Name).(*types.Func)
+	if funcObj == nil {
+		return
+	}
+	t.res.Patches = append(t.res.Patches, &superpose.Patch{
+		Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+		Str:   fmt.Sprintf(" %v.Inc();", t.counter("call", funcObj.FullName(), decl)),
+	})
+	// Function literals are named after their function like the runtime does
+	var lits int
+	ast.Inspect(decl.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			lits++
+			t.res.Patches = append(t.res.Patches, &superpose.Patch{
+				Range: superpose.Range{Pos: n.Body.Lbrace + 1},
+				Str:   fmt.Sprintf(" %v.Inc();", t.counter("call", fmt.Sprintf("%v.func%v", funcObj.FullName(), lits), n)),
+			})
+		case *ast.CallExpr:
+			ident, _ := astutil.Unparen(n.Fun).(*ast.Ident)
+			if ident == nil {
+				break
+			}
+			if builtin, _ := t.pkg.TypesInfo.Uses[ident].(*types.Builtin); builtin != nil && allocBuiltins[builtin.Name()] {
+				t.res.Patches = append(t.res.Patches,
+					&superpose.Patch{
+						Range: superpose.Range{Pos: n.Pos()},
+						Str:   fmt.Sprintf("__counts.Alloc(%v, ", t.counter(builtin.Name(), funcObj.FullName(), n)),
+					},
+					&superpose.Patch{Range: superpose.Range{Pos: n.End()}, Str: ")"},
+				)
+			}
+		}
+		return true
+	})
+}
+
+// Adds a site and returns the expression for its counter
+func (t *transformCounts) counter(kind, funcName string, n ast.Node) string {
+	pos := t.pkg.Fset.Position(n.Pos())
+	t.sites = append(t.sites, fmt.Sprintf("__counts.Site{Kind: %q, Func: %q, Pos: \"%v:%v\"}",
+		kind, funcName, filepath.Base(pos.Filename), pos.Line))
+	return fmt.Sprintf("%v[%v]", t.countersVar, len(t.sites)-1)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/cretz/superpose/example/detrand/randstream"
+)
+
+func Roll() []int {
+	rolls := make([]int, 5)
+	for i := range rolls {
+		rolls[i] = rand.Intn(6) + 1
+	}
+	return rolls
+}
+
+var deterministicRoll func() []int //detrand:Roll
+
+func main() {
+	fmt.Println("Normal rolls:", Roll())
+	fmt.Println("Normal rolls again:", Roll())
+
+	// Seeding is optional, but lets us replay the same stream
+	randstream.Seed(1234)
+	fmt.Println("Deterministic rolls:", deterministicRoll())
+	randstream.Seed(1234)
+	fmt.Println("Deterministic rolls again:", deterministicRoll())
+}
@@ -0,0 +1,35 @@
+// Package randstream is the single random stream used by math/rand and
+// math/rand/v2 in the detrand dimension.
+//
+// This package is shared between the dimension and non-dimension code, so it
+// can be seeded from either.
+package randstream
+
+import "sync"
+
+// DefaultSeed is the seed used if Seed is never called.
+const DefaultSeed = 1
+
+var (
+	lock  sync.Mutex
+	state uint64 = DefaultSeed
+)
+
+// Seed resets the stream to the given seed.
+func Seed(seed int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	state = uint64(seed)
+}
+
+// Uint64 returns the next value in the stream.
+func Uint64() uint64 {
+	lock.Lock()
+	defer lock.Unlock()
+	// This is SplitMix64
+	state += 0x9e3779b97f4a7c15
+	z := state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"detrand": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// Since we patch math/rand itself, every package in the dimension using it,
+	// including other stdlib packages, gets the deterministic source
+	if pkgPath == "math/rand" || pkgPath == "math/rand/v2" {
+		return true, nil
+	}
+	// Also any of our packages but the stream itself which we want shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/detrand") &&
+		!strings.Contains(pkgPath, "randstream"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	if pkg.PkgPath != "math/rand" && pkg.PkgPath != "math/rand/v2" {
+		return res, nil
+	}
+
+	// Every global function in the rand packages has a method of the same name
+	// on *Rand, so we make each return early with a call to that method on our
+	// own *Rand. We take care not to mess up original line numbers.
+	randType, _ := pkg.Types.Scope().Lookup("Rand").(*types.TypeName)
+	if randType == nil {
+		return nil, fmt.Errorf("could not find %v.Rand", pkg.PkgPath)
+	}
+	randMethods := types.NewMethodSet(types.NewPointer(randType.Type()))
+	var declFile *ast.File
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			if funcDecl == nil || funcDecl.Recv != nil || funcDecl.Body == nil || !funcDecl.Name.IsExported() {
+				continue
+			}
+			funcObj, _ := pkg.TypesInfo.ObjectOf(funcDecl.Name).(*types.Func)
+			if funcObj == nil {
+				continue
+			}
+			var body string
+			if special := specialFuncBodies[funcObj.FullName()]; special != nil {
+				body = special(funcDecl)
+			} else if funcDecl.Type.TypeParams == nil && randMethods.Lookup(pkg.Types, funcDecl.Name.Name) != nil {
+				body = fmt.Sprintf("__detRand.%v(%v)", funcDecl.Name.Name, callArgs(funcDecl))
+				if funcDecl.Type.Results == nil {
+					body += "; return"
+				} else {
+					body = "return " + body
+				}
+			} else {
+				continue
+			}
+			res.Patches = append(res.Patches, &superpose.Patch{
+				Range: superpose.Range{Pos: funcDecl.Body.Lbrace + 1},
+				Str:   " " + body + ";",
+			})
+			if declFile == nil {
+				declFile = file
+			}
+		}
+	}
+	if declFile == nil {
+		return nil, fmt.Errorf("could not find any global functions in %v", pkg.PkgPath)
+	}
+
+	// Add our import and our declarations at the very end of the same file
+	if err := res.AddImport(ctx, declFile, randStreamPkg, "__randstream"); err != nil {
+		return nil, err
+	}
+	res.Patches = append(res.Patches, &superpose.Patch{Range: superpose.Range{Pos: declFile.End()}, Str: randDecls})
+	return res, nil
+}
+
+const randStreamPkg = "github.com/cretz/superpose/example/detrand/randstream"
+
+// Declarations added to each rand package. The source satisfies the source
+// interfaces of both math/rand and math/rand/v2 so both share a single stream.
+// Seeding the global math/rand source reseeds the shared stream.
+const randDecls = "; var __detRand = New(__detSource{})" +
+	"; type __detSource struct{}" +
+	"; func (__detSource) Int63() int64 { return int64(__randstream.Uint64() >> 1) }" +
+	"; func (__detSource) Uint64() uint64 { return __randstream.Uint64() }" +
+	"; func (__detSource) Seed(seed int64) { __randstream.Seed(seed) }"
+
+// Bodies for global functions that have no *Rand method of the same name keyed
+// by full function name. These vary by Go version, so not all are required to
+// be present.
+var specialFuncBodies = map[string]func(decl *ast.FuncDecl) string{
+	"math/rand/v2.N": func(decl *ast.FuncDecl) string {
+		return fmt.Sprintf("return %v(__detRand.Uint64N(uint64(%v)))",
+			decl.Type.TypeParams.List[0].Names[0].Name, callArgs(decl))
+	},
+}
+
+func callArgs(decl *ast.FuncDecl) string {
+	var args []string
+	for _, param := range decl.Type.Params.List {
+		for _, name := range param.Names {
+			args = append(args, name.Name)
+		}
+		if _, variadic := param.Type.(*ast.Ellipsis); variadic {
+			args[len(args)-1] += "..."
+		}
+	}
+	return strings.Join(args, ", ")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cretz/superpose/example/detselect/selectorder"
+)
+
+// CountPicks runs a select with two ready channels the given number of times
+// and returns how many times each was picked.
+func CountPicks(n int) (first int, second int) {
+	ch1, ch2 := make(chan int, 1), make(chan int, 1)
+	for i := 0; i < n; i++ {
+		ch1 <- i
+		ch2 <- i
+		select {
+		case <-ch1:
+			first++
+			<-ch2
+		case <-ch2:
+			second++
+			<-ch1
+		}
+	}
+	return
+}
+
+var countPicksDeterministic func(n int) (first int, second int) //detselect:CountPicks
+
+func main() {
+	first, second := CountPicks(1000)
+	fmt.Printf("Normal picks: first %v, second %v\n", first, second)
+	first, second = countPicksDeterministic(1000)
+	fmt.Printf("Deterministic picks: first %v, second %v\n", first, second)
+	selectorder.Seed(1234)
+	first, second = countPicksDeterministic(1000)
+	fmt.Printf("Seeded picks: first %v, second %v\n", first, second)
+	selectorder.Seed(1234)
+	first, second = countPicksDeterministic(1000)
+	fmt.Printf("Seeded picks again: first %v, second %v\n", first, second)
+}
@@ -0,0 +1,127 @@
+// Package selectorder is the runtime used by the detselect dimension to choose
+// select cases deterministically.
+//
+// The dimension evaluates the channels and sent values of each select statement
+// up front like Go does, performs the chosen operation with [Select], then runs
+// the original select statement with [Chan] replacing each channel so only the
+// chosen case can proceed.
+package selectorder
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	seeded   bool
+	seedRand uint64
+	seedLock sync.Mutex
+)
+
+// Seed makes every select try its ready cases in an order from a random source
+// with the given seed instead of in source order. This can be used to explore
+// different orders reproducibly.
+func Seed(seed int64) {
+	seedLock.Lock()
+	defer seedLock.Unlock()
+	seeded, seedRand = true, uint64(seed)
+}
+
+// Unseed reverts to trying select cases in source order.
+func Unseed() {
+	seedLock.Lock()
+	defer seedLock.Unlock()
+	seeded = false
+}
+
+// Case is a case of a select statement.
+type Case struct {
+	reflect.SelectCase
+}
+
+// Recv creates a case receiving from the given channel.
+func Recv[T any](c <-chan T) Case {
+	return Case{reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)}}
+}
+
+// Send creates a case sending the given value on the given channel.
+func Send[T any](c chan<- T, v T) Case {
+	return Case{reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(c), Send: reflect.ValueOf(&v).Elem()}}
+}
+
+// Selection is the result of [Select].
+type Selection struct {
+	// Chosen is the index of the chosen case or -1 for the default case.
+	Chosen int
+	recv   reflect.Value
+	recvOK bool
+}
+
+// Select performs the operation of the first ready case and returns which one
+// was chosen. Cases are tried in the given order unless [Seed] was called. If no
+// case is ready, the default case is chosen if there is one, otherwise this
+// blocks until a case is ready.
+func Select(hasDefault bool, cases ...Case) *Selection {
+	order := make([]int, len(cases))
+	for i := range order {
+		order[i] = i
+	}
+	seedLock.Lock()
+	if seeded {
+		// Fisher-Yates shuffle with SplitMix64
+		for i := len(order) - 1; i > 0; i-- {
+			seedRand += 0x9e3779b97f4a7c15
+			z := seedRand
+			z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+			z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+			j := int((z ^ (z >> 31)) % uint64(i+1))
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	seedLock.Unlock()
+	for _, i := range order {
+		chosen, recv, recvOK := reflect.Select([]reflect.SelectCase{
+			cases[i].SelectCase,
+			{Dir: reflect.SelectDefault},
+		})
+		if chosen == 0 {
+			return &Selection{Chosen: i, recv: recv, recvOK: recvOK}
+		}
+	}
+	if hasDefault {
+		return &Selection{Chosen: -1}
+	}
+	// When blocking, the runtime picks if multiple become ready at once
+	all := make([]reflect.SelectCase, len(cases))
+	for i, c := range cases {
+		all[i] = c.SelectCase
+	}
+	chosen, recv, recvOK := reflect.Select(all)
+	return &Selection{Chosen: chosen, recv: recv, recvOK: recvOK}
+}
+
+// Chan returns the channel to use in place of the given channel for the case at
+// the given index. If the case was not chosen, this is a nil channel which
+// never proceeds. Otherwise, it is a new channel that immediately proceeds with
+// the same result as the operation performed by [Select].
+func Chan[C any](s *Selection, i int, c C) C {
+	var ret C
+	if s.Chosen != i {
+		return ret
+	}
+	typ := reflect.TypeOf(&ret).Elem()
+	ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, typ.Elem()), 1)
+	if typ.ChanDir()&reflect.RecvDir != 0 && s.recv.IsValid() {
+		if s.recvOK {
+			ch.Send(s.recv)
+		} else {
+			ch.Close()
+		}
+	}
+	reflect.ValueOf(&ret).Elem().Set(ch.Convert(typ))
+	return ret
+}
+
+// Zero returns the zero value of the given channel's element type. This is sent
+// on the channel from [Chan] since the value was already sent by [Select].
+func Zero[T any](c chan<- T) (v T) { return }
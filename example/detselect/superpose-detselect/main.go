@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"detselect": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// Any of our packages but the select order package itself which we want
+	// shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/detselect") &&
+		!strings.Contains(pkgPath, "selectorder"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	for _, file := range pkg.Syntax {
+		t := &transformSelects{res: res}
+		ast.Inspect(file, t.inspect)
+		if t.count > 0 {
+			if err := res.AddImport(ctx, file, selectOrderPkg, "__selectorder"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+const selectOrderPkg = "github.com/cretz/superpose/example/detselect/selectorder"
+
+type transformSelects struct {
+	res *superpose.TransformResult
+	// Number of selects transformed in the file, used for unique var names
+	count int
+	// Where the statements for a select go if not at the select itself
+	labeled map[*ast.SelectStmt]token.Pos
+}
+
+// For each select statement like:
+//
+//	select {
+//	case v := <-a:
+//	case b <- x:
+//	default:
+//	}
+//
+// We add statements before it (on the same line) and alter the cases like:
+//
+//	__detsel1_0 := a; __detsel1_1 := b
+//	__detsel1 := __selectorder.Select(true, __selectorder.Recv(__detsel1_0), __selectorder.Send(__detsel1_1, x))
+//	select {
+//	case v := <-__selectorder.Chan(__detsel1, 0, __detsel1_0):
+//	case __selectorder.Chan(__detsel1, 1, __detsel1_1) <- __selectorder.Zero(__detsel1_1):
+//	default:
+//	}
+//
+// This evaluates the channels and sent values once and in order like Go does,
+// performs the chosen operation, and then leaves only the chosen case able to
+// proceed so the original case bodies run unaltered.
+func (t *transformSelects) inspect(n ast.Node) bool {
+	switch n := n.(type) {
+	case *ast.LabeledStmt:
+		// Our statements must go before the label so it still labels the select
+		if sel, _ := n.Stmt.(*ast.SelectStmt); sel != nil {
+			if t.labeled == nil {
+				t.labeled = map[*ast.SelectStmt]token.Pos{}
+			}
+			t.labeled[sel] = n.Pos()
+		}
+	case *ast.SelectStmt:
+		t.transformSelect(n)
+		// We only continue into the bodies since the channel expressions are moved
+		// and cannot have patches of their own
+		for _, clause := range n.Body.List {
+			for _, stmt := range clause.(*ast.CommClause).Body {
+				ast.Inspect(stmt, t.inspect)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (t *transformSelects) transformSelect(sel *ast.SelectStmt) {
+	var hasDefault bool
+	var comms []ast.Stmt
+	for _, clause := range sel.Body.List {
+		if comm := clause.(*ast.CommClause).Comm; comm != nil {
+			comms = append(comms, comm)
+		} else {
+			hasDefault = true
+		}
+	}
+	// Selects with less than two cases are already deterministic
+	if len(comms) < 2 {
+		return
+	}
+	t.count++
+	selVar := fmt.Sprintf("__detsel%v", t.count)
+	pre := &superpose.Patch{Range: superpose.Range{Pos: sel.Pos()}, Captures: map[string]superpose.Range{}}
+	if pos, ok := t.labeled[sel]; ok {
+		pre.Range.Pos = pos
+	}
+	var cases []string
+	for i, comm := range comms {
+		chanVar := fmt.Sprintf("%v_%v", selVar, i)
+		var chanExpr ast.Expr
+		if send, _ := comm.(*ast.SendStmt); send != nil {
+			chanExpr = send.Chan
+			valueCapture := fmt.Sprintf("v%v", i)
+			pre.Captures[valueCapture] = superpose.RangeOf(send.Value)
+			cases = append(cases, fmt.Sprintf("__selectorder.Send(%v, {{.%v}})", chanVar, valueCapture))
+			t.res.Patches = append(t.res.Patches, &superpose.Patch{
+				Range: superpose.RangeOf(send.Value),
+				Str:   fmt.Sprintf("__selectorder.Zero(%v)", chanVar),
+			})
+		} else {
+			chanExpr = recvChan(comm)
+			cases = append(cases, fmt.Sprintf("__selectorder.Recv(%v)", chanVar))
+		}
+		chanCapture := fmt.Sprintf("c%v", i)
+		pre.Captures[chanCapture] = superpose.RangeOf(chanExpr)
+		pre.Str += fmt.Sprintf("%v := {{.%v}}; ", chanVar, chanCapture)
+		t.res.Patches = append(t.res.Patches, &superpose.Patch{
+			Range: superpose.RangeOf(chanExpr),
+			Str:   fmt.Sprintf("__selectorder.Chan(%v, %v, %v)", selVar, i, chanVar),
+		})
+	}
+	pre.Str += fmt.Sprintf("%v := __selectorder.Select(%v, %v); ", selVar, hasDefault, strings.Join(cases, ", "))
+	t.res.Patches = append(t.res.Patches, pre)
+}
+
+// Receive comm clauses are "<-c", "v := <-c", or "v = <-c"
+func recvChan(comm ast.Stmt) ast.Expr {
+	var expr ast.Expr
+	switch comm := comm.(type) {
+	case *ast.ExprStmt:
+		expr = comm.X
+	case *ast.AssignStmt:
+		expr = comm.Rhs[0]
+	}
+	return astutil.Unparen(expr).(*ast.UnaryExpr).X
+}
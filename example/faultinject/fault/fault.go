@@ -0,0 +1,124 @@
+// Package fault is the runtime used by the faultinject dimension to decide
+// when to inject errors.
+//
+// This package is shared between the dimension and non-dimension code, so rules
+// added outside of the dimension apply to calls made inside of it.
+package fault
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Rule is a rule for injecting an error into calls of a function.
+type Rule struct {
+	// Site is the full name of the function whose calls get the error, e.g.
+	// "os.ReadFile", "(*os.File).Write", or "(io.Reader).Read". Required.
+	Site string
+
+	// Err is the error to return instead of calling the function. Required.
+	Err error
+
+	// Skip is the number of matching calls to let through before injecting.
+	Skip int
+
+	// Count is the number of times to inject after skipping. If 0, the error is
+	// injected on every matching call.
+	Count int
+}
+
+type rule struct {
+	Rule
+	calls int
+}
+
+var (
+	rules     []*rule
+	rulesLock sync.Mutex
+)
+
+// AddRule adds a rule and returns a function that removes it. When multiple
+// rules match a call, the first one added that injects wins.
+func AddRule(r Rule) (remove func()) {
+	if r.Site == "" || r.Err == nil {
+		panic("fault rule requires site and error")
+	}
+	added := &rule{Rule: r}
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	rules = append(rules, added)
+	return func() {
+		rulesLock.Lock()
+		defer rulesLock.Unlock()
+		for i, existing := range rules {
+			if existing == added {
+				rules = append(rules[:i], rules[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// ClearRules removes all rules.
+func ClearRules() {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	rules = nil
+}
+
+// Wrap returns a function that, when called, either returns an injected error
+// or calls the given function. The given function must have an error as its
+// last result. The faultinject dimension wraps the function of every call that
+// returns an error with this.
+//
+// If there are no rules for the site when Wrap is called, the function is
+// returned as is. So for deferred calls and go statements, the rules must be in
+// place before the defer or go statement.
+func Wrap[F any](site string, f F) F {
+	if !hasRules(site) {
+		return f
+	}
+	fn := reflect.ValueOf(f)
+	return reflect.MakeFunc(fn.Type(), func(args []reflect.Value) []reflect.Value {
+		if err := injectedErr(site); err != nil {
+			// Zero values for all but the last result which is the error
+			results := make([]reflect.Value, fn.Type().NumOut())
+			for i := range results[:len(results)-1] {
+				results[i] = reflect.Zero(fn.Type().Out(i))
+			}
+			results[len(results)-1] = reflect.New(fn.Type().Out(len(results) - 1)).Elem()
+			results[len(results)-1].Set(reflect.ValueOf(err))
+			return results
+		}
+		if fn.Type().IsVariadic() {
+			return fn.CallSlice(args)
+		}
+		return fn.Call(args)
+	}).Interface().(F)
+}
+
+func hasRules(site string) bool {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	for _, r := range rules {
+		if r.Site == site {
+			return true
+		}
+	}
+	return false
+}
+
+func injectedErr(site string) error {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	for _, r := range rules {
+		if r.Site != site {
+			continue
+		}
+		r.calls++
+		if r.calls > r.Skip && (r.Count == 0 || r.calls <= r.Skip+r.Count) {
+			return r.Err
+		}
+	}
+	return nil
+}
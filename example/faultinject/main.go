@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/cretz/superpose/example/faultinject/fault"
+)
+
+func ReadConfig(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed reading config: %w", err)
+	}
+	return string(b), nil
+}
+
+var readConfigWithFaults func(path string) (string, error) //faultinject:ReadConfig
+
+func main() {
+	dir, err := os.MkdirTemp("", "faultinject-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.txt")
+	if err := os.WriteFile(path, []byte("some config"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	// Inject a single failure into os.ReadFile calls in the dimension
+	defer fault.AddRule(fault.Rule{Site: "os.ReadFile", Err: errors.New("disk on fire"), Count: 1})()
+	fmt.Println(ReadConfig(path))
+	fmt.Println(readConfigWithFaults(path))
+	fmt.Println(readConfigWithFaults(path))
+}
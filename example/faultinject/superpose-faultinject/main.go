@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"faultinject": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// We only rewrite call sites in our packages, not the fault package itself
+	// which we want shared. The functions called can be from any package.
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/faultinject") &&
+		!strings.HasSuffix(pkgPath, "/fault"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	// We change every "<fn>(<args>)" that calls a function returning an error to
+	// "__fault.Wrap(<site>, <fn>)(<args>)". Like a normal call, the function and
+	// args are evaluated before the call, and we do not alter line numbers.
+	for _, file := range pkg.Syntax {
+		patchedFile := false
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, _ := n.(*ast.CallExpr)
+			if call == nil {
+				return true
+			}
+			site := faultSite(pkg, call)
+			if site == "" {
+				return true
+			}
+			// The function expression may have calls of its own that are wrapped
+			// too, so we insert around it instead of replacing it
+			res.Patches = append(res.Patches,
+				&superpose.Patch{Range: superpose.Range{Pos: call.Fun.Pos()}, Str: fmt.Sprintf("__fault.Wrap(%q, ", site)},
+				&superpose.Patch{Range: superpose.Range{Pos: call.Fun.End()}, Str: ")"},
+			)
+			patchedFile = true
+			return true
+		})
+		if patchedFile {
+			if err := res.AddImport(ctx, file, faultPkg, "__fault"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Parents are visited before their children, so an outer call's wrap starts
+	// first where both start at the same position
+	res.Patches = recipes.MergeInserts(res.Patches)
+	return res, nil
+}
+
+const faultPkg = "github.com/cretz/superpose/example/faultinject/fault"
+
+var errorType = types.Universe.Lookup("error").Type()
+
+// Returns the full name of the function called if it is a function or method
+// whose last result is an error and can be used as a value, or empty string
+// otherwise.
+func faultSite(pkg *superpose.TransformPackage, call *ast.CallExpr) string {
+	fn, _ := typeutil.Callee(pkg.TypesInfo, call).(*types.Func)
+	if fn == nil {
+		return ""
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Results().Len() == 0 || !types.Identical(sig.Results().At(sig.Results().Len()-1).Type(), errorType) {
+		return ""
+	}
+	// Generic functions can only be used as values when instantiated explicitly
+	if sig.TypeParams().Len() > 0 {
+		switch astutil.Unparen(call.Fun).(type) {
+		case *ast.IndexExpr, *ast.IndexListExpr:
+		default:
+			return ""
+		}
+	}
+	return fn.FullName()
+}
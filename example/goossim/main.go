@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Paths returns the results of some path functions
+func Paths() []string {
+	matched, _ := filepath.Match(`dir\*.txt`, `dir\file.txt`)
+	return []string{
+		filepath.Join("dir", "sub", "file.txt"),
+		filepath.Clean(`C:\dir\..\other\.\file.txt`),
+		fmt.Sprint(filepath.IsAbs(`C:\dir`)),
+		filepath.VolumeName(`C:\dir\file.txt`),
+		fmt.Sprint(filepath.SplitList("a;b:c")),
+		fmt.Sprint(matched),
+	}
+}
+
+var windowsPaths func() []string //windows:Paths
+
+func main() {
+	labels := []string{"Join", "Clean", "IsAbs", "VolumeName", "SplitList", "Match"}
+	paths, winPaths := Paths(), windowsPaths()
+	for i, label := range labels {
+		fmt.Printf("%-10v  normal: %-30v  windows: %v\n", label, paths[i], winPaths[i])
+	}
+}
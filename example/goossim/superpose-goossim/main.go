@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"windows": transformer{}},
+			// Select files and type check as if building for Windows
+			DimensionEnv: map[string][]string{"windows": {"GOOS=windows"}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// The filepath package and the internal package that implements most of it,
+	// and our package that calls them
+	return pkgPath == "path/filepath" || pkgPath == "internal/filepathlite" ||
+		pkgPath == "github.com/cretz/superpose/example/goossim", nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// The packages are loaded for Windows but compiled against the packages of
+	// this platform. So functions that make Windows system calls can't be
+	// compiled, and we make them panic instead.
+	var drops []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if funcDecl, _ := decl.(*ast.FuncDecl); funcDecl != nil && referencesSyscalls(pkg, funcDecl) {
+				drops = append(drops, recipes.DropFuncBody(pkg, funcDecl,
+					fmt.Sprintf("panic(%q)", funcDecl.Name.Name+" not supported when simulating Windows"))...)
+			}
+		}
+	}
+
+	// Constants of this platform's packages, like os.PathSeparator and
+	// runtime.GOOS, need their Windows values
+	patches := recipes.InlineConstants(pkg, nil)
+	// So does os.IsPathSeparator, which we redirect to the one in filepathlite via
+	// a var in a file that imports it
+	if pkg.PkgPath == "path/filepath" {
+		patches = append(patches,
+			recipes.RedirectFuncs(pkg, map[string]string{"os.IsPathSeparator": "__isPathSeparator"})...)
+		for _, file := range pkg.Syntax {
+			if fileImports(file, "internal/filepathlite") {
+				patches = append(patches, &superpose.Patch{
+					Range: superpose.Range{Pos: file.End()},
+					Str:   "; var __isPathSeparator = filepathlite.IsPathSeparator",
+				})
+				break
+			}
+		}
+	}
+	patches = append(drops, recipes.ExcludeOverlapping(patches, drops)...)
+
+	// Imports only used by what was dropped or inlined are removed since they
+	// may not even exist on this platform
+	removals, err := recipes.RemoveUnusedImports(ctx, pkg, patches)
+	if err != nil {
+		return nil, err
+	}
+	return &superpose.TransformResult{
+		Patches:           recipes.MergeInserts(append(patches, removals...)),
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}, nil
+}
+
+// Whether the node references anything in the Windows system call packages
+func referencesSyscalls(pkg *superpose.TransformPackage, node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, _ := n.(*ast.Ident); ident != nil {
+			if obj := pkg.TypesInfo.Uses[ident]; obj != nil && obj.Pkg() != nil {
+				if _, isPkgName := obj.(*types.PkgName); !isPkgName {
+					found = found || obj.Pkg().Path() == "syscall" || obj.Pkg().Path() == "internal/syscall/windows"
+				}
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func fileImports(file *ast.File, pkgPath string) bool {
+	for _, spec := range file.Imports {
+		if spec.Path.Value == strconv.Quote(pkgPath) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+// Package aloha has the functions that calls to fmt in the log package are
+// redirected to in the alterlog dimension. Each formats the same as the fmt
+// function of the same name but changes "Hello" to "Aloha" in what it formats.
+//
+// This package is not in the dimension, so it uses the real fmt package.
+package aloha
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Append is [fmt.Append] with "Hello" changed to "Aloha".
+func Append(b []byte, a ...interface{}) []byte {
+	return replaceFrom(fmt.Append(b, a...), len(b))
+}
+
+// Appendf is [fmt.Appendf] with "Hello" changed to "Aloha".
+func Appendf(b []byte, format string, a ...interface{}) []byte {
+	return replaceFrom(fmt.Appendf(b, format, a...), len(b))
+}
+
+// Appendln is [fmt.Appendln] with "Hello" changed to "Aloha".
+func Appendln(b []byte, a ...interface{}) []byte {
+	return replaceFrom(fmt.Appendln(b, a...), len(b))
+}
+
+// Sprint is [fmt.Sprint] with "Hello" changed to "Aloha".
+func Sprint(a ...interface{}) string {
+	return strings.ReplaceAll(fmt.Sprint(a...), "Hello", "Aloha")
+}
+
+// Sprintf is [fmt.Sprintf] with "Hello" changed to "Aloha".
+func Sprintf(format string, a ...interface{}) string {
+	return strings.ReplaceAll(fmt.Sprintf(format, a...), "Hello", "Aloha")
+}
+
+// Sprintln is [fmt.Sprintln] with "Hello" changed to "Aloha".
+func Sprintln(a ...interface{}) string {
+	return strings.ReplaceAll(fmt.Sprintln(a...), "Hello", "Aloha")
+}
+
+// Replaces in what was appended after start, leaving what was already there
+func replaceFrom(b []byte, start int) []byte {
+	return append(b[:start:start], bytes.ReplaceAll(b[start:], []byte("Hello"), []byte("Aloha"))...)
+}
@@ -1,9 +1,17 @@
 package main
 
-import "log"
+import (
+	"log"
+	"log/slog"
+	"os"
+)
 
 func Log(s string) {
 	log.Print(s)
+	// The default slog logger writes through the log package, but a text handler
+	// does not
+	slog.Info(s)
+	slog.New(slog.NewTextHandler(os.Stderr, nil)).Info(s)
 }
 
 var normalLog = Log
@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"go/ast"
-	"go/token"
 	"go/types"
 	"strings"
 
 	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
 )
 
 func main() {
@@ -27,9 +27,10 @@ func main() {
 type transformer struct{}
 
 func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
-	// Our dimension applies to the standard logging package and our sample
-	// package
-	return pkgPath == "log" || strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/logger"), nil
+	// Our dimension applies to the standard logging packages and our sample
+	// package, but not the package log calls are redirected to
+	return pkgPath == "log" || pkgPath == "log/slog" ||
+		(strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/logger") && pkgPath != alohaPkg), nil
 }
 
 func (transformer) Transform(
@@ -37,59 +38,120 @@ func (transformer) Transform(
 	pkg *superpose.TransformPackage,
 ) (*superpose.TransformResult, error) {
 	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
-	// We only want to transform the log package
+	// We only want to transform the log packages
 	res := &superpose.TransformResult{
 		AddLineDirectives: true,
 		LogPatchedFiles:   true,
 	}
-	if pkg.PkgPath != "log" {
-		return res, nil
+	switch pkg.PkgPath {
+	case "log":
+		return transformLog(ctx, pkg, res)
+	case "log/slog":
+		return transformSlog(ctx, pkg, res)
 	}
+	return res, nil
+}
 
-	// Specifically we want to transform Logger.Output to always replace "Hello"
-	// with "Aloha". So we must first find that method decl, and then we will put
-	// our replacement on the same line as the opening brace to keep all other
-	// line numbers intact.
-	for _, file := range pkg.Syntax {
-		var lastImportEndPos token.Pos
-		for _, decl := range file.Decls {
-			// Track last import
-			if decl, _ := decl.(*ast.GenDecl); decl != nil && decl.Tok == token.IMPORT {
-				lastImportEndPos = decl.End()
+// Calls in the log package to these fmt functions are redirected to the ones in
+// the aloha package of the same name
+var logFmtFuncs = []string{"Append", "Appendf", "Appendln", "Sprint", "Sprintf", "Sprintln"}
+
+const alohaPkg = "github.com/cretz/superpose/example/logger/aloha"
+
+func transformLog(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	res *superpose.TransformResult,
+) (*superpose.TransformResult, error) {
+	// Every log message is formatted with fmt before it is written, so we
+	// redirect those calls to functions that change "Hello" to "Aloha" in what
+	// they format. The redirect adds the import of the aloha package on the same
+	// line as the last import to keep line numbers intact, and includes it as a
+	// dependency for the linker.
+	for _, name := range logFmtFuncs {
+		redirected, err := recipes.RedirectCalls(ctx, pkg, "fmt."+name, alohaPkg+"."+name)
+		if err != nil {
+			return nil, err
+		}
+		res.Patches = append(res.Patches, redirected.Patches...)
+		for depPkg := range redirected.IncludeDependencyPackages {
+			if res.IncludeDependencyPackages == nil {
+				res.IncludeDependencyPackages = map[string]struct{}{}
 			}
+			res.IncludeDependencyPackages[depPkg] = struct{}{}
+		}
+	}
+	if len(res.Patches) == 0 {
+		return nil, fmt.Errorf("could not find any fmt calls")
+	}
+	// Each redirect imports the package on the same line
+	res.Patches = recipes.MergeInserts(res.Patches)
+	return res, nil
+}
 
-			// Make sure it's the func we want
+func transformSlog(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	res *superpose.TransformResult,
+) (*superpose.TransformResult, error) {
+	// Unlike log, slog output goes through the Handler interface. So instead of a
+	// single method, we transform the Handle method of every type in the package
+	// whose method set implements Handler. This includes the text and JSON
+	// handlers and the handler behind the default logger. The record is passed by
+	// value, so we can replace "Hello" with "Aloha" in its message on the same
+	// line as the opening brace.
+	handlerObj, _ := pkg.Types.Scope().Lookup("Handler").(*types.TypeName)
+	if handlerObj == nil {
+		return nil, fmt.Errorf("could not find Handler")
+	}
+	handlerIface, _ := handlerObj.Type().Underlying().(*types.Interface)
+	if handlerIface == nil {
+		return nil, fmt.Errorf("Handler is not an interface")
+	}
+	var found bool
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			// Make sure it's a Handle method on a Handler implementation. We check
+			// the pointer type since its method set includes value methods.
 			decl, _ := decl.(*ast.FuncDecl)
-			if decl == nil {
+			if decl == nil || decl.Recv == nil || decl.Name.Name != "Handle" || decl.Body == nil {
 				continue
 			}
 			funcObj, _ := pkg.TypesInfo.ObjectOf(decl.Name).(*types.Func)
-			if funcObj == nil || funcObj.FullName() != "(*log.Logger).Output" {
+			if funcObj == nil {
 				continue
 			}
+			sig := funcObj.Type().(*types.Signature)
+			recvType := sig.Recv().Type()
+			if ptr, _ := recvType.(*types.Pointer); ptr != nil {
+				recvType = ptr.Elem()
+			}
+			if !types.Implements(types.NewPointer(recvType), handlerIface) {
+				continue
+			}
+			found = true
 
-			// Add our custom string import just after the last import, but on the
-			// same line to prevent inadvertently altering line numbers.
-			res.Patches = append(res.Patches, &superpose.Patch{
-				Range: superpose.Range{Pos: lastImportEndPos},
-				Str:   `; import __strings "strings"`,
-			})
-
-			// We have to also tell the linker that we have a new dependency on
-			// "strings" just in case it wasn't there before
-			res.IncludeDependencyPackages = map[string]struct{}{"strings": {}}
-
-			// Now change the second parameter, string, to replace "Hello" with
-			// "Aloha". Note, we don't assume the param name, we obtain it for
-			// correctness.
-			paramName := funcObj.Type().(*types.Signature).Params().At(1).Name()
+			// Handlers that don't name the record, like the discard handler, don't
+			// use it
+			paramName := sig.Params().At(1).Name()
+			if paramName == "" || paramName == "_" {
+				continue
+			}
 			res.Patches = append(res.Patches, &superpose.Patch{
 				Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
-				Str:   fmt.Sprintf(`%[1]v = __strings.ReplaceAll(%[1]v, "Hello", "Aloha")`, paramName),
+				Str:   fmt.Sprintf(`%[1]v.Message = __strings.ReplaceAll(%[1]v.Message, "Hello", "Aloha")`, paramName),
 			})
 
-			return res, nil
+			// Add our custom string import just after the last import, but on the
+			// same line to prevent inadvertently altering line numbers. A file can
+			// have multiple handlers, but the import is only added once.
+			if err := res.AddImport(ctx, file, "strings", "__strings"); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return nil, fmt.Errorf("could not find Logger.Output")
+	if !found {
+		return nil, fmt.Errorf("could not find any Handler implementations")
+	}
+	return res, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"log"
+	"log/slog"
 	"strings"
 	"testing"
 )
@@ -13,6 +14,13 @@ func NewLogger(w io.Writer) interface{ Print(...any) } { return log.New(w, "", 0
 
 var NewAlteredLogger func(w io.Writer) interface{ Print(...any) } //alterlog:NewLogger
 
+// Same as above, "*slog.Logger" is different in the other dimension
+func NewSlogLogger(w io.Writer) interface{ Info(string, ...any) } {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+var NewAlteredSlogLogger func(w io.Writer) interface{ Info(string, ...any) } //alterlog:NewSlogLogger
+
 func TestTransformer(t *testing.T) {
 	var out strings.Builder
 	NewLogger(&out).Print("Hi, Hello")
@@ -25,3 +33,16 @@ func TestTransformer(t *testing.T) {
 		t.Fatalf("invalid results of %v", out)
 	}
 }
+
+func TestSlogTransformer(t *testing.T) {
+	var out strings.Builder
+	NewSlogLogger(&out).Info("Hi, Hello")
+	if !strings.Contains(out.String(), `"msg":"Hi, Hello"`) {
+		t.Fatalf("invalid results of %v", out.String())
+	}
+	out.Reset()
+	NewAlteredSlogLogger(&out).Info("Hi, Hello")
+	if !strings.Contains(out.String(), `"msg":"Hi, Aloha"`) {
+		t.Fatalf("invalid results of %v", out.String())
+	}
+}
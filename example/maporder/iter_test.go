@@ -0,0 +1,51 @@
+//go:build go1.23
+
+package main
+
+import (
+	"maps"
+	"reflect"
+	"testing"
+)
+
+// Gives the keys of a map in the order the iterators of maps.All and maps.Keys
+// yield them. The iterators are called directly since this module's Go version
+// predates range over func, but a range over them calls them the same way.
+func IterKeys() (all, keys []string) {
+	m := map[string]int{}
+	for i, k := range []string{"qux", "foo", "baz", "bar"} {
+		m[k] = i
+	}
+	maps.All(m)(func(k string, _ int) bool {
+		all = append(all, k)
+		return true
+	})
+	maps.Keys(m)(func(k string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return all, keys
+}
+
+var sortedIterKeys func() (all, keys []string) //maporder_sorted:IterKeys
+
+var insertionIterKeys func() (all, keys []string) //maporder_insertion:IterKeys
+
+func TestIterOrder(t *testing.T) {
+	if sortedIterKeys == nil {
+		t.Skip("must be run with superpose-maporder as toolexec")
+	}
+	// Run several times since normal map order is random
+	for i := 0; i < 10; i++ {
+		all, keys := sortedIterKeys()
+		if expected := []string{"bar", "baz", "foo", "qux"}; !reflect.DeepEqual(expected, all) ||
+			!reflect.DeepEqual(expected, keys) {
+			t.Fatalf("expected sorted %v, got %v from maps.All and %v from maps.Keys", expected, all, keys)
+		}
+		all, keys = insertionIterKeys()
+		if expected := []string{"qux", "foo", "baz", "bar"}; !reflect.DeepEqual(expected, all) ||
+			!reflect.DeepEqual(expected, keys) {
+			t.Fatalf("expected insertion order %v, got %v from maps.All and %v from maps.Keys", expected, all, keys)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/cretz/superpose/example/maporder/otherpkg"
+	"github.com/cretz/superpose/example/maporder/superpose-maporder/mapiter"
 )
 
 var someMap = map[string]string{
@@ -16,7 +17,15 @@ var someMap = map[string]string{
 func main() {
 	PrintMap()
 	sortedPrintMap()
-	// insertionPrintMap()
+	insertionPrintMap()
+
+	// An ordered map can also be built outside of the dimension and handed in
+	ordered := mapiter.NewOrderedMap[string, string](4)
+	ordered.Set("qux-key", "qux-val")
+	ordered.Set("foo-key", "foo-val")
+	ordered.Set("baz-key", "baz-val")
+	ordered.Set("bar-key", "bar-val")
+	insertionPrintOrderedMap(ordered.Map())
 }
 
 func PrintMap() {
@@ -24,8 +33,8 @@ func PrintMap() {
 	switch {
 	case inSorted:
 		fmt.Println("Ordered print map via sorted iteration:")
-	// case inInsertion:
-	// 	fmt.Println("Ordered print map by insertion order:")
+	case inInsertion:
+		fmt.Println("Ordered print map by insertion order:")
 	default:
 		fmt.Println("Normal print map:")
 	}
@@ -37,5 +46,12 @@ func PrintMap() {
 var sortedPrintMap func() //maporder_sorted:PrintMap
 var inSorted bool         //maporder_sorted:<in>
 
-// var insertionPrintMap func() //maporder_insertion:PrintMap
-// var inInsertion bool         //maporder_insertion:<in>
+var insertionPrintMap func() //maporder_insertion:PrintMap
+var inInsertion bool         //maporder_insertion:<in>
+
+func PrintOrderedMap(m map[string]string) {
+	fmt.Println("Ordered print map by order built outside the dimension:")
+	otherpkg.PrintMap(m)
+}
+
+var insertionPrintOrderedMap func(m map[string]string) //maporder_insertion:PrintOrderedMap
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"go/ast"
+	"go/types"
+	"strconv"
 
 	"github.com/cretz/superpose"
 )
@@ -13,8 +16,8 @@ func main() {
 			Version: superpose.MustLoadCurrentExeContentID(),
 			Transformers: map[string]superpose.Transformer{
 				// Transform both of these dimensions
-				"maporder_sorted": transformerSorted{},
-				// TODO(cretz): "mapsort_insertion": transformerInsertion{},
+				"maporder_sorted":    transformerSorted{},
+				"maporder_insertion": transformerInsertion{},
 			},
 			// Set to true to see compilation details
 			Verbose: false,
@@ -27,3 +30,58 @@ const (
 	mapIterPkg   = "github.com/cretz/superpose/example/maporder/superpose-maporder/mapiter"
 	mapIterAlias = "__mapiter"
 )
+
+func appliesToPackage(pkgPath string) bool {
+	// We could make this apply across most of the standard library, but we'll
+	// just keep it limited to these for now. The standard library maps package
+	// is included so its functions keep the ordering semantics.
+	return pkgPath == "maps" ||
+		pkgPath == "github.com/cretz/superpose/example/maporder" ||
+		pkgPath == "github.com/cretz/superpose/example/maporder/otherpkg"
+}
+
+// mapTypeOf returns the map type of the given type or nil if not a map. This
+// supports named map types and type parameters whose constraint only allows
+// the same map type (e.g. "M ~map[K]V" as used in the maps package).
+func mapTypeOf(typ types.Type) *types.Map {
+	typeParam, _ := typ.(*types.TypeParam)
+	if typeParam == nil {
+		mapType, _ := typ.Underlying().(*types.Map)
+		return mapType
+	}
+	iface, _ := typeParam.Constraint().Underlying().(*types.Interface)
+	if iface == nil || iface.NumEmbeddeds() != 1 {
+		return nil
+	}
+	var mapType *types.Map
+	if union, _ := iface.EmbeddedType(0).(*types.Union); union != nil {
+		for i := 0; i < union.Len(); i++ {
+			termMapType, _ := union.Term(i).Type().Underlying().(*types.Map)
+			if termMapType == nil || (mapType != nil && !types.Identical(mapType, termMapType)) {
+				return nil
+			}
+			mapType = termMapType
+		}
+	} else {
+		mapType, _ = iface.EmbeddedType(0).Underlying().(*types.Map)
+	}
+	return mapType
+}
+
+// importName returns the name the given package is referenced by in the given
+// file or false if the package is not imported in a referenceable way. The
+// name is empty for dot imports.
+func importName(file *ast.File, pkg *types.Package) (string, bool) {
+	for _, mport := range file.Imports {
+		if path, _ := strconv.Unquote(mport.Path.Value); path != pkg.Path() {
+			continue
+		} else if mport.Name == nil {
+			return pkg.Name(), true
+		} else if mport.Name.Name == "." {
+			return "", true
+		} else if mport.Name.Name != "_" {
+			return mport.Name.Name, true
+		}
+	}
+	return "", false
+}
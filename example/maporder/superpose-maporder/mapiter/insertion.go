@@ -3,7 +3,6 @@ package mapiter
 import (
 	"math"
 	"reflect"
-	"runtime"
 	"sort"
 	"sync"
 )
@@ -11,10 +10,21 @@ import (
 const reindexKeysAfterCounter = math.MaxInt / 2
 const reindexKeysAfterGap = 1000
 
-// Keyed by weak pointer
-var insertionMaps = map[uintptr]any{}
+// Tracked maps are keyed by their runtime map pointer which, since Go does not
+// move heap objects and map headers are not reallocated on growth, is stable
+// for the life of the map. The registry holds a strong reference to each map so
+// that its address can never be reused by another map while it is still in the
+// registry. This means tracked maps are never garbage collected, which is an
+// acceptable tradeoff for a dimension meant for deterministic execution.
+var insertionMaps = map[uintptr]trackedMap{}
 var insertionMapsLock sync.RWMutex
 
+type trackedMap struct {
+	// Only held to keep the map alive
+	m  any
+	im any
+}
+
 type insertionMap[K comparable, V any] struct {
 	keyCounter int
 	keyIndices map[K]int
@@ -23,6 +33,9 @@ type insertionMap[K comparable, V any] struct {
 	// concurrent map access are on their map and not ours. If we were more
 	// performance conscious we could use a skip list maybe.
 	keyIndicesLock sync.RWMutex
+	// If true, all map operations are done under mapLock
+	synchronized bool
+	mapLock      sync.RWMutex
 }
 
 type lit[M ~map[K]V, K comparable, V any] map[K]V
@@ -31,6 +44,12 @@ func NewTrackedMapLit[M ~map[K]V, K comparable, V any](size int) lit[M, K, V] {
 	return lit[M, K, V](MakeTrackedMap[M](size))
 }
 
+// NewSyncTrackedMapLit is like NewTrackedMapLit but the map is synchronized.
+// See MakeSyncTrackedMap.
+func NewSyncTrackedMapLit[M ~map[K]V, K comparable, V any](size int) lit[M, K, V] {
+	return lit[M, K, V](MakeSyncTrackedMap[M](size))
+}
+
 func (l lit[M, K, V]) Put(k K, v V) lit[M, K, V] {
 	TrackedPut(l, k, v)
 	return l
@@ -44,69 +63,213 @@ func MakeTrackedMap[M ~map[K]V, K comparable, V any](size int) M {
 	return TrackMap(make(M, size))
 }
 
+// MakeSyncTrackedMap is like MakeTrackedMap but all tracked operations on the
+// map are done under a lock. This only makes the map safe for concurrent use if
+// all reads are done with TrackedGet, TrackedGetOK, TrackedLen, and TrackedIter
+// too.
+func MakeSyncTrackedMap[M ~map[K]V, K comparable, V any](size int) M {
+	m := make(M, size)
+	getInsertionMap(m).synchronized = true
+	return m
+}
+
 func TrackMap[K comparable, V any](m map[K]V) map[K]V {
-	// Take pointer and add finalizer to remove
-	im := &insertionMap[K, V]{}
-	ptr := reflect.ValueOf(m).UnsafeAddr()
-	insertionMapsLock.Lock()
-	insertionMaps[ptr] = im
-	insertionMapsLock.Unlock()
-	runtime.SetFinalizer(m, func(map[K]V) {
-		insertionMapsLock.Lock()
-		delete(insertionMaps, ptr)
-		insertionMapsLock.Unlock()
-	})
+	getInsertionMap(m)
 	return m
 }
 
 func TrackedPut[K comparable, V any](m map[K]V, k K, v V) struct{} {
+	if m == nil {
+		// Let Go panic as it would for the untransformed put
+		m[k] = v
+	}
 	getInsertionMap(m).put(m, k, v)
 	// We need to return a value in cases like multi-assign
 	return struct{}{}
 }
 
+// MapKey just returns the map and key given. This is used to give untyped
+// constant keys the proper key type.
+func MapKey[K comparable, V any](m map[K]V, k K) (map[K]V, K) {
+	return m, k
+}
+
+// MultiAssign tracks puts in a multi-assignment statement.
+type MultiAssign struct {
+	puts []func()
+}
+
+// TrackedAssignMulti runs the given assignment function then performs all puts
+// recorded by [MultiKey] in order.
+func TrackedAssignMulti(f func(*MultiAssign)) {
+	var a MultiAssign
+	f(&a)
+	for _, put := range a.puts {
+		put()
+	}
+}
+
+// MultiKey records a put for the given map and key and returns a pointer to
+// the value that will be put once the assignment is complete.
+func MultiKey[K comparable, V any](a *MultiAssign, m map[K]V, k K) *V {
+	var v V
+	a.puts = append(a.puts, func() { TrackedPut(m, k, v) })
+	return &v
+}
+
+// TrackedGet returns the value for the key in the map.
+func TrackedGet[K comparable, V any](m map[K]V, k K) V {
+	v, _ := TrackedGetOK(m, k)
+	return v
+}
+
+// TrackedGetOK returns the value for the key in the map and whether it exists.
+func TrackedGetOK[K comparable, V any](m map[K]V, k K) (V, bool) {
+	if m == nil {
+		v, ok := m[k]
+		return v, ok
+	}
+	return getInsertionMap(m).get(m, k)
+}
+
+// TrackedLen returns the length of the map.
+func TrackedLen[K comparable, V any](m map[K]V) int {
+	if m == nil {
+		return 0
+	}
+	return getInsertionMap(m).len(m)
+}
+
 func TrackedDelete[K comparable, V any](m map[K]V, k K) {
+	if m == nil {
+		return
+	}
 	getInsertionMap(m).delete(m, k)
 }
 
+func TrackedClear[K comparable, V any](m map[K]V) {
+	if m == nil {
+		return
+	}
+	getInsertionMap(m).clear(m)
+}
+
+func TrackedClone[M ~map[K]V, K comparable, V any](m M) M {
+	// Preserve nil like the maps package does
+	if m == nil {
+		return nil
+	}
+	// Clones of synchronized maps are synchronized too
+	var ret M
+	if im := getInsertionMap(m); im.synchronized {
+		ret = MakeSyncTrackedMap[M](im.len(m))
+	} else {
+		ret = MakeTrackedMap[M](len(m))
+	}
+	for iter := TrackedIter(m); iter.Next(); {
+		k, v := iter.Pair()
+		TrackedPut(ret, k, v)
+	}
+	return ret
+}
+
 func TrackedIter[K comparable, V any](m map[K]V) *MapIter[K, V] {
+	if m == nil {
+		return &MapIter[K, V]{m: m, keyIndex: -1}
+	}
 	return getInsertionMap(m).iter(m)
 }
 
 func getInsertionMap[K comparable, V any](m map[K]V) *insertionMap[K, V] {
+	ptr := reflect.ValueOf(m).Pointer()
 	insertionMapsLock.RLock()
-	im := insertionMaps[reflect.ValueOf(m).UnsafeAddr()]
+	tracked, ok := insertionMaps[ptr]
 	insertionMapsLock.RUnlock()
-	if im == nil {
-		panic("map never tracked")
+	if ok {
+		return tracked.im.(*insertionMap[K, V])
+	}
+	// Maps not created in the dimension (e.g. returned from an untransformed
+	// package) are tracked on first use with their existing keys in whatever
+	// order Go iterates them
+	insertionMapsLock.Lock()
+	defer insertionMapsLock.Unlock()
+	if tracked, ok := insertionMaps[ptr]; ok {
+		return tracked.im.(*insertionMap[K, V])
+	}
+	im := &insertionMap[K, V]{keyIndices: make(map[K]int, len(m))}
+	for k := range m {
+		im.keyIndices[k] = im.keyCounter
+		im.keyCounter++
 	}
-	return im.(*insertionMap[K, V])
+	insertionMaps[ptr] = trackedMap{m: m, im: im}
+	return im
 }
 
 func (i *insertionMap[K, V]) put(m map[K]V, k K, v V) {
+	if i.synchronized {
+		i.mapLock.Lock()
+		defer i.mapLock.Unlock()
+	}
 	i.keyIndicesLock.Lock()
-	if i.keyIndices == nil {
-		i.keyIndices = map[K]int{k: i.keyCounter}
-	} else {
-		i.keyIndices[k] = len(i.keyIndices) + 1
+	// Replacing the value of an existing key does not change its order
+	if _, exists := i.keyIndices[k]; !exists {
+		if i.keyIndices == nil {
+			i.keyIndices = map[K]int{}
+		}
+		i.keyIndices[k] = i.keyCounter
+		i.keyCounter++
 		if i.keyCounter > reindexKeysAfterCounter && i.keyCounter-len(i.keyIndices) > reindexKeysAfterGap {
 			i.reindexKeysUnlocked()
 		}
 	}
-	i.keyCounter++
 	i.keyIndicesLock.Unlock()
-	// TODO(cretz): Might as well put all ops under lock and make all maps
-	// concurrency safe?
 	m[k] = v
 }
 
+func (i *insertionMap[K, V]) get(m map[K]V, k K) (V, bool) {
+	if i.synchronized {
+		i.mapLock.RLock()
+		defer i.mapLock.RUnlock()
+	}
+	v, ok := m[k]
+	return v, ok
+}
+
+func (i *insertionMap[K, V]) len(m map[K]V) int {
+	if i.synchronized {
+		i.mapLock.RLock()
+		defer i.mapLock.RUnlock()
+	}
+	return len(m)
+}
+
 func (i *insertionMap[K, V]) delete(m map[K]V, k K) {
+	if i.synchronized {
+		i.mapLock.Lock()
+		defer i.mapLock.Unlock()
+	}
 	i.keyIndicesLock.Lock()
 	delete(i.keyIndices, k)
 	i.keyIndicesLock.Unlock()
 	delete(m, k)
 }
 
+func (i *insertionMap[K, V]) clear(m map[K]V) {
+	if i.synchronized {
+		i.mapLock.Lock()
+		defer i.mapLock.Unlock()
+	}
+	i.keyIndicesLock.Lock()
+	i.keyIndices = nil
+	i.keyCounter = 0
+	i.keyIndicesLock.Unlock()
+	// We can't use the clear builtin at our Go version, so we delete each. This
+	// means NaN keys cannot be removed.
+	for k := range m {
+		delete(m, k)
+	}
+}
+
 func (i *insertionMap[K, V]) iter(m map[K]V) *MapIter[K, V] {
 	// Get keys in sorted order
 	// TODO(cretz): Could make this way more performant but I'm lazy
@@ -117,11 +280,16 @@ func (i *insertionMap[K, V]) iter(m map[K]V) *MapIter[K, V] {
 	}
 	sort.Slice(keys, func(a, b int) bool { return i.keyIndices[keys[a]] < i.keyIndices[keys[b]] })
 	i.keyIndicesLock.RUnlock()
-	return &MapIter[K, V]{
+	iter := &MapIter[K, V]{
 		initialKeys: keys,
 		m:           m,
 		keyIndex:    -1,
 	}
+	// Only lock for each value lookup so the loop body can alter the map
+	if i.synchronized {
+		iter.lock = i.mapLock.RLocker()
+	}
+	return iter
 }
 
 func (i *insertionMap[K, V]) reindexKeysUnlocked() {
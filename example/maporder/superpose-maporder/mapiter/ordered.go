@@ -0,0 +1,101 @@
+package mapiter
+
+import "reflect"
+
+// OrderedMap is a map that iterates in the order keys were first inserted. It
+// uses the same ordering as maps tracked in the insertion dimension, but can be
+// used from any code including code that is not transformed. Unlike tracked
+// maps, it is garbage collected like any other value.
+//
+// Use [OrderedMapFrom] and [OrderedMap.Map] to convert to and from plain maps,
+// e.g. to hand an ordered map into insertion dimension code.
+//
+// An OrderedMap is no more concurrency safe than a normal Go map.
+type OrderedMap[K comparable, V any] struct {
+	m  map[K]V
+	im insertionMap[K, V]
+}
+
+// NewOrderedMap creates an empty ordered map with space for the given number of
+// keys.
+func NewOrderedMap[K comparable, V any](size int) *OrderedMap[K, V] {
+	return &OrderedMap[K, V]{m: make(map[K]V, size), im: insertionMap[K, V]{keyIndices: make(map[K]int, size)}}
+}
+
+// OrderedMapFrom creates an ordered map from a copy of the given map. If the
+// map is tracked (e.g. created in the insertion dimension), the keys are in
+// tracked order. Otherwise, since plain maps have no order, the keys are in
+// sorted order if they are ordered or in hash order otherwise (see
+// [NewDynamicOrHashSortedIter]).
+func OrderedMapFrom[K comparable, V any](m map[K]V) *OrderedMap[K, V] {
+	ret := NewOrderedMap[K, V](len(m))
+	if m == nil {
+		return ret
+	}
+	// We check the registry directly instead of using getInsertionMap since we
+	// don't want to start tracking a map just to read it
+	insertionMapsLock.RLock()
+	tracked, ok := insertionMaps[reflect.ValueOf(m).Pointer()]
+	insertionMapsLock.RUnlock()
+	var iter *MapIter[K, V]
+	if ok {
+		iter = tracked.im.(*insertionMap[K, V]).iter(m)
+	} else {
+		iter = NewDynamicOrHashSortedIter(m)
+	}
+	for iter.Next() {
+		ret.Set(iter.Pair())
+	}
+	return ret
+}
+
+// Set sets the value for the key. Replacing the value of an existing key does
+// not change its order.
+func (o *OrderedMap[K, V]) Set(k K, v V) {
+	o.im.put(o.m, k, v)
+}
+
+// Get returns the value for the key and whether it exists.
+func (o *OrderedMap[K, V]) Get(k K) (V, bool) {
+	return o.im.get(o.m, k)
+}
+
+// Delete removes the key. If it is set again, it is ordered as a new key.
+func (o *OrderedMap[K, V]) Delete(k K) {
+	o.im.delete(o.m, k)
+}
+
+// Len returns the number of keys.
+func (o *OrderedMap[K, V]) Len() int {
+	return len(o.m)
+}
+
+// Keys returns the keys in order.
+func (o *OrderedMap[K, V]) Keys() []K {
+	keys := make([]K, 0, len(o.m))
+	for iter := o.Iter(); iter.Next(); {
+		k, _ := iter.Pair()
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Iter returns an iterator over the keys and values in order. Like ranging over
+// a map, the map can be altered during iteration. Deleted keys not yet reached
+// are skipped and added keys are not iterated.
+func (o *OrderedMap[K, V]) Iter() *MapIter[K, V] {
+	return o.im.iter(o.m)
+}
+
+// Map returns a copy of this map as a plain map that is tracked with the same
+// order. Ranging over it in the insertion dimension is in this map's order, but
+// later changes to either map are not reflected in the other. Like all tracked
+// maps, the result is never garbage collected.
+func (o *OrderedMap[K, V]) Map() map[K]V {
+	m := MakeTrackedMap[map[K]V](len(o.m))
+	for iter := o.Iter(); iter.Next(); {
+		k, v := iter.Pair()
+		TrackedPut(m, k, v)
+	}
+	return m
+}
@@ -1,7 +1,12 @@
 package mapiter
 
 import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 
 	"golang.org/x/exp/constraints"
 )
@@ -15,6 +20,8 @@ type MapIter[K comparable, V any] struct {
 	m           map[K]V
 	keyIndex    int
 	value       V
+	// Optional lock held while looking up each value
+	lock sync.Locker
 }
 
 func NewSortedIter[K constraints.Ordered, V interface{}](m map[K]V) *MapIter[K, V] {
@@ -30,8 +37,108 @@ func NewSortedIter[K constraints.Ordered, V interface{}](m map[K]V) *MapIter[K,
 	return ret
 }
 
+// NewCompareSortedIter is like NewSortedIter but for keys that have a Compare
+// method like time.Time.
+func NewCompareSortedIter[K interface {
+	comparable
+	Compare(K) int
+}, V any](m map[K]V) *MapIter[K, V] {
+	return NewFuncSortedIter(m, func(a, b K) int { return a.Compare(b) })
+}
+
+// NewFuncSortedIter is like NewSortedIter but uses the given comparator which
+// returns a negative number when a < b, a positive number when a > b, and 0
+// otherwise.
+func NewFuncSortedIter[K comparable, V any](m map[K]V, cmp func(a, b K) int) *MapIter[K, V] {
+	ret := &MapIter[K, V]{
+		initialKeys: make([]K, 0, len(m)),
+		m:           m,
+		keyIndex:    -1,
+	}
+	for k := range m {
+		ret.initialKeys = append(ret.initialKeys, k)
+	}
+	sort.Slice(ret.initialKeys, func(i, j int) bool { return cmp(ret.initialKeys[i], ret.initialKeys[j]) < 0 })
+	return ret
+}
+
+// NewHashSortedIter is like NewSortedIter but for keys that are not ordered.
+// The keys are sorted by a hash of their Go-syntax representation which is
+// deterministic across runs as long as the keys do not contain pointers,
+// channels, or other values whose representation is an address.
+func NewHashSortedIter[K comparable, V any](m map[K]V) *MapIter[K, V] {
+	reprs := make(map[K]string, len(m))
+	hashes := make(map[K]uint64, len(m))
+	for k := range m {
+		repr := fmt.Sprintf("%#v", k)
+		h := fnv.New64a()
+		h.Write([]byte(repr))
+		reprs[k], hashes[k] = repr, h.Sum64()
+	}
+	return NewFuncSortedIter(m, func(a, b K) int {
+		// Representation is the tie breaker for hash collisions
+		if hashes[a] != hashes[b] {
+			if hashes[a] < hashes[b] {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(reprs[a], reprs[b])
+	})
+}
+
+// NewDynamicSortedIter is like NewSortedIter but for keys that can only be
+// known as ordered at runtime (e.g. type parameters). This panics if the key is
+// not ordered.
+func NewDynamicSortedIter[K comparable, V any](m map[K]V) *MapIter[K, V] {
+	if cmp := dynamicCompare[K](); cmp != nil {
+		return NewFuncSortedIter(m, cmp)
+	}
+	panic("cannot do safe map iteration on unordered keys")
+}
+
+// NewDynamicOrHashSortedIter is like NewDynamicSortedIter but falls back to
+// NewHashSortedIter if the key is not ordered.
+func NewDynamicOrHashSortedIter[K comparable, V any](m map[K]V) *MapIter[K, V] {
+	if cmp := dynamicCompare[K](); cmp != nil {
+		return NewFuncSortedIter(m, cmp)
+	}
+	return NewHashSortedIter(m)
+}
+
+// Returns a comparator for the key based on its kind or nil if not ordered
+func dynamicCompare[K comparable]() func(a, b K) int {
+	var cmp func(a, b reflect.Value) int
+	switch reflect.TypeOf((*K)(nil)).Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cmp = func(a, b reflect.Value) int { return compareOrdered(a.Int(), b.Int()) }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cmp = func(a, b reflect.Value) int { return compareOrdered(a.Uint(), b.Uint()) }
+	case reflect.Float32, reflect.Float64:
+		cmp = func(a, b reflect.Value) int { return compareOrdered(a.Float(), b.Float()) }
+	case reflect.String:
+		cmp = func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) }
+	default:
+		return nil
+	}
+	return func(a, b K) int { return cmp(reflect.ValueOf(a), reflect.ValueOf(b)) }
+}
+
+func compareOrdered[T constraints.Ordered](a, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
 func (m *MapIter[K, V]) Next() bool {
 	// Loop until we find a value or no more next
+	if m.lock != nil {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+	}
 	for m.keyIndex+1 < len(m.initialKeys) {
 		m.keyIndex++
 		var ok bool
@@ -3,23 +3,30 @@ package main
 import (
 	"fmt"
 	"go/ast"
+	"go/scanner"
+	"go/token"
 	"go/types"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/cretz/superpose"
 	"golang.org/x/tools/go/ast/inspector"
 )
 
-type transformerInsertion struct{}
+type transformerInsertion struct {
+	// If true, maps created in the dimension are fully synchronized so they can
+	// be used concurrently without extra locking. This also transforms all map
+	// reads and lengths so they are done under the map's lock. Maps created
+	// outside of transformed packages are never synchronized.
+	synchronized bool
+}
 
 func (transformerInsertion) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
-	// We could make this apply across most of the standard library, but we'll
-	// just keep it limited to these for now
-	return pkgPath == "github.com/cretz/superpose/example/maporder" ||
-		pkgPath == "github.com/cretz/superpose/example/maporder/otherpkg", nil
+	return appliesToPackage(pkgPath), nil
 }
 
-func (transformerInsertion) Transform(
+func (tr transformerInsertion) Transform(
 	ctx *superpose.TransformContext,
 	pkg *superpose.TransformPackage,
 ) (*superpose.TransformResult, error) {
@@ -32,23 +39,27 @@ func (transformerInsertion) Transform(
 	// inspector so that we can have the stack.
 	ins := inspector.New(pkg.Syntax)
 	patchedFiles := map[*ast.File]struct{}{}
-	t := &transformInsertionPackage{TransformContext: ctx, TransformPackage: pkg}
+	t := &transformInsertionPackage{TransformContext: ctx, TransformPackage: pkg, synchronized: tr.synchronized}
+	var err error
 	ins.WithStack(nil, func(n ast.Node, push bool, stack []ast.Node) (proceed bool) {
-		// We only care about push
-		if push {
-			if patches := t.transformNode(n, stack); len(patches) > 0 {
+		// We only care about push and we stop on first error
+		if push && err == nil {
+			var patches []*superpose.Patch
+			if patches, err = t.transformNode(n, stack); len(patches) > 0 {
 				res.Patches = append(res.Patches, patches...)
 				patchedFiles[stack[0].(*ast.File)] = struct{}{}
 			}
 		}
-		return true
+		return err == nil
 	})
-	// For all files we patched, add our mapiter import at the top
+	if err != nil {
+		return nil, err
+	}
+	// For all files we patched, add our mapiter import
 	for file := range patchedFiles {
-		res.Patches = append(res.Patches, &superpose.Patch{
-			Range: superpose.Range{Pos: file.Name.End()},
-			Str:   fmt.Sprintf("; import %s %q", mapIterAlias, mapIterPkg),
-		})
+		if err := res.AddImport(ctx, file, mapIterPkg, mapIterAlias); err != nil {
+			return nil, err
+		}
 	}
 	return res, nil
 }
@@ -56,7 +67,9 @@ func (transformerInsertion) Transform(
 type transformInsertionPackage struct {
 	*superpose.TransformContext
 	*superpose.TransformPackage
-	cachedFiles map[string][]byte
+	synchronized bool
+	cachedFiles  map[string][]byte
+	inserts      map[token.Pos]*superpose.Patch
 }
 
 func (t *transformInsertionPackage) fileContents(file string) []byte {
@@ -75,53 +88,86 @@ func (t *transformInsertionPackage) fileContents(file string) []byte {
 	return b
 }
 
-func (t *transformInsertionPackage) transformNode(n ast.Node, stack []ast.Node) []*superpose.Patch {
+func (t *transformInsertionPackage) transformNode(n ast.Node, stack []ast.Node) ([]*superpose.Patch, error) {
 	// Patches needed:
 	// * Map creation via "make"
 	// * Map creation via literal syntax
 	// * Map put
 	// * Map delete
+	// * Map clear
 	// * Map range
+	// * Clone in the maps package
+	// * Map get and length if synchronized
 	switch n := n.(type) {
-	// Check if call to "make" or "delete" for a map
+	// Check if call to "make", "delete", or "clear" for a map
 	case *ast.CallExpr:
 		if funIdent, _ := n.Fun.(*ast.Ident); funIdent == nil || len(n.Args) == 0 {
-			return nil
+			return nil, nil
 		} else if _, builtIn := t.TypesInfo.ObjectOf(funIdent).(*types.Builtin); !builtIn {
 			// We make sure to check built-in type because anyone can create their
 			// own function/var called make/delete
-			return nil
+			return nil, nil
 		} else if funIdent.Name == "make" {
-			if mapType, _ := t.TypesInfo.TypeOf(n).(*types.Map); mapType != nil {
-				return t.transformMake(n, mapType)
+			if mapType := mapTypeOf(t.TypesInfo.TypeOf(n)); mapType != nil {
+				return t.transformMake(n, mapType), nil
 			}
 		} else if funIdent.Name == "delete" {
-			if mapType, _ := t.TypesInfo.TypeOf(n.Args[0]).(*types.Map); mapType != nil {
-				return t.transformDelete(n, mapType)
+			if mapType := mapTypeOf(t.TypesInfo.TypeOf(n.Args[0])); mapType != nil {
+				return t.transformDelete(n, mapType), nil
+			}
+		} else if funIdent.Name == "clear" {
+			if mapType := mapTypeOf(t.TypesInfo.TypeOf(n.Args[0])); mapType != nil {
+				return t.transformClear(n, mapType), nil
+			}
+		} else if funIdent.Name == "len" && t.synchronized {
+			if mapType := mapTypeOf(t.TypesInfo.TypeOf(n.Args[0])); mapType != nil {
+				return t.transformLen(n, mapType), nil
 			}
 		}
-	// Check if map creation as literal
+	// Check if map creation as literal. We use the underlying type here since
+	// the literal may be of a named map type.
 	case *ast.CompositeLit:
-		if mapType, _ := t.TypesInfo.TypeOf(n).(*types.Map); mapType != nil {
+		litType := t.TypesInfo.TypeOf(n)
+		if mapType, _ := litType.Underlying().(*types.Map); mapType != nil {
 			return t.transformLit(n, mapType, stack)
+		} else if ptrType, _ := litType.(*types.Pointer); ptrType != nil {
+			// Elided pointer literals are typed as the pointer and are implicitly
+			// addressed which we can't do with a call result
+			if _, isMap := ptrType.Elem().Underlying().(*types.Map); isMap {
+				return nil, fmt.Errorf("cannot take address of map literal at %v", t.Fset.Position(n.Pos()))
+			}
 		}
 	// Check if map put
 	case *ast.AssignStmt:
 		// If _any_ LHS is an index expr with X as map, it's a put of some form
 		for _, x := range n.Lhs {
-			if index, _ := x.(*ast.IndexExpr); index != nil {
-				if _, mapType := t.TypesInfo.TypeOf(index.X).(*types.Map); mapType {
-					return t.transformPut(n)
-				}
+			if t.mapIndex(x) != nil {
+				return t.transformPut(n), nil
 			}
 		}
-	// Check if map range
+	// Check if map get. Only needed when synchronized.
+	case *ast.IndexExpr:
+		if t.synchronized && t.mapIndex(n) != nil {
+			return t.transformGet(n, stack), nil
+		}
+	// Check if map put via increment/decrement
+	case *ast.IncDecStmt:
+		if index := t.mapIndex(n.X); index != nil {
+			return t.transformIncDec(n, index), nil
+		}
+	// Check if the maps package clone which uses the runtime directly
+	case *ast.FuncDecl:
+		if t.PkgPath == "maps" && n.Recv == nil && n.Name.Name == "Clone" {
+			return t.transformMapsClone(n), nil
+		}
+	// Check if map range. Ranges over iterator funcs like maps.All are not maps
+	// and are ordered because the maps package ranges are transformed.
 	case *ast.RangeStmt:
-		if mapType, _ := t.TypesInfo.TypeOf(n.X).(*types.Map); mapType != nil {
+		if mapType := mapTypeOf(t.TypesInfo.TypeOf(n.X)); mapType != nil {
 			return t.transformRange(n, mapType)
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 func (t *transformInsertionPackage) transformMake(call *ast.CallExpr, mapType *types.Map) (patches []*superpose.Patch) {
@@ -129,28 +175,33 @@ func (t *transformInsertionPackage) transformMake(call *ast.CallExpr, mapType *t
 	// and not mess with the potential size parameter. This allows the size
 	// parameter to potentially be patched too.
 
-	// Change make(<type>[,<size>]) to MakeTrackedMap[<type>](0|<size>). It is
+	// Change make(<type>[,<size>]) to MakeTrackedMap[<type>](0|<size>) or the
+	// synchronized form. It is
 	// important not to patch over the size in case it recursively must be
 	// patched.
+	fn := "MakeTrackedMap"
+	if t.synchronized {
+		fn = "MakeSyncTrackedMap"
+	}
 	patches = append(patches, &superpose.Patch{
 		Range: superpose.Range{Pos: call.Fun.Pos(), End: call.Lparen + 1},
-		Str:   mapIterAlias + ".MakeTrackedMap[",
+		Str:   mapIterAlias + "." + fn + "[",
 	})
 	if len(call.Args) == 1 {
 		// Add ending bracket and open paren with a 0 size
 		patches = append(patches, &superpose.Patch{
-			Range: superpose.Range{Pos: call.Args[0].End() + 1},
+			Range: superpose.Range{Pos: call.Args[0].End()},
 			Str:   "](0",
 		})
 	} else {
 		// Add ending bracket and open paren squashing any potential comma
 		patches = append(patches, &superpose.Patch{
-			Range: superpose.Range{Pos: call.Args[0].End() + 1, End: call.Args[1].Pos()},
+			Range: superpose.Range{Pos: call.Args[0].End(), End: call.Args[1].Pos()},
 			Str:   "](",
 		})
 	}
-	// Reset the line
-	return append(patches, t.LineResetPatch(call))
+	// No line reset is needed since we never add or remove newlines
+	return patches
 }
 
 func (t *transformInsertionPackage) transformDelete(call *ast.CallExpr, mapType *types.Map) []*superpose.Patch {
@@ -162,18 +213,207 @@ func (t *transformInsertionPackage) transformDelete(call *ast.CallExpr, mapType
 	}}
 }
 
+func (t *transformInsertionPackage) transformClear(call *ast.CallExpr, mapType *types.Map) []*superpose.Patch {
+	// Change clear(<map>) to TrackedClear(<map>). The builtin clears the map
+	// without going through delete, so we must reset the tracked keys too.
+	return []*superpose.Patch{{
+		Range: superpose.RangeOf(call.Fun),
+		Str:   mapIterAlias + ".TrackedClear",
+	}}
+}
+
+func (t *transformInsertionPackage) transformLen(call *ast.CallExpr, mapType *types.Map) []*superpose.Patch {
+	// Change len(<map>) to TrackedLen(<map>)
+	return []*superpose.Patch{{
+		Range: superpose.RangeOf(call.Fun),
+		Str:   mapIterAlias + ".TrackedLen",
+	}}
+}
+
+func (t *transformInsertionPackage) transformGet(index *ast.IndexExpr, stack []ast.Node) (patches []*superpose.Patch) {
+	// Index expressions that are assigned to are puts and handled elsewhere
+	fn := "TrackedGet"
+	switch parent := stack[len(stack)-2].(type) {
+	case *ast.AssignStmt:
+		for _, lhs := range parent.Lhs {
+			if lhs == index {
+				return nil
+			}
+		}
+		if len(parent.Lhs) == 2 && len(parent.Rhs) == 1 {
+			fn = "TrackedGetOK"
+		}
+	case *ast.ValueSpec:
+		if len(parent.Names) == 2 && len(parent.Values) == 1 {
+			fn = "TrackedGetOK"
+		}
+	case *ast.IncDecStmt:
+		return nil
+	case *ast.RangeStmt:
+		if parent.Key == index || parent.Value == index {
+			return nil
+		}
+	}
+	// Change <map>[<k>] to TrackedGet[OK](<map>, <k>)
+	patches = t.appendInsert(patches, index.Pos(), mapIterAlias+"."+fn+"(")
+	return append(patches,
+		&superpose.Patch{Range: superpose.Range{Pos: index.Lbrack, End: index.Lbrack + 1}, Str: ", "},
+		&superpose.Patch{Range: superpose.Range{Pos: index.Rbrack, End: index.Rbrack + 1}, Str: ")"},
+	)
+}
+
+func (t *transformInsertionPackage) transformMapsClone(decl *ast.FuncDecl) []*superpose.Patch {
+	// The maps package clones with a runtime function that of course does not
+	// copy our tracking, so we change the body to use our own clone.
+	return []*superpose.Patch{superpose.ReplaceFuncBody(t.TransformPackage, decl,
+		fmt.Sprintf("return %v.TrackedClone(%v)", mapIterAlias, decl.Type.Params.List[0].Names[0].Name))}
+}
+
 func (t *transformInsertionPackage) transformLit(
 	lit *ast.CompositeLit,
 	mapType *types.Map,
 	stack []ast.Node,
-) []*superpose.Patch {
+) ([]*superpose.Patch, error) {
 	// Change <type>{<key1>:<val1>,<key2>:<val2>} to
 	// NewTrackedMapLit[<type>](2).Put(<key1>,<val1>).Put(<key2>,<val2>).Done().
 	// It is important we don't patch over and expressions in case they are
 	// recursively patched. Also since nested literals don't have to put the type
 	// before the key or value literal but we do, we have to walk the parent
 	// composite literals to get the types we need for instantiation.
-	panic("TODO")
+	//
+	// We only replace the braces, colons, and commas so that all newlines and
+	// comments remain and line numbers are unaffected. A trailing comma is left
+	// alone since it is valid inside call parens.
+	file := stack[0].(*ast.File)
+	if parent, _ := stack[len(stack)-2].(*ast.UnaryExpr); parent != nil && parent.Op == token.AND {
+		return nil, fmt.Errorf("cannot take address of map literal at %v", t.Fset.Position(lit.Pos()))
+	}
+
+	// Replace the type and opening brace with the constructor. If the type is
+	// present, we capture it as is, otherwise we have to build it.
+	fn := "NewTrackedMapLit"
+	if t.synchronized {
+		fn = "NewSyncTrackedMapLit"
+	}
+	header := &superpose.Patch{Range: superpose.Range{Pos: lit.Lbrace, End: lit.Lbrace + 1}}
+	if lit.Type != nil {
+		header.Range.Pos = lit.Type.Pos()
+		header.Captures = map[string]superpose.Range{"type": superpose.RangeOf(lit.Type)}
+		header.Str = mapIterAlias + "." + fn + "[{{.type}}]("
+	} else {
+		typeStr, err := t.typeString(file, t.TypesInfo.TypeOf(lit))
+		if err != nil {
+			return nil, err
+		}
+		header.Str = mapIterAlias + "." + fn + "[" + typeStr + "]("
+	}
+	header.Str += strconv.Itoa(len(lit.Elts))
+	if len(lit.Elts) > 0 {
+		header.Str += ").Put("
+	}
+	patches := []*superpose.Patch{header}
+
+	// Patch each element
+	for i, elt := range lit.Elts {
+		kv, _ := elt.(*ast.KeyValueExpr)
+		if kv == nil {
+			return nil, fmt.Errorf("map literal element at %v is not key/value", t.Fset.Position(elt.Pos()))
+		}
+		// Elided composite literal types are no longer allowed once they are
+		// call arguments, so we have to add them. Map literals are skipped since
+		// they are transformed themselves with their type.
+		for _, keyOrValue := range []struct {
+			expr ast.Expr
+			typ  types.Type
+		}{{kv.Key, mapType.Key()}, {kv.Value, mapType.Elem()}} {
+			patch, err := t.elidedTypePatch(file, keyOrValue.expr, keyOrValue.typ)
+			if err != nil {
+				return nil, err
+			} else if patch != nil {
+				patches = append(patches, patch)
+			}
+		}
+		// Colon becomes comma
+		patches = append(patches, &superpose.Patch{
+			Range: superpose.Range{Pos: kv.Colon, End: kv.Colon + 1},
+			Str:   ",",
+		})
+		// Comma between this and next element becomes the next put
+		if i < len(lit.Elts)-1 {
+			commaPos, err := t.commaPos(kv.End(), lit.Elts[i+1].Pos())
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, &superpose.Patch{
+				Range: superpose.Range{Pos: commaPos, End: commaPos + 1},
+				Str:   ").Put(",
+			})
+		}
+	}
+
+	// Closing brace becomes done
+	return append(patches, &superpose.Patch{
+		Range: superpose.Range{Pos: lit.Rbrace, End: lit.Rbrace + 1},
+		Str:   ").Done()",
+	}), nil
+}
+
+func (t *transformInsertionPackage) elidedTypePatch(
+	file *ast.File,
+	expr ast.Expr,
+	typ types.Type,
+) (*superpose.Patch, error) {
+	lit, _ := expr.(*ast.CompositeLit)
+	if lit == nil || lit.Type != nil {
+		return nil, nil
+	}
+	// Elided pointer literals are implicitly addressed
+	prefix := ""
+	if ptrType, _ := typ.(*types.Pointer); ptrType != nil {
+		prefix, typ = "&", ptrType.Elem()
+	}
+	if _, isMap := typ.Underlying().(*types.Map); isMap {
+		return nil, nil
+	}
+	typeStr, err := t.typeString(file, typ)
+	if err != nil {
+		return nil, err
+	}
+	return &superpose.Patch{Range: superpose.Range{Pos: lit.Lbrace}, Str: prefix + typeStr}, nil
+}
+
+// Gives the type as it would be referenced in the given file
+func (t *transformInsertionPackage) typeString(file *ast.File, typ types.Type) (string, error) {
+	var err error
+	str := types.TypeString(typ, func(other *types.Package) string {
+		if other == t.Types {
+			return ""
+		}
+		if name, ok := importName(file, other); ok {
+			return name
+		} else if err == nil {
+			err = fmt.Errorf("type %v not referenceable in file %v", typ, t.Fset.Position(file.Pos()).Filename)
+		}
+		return other.Name()
+	})
+	return str, err
+}
+
+// Find the position of the comma token between two positions
+func (t *transformInsertionPackage) commaPos(from, to token.Pos) (token.Pos, error) {
+	fromPos, toPos := t.Fset.Position(from), t.Fset.Position(to)
+	src := t.fileContents(fromPos.Filename)[fromPos.Offset:toPos.Offset]
+	var s scanner.Scanner
+	s.Init(token.NewFileSet().AddFile("", -1, len(src)), src, nil, 0)
+	for {
+		pos, tok, _ := s.Scan()
+		if tok == token.COMMA {
+			// Scanner positions in new file set are 1-based offsets
+			return from + pos - 1, nil
+		} else if tok == token.EOF {
+			return token.NoPos, fmt.Errorf("no comma found at %v", fromPos)
+		}
+	}
 }
 
 func (t *transformInsertionPackage) transformPut(assn *ast.AssignStmt) []*superpose.Patch {
@@ -184,31 +424,153 @@ func (t *transformInsertionPackage) transformPut(assn *ast.AssignStmt) []*superp
 	//
 	// As with others, we make sure not to overwrite expressions that may have
 	// nested patches
+	if len(assn.Lhs) == 1 && len(assn.Rhs) == 1 {
+		index := t.mapIndex(assn.Lhs[0])
+		if assn.Tok == token.ASSIGN {
+			// For 1, change <map>[<k>] = <v> to TrackedPut(<map>, <k>, <v>)
+			return append(t.appendInsert(nil, index.Pos(), mapIterAlias+".TrackedPut("),
+				&superpose.Patch{Range: superpose.Range{Pos: index.Lbrack, End: index.Lbrack + 1}, Str: ", "},
+				&superpose.Patch{Range: superpose.Range{Pos: index.Rbrack, End: assn.Rhs[0].Pos()}, Str: ", "},
+				&superpose.Patch{Range: superpose.Range{Pos: assn.Rhs[0].End()}, Str: ")"},
+			)
+		}
 
-	// For 1, change <map>[<k>] = <v> to TrackedPut(<map>, <k>, <v>)
+		// For 2, change <map>[<k>] <op>= <v> to collapsed form of:
+		// func() {
+		//   __m, __k := MapKey(<map>, <k>)
+		//   TrackedPut(__m, __k, __m[__k] <op> (<v>))
+		// }().
+		// We have to use a func for hygiene and for places where only one
+		// statement is allowed. MapKey is used to give untyped constant keys the
+		// map's key type.
+		op := strings.TrimSuffix(assn.Tok.String(), "=")
+		return append(t.appendInsert(nil, index.Pos(), "func() { __m, __k := "+mapIterAlias+".MapKey("),
+			&superpose.Patch{Range: superpose.Range{Pos: index.Lbrack, End: index.Lbrack + 1}, Str: ", "},
+			&superpose.Patch{
+				Range: superpose.Range{Pos: index.Rbrack, End: assn.Rhs[0].Pos()},
+				Str:   "); " + mapIterAlias + ".TrackedPut(__m, __k, " + t.currentValue() + " " + op + " (",
+			},
+			&superpose.Patch{Range: superpose.Range{Pos: assn.Rhs[0].End()}, Str: ")) }()"},
+		)
+	}
+
+	// For 3, change <map1>[<k1>], <map2>[<k2>], <other> = <v1>, <v2>, <v3> to
+	// collapsed form of:
+	// TrackedAssignMulti(func(__m *MultiAssign) {
+	//   *MultiKey(__m, <map1>, <k1>), *MultiKey(__m, <map2>, <k2>), <other> = <v1>, <v2>, <v3>
+	// }).
+	// We do this to keep the expressions in order and support single-statement
+	// situations. Go evaluates all LHS index operands and pointer indirections
+	// before any assignment, so the "MultiKey" calls record the map puts in
+	// order and give back a pointer to a temporary value that is assigned. Once
+	// the function returns, the temporary values are put in order. This also
+	// works for tuple assignments from a multi-value call on the RHS.
+	patches := t.appendInsert(nil, assn.Pos(),
+		mapIterAlias+".TrackedAssignMulti(func(__m *"+mapIterAlias+".MultiAssign) { ")
+	for _, lhs := range assn.Lhs {
+		index := t.mapIndex(lhs)
+		if index == nil {
+			continue
+		}
+		patches = append(t.appendInsert(patches, index.Pos(), "*"+mapIterAlias+".MultiKey(__m, "),
+			&superpose.Patch{Range: superpose.Range{Pos: index.Lbrack, End: index.Lbrack + 1}, Str: ", "},
+			&superpose.Patch{Range: superpose.Range{Pos: index.Rbrack, End: index.Rbrack + 1}, Str: ")"},
+		)
+	}
+	return append(patches, &superpose.Patch{Range: superpose.Range{Pos: assn.End()}, Str: " })"})
+}
 
-	// For 2, change <map>[<k>] <op>= <v> to collapsed form of:
+func (t *transformInsertionPackage) transformIncDec(stmt *ast.IncDecStmt, index *ast.IndexExpr) []*superpose.Patch {
+	// Same as <op>= put above, change <map>[<k>]++ to collapsed form of:
 	// func() {
-	//   __m, __k := <map>, <k>
-	//   TrackedPut(__m, __k, __m[__k] <op> <v>)
+	//   __m, __k := MapKey(<map>, <k>)
+	//   TrackedPut(__m, __k, __m[__k] + 1)
 	// }().
-	// We have to use a func for hygiene and for places where only one statement
-	// is allowed.
+	op := "+"
+	if stmt.Tok == token.DEC {
+		op = "-"
+	}
+	return append(t.appendInsert(nil, index.Pos(), "func() { __m, __k := "+mapIterAlias+".MapKey("),
+		&superpose.Patch{Range: superpose.Range{Pos: index.Lbrack, End: index.Lbrack + 1}, Str: ", "},
+		&superpose.Patch{
+			Range: superpose.Range{Pos: index.Rbrack, End: stmt.End()},
+			Str:   "); " + mapIterAlias + ".TrackedPut(__m, __k, " + t.currentValue() + " " + op + " 1) }()",
+		},
+	)
+}
 
-	// Change <map1>[<k1>], <map2>[<k2>], <other> = <v1>, <v2>, <v3> to collapsed
-	// form of:
-	// TrackedAssignMulti(func(__m *TrackedMultiAssign) {
-	//   *__m.Key(<map1>, <k1>), *__m.Key(<map2>, <k2>, 1), <other> = __m.Val(<v1>), __m.Val(<v2>), <v3>
-	// }).
-	// We do this to keep the expressions in order and support single-statement
-	// situations. Go evaluates all LHS before any RHS for indexes (like original
-	// code) and pointer indirections (like this code). Those pointers are
-	// worthless values as is the return from "Val", they're just there to
-	// preserve order. The "Key" calls keep track of order and "Val" calls will
-	// use the keys in order.
-	panic("TODO")
+// Appends an insert patch at the given position unless there is already one
+// there, in which case the string is appended to it. Since parent nodes are
+// visited before their children, this keeps outer calls before inner ones for
+// expressions that start at the same position (e.g. "m[k1][k2] = v" with a
+// synchronized get of "m[k1]").
+func (t *transformInsertionPackage) appendInsert(
+	patches []*superpose.Patch,
+	pos token.Pos,
+	str string,
+) []*superpose.Patch {
+	if existing := t.inserts[pos]; existing != nil {
+		existing.Str += str
+		return patches
+	}
+	if t.inserts == nil {
+		t.inserts = map[token.Pos]*superpose.Patch{}
+	}
+	patch := &superpose.Patch{Range: superpose.Range{Pos: pos}, Str: str}
+	t.inserts[pos] = patch
+	return append(patches, patch)
+}
+
+// Gives the expression for the current value of "__m[__k]" in generated code
+func (t *transformInsertionPackage) currentValue() string {
+	if t.synchronized {
+		return mapIterAlias + ".TrackedGet(__m, __k)"
+	}
+	return "__m[__k]"
+}
+
+// Returns the index expression if the given expression is an index into a map
+func (t *transformInsertionPackage) mapIndex(x ast.Expr) *ast.IndexExpr {
+	if index, _ := x.(*ast.IndexExpr); index != nil {
+		if mapTypeOf(t.TypesInfo.TypeOf(index.X)) != nil {
+			return index
+		}
+	}
+	return nil
+}
+
+func (t *transformInsertionPackage) transformRange(
+	rang *ast.RangeStmt,
+	mapType *types.Map,
+) ([]*superpose.Patch, error) {
+	// Change:
+	//   for <Key>, <Val> :=|= range <X> {<Body>
+	// to:
+	//   for __iter := TrackedIter(<X>); __iter.Next(); { <Key>, <Val> :=|= __iter.Pair()<Body>
+	// Unlike the sorted transformer, we don't patch over <X> or <Body> since they
+	// may be recursively patched.
+	children := map[string]superpose.Range{
+		"x":    superpose.RangeOf(rang.X),
+		"body": {Pos: rang.Body.Lbrace + 1, End: rang.Body.End()},
+	}
+	tmpl := "for __iter := " + mapIterAlias + ".TrackedIter({{.x}}); __iter.Next(); {"
+	// Only assign if there is something non-blank to assign to, otherwise a
+	// define would fail with no new variables
+	if !isBlank(rang.Key) || !isBlank(rang.Value) {
+		children["key"] = superpose.RangeOf(rang.Key)
+		tmpl += " {{.key}}, "
+		if rang.Value != nil {
+			children["value"] = superpose.RangeOf(rang.Value)
+			tmpl += "{{.value}} "
+		} else {
+			tmpl += "_ "
+		}
+		tmpl += rang.Tok.String() + " __iter.Pair()"
+	}
+	return superpose.TemplatePatch(rang, tmpl+"{{.body}}", children)
 }
 
-func (t *transformInsertionPackage) transformRange(rang *ast.RangeStmt, mapType *types.Map) []*superpose.Patch {
-	panic("TODO")
+func isBlank(x ast.Expr) bool {
+	ident, _ := x.(*ast.Ident)
+	return x == nil || (ident != nil && ident.Name == "_")
 }
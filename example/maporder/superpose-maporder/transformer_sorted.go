@@ -4,17 +4,27 @@ import (
 	"fmt"
 	"go/ast"
 	"go/types"
+	"strings"
 
 	"github.com/cretz/superpose"
 )
 
-type transformerSorted struct{}
+type transformerSorted struct {
+	// Comparators for map keys that are not ordered. The key is the qualified
+	// key type (e.g. "example.com/foo.Point") and the value is the qualified
+	// comparator function (e.g. "example.com/foo.ComparePoints"). The function
+	// must be a "func(a, b K) int" in the package being transformed or in a
+	// package already imported by the file with the map range. Keys with a
+	// "Compare(K) int" method do not need a comparator.
+	comparators map[string]string
+
+	// If true, map keys that are not ordered and have no comparator are iterated
+	// in a deterministic hash order instead of panicking.
+	hashOrderFallback bool
+}
 
 func (transformerSorted) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
-	// We could make this apply across most of the standard library, but we'll
-	// just keep it limited to these for now
-	return pkgPath == "github.com/cretz/superpose/example/maporder" ||
-		pkgPath == "github.com/cretz/superpose/example/maporder/otherpkg", nil
+	return appliesToPackage(pkgPath), nil
 }
 
 func (t transformerSorted) Transform(
@@ -29,41 +39,47 @@ func (t transformerSorted) Transform(
 	// Go over each file adding patches if there are any
 	for _, file := range pkg.Syntax {
 		patchedFile := false
+		var err error
 		ast.Inspect(file, func(n ast.Node) bool {
-			if nodePatch := t.transformNode(pkg, n); nodePatch != nil {
+			var nodePatch *superpose.Patch
+			if nodePatch, err = t.transformNode(pkg, file, n); nodePatch != nil {
 				res.Patches = append(res.Patches, nodePatch)
 				patchedFile = true
 			}
-			return true
+			return err == nil
 		})
-		if patchedFile {
-			// We add our import at the very top on the same line as package
-			res.Patches = append(res.Patches, &superpose.Patch{
-				Range: superpose.Range{Pos: file.Name.End()},
-				Str:   fmt.Sprintf("; import %s %q", mapIterAlias, mapIterPkg),
-			})
-			res.IncludeDependencyPackages = map[string]struct{}{
-				mapIterPkg:                     {},
-				"golang.org/x/exp/constraints": {},
+		if err != nil {
+			return nil, err
+		} else if patchedFile {
+			// We add our import after the other imports on the same line
+			if err := res.AddImport(ctx, file, mapIterPkg, mapIterAlias); err != nil {
+				return nil, err
 			}
 		}
 	}
 	return res, nil
 }
 
-func (transformerSorted) transformNode(pkg *superpose.TransformPackage, node ast.Node) *superpose.Patch {
+func (t transformerSorted) transformNode(
+	pkg *superpose.TransformPackage,
+	file *ast.File,
+	node ast.Node,
+) (*superpose.Patch, error) {
 	rangeStmt, _ := node.(*ast.RangeStmt)
 	if rangeStmt == nil {
-		return nil
+		return nil, nil
 	}
-	rangeType, _ := pkg.TypesInfo.TypeOf(rangeStmt.X).(*types.Map)
+	// Ranges over iterator funcs like maps.All are not maps and are skipped
+	// here. They are ordered because the maps package ranges are transformed.
+	rangeType := mapTypeOf(pkg.TypesInfo.TypeOf(rangeStmt.X))
 	if rangeType == nil {
-		return nil
+		return nil, nil
 	}
-
-	// If the map has an unordered key, just change the range statement to panic
-	if b, _ := rangeType.Key().(*types.Basic); b == nil || b.Info()&types.IsOrdered == 0 {
-		return superpose.WrapWithPatch(rangeStmt.X, mapIterAlias+".PanicUnorderedKeys(", ")")
+	newIter, extraArgs, err := t.newIterCall(pkg, file, rangeType.Key())
+	if err != nil {
+		return nil, err
+	} else if newIter == "" {
+		return superpose.WrapWithPatch(rangeStmt.X, mapIterAlias+".PanicUnorderedKeys(", ")"), nil
 	}
 
 	// Change to:
@@ -73,7 +89,7 @@ func (transformerSorted) transformNode(pkg *superpose.TransformPackage, node ast
 		Captures: map[string]superpose.Range{
 			"x": superpose.RangeOf(rangeStmt.X),
 		},
-		Str: "for __iter := " + mapIterAlias + ".NewSortedIter({{.x}}); __iter.Next(); {",
+		Str: "for __iter := " + mapIterAlias + "." + newIter + "({{.x}}" + extraArgs + "); __iter.Next(); {",
 	}
 	if rangeStmt.Key != nil || rangeStmt.Value != nil {
 		if rangeStmt.Key != nil {
@@ -90,5 +106,60 @@ func (transformerSorted) transformNode(pkg *superpose.TransformPackage, node ast
 		}
 		patch.Str += rangeStmt.Tok.String() + " __iter.Pair()"
 	}
-	return patch
+	return patch, nil
+}
+
+// Returns the iterator constructor and any extra args after the map for the
+// given key type, or an empty constructor if the range should panic.
+func (t transformerSorted) newIterCall(
+	pkg *superpose.TransformPackage,
+	file *ast.File,
+	key types.Type,
+) (newIter string, extraArgs string, err error) {
+	// If the key is a type parameter, we have to check whether it is ordered at
+	// runtime
+	if _, typeParam := key.(*types.TypeParam); typeParam {
+		if t.hashOrderFallback {
+			return "NewDynamicOrHashSortedIter", "", nil
+		}
+		return "NewDynamicSortedIter", "", nil
+	}
+	if b, _ := key.Underlying().(*types.Basic); b != nil && b.Info()&types.IsOrdered != 0 {
+		return "NewSortedIter", "", nil
+	}
+	// Use configured comparator if present
+	keyStr := types.TypeString(key, nil)
+	if cmp := t.comparators[keyStr]; cmp != "" {
+		lastDot := strings.LastIndex(cmp, ".")
+		if lastDot == -1 {
+			return "", "", fmt.Errorf("comparator %v for key %v is not qualified", cmp, keyStr)
+		}
+		cmpPkgPath, cmpName := cmp[:lastDot], cmp[lastDot+1:]
+		if cmpPkgPath == pkg.PkgPath {
+			return "NewFuncSortedIter", ", " + cmpName, nil
+		}
+		for _, cmpPkg := range pkg.Types.Imports() {
+			if cmpPkg.Path() != cmpPkgPath {
+				continue
+			} else if name, ok := importName(file, cmpPkg); ok && name != "" {
+				return "NewFuncSortedIter", ", " + name + "." + cmpName, nil
+			} else if ok {
+				return "NewFuncSortedIter", ", " + cmpName, nil
+			}
+		}
+		return "", "", fmt.Errorf("comparator %v for key %v is not imported in file %v",
+			cmp, keyStr, pkg.Fset.Position(file.Pos()).Filename)
+	}
+	// Use the key's compare method if present
+	if compare := types.NewMethodSet(key).Lookup(nil, "Compare"); compare != nil {
+		sig := compare.Type().(*types.Signature)
+		if sig.Params().Len() == 1 && types.Identical(sig.Params().At(0).Type(), key) &&
+			sig.Results().Len() == 1 && types.Identical(sig.Results().At(0).Type(), types.Typ[types.Int]) {
+			return "NewCompareSortedIter", "", nil
+		}
+	}
+	if t.hashOrderFallback {
+		return "NewHashSortedIter", "", nil
+	}
+	return "", "", nil
 }
@@ -1,3 +1,325 @@
+// Package clock is the virtual clock used by the mocktime dimension.
+//
+// This package is shared between the mocked and non-mocked code, so it
+// intentionally does not use any time types and all times and durations are in
+// nanoseconds.
+//
+// The package-level functions use the clock bound to the current goroutine via
+// [Bind], or the default clock if none is bound. Goroutines started in the
+// mocktime dimension inherit the clock of the goroutine that started them.
 package clock
 
-var NowUnixMilli int64
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is a virtual clock.
+type Clock struct {
+	lock        sync.Mutex
+	nowUnixNano int64
+	pending     []*Timer
+	// Broadcast whenever the set of pending timers changes
+	pendingChanged *sync.Cond
+	// Incremented on every use of the clock
+	activity uint64
+}
+
+// New creates a clock at the given nanoseconds since the Unix epoch.
+func New(unixNano int64) *Clock {
+	c := &Clock{nowUnixNano: unixNano}
+	c.pendingChanged = sync.NewCond(&c.lock)
+	return c
+}
+
+var defaultClock = New(0)
+
+var (
+	goroutineClocks     = map[int64]*Clock{}
+	goroutineClocksLock sync.RWMutex
+	// Number of bound goroutines so we only look up the goroutine when needed
+	goroutineClocksLen int64
+)
+
+// Default returns the clock used by goroutines with no bound clock.
+func Default() *Clock { return defaultClock }
+
+// Current returns the clock bound to the current goroutine or the default
+// clock if none is bound.
+func Current() *Clock {
+	if atomic.LoadInt64(&goroutineClocksLen) == 0 {
+		return defaultClock
+	}
+	goroutineClocksLock.RLock()
+	c := goroutineClocks[goroutineID()]
+	goroutineClocksLock.RUnlock()
+	if c == nil {
+		return defaultClock
+	}
+	return c
+}
+
+// Bind binds the given clock to the current goroutine and returns a function
+// that restores the previous binding. A nil clock unbinds the goroutine so it
+// uses the default clock.
+func Bind(c *Clock) (restore func()) {
+	id := goroutineID()
+	goroutineClocksLock.Lock()
+	defer goroutineClocksLock.Unlock()
+	prev := goroutineClocks[id]
+	setGoroutineClockUnlocked(id, c)
+	return func() {
+		goroutineClocksLock.Lock()
+		defer goroutineClocksLock.Unlock()
+		setGoroutineClockUnlocked(id, prev)
+	}
+}
+
+func setGoroutineClockUnlocked(id int64, c *Clock) {
+	if c == nil {
+		delete(goroutineClocks, id)
+	} else {
+		goroutineClocks[id] = c
+	}
+	atomic.StoreInt64(&goroutineClocksLen, int64(len(goroutineClocks)))
+}
+
+// Inherit returns a function that, when called, runs the given function with
+// the clock of the goroutine calling Inherit bound. The mocktime dimension
+// wraps the function of every go statement with this.
+func Inherit[F any](f F) F {
+	// Nothing to bind if there are no goroutine clocks
+	c := Current()
+	if c == defaultClock {
+		return f
+	}
+	fn := reflect.ValueOf(f)
+	return reflect.MakeFunc(fn.Type(), func(args []reflect.Value) []reflect.Value {
+		defer Bind(c)()
+		if fn.Type().IsVariadic() {
+			return fn.CallSlice(args)
+		}
+		return fn.Call(args)
+	}).Interface().(F)
+}
+
+func goroutineID() int64 {
+	// The stack begins with "goroutine <id> "
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	id, err := strconv.ParseInt(string(b[:bytes.IndexByte(b, ' ')]), 10, 64)
+	if err != nil {
+		panic("unable to get goroutine ID")
+	}
+	return id
+}
+
+// AutoAdvance calls [Clock.AutoAdvance] on the current clock.
+func AutoAdvance(idleNanos int64) (stop func()) { return Current().AutoAdvance(idleNanos) }
+
+// NowUnixNano calls [Clock.NowUnixNano] on the current clock.
+func NowUnixNano() int64 { return Current().NowUnixNano() }
+
+// SetUnixNano calls [Clock.SetUnixNano] on the current clock.
+func SetUnixNano(unixNano int64) { Current().SetUnixNano(unixNano) }
+
+// Advance calls [Clock.Advance] on the current clock.
+func Advance(nanos int64) { Current().Advance(nanos) }
+
+// BlockUntilTimers calls [Clock.BlockUntilTimers] on the current clock.
+func BlockUntilTimers(n int) { Current().BlockUntilTimers(n) }
+
+// Sleep calls [Clock.Sleep] on the current clock.
+func Sleep(nanos int64) { Current().Sleep(nanos) }
+
+// NewTimer calls [Clock.NewTimer] on the current clock.
+func NewTimer(f func()) *Timer { return Current().NewTimer(f) }
+
+// NowUnixNano returns the current virtual time as nanoseconds since the Unix
+// epoch.
+func (c *Clock) NowUnixNano() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.activity++
+	return c.nowUnixNano
+}
+
+// SetUnixNano sets the current virtual time as nanoseconds since the Unix
+// epoch. This does not fire any timers, so it should usually only be used to
+// set the initial time. Use [Clock.Advance] to move time forward.
+func (c *Clock) SetUnixNano(unixNano int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.activity++
+	c.nowUnixNano = unixNano
+}
+
+// Advance moves the virtual time forward by the given nanoseconds, firing all
+// timers that become due in order. Each timer is fired with the virtual time
+// set to when it was due.
+func (c *Clock) Advance(nanos int64) {
+	c.lock.Lock()
+	c.activity++
+	target := c.nowUnixNano + nanos
+	for len(c.pending) > 0 && c.pending[0].when <= target {
+		t := c.pending[0]
+		c.nowUnixNano = t.when
+		t.removeUnlocked()
+		if t.period > 0 {
+			t.when += t.period
+			t.addUnlocked()
+		}
+		// Fire outside of the lock so the timer func can use the clock
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.nowUnixNano = target
+	c.lock.Unlock()
+}
+
+// AutoAdvance starts advancing the clock to the next pending timer each time
+// the clock has not been used for the given real nanoseconds. This is a
+// heuristic for when all goroutines are blocked waiting on the clock so code
+// with timeouts completes without manual calls to [Clock.Advance]. The idle
+// duration should be long enough for goroutines to start waiting on the clock
+// after being woken up. The returned function stops auto-advancing.
+func (c *Clock) AutoAdvance(idleNanos int64) (stop func()) {
+	stopCh := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(idleNanos))
+		defer ticker.Stop()
+		var lastActivity uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			// Only advance if idle since last check and there is a timer
+			c.lock.Lock()
+			idle := c.activity == lastActivity
+			lastActivity = c.activity
+			var next int64 = -1
+			if idle && len(c.pending) > 0 {
+				if next = c.pending[0].when - c.nowUnixNano; next < 0 {
+					next = 0
+				}
+			}
+			c.lock.Unlock()
+			if next >= 0 {
+				c.Advance(next)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(stopCh) }) }
+}
+
+// BlockUntilTimers blocks until there are at least the given number of pending
+// timers. This is useful to wait for other goroutines to sleep or wait on
+// timers before calling [Clock.Advance].
+func (c *Clock) BlockUntilTimers(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.pending) < n {
+		c.pendingChanged.Wait()
+	}
+}
+
+// Sleep blocks until the virtual time has advanced by the given nanoseconds.
+func (c *Clock) Sleep(nanos int64) {
+	if nanos <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.NewTimer(func() { close(done) }).Reset(nanos, 0)
+	<-done
+}
+
+// Timer is a timer on the virtual clock. It is not pending until [Timer.Reset]
+// is called.
+type Timer struct {
+	c      *Clock
+	f      func()
+	when   int64
+	period int64
+	// Index in pending or -1 if not pending
+	index int
+}
+
+// NewTimer creates a timer that calls the given function each time it fires.
+// The function is called on the goroutine calling [Clock.Advance] and should
+// not block.
+func (c *Clock) NewTimer(f func()) *Timer {
+	return &Timer{c: c, f: f, index: -1}
+}
+
+// Reset makes the timer pending to fire after the given nanoseconds and then
+// every period nanoseconds if the period is positive. If the nanoseconds are
+// not positive, the timer is fired immediately on this goroutine. Returns true
+// if the timer was pending before this call.
+func (t *Timer) Reset(nanos, period int64) bool {
+	t.c.lock.Lock()
+	t.c.activity++
+	wasPending := t.removeUnlocked()
+	t.when, t.period = t.c.nowUnixNano+nanos, period
+	if nanos > 0 {
+		t.addUnlocked()
+		t.c.lock.Unlock()
+		return wasPending
+	}
+	// Timers that are already due fire immediately
+	if period > 0 {
+		t.when += period
+		t.addUnlocked()
+	}
+	t.c.lock.Unlock()
+	t.f()
+	return wasPending
+}
+
+// Stop makes the timer no longer pending. Returns true if the timer was
+// pending before this call.
+func (t *Timer) Stop() bool {
+	t.c.lock.Lock()
+	defer t.c.lock.Unlock()
+	t.c.activity++
+	return t.removeUnlocked()
+}
+
+func (t *Timer) addUnlocked() {
+	// Insert after all timers due at the same time so they fire in the order
+	// they were added
+	c := t.c
+	i := sort.Search(len(c.pending), func(i int) bool { return c.pending[i].when > t.when })
+	c.pending = append(c.pending, nil)
+	copy(c.pending[i+1:], c.pending[i:])
+	c.pending[i] = t
+	c.reindexUnlocked(i)
+	c.pendingChanged.Broadcast()
+}
+
+func (t *Timer) removeUnlocked() bool {
+	if t.index < 0 {
+		return false
+	}
+	c, i := t.c, t.index
+	c.pending = append(c.pending[:i], c.pending[i+1:]...)
+	t.index = -1
+	c.reindexUnlocked(i)
+	c.pendingChanged.Broadcast()
+	return true
+}
+
+func (c *Clock) reindexUnlocked(from int) {
+	for i := from; i < len(c.pending); i++ {
+		c.pending[i].index = i
+	}
+}
@@ -9,11 +9,17 @@ import (
 
 func Log(msg string) { log.Print(msg) }
 
-var LogInMockEnv func(msg string) //mocktime:Log
+func SleepAndLog(msg string) {
+	time.Sleep(time.Hour)
+	log.Print(msg)
+}
+
+var LogInMockEnv func(msg string)         //mocktime:Log
+var SleepAndLogInMockEnv func(msg string) //mocktime:SleepAndLog
 
 func main() {
 	// Let's set our mock clock to 2020-01-01
-	clock.NowUnixMilli = time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local).UnixMilli()
+	clock.SetUnixNano(time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local).UnixNano())
 
 	// Log
 	Log("Non-mocked begin")
@@ -21,9 +27,20 @@ func main() {
 
 	// Wait 2s in real time, but 30s in mocked time
 	time.Sleep(2 * time.Second)
-	clock.NowUnixMilli += 30000
+	clock.Advance(int64(30 * time.Second))
 
 	// Log again
 	Log("Non-mocked after 2s")
 	LogInMockEnv("Mocked after 2s")
+
+	// Sleep an hour in mocked time without waiting in real time. We have to wait
+	// until the sleep has started before advancing.
+	done := make(chan struct{})
+	go func() {
+		SleepAndLogInMockEnv("Mocked after 1h sleep")
+		close(done)
+	}()
+	clock.BlockUntilTimers(1)
+	clock.Advance(int64(time.Hour))
+	<-done
 }
@@ -4,15 +4,11 @@ import (
 	"context"
 	"fmt"
 	"go/ast"
-	"go/token"
 	"go/types"
-	"strconv"
 	"strings"
 
 	"github.com/cretz/superpose"
-	// We include the clock because we want to force it to be compiled ahead of
-	// time
-	_ "github.com/cretz/superpose/example/mocktime/clock"
+	"golang.org/x/tools/go/ast/astutil"
 )
 
 func main() {
@@ -45,57 +41,242 @@ func (transformer) Transform(
 	pkg *superpose.TransformPackage,
 ) (*superpose.TransformResult, error) {
 	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
-	// We only want to transform the log package
 	res := &superpose.TransformResult{
 		AddLineDirectives: true,
 		LogPatchedFiles:   true,
 	}
 	if pkg.PkgPath != "time" {
+		if err := transformGoStmts(ctx, pkg, res); err != nil {
+			return nil, err
+		}
 		return res, nil
 	}
 
-	// When we encounter the time.Now() function, we want to replace its entire
-	// body with our mocked form. We also need to import our clock, so we do that
-	// after the last import. We take care not to mess up original line numbers.
+	// We make the functions that use the runtime clock return early with calls to
+	// our clock and add a clock timer field to the timer and ticker structs. We
+	// take care not to mess up original line numbers.
+	found := map[string]bool{}
 	for _, file := range pkg.Syntax {
-		var lastImportEndPos token.Pos
+		patchedFile := false
 		for _, decl := range file.Decls {
-			// Track last import
-			if decl, _ := decl.(*ast.GenDecl); decl != nil && decl.Tok == token.IMPORT {
-				lastImportEndPos = decl.End()
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if patch := timeStructPatch(spec); patch != nil {
+						res.Patches = append(res.Patches, patch)
+						found["time."+spec.(*ast.TypeSpec).Name.Name] = true
+						patchedFile = true
+					}
+				}
+			case *ast.FuncDecl:
+				funcObj, _ := pkg.TypesInfo.ObjectOf(decl.Name).(*types.Func)
+				if funcObj == nil {
+					continue
+				}
+				body := timeFuncBodies[funcObj.FullName()]
+				if body == nil && decl.Body == nil {
+					body = runtimeFuncBodies[funcObj.FullName()]
+				}
+				if body != nil {
+					res.Patches = append(res.Patches, timeFuncPatch(decl, body))
+					found[funcObj.FullName()] = true
+					patchedFile = true
+				}
 			}
+		}
 
-			// Make sure it's the func we want
-			decl, _ := decl.(*ast.FuncDecl)
-			if decl == nil {
-				continue
+		// Since the dimension is compiled as a different package, linknames that
+		// define symbols in the real time package would be duplicates, so we turn
+		// them into regular comments
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				if fields := strings.Fields(comment.Text); len(fields) == 3 && fields[0] == "//go:linkname" &&
+					strings.HasPrefix(fields[2], "time.") {
+					res.Patches = append(res.Patches, &superpose.Patch{
+						Range: superpose.Range{Pos: comment.Pos(), End: comment.Pos() + 5},
+						Str:   "// ",
+					})
+				}
 			}
-			funcObj, _ := pkg.TypesInfo.ObjectOf(decl.Name).(*types.Func)
-			if funcObj == nil || funcObj.FullName() != "time.Now" {
-				continue
+		}
+
+		// Add our clock import
+		if patchedFile {
+			if err := res.AddImport(ctx, file, clockPkg, "__clock"); err != nil {
+				return nil, err
 			}
+		}
+	}
 
-			// Add our custom string import just after the last import, but on the
-			// same line to prevent inadvertently altering line numbers.
-			res.Patches = append(res.Patches, &superpose.Patch{
-				Range: superpose.Range{Pos: lastImportEndPos},
-				Str:   `; import __clock "github.com/cretz/superpose/example/mocktime/clock"`,
-			})
-
-			// We have to also tell the linker that we have a new dependency
-			res.IncludeDependencyPackages = map[string]struct{}{"github.com/cretz/superpose/example/mocktime/clock": {}}
-
-			// Now we want to replace the body with our return, but also we need a
-			// line directive to tell it to pick up where it left off when it sees the
-			// rbrace
-			rbracePos := pkg.Fset.Position(decl.Body.Rbrace)
-			res.Patches = append(res.Patches, &superpose.Patch{
-				Range: superpose.Range{Pos: decl.Body.Lbrace + 1, End: decl.Body.Rbrace - 1},
-				Str:   " return UnixMilli(__clock.NowUnixMilli); /*line :" + strconv.Itoa(rbracePos.Line) + "*/",
-			})
-
-			return res, nil
+	// Make sure we found everything
+	for name := range timeFuncBodies {
+		if !found[name] {
+			return nil, fmt.Errorf("could not find %v", name)
+		}
+	}
+	for _, name := range timeStructs {
+		if !found["time."+name] {
+			return nil, fmt.Errorf("could not find time.%v", name)
 		}
 	}
-	return nil, fmt.Errorf("could not find Logger.Output")
+	return res, nil
+}
+
+const clockPkg = "github.com/cretz/superpose/example/mocktime/clock"
+
+// Statements to put at the start of functions in the time package keyed by full
+// function name. Each must end with a return and is given the receiver name if
+// any followed by the parameter names.
+var timeFuncBodies = map[string]func(names ...string) string{
+	"time.Now": func(...string) string {
+		return "return Unix(0, __clock.NowUnixNano())"
+	},
+	// These normally use the runtime monotonic clock for times with a monotonic
+	// reading. Times from the mocked Now have no monotonic reading, and we strip
+	// it from any others so these are always consistent with Sub against the
+	// mocked Now.
+	"time.Since": func(names ...string) string {
+		return fmt.Sprintf("return Now().Sub(%v.Round(0))", names[0])
+	},
+	"time.Until": func(names ...string) string {
+		return fmt.Sprintf("return %v.Round(0).Sub(Now())", names[0])
+	},
+	"time.Sleep": func(names ...string) string {
+		return fmt.Sprintf("__clock.Sleep(int64(%v)); return", names[0])
+	},
+	"time.NewTimer": func(names ...string) string {
+		return fmt.Sprintf("__c := make(chan Time, 1); "+
+			"__t := &Timer{C: __c, __clockTimer: __clock.NewTimer(func() { select { case __c <- Now(): default: } })}; "+
+			"__t.__clockTimer.Reset(int64(%v), 0); return __t", names[0])
+	},
+	"time.AfterFunc": func(names ...string) string {
+		return fmt.Sprintf("__f := __clock.Inherit(%v); __t := &Timer{__clockTimer: __clock.NewTimer(func() { go __f() })}; "+
+			"__t.__clockTimer.Reset(int64(%v), 0); return __t", names[1], names[0])
+	},
+	"(*time.Timer).Stop": func(names ...string) string {
+		return fmt.Sprintf("return %v.__clockTimer.Stop()", names[0])
+	},
+	"(*time.Timer).Reset": func(names ...string) string {
+		return fmt.Sprintf("return %v.__clockTimer.Reset(int64(%v), 0)", names[0], names[1])
+	},
+	"time.NewTicker": func(names ...string) string {
+		return fmt.Sprintf("if %[1]v <= 0 { panic(\"non-positive interval for NewTicker\") }; "+
+			"__c := make(chan Time, 1); "+
+			"__t := &Ticker{C: __c, __clockTimer: __clock.NewTimer(func() { select { case __c <- Now(): default: } })}; "+
+			"__t.__clockTimer.Reset(int64(%[1]v), int64(%[1]v)); return __t", names[0])
+	},
+	"(*time.Ticker).Stop": func(names ...string) string {
+		return fmt.Sprintf("%v.__clockTimer.Stop(); return", names[0])
+	},
+	"(*time.Ticker).Reset": func(names ...string) string {
+		return fmt.Sprintf("if %[2]v <= 0 { panic(\"non-positive interval for Ticker.Reset\") }; "+
+			"%[1]v.__clockTimer.Reset(int64(%[2]v), int64(%[2]v)); return", names[0], names[1])
+	},
+}
+
+// Bodies for functions in the time package that are implemented by the runtime
+// and still referenced by the rest of the package. Since the dimension is
+// compiled as a different package, the runtime does not provide these. These
+// vary by Go version, so unlike the above, not all are required to be present.
+var runtimeFuncBodies = map[string]func(names ...string) string{
+	"time.now": func(...string) string {
+		return "__n := __clock.NowUnixNano(); return __n / 1e9, int32(__n % 1e9), __n"
+	},
+	"time.runtimeNow": func(...string) string {
+		return "__n := __clock.NowUnixNano(); return __n / 1e9, int32(__n % 1e9), __n"
+	},
+	"time.runtimeNano": func(...string) string {
+		return "return __clock.NowUnixNano()"
+	},
+	"time.runtimeIsBubbled": func(...string) string {
+		return "return false"
+	},
+}
+
+// Goroutines started outside of the time package must inherit the clock of the
+// goroutine that started them, so we change every "go <fn>(<args>)" to
+// "go __clock.Inherit(<fn>)(<args>)". The function and args are still evaluated
+// on the current goroutine like they are with a normal go statement.
+func transformGoStmts(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	res *superpose.TransformResult,
+) error {
+	for _, file := range pkg.Syntax {
+		patchedFile := false
+		ast.Inspect(file, func(n ast.Node) bool {
+			goStmt, _ := n.(*ast.GoStmt)
+			if goStmt == nil {
+				return true
+			}
+			// Built-in functions are not values and cannot be wrapped
+			if ident, _ := astutil.Unparen(goStmt.Call.Fun).(*ast.Ident); ident != nil {
+				if _, builtin := pkg.TypesInfo.ObjectOf(ident).(*types.Builtin); builtin {
+					return true
+				}
+			}
+			// We insert instead of wrapping since the function may be a literal
+			// with nested go statements
+			res.Patches = append(res.Patches,
+				&superpose.Patch{Range: superpose.Range{Pos: goStmt.Call.Fun.Pos()}, Str: "__clock.Inherit("},
+				&superpose.Patch{Range: superpose.Range{Pos: goStmt.Call.Fun.End()}, Str: ")"},
+			)
+			patchedFile = true
+			return true
+		})
+		if patchedFile {
+			if err := res.AddImport(ctx, file, clockPkg, "__clock"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Structs in the time package that get a clock timer field
+var timeStructs = []string{"Timer", "Ticker"}
+
+func timeStructPatch(spec ast.Spec) *superpose.Patch {
+	typeSpec, _ := spec.(*ast.TypeSpec)
+	if typeSpec == nil {
+		return nil
+	}
+	for _, name := range timeStructs {
+		if typeSpec.Name.Name != name {
+			continue
+		}
+		// Add the field just before the closing brace on the same line
+		if structType, _ := typeSpec.Type.(*ast.StructType); structType != nil {
+			return &superpose.Patch{
+				Range: superpose.Range{Pos: structType.Fields.Closing},
+				Str:   "__clockTimer *__clock.Timer; ",
+			}
+		}
+	}
+	return nil
+}
+
+func timeFuncPatch(decl *ast.FuncDecl, body func(names ...string) string) *superpose.Patch {
+	var names []string
+	if decl.Recv != nil {
+		names = append(names, decl.Recv.List[0].Names[0].Name)
+	}
+	for _, param := range decl.Type.Params.List {
+		for _, name := range param.Names {
+			names = append(names, name.Name)
+		}
+	}
+	// Functions implemented by the runtime have no body, so we add one
+	if decl.Body == nil {
+		return &superpose.Patch{
+			Range: superpose.Range{Pos: decl.Type.End()},
+			Str:   " { " + body(names...) + " }",
+		}
+	}
+	// We leave the original body after our return instead of replacing it so
+	// that everything it references, such as imports, is still used
+	return &superpose.Patch{
+		Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+		Str:   " " + body(names...) + ";",
+	}
 }
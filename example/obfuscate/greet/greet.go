@@ -0,0 +1,52 @@
+// Package greet has string literals of several kinds to obfuscate.
+package greet
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Constants must remain constant, so they are not obfuscated. Only their uses
+// outside of constant expressions are.
+const defaultName = "gopher"
+
+var punctuation = map[string]string{"hello": "!", "farewell": "."}
+
+var banner = `
+  Hello
+    from
+      greet
+`
+
+// Hello returns a greeting for the name or a default one if empty.
+func Hello(name string) string {
+	if name == "" {
+		name = defaultName
+	}
+	return fmt.Sprintf("Hello, %v%v", name, punctuation["hello"])
+}
+
+// Farewell returns a farewell in the given language.
+func Farewell(lang string) string {
+	switch lang {
+	case "es":
+		return "Adiós" + punctuation["farewell"]
+	case "fr":
+		return "Au revoir" + punctuation["farewell"]
+	default:
+		return "Goodbye" + punctuation["farewell"]
+	}
+}
+
+// Banner returns the banner words on one line.
+func Banner() string {
+	return strings.Join(strings.Fields(banner), " ")
+}
+
+// Where returns the file and line of the caller. Since obfuscation does not
+// alter line numbers, this is the same in the obfuscated dimension.
+func Where() string {
+	_, file, line, _ := runtime.Caller(1)
+	return fmt.Sprintf("%v:%v", file[strings.LastIndex(file, "/")+1:], line)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cretz/superpose/example/obfuscate/greet"
+)
+
+func Greetings() []string {
+	return []string{
+		greet.Hello(""),
+		greet.Hello("world"),
+		greet.Farewell("es"),
+		greet.Banner(),
+		greet.Where(),
+	}
+}
+
+var obfuscatedGreetings func() []string //obfuscate:Greetings
+
+func main() {
+	normal, obfuscated := Greetings(), obfuscatedGreetings()
+	for i := range normal {
+		fmt.Printf("normal: %-25q  obfuscated: %q\n", normal[i], obfuscated[i])
+	}
+}
@@ -0,0 +1,15 @@
+// Package reveal decodes the string literals obfuscated in the obfuscate
+// dimension.
+//
+// Nothing in the example imports this package. It is only linked because the
+// transformer includes it as a dependency of the packages it patches.
+package reveal
+
+// String returns the data XORed with the key which must be at least as long.
+func String(key, data []byte) string {
+	b := make([]byte, len(data))
+	for i := range data {
+		b[i] = data[i] ^ key[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"obfuscate": transformer{}},
+			// Set to true to see compilation details and the patched files
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const revealPkg = "github.com/cretz/superpose/example/obfuscate/reveal"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// Every package of the example but the reveal package which is needed to
+	// decode the others
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/obfuscate") &&
+		pkgPath != revealPkg, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	// We replace every string literal that is not required to be constant with a
+	// call that decodes it at runtime. There is a patch per literal, and each
+	// file with any of them gets a new import.
+	for _, file := range pkg.Syntax {
+		var patches []*superpose.Patch
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.GenDecl:
+				// Constants and import paths must remain literals
+				return n.Tok != token.CONST && n.Tok != token.IMPORT
+			case *ast.Field:
+				// Struct tags must remain literals and field types have no others
+				return false
+			case *ast.ArrayType:
+				// Array lengths must remain constant and types have no others
+				return false
+			case *ast.BasicLit:
+				if patch := obfuscateLit(pkg, n); patch != nil {
+					patches = append(patches, patch)
+				}
+			}
+			return true
+		})
+		if len(patches) > 0 {
+			res.Patches = append(res.Patches, patches...)
+			// The reveal package is not imported by the original packages, so this
+			// also tells the compiler and linker about it and its dependencies
+			if err := res.AddImport(ctx, file, revealPkg, "__reveal"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// Returns nil if the literal is not a non-empty string that is only used as a
+// plain string value
+func obfuscateLit(pkg *superpose.TransformPackage, lit *ast.BasicLit) *superpose.Patch {
+	if lit.Kind != token.STRING {
+		return nil
+	}
+	// Untyped string constants used as another type, e.g. a named string type, or
+	// in constant expressions are not converted to string
+	tv, ok := pkg.TypesInfo.Types[lit]
+	if !ok || tv.Value == nil || !types.Identical(tv.Type, types.Typ[types.String]) {
+		return nil
+	}
+	str := constant.StringVal(tv.Value)
+	if str == "" {
+		return nil
+	}
+	// The key is derived from the position so builds are reproducible
+	pos := pkg.Fset.Position(lit.Pos())
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%v/%v:%v", pkg.PkgPath, filepath.Base(pos.Filename), pos.Offset)
+	state := hash.Sum64()
+	key, data := make([]string, len(str)), make([]string, len(str))
+	for i := 0; i < len(str); i++ {
+		// This is a simple LCG
+		state = state*6364136223846793005 + 1442695040888963407
+		key[i] = fmt.Sprintf("%#x", byte(state>>56))
+		data[i] = fmt.Sprintf("%#x", str[i]^byte(state>>56))
+	}
+	// Raw strings may span lines, so we keep the lines after a trailing comma
+	// where no semicolons are inserted
+	if newlines := strings.Count(lit.Value, "\n"); newlines > 0 {
+		data[len(data)-1] += "," + strings.Repeat("\n", newlines)
+	}
+	return &superpose.Patch{
+		Range: superpose.RangeOf(lit),
+		Str:   "__reveal.String([]byte{" + strings.Join(key, ", ") + "}, []byte{" + strings.Join(data, ", ") + "})",
+	}
+}
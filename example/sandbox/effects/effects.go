@@ -0,0 +1,66 @@
+// Package effects is the runtime used by the sandbox dimension to either fake
+// or disallow calls with side effects.
+//
+// This package is shared between the dimension and non-dimension code, so fakes
+// registered outside of the dimension apply to calls made inside of it.
+package effects
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Violation is the value the sandbox dimension panics with when a function with
+// side effects is called and there is no fake for it.
+type Violation struct {
+	// Func is the full name of the function called, e.g. "os.ReadFile" or
+	// "(*os.File).Write".
+	Func string
+}
+
+// Error implements error.
+func (v *Violation) Error() string {
+	return fmt.Sprintf("side effect from calling %v not allowed in sandbox", v.Func)
+}
+
+var (
+	fakes     = map[string]any{}
+	fakesLock sync.RWMutex
+)
+
+// Fake registers a function to call instead of the function with the given
+// full name and returns a function that removes it. The fake must have the same
+// type as the function, including the receiver as the first parameter for
+// method expressions, but not for method calls which are bound to their
+// receiver.
+func Fake[F any](name string, fake F) (remove func()) {
+	fakesLock.Lock()
+	defer fakesLock.Unlock()
+	fakes[name] = fake
+	return func() {
+		fakesLock.Lock()
+		defer fakesLock.Unlock()
+		delete(fakes, name)
+	}
+}
+
+// Guard returns the fake for the given function if there is one, otherwise a
+// function of the same type that panics with a [*Violation] when called. The
+// sandbox dimension wraps the function of every call with side effects with
+// this.
+func Guard[F any](name string, f F) F {
+	fakesLock.RLock()
+	fake, ok := fakes[name]
+	fakesLock.RUnlock()
+	if ok {
+		typedFake, ok := fake.(F)
+		if !ok {
+			panic(fmt.Sprintf("fake for %v is %T, expected %T", name, fake, f))
+		}
+		return typedFake
+	}
+	return reflect.MakeFunc(reflect.TypeOf(f), func([]reflect.Value) []reflect.Value {
+		panic(&Violation{Func: name})
+	}).Interface().(F)
+}
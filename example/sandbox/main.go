@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cretz/superpose/example/sandbox/effects"
+)
+
+// Greet is deterministic other than its use of the current time.
+func Greet(name string) string {
+	return fmt.Sprintf("Hello, %v! It is %v.", strings.ToUpper(name), time.Now().Format(time.Kitchen))
+}
+
+// Hostname has a side effect we have not faked.
+func Hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+var greetInSandbox func(name string) string //sandbox:Greet
+
+var hostnameInSandbox func() string //sandbox:Hostname
+
+func main() {
+	fmt.Println("Normal greeting:", Greet("world"))
+	fmt.Println("Normal hostname:", Hostname())
+
+	// Fake the current time in the sandbox
+	defer effects.Fake("time.Now", func() time.Time { return time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC) })()
+	fmt.Println("Sandbox greeting:", greetInSandbox("world"))
+
+	// Side effects without fakes panic
+	defer func() { fmt.Println("Sandbox hostname panic:", recover()) }()
+	fmt.Println("Sandbox hostname:", hostnameInSandbox())
+}
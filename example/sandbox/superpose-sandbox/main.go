@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"sandbox": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// We only rewrite call sites in our packages, not the effects package itself
+	// which we want shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/sandbox") &&
+		!strings.Contains(pkgPath, "effects"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	// We change every "<fn>(<args>)" that calls a function with side effects to
+	// "__effects.Guard(<name>, <fn>)(<args>)". Like a normal call, the function
+	// and args are evaluated before the call, and we do not alter line numbers.
+	for _, file := range pkg.Syntax {
+		patchedFile := false
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, _ := n.(*ast.CallExpr)
+			if call == nil {
+				return true
+			}
+			fn, _ := typeutil.Callee(pkg.TypesInfo, call).(*types.Func)
+			if fn == nil || !hasSideEffects(fn) {
+				return true
+			}
+			res.Patches = append(res.Patches,
+				&superpose.Patch{
+					Range: superpose.Range{Pos: call.Fun.Pos()},
+					Str:   fmt.Sprintf("__effects.Guard(%q, ", fn.FullName()),
+				},
+				&superpose.Patch{Range: superpose.Range{Pos: call.Fun.End()}, Str: ")"},
+			)
+			patchedFile = true
+			return true
+		})
+		if patchedFile {
+			if err := res.AddImport(ctx, file, effectsPkg, "__effects"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Guards of calls nested in the function expression start at the same
+	// position as the outer guard and are added after it
+	res.Patches = recipes.MergeInserts(res.Patches)
+	return res, nil
+}
+
+const effectsPkg = "github.com/cretz/superpose/example/sandbox/effects"
+
+// Packages where all functions and methods are considered to have side effects
+// unless they are known to be pure
+var sideEffectPackages = map[string]bool{"os": true, "os/exec": true, "os/signal": true, "net": true}
+
+// Functions in the time package that have side effects. The rest of the time
+// package is pure.
+var timeSideEffects = map[string]bool{
+	"time.Now":       true,
+	"time.Since":     true,
+	"time.Until":     true,
+	"time.Sleep":     true,
+	"time.After":     true,
+	"time.AfterFunc": true,
+	"time.Tick":      true,
+	"time.NewTimer":  true,
+	"time.NewTicker": true,
+}
+
+// Pure functions in side effect packages
+var pureFuncs = map[string]bool{
+	"os.IsExist":         true,
+	"os.IsNotExist":      true,
+	"os.IsPathSeparator": true,
+	"os.IsPermission":    true,
+	"os.IsTimeout":       true,
+	"net.CIDRMask":       true,
+	"net.IPv4":           true,
+	"net.IPv4Mask":       true,
+	"net.JoinHostPort":   true,
+	"net.ParseCIDR":      true,
+	"net.ParseIP":        true,
+	"net.ParseMAC":       true,
+	"net.SplitHostPort":  true,
+}
+
+// Types in side effect packages whose methods are all pure
+var pureTypes = map[string]bool{"net.HardwareAddr": true, "net.IP": true, "net.IPMask": true, "net.IPNet": true}
+
+// Methods that are pure no matter the type since they are usually on errors
+var pureMethods = map[string]bool{"Error": true, "String": true, "Temporary": true, "Timeout": true, "Unwrap": true}
+
+func hasSideEffects(fn *types.Func) bool {
+	if fn.Pkg() == nil {
+		return false
+	} else if fn.Pkg().Path() == "time" {
+		return timeSideEffects[fn.FullName()]
+	} else if !sideEffectPackages[fn.Pkg().Path()] || pureFuncs[fn.FullName()] {
+		return false
+	}
+	if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+		if pureMethods[fn.Name()] {
+			return false
+		}
+		recvType := recv.Type()
+		if ptr, _ := recvType.(*types.Pointer); ptr != nil {
+			recvType = ptr.Elem()
+		}
+		if named, _ := recvType.(*types.Named); named != nil && pureTypes[named.Obj().Pkg().Path()+"."+named.Obj().Name()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cretz/superpose/example/schedule/sched"
+)
+
+// Interleave starts workers that each send their name a few times and returns
+// the order the names were received in.
+func Interleave() string {
+	names := make(chan string)
+	done := make(chan struct{})
+	for _, name := range []string{"a", "b", "c"} {
+		go func(name string) {
+			for i := 0; i < 3; i++ {
+				names <- name
+			}
+			done <- struct{}{}
+		}(name)
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		close(names)
+	}()
+	var order []string
+	for name := range names {
+		order = append(order, name)
+	}
+	return strings.Join(order, "")
+}
+
+var interleaveScheduled func() string //schedule:Interleave
+
+func runScheduled(s *sched.Scheduler) (order string) {
+	s.Run(func() { order = interleaveScheduled() })
+	return
+}
+
+func main() {
+	fmt.Println("Normal:", Interleave(), Interleave(), Interleave())
+
+	s := sched.New(1234)
+	fmt.Println("Scheduled with seed 1234:", runScheduled(s))
+	fmt.Println("Scheduled with seed 1234 again:", runScheduled(sched.New(1234)))
+	fmt.Println("Scheduled with seed 5678:", runScheduled(sched.New(5678)))
+	fmt.Println("Replayed from seed 1234 decisions:", runScheduled(sched.NewReplay(s.Decisions())))
+}
@@ -0,0 +1,457 @@
+// Package sched is the cooperative scheduler used by the schedule dimension.
+//
+// Only one goroutine started under [Scheduler.Run] runs at a time. Goroutines
+// give up their turn at each go statement and channel operation in the
+// dimension, and the scheduler chooses which runnable goroutine goes next.
+// Choices are made from a seeded random source and recorded so an execution
+// can be replayed exactly with [NewReplay].
+//
+// This package is shared between the dimension and non-dimension code. Code
+// not running under a scheduler, even in the dimension, is unaffected.
+package sched
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler schedules goroutines cooperatively.
+type Scheduler struct {
+	lock sync.Mutex
+	// Live goroutines in creation order
+	gs      []*goroutine
+	current *goroutine
+	nextID  int
+	// Used to choose among blocked goroutines when none can proceed
+	spins     int
+	rand      uint64
+	replay    []int
+	decisions []int
+	done      chan struct{}
+	// Waiting channel operations keyed by channel pointer
+	waiting map[uintptr][]*waiter
+}
+
+type goroutine struct {
+	s    *Scheduler
+	id   int
+	wake chan struct{}
+	// Whether waiting on a channel operation
+	blocked bool
+	// Whether running outside of scheduler control
+	released bool
+}
+
+// New creates a scheduler that makes choices from a random source with the
+// given seed.
+func New(seed int64) *Scheduler {
+	return &Scheduler{rand: uint64(seed), done: make(chan struct{}), waiting: map[uintptr][]*waiter{}}
+}
+
+// NewReplay creates a scheduler that makes the given choices, usually from
+// [Scheduler.Decisions] of a previous run. Panics if the execution diverges.
+func NewReplay(decisions []int) *Scheduler {
+	return &Scheduler{
+		replay:  append([]int{}, decisions...),
+		done:    make(chan struct{}),
+		waiting: map[uintptr][]*waiter{},
+	}
+}
+
+// Decisions returns the goroutine IDs chosen each time there was more than one
+// runnable goroutine. The goroutine calling Run is ID 0 and the rest are
+// numbered in the order they were started.
+func (s *Scheduler) Decisions() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int{}, s.decisions...)
+}
+
+// Run runs the given function on the current goroutine under this scheduler
+// and returns when it and every goroutine it started have completed. A
+// scheduler can only be run once.
+func (s *Scheduler) Run(f func()) {
+	root := s.newG()
+	s.current = root
+	bind(root)
+	func() {
+		defer s.exit(root)
+		f()
+	}()
+	<-s.done
+}
+
+func (s *Scheduler) newG() *goroutine {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g := &goroutine{s: s, id: s.nextID, wake: make(chan struct{}, 1)}
+	s.nextID++
+	s.gs = append(s.gs, g)
+	return g
+}
+
+// Go returns a function that, when called, runs the given function as a new
+// goroutine of the current scheduler. The schedule dimension wraps the function
+// of every go statement with this.
+func Go[F any](f F) F {
+	parent := current()
+	if parent == nil {
+		return f
+	}
+	s := parent.s
+	child := s.newG()
+	// If started while released with no goroutine having a turn, the child gets
+	// it
+	s.lock.Lock()
+	if s.current == nil {
+		s.current = child
+		child.wake <- struct{}{}
+	}
+	s.lock.Unlock()
+	fn := reflect.ValueOf(f)
+	return reflect.MakeFunc(fn.Type(), func(args []reflect.Value) []reflect.Value {
+		bind(child)
+		<-child.wake
+		defer s.exit(child)
+		if fn.Type().IsVariadic() {
+			return fn.CallSlice(args)
+		}
+		return fn.Call(args)
+	}).Interface().(F)
+}
+
+// Send sends the value on the channel, giving up the turn of the current
+// goroutine. The schedule dimension replaces every send statement outside of
+// a select with this.
+func Send[T any](c chan<- T, v T) {
+	g := current()
+	if g == nil || g.released {
+		c <- v
+		return
+	}
+	g.s.op(g, &waiter{g: g, ch: reflect.ValueOf(c), send: true, value: reflect.ValueOf(&v).Elem()})
+}
+
+// Recv receives from the channel, giving up the turn of the current goroutine.
+// The schedule dimension replaces every receive outside of a select with this.
+func Recv[T any](c <-chan T) T {
+	v, _ := Recv2(c)
+	return v
+}
+
+// Recv2 is [Recv] for receives that also check whether the channel is closed.
+func Recv2[T any](c <-chan T) (v T, ok bool) {
+	g := current()
+	if g == nil || g.released {
+		v, ok = <-c
+		return
+	}
+	w := &waiter{g: g, ch: reflect.ValueOf(c)}
+	g.s.op(g, w)
+	reflect.ValueOf(&v).Elem().Set(w.value)
+	return v, w.ok
+}
+
+// RangeStart returns the channel and the first [Recv2] from it. The schedule
+// dimension replaces ranges over channels with loops using this and [Recv2].
+func RangeStart[T any](c <-chan T) (<-chan T, T, bool) {
+	v, ok := Recv2(c)
+	return c, v, ok
+}
+
+// Close closes the channel, completing the operations of goroutines waiting on
+// it. The schedule dimension replaces every close call with this.
+func Close[T any](c chan<- T) {
+	close(c)
+	g := current()
+	if g == nil {
+		return
+	}
+	s := g.s
+	key := reflect.ValueOf(c).Pointer()
+	s.lock.Lock()
+	for _, w := range s.waiting[key] {
+		if w.send {
+			w.closed = true
+		} else {
+			w.value = reflect.Zero(w.ch.Type().Elem())
+		}
+		w.done, w.g.blocked = true, false
+	}
+	delete(s.waiting, key)
+	s.lock.Unlock()
+	if !g.released {
+		s.yield(g)
+	}
+}
+
+// Release lets the current goroutine run outside of scheduler control until
+// [Acquire] is called. The schedule dimension calls this before every select
+// statement since they may block.
+func Release() {
+	if g := current(); g != nil && !g.released {
+		g.s.release(g)
+	}
+}
+
+// Acquire waits for the current goroutine to be under scheduler control again
+// after [Release]. The schedule dimension calls this at the start of every
+// select case.
+func Acquire() {
+	if g := current(); g != nil && g.released {
+		g.s.acquire(g)
+	}
+}
+
+// A channel operation of a goroutine. Since only one goroutine runs at a time,
+// goroutines cannot block on channels like normal or they would never meet.
+// Instead, goroutines wait on the scheduler and the goroutine on the other side
+// of the operation completes it for them.
+type waiter struct {
+	g *goroutine
+	// Channel as given which is send-capable for sends and receive-capable for
+	// receives
+	ch   reflect.Value
+	send bool
+	// Value to send or value received
+	value reflect.Value
+	ok    bool
+	done  bool
+	// Whether the channel was closed while waiting to send
+	closed bool
+}
+
+// Performs the operation then gives up the turn
+func (s *Scheduler) op(g *goroutine, w *waiter) {
+	key := w.ch.Pointer()
+	for !w.done {
+		// Try without waiting first
+		if s.try(w) {
+			s.lock.Lock()
+			s.removeWaiterUnlocked(key, w)
+			// A buffered operation may let a waiting goroutine on the other side
+			// proceed
+			if other := s.waiterUnlocked(key, !w.send); other != nil && s.try(other) {
+				s.removeWaiterUnlocked(key, other)
+				other.g.blocked = false
+			}
+			s.lock.Unlock()
+			break
+		}
+		s.lock.Lock()
+		// Complete with a waiting goroutine on the other side if there is one,
+		// otherwise wait
+		if other := s.waiterUnlocked(key, !w.send); other != nil {
+			s.removeWaiterUnlocked(key, other)
+			if w.send {
+				other.value, other.ok = w.value, true
+			} else {
+				w.value, w.ok = other.value, true
+			}
+			other.done, other.g.blocked = true, false
+			s.lock.Unlock()
+			break
+		}
+		if !w.g.blocked {
+			s.waiting[key] = append(s.waiting[key], w)
+			w.g.blocked = true
+		}
+		s.lock.Unlock()
+		s.yield(g)
+	}
+	if w.closed {
+		panic("send on closed channel")
+	}
+	s.yield(g)
+}
+
+// Tries the operation without blocking, marking it done on success
+func (s *Scheduler) try(w *waiter) bool {
+	if w.send {
+		w.done = w.ch.TrySend(w.value)
+	} else if v, ok := w.ch.TryRecv(); v.IsValid() {
+		w.value, w.ok, w.done = v, ok, true
+	}
+	return w.done
+}
+
+func (s *Scheduler) waiterUnlocked(key uintptr, send bool) *waiter {
+	for _, w := range s.waiting[key] {
+		if w.send == send {
+			return w
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) removeWaiterUnlocked(key uintptr, w *waiter) {
+	waiting := s.waiting[key]
+	for i, other := range waiting {
+		if other == w {
+			s.waiting[key] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(s.waiting[key]) == 0 {
+		delete(s.waiting, key)
+	}
+	w.g.blocked = false
+}
+
+func (s *Scheduler) yield(g *goroutine) {
+	s.lock.Lock()
+	next, allBlocked := s.chooseUnlocked()
+	s.current = next
+	s.lock.Unlock()
+	// When nothing can proceed, we give goroutines outside of the scheduler time
+	// to unblock us
+	if allBlocked {
+		time.Sleep(100 * time.Microsecond)
+	}
+	if next != g {
+		next.wake <- struct{}{}
+		<-g.wake
+	}
+}
+
+func (s *Scheduler) exit(g *goroutine) {
+	unbind()
+	s.lock.Lock()
+	for i, other := range s.gs {
+		if other == g {
+			s.gs = append(s.gs[:i], s.gs[i+1:]...)
+			break
+		}
+	}
+	// Only hand off our turn if we have it or nobody does, we may have exited
+	// while released
+	var next *goroutine
+	if s.current == g || s.current == nil {
+		next, _ = s.chooseUnlocked()
+		s.current = next
+	}
+	if len(s.gs) == 0 {
+		close(s.done)
+	}
+	s.lock.Unlock()
+	if next != nil {
+		next.wake <- struct{}{}
+	}
+}
+
+func (s *Scheduler) release(g *goroutine) {
+	s.lock.Lock()
+	g.released = true
+	next, _ := s.chooseUnlocked()
+	s.current = next
+	s.lock.Unlock()
+	if next != nil {
+		next.wake <- struct{}{}
+	}
+}
+
+func (s *Scheduler) acquire(g *goroutine) {
+	s.lock.Lock()
+	g.released = false
+	if s.current == nil {
+		s.current = g
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+	<-g.wake
+}
+
+// Chooses the next goroutine to run or nil if none are under scheduler control.
+// Also returns whether all goroutines are blocked.
+func (s *Scheduler) chooseUnlocked() (next *goroutine, allBlocked bool) {
+	var runnable, blocked []*goroutine
+	for _, g := range s.gs {
+		if g.released {
+			continue
+		} else if g.blocked {
+			blocked = append(blocked, g)
+		} else {
+			runnable = append(runnable, g)
+		}
+	}
+	switch {
+	case len(runnable) == 0 && len(blocked) == 0:
+		return nil, false
+	case len(runnable) == 0:
+		// Blocked goroutines are retried in turn and not recorded since they can
+		// only proceed due to goroutines outside of the scheduler
+		s.spins++
+		return blocked[s.spins%len(blocked)], true
+	case len(runnable) == 1:
+		return runnable[0], false
+	}
+	var id int
+	if s.replay != nil {
+		if len(s.decisions) >= len(s.replay) {
+			panic("replay has no more decisions")
+		}
+		id = s.replay[len(s.decisions)]
+	} else {
+		// This is SplitMix64
+		s.rand += 0x9e3779b97f4a7c15
+		z := s.rand
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		id = runnable[(z^(z>>31))%uint64(len(runnable))].id
+	}
+	for _, g := range runnable {
+		if g.id == id {
+			s.decisions = append(s.decisions, id)
+			return g, false
+		}
+	}
+	panic(fmt.Sprintf("replay diverged, goroutine %v is not runnable", id))
+}
+
+var (
+	goroutines     = map[int64]*goroutine{}
+	goroutinesLock sync.RWMutex
+	// Number of bound goroutines so we only look up the goroutine when needed
+	goroutinesLen int64
+)
+
+func current() *goroutine {
+	if atomic.LoadInt64(&goroutinesLen) == 0 {
+		return nil
+	}
+	goroutinesLock.RLock()
+	defer goroutinesLock.RUnlock()
+	return goroutines[goroutineID()]
+}
+
+func bind(g *goroutine) {
+	goroutinesLock.Lock()
+	defer goroutinesLock.Unlock()
+	goroutines[goroutineID()] = g
+	atomic.StoreInt64(&goroutinesLen, int64(len(goroutines)))
+}
+
+func unbind() {
+	goroutinesLock.Lock()
+	defer goroutinesLock.Unlock()
+	delete(goroutines, goroutineID())
+	atomic.StoreInt64(&goroutinesLen, int64(len(goroutines)))
+}
+
+func goroutineID() int64 {
+	// The stack begins with "goroutine <id> "
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	id, err := strconv.ParseInt(string(b[:bytes.IndexByte(b, ' ')]), 10, 64)
+	if err != nil {
+		panic("unable to get goroutine ID")
+	}
+	return id
+}
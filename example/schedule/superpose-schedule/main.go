@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"schedule": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// Any of our packages but the scheduler itself which we want shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/schedule") &&
+		!strings.HasSuffix(pkgPath, "/sched"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	for _, file := range pkg.Syntax {
+		t := &transformSched{pkg: pkg, patches: map[token.Pos]*superpose.Patch{}}
+		ast.Inspect(file, t.inspect)
+		if len(t.patches) == 0 {
+			continue
+		}
+		for _, patch := range t.patches {
+			res.Patches = append(res.Patches, patch)
+		}
+		if err := res.AddImport(ctx, file, schedPkg, "__sched"); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+const schedPkg = "github.com/cretz/superpose/example/schedule/sched"
+
+type transformSched struct {
+	pkg *superpose.TransformPackage
+	// Keyed by position so patches at the same position can be combined
+	patches map[token.Pos]*superpose.Patch
+	// Where statements for a select go if not at the select itself
+	labeled map[*ast.SelectStmt]token.Pos
+}
+
+// We change the following, all without altering line numbers:
+//
+//   - "go <fn>(<args>)" to "go __sched.Go(<fn>)(<args>)"
+//   - "<ch> <- <v>" to "__sched.Send(<ch>, <v>)"
+//   - "<-<ch>" to "__sched.Recv(<ch>)" or "__sched.Recv2(<ch>)" for the
+//     two-value form
+//   - "close(<ch>)" to "__sched.Close(<ch>)"
+//   - "for <v> := range <ch> {" to
+//     "for __c, <v>, __ok := __sched.RangeStart(<ch>); __ok; <v>, __ok = __sched.Recv2(__c) {"
+//   - "select {" to "__sched.Release(); select {" with "__sched.Acquire();" at
+//     the start of each case
+//
+// Channel operations in select cases are left alone since the select itself is
+// run outside of scheduler control.
+func (t *transformSched) inspect(n ast.Node) bool {
+	switch n := n.(type) {
+	case *ast.GoStmt:
+		// Built-in functions are not values and cannot be wrapped
+		if ident, _ := astutil.Unparen(n.Call.Fun).(*ast.Ident); ident != nil {
+			if _, builtin := t.pkg.TypesInfo.ObjectOf(ident).(*types.Builtin); builtin {
+				return true
+			}
+		}
+		t.add(n.Call.Fun.Pos(), token.NoPos, "__sched.Go(", false)
+		t.add(n.Call.Fun.End(), token.NoPos, ")", true)
+	case *ast.CallExpr:
+		if ident, _ := astutil.Unparen(n.Fun).(*ast.Ident); ident != nil {
+			if builtin, _ := t.pkg.TypesInfo.ObjectOf(ident).(*types.Builtin); builtin != nil && builtin.Name() == "close" {
+				t.add(ident.Pos(), ident.End(), "__sched.Close", false)
+			}
+		}
+	case *ast.SendStmt:
+		t.add(n.Chan.Pos(), token.NoPos, "__sched.Send(", false)
+		t.add(n.Arrow, n.Arrow+2, ",", false)
+		t.add(n.Value.End(), token.NoPos, ")", true)
+	case *ast.AssignStmt:
+		if len(n.Lhs) == 2 && len(n.Rhs) == 1 {
+			t.recvOK(n.Rhs[0])
+		}
+	case *ast.ValueSpec:
+		if len(n.Names) == 2 && len(n.Values) == 1 {
+			t.recvOK(n.Values[0])
+		}
+	case *ast.UnaryExpr:
+		if n.Op == token.ARROW {
+			// Already done if this is a two-value receive
+			if t.patches[n.OpPos] == nil || t.patches[n.OpPos].Range.End != n.OpPos+2 {
+				t.add(n.OpPos, n.OpPos+2, "__sched.Recv(", false)
+			}
+			t.add(n.X.End(), token.NoPos, ")", true)
+		}
+	case *ast.RangeStmt:
+		if _, ok := t.pkg.TypesInfo.TypeOf(n.X).Underlying().(*types.Chan); ok {
+			t.transformRange(n)
+			// The channel expression is moved and cannot have patches of its own
+			ast.Inspect(n.Body, t.inspect)
+			return false
+		}
+	case *ast.LabeledStmt:
+		// Our statement must go before the label so it still labels the select
+		if sel, _ := n.Stmt.(*ast.SelectStmt); sel != nil {
+			if t.labeled == nil {
+				t.labeled = map[*ast.SelectStmt]token.Pos{}
+			}
+			t.labeled[sel] = n.Pos()
+		}
+	case *ast.SelectStmt:
+		pos, ok := t.labeled[n]
+		if !ok {
+			pos = n.Pos()
+		}
+		t.add(pos, token.NoPos, "__sched.Release(); ", false)
+		for _, clause := range n.Body.List {
+			clause := clause.(*ast.CommClause)
+			t.add(clause.Colon+1, token.NoPos, " __sched.Acquire();", false)
+			// We only continue into the bodies
+			for _, stmt := range clause.Body {
+				ast.Inspect(stmt, t.inspect)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Two-value receives are visited before the receive itself
+func (t *transformSched) recvOK(expr ast.Expr) {
+	if unary, _ := astutil.Unparen(expr).(*ast.UnaryExpr); unary != nil && unary.Op == token.ARROW {
+		t.add(unary.OpPos, unary.OpPos+2, "__sched.Recv2(", false)
+	}
+}
+
+func (t *transformSched) transformRange(n *ast.RangeStmt) {
+	patch := &superpose.Patch{
+		Range:    superpose.Range{Pos: n.Range, End: n.X.End()},
+		Captures: map[string]superpose.Range{"x": superpose.RangeOf(n.X)},
+	}
+	key := "_"
+	if n.Key != nil {
+		patch.Range.Pos = n.Key.Pos()
+		patch.Captures["key"] = superpose.RangeOf(n.Key)
+		key = "{{.key}}"
+		// For assignment instead of definition, we assign at the start of the body
+		if n.Tok == token.ASSIGN {
+			key = "__v"
+			t.add(n.Body.Lbrace+1, token.NoPos, " {{.key}} = __v;", false)
+			t.patches[n.Body.Lbrace+1].Captures = patch.Captures
+		}
+	}
+	patch.Str = fmt.Sprintf("__c, %[1]v, __ok := __sched.RangeStart({{.x}}); __ok; %[1]v, __ok = __sched.Recv2(__c)", key)
+	t.patches[patch.Range.Pos] = patch
+}
+
+// Adds an insert, or a replace if end is set, combining with any existing patch
+// at the same position. Since parents are visited first, text is appended to
+// existing text unless it is closing in which case it is prepended.
+func (t *transformSched) add(pos, end token.Pos, str string, closing bool) {
+	patch := t.patches[pos]
+	if patch == nil {
+		t.patches[pos] = &superpose.Patch{Range: superpose.Range{Pos: pos, End: end}, Str: str}
+		return
+	}
+	if end.IsValid() {
+		patch.Range.End = end
+	}
+	if closing {
+		patch.Str = str + patch.Str
+	} else {
+		patch.Str += str
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"time"
+
+	"github.com/cretz/superpose/example/tracing/recorder"
+)
+
+const src = `package example
+
+import "fmt"
+
+type Greeter struct {
+	Name  string
+	Count int
+}
+
+func (g *Greeter) Greet(names ...string) []string {
+	var ret []string
+	for i, name := range names {
+		if i >= g.Count {
+			break
+		}
+		ret = append(ret, fmt.Sprintf("Hello %v from %v", name, g.Name))
+	}
+	return ret
+}
+`
+
+// Parse parses some Go source the given number of times.
+func Parse(n int) {
+	for i := 0; i < n; i++ {
+		if _, err := parser.ParseFile(token.NewFileSet(), "example.go", src, parser.ParseComments); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+var parseTraced func(n int) //tracing:Parse
+
+func main() {
+	const n = 10000
+	start := time.Now()
+	Parse(n)
+	fmt.Printf("Untraced: %v\n", time.Since(start))
+	start = time.Now()
+	parseTraced(n)
+	fmt.Printf("Traced: %v\n", time.Since(start))
+
+	fmt.Println("Top functions by total time:")
+	for i, f := range recorder.Stats() {
+		if i == 10 {
+			break
+		}
+		fmt.Printf("  %v - %v calls, %v\n", f.Name, f.Calls, f.Total)
+	}
+}
@@ -0,0 +1,77 @@
+// Package recorder is a minimal span recorder used by the tracing dimension.
+//
+// This package is shared between the dimension and non-dimension code, so what
+// was recorded in the dimension can be read outside of it.
+package recorder
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Span is an in-progress function call. It is returned from [Start] and given
+// to [End].
+type Span struct {
+	name  string
+	start time.Time
+}
+
+// FuncStats are the recorded stats for a single function.
+type FuncStats struct {
+	// Name is the full name of the function. Function literals are named after
+	// their enclosing function with a ".func<N>" suffix.
+	Name string
+	// Calls is the number of completed calls.
+	Calls int
+	// Total is the total time spent in the function including calls it made.
+	Total time.Duration
+}
+
+var (
+	stats     = map[string]*FuncStats{}
+	statsLock sync.Mutex
+)
+
+// Start starts a span for the given function. The tracing dimension adds
+// "defer End(Start(<name>))" to the start of every function.
+func Start(name string) Span { return Span{name: name, start: time.Now()} }
+
+// End records the given span as complete.
+func End(s Span) {
+	d := time.Since(s.start)
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	f := stats[s.name]
+	if f == nil {
+		f = &FuncStats{Name: s.name}
+		stats[s.name] = f
+	}
+	f.Calls++
+	f.Total += d
+}
+
+// Stats returns the stats for all recorded functions sorted by total time
+// descending.
+func Stats() []FuncStats {
+	statsLock.Lock()
+	ret := make([]FuncStats, 0, len(stats))
+	for _, f := range stats {
+		ret = append(ret, *f)
+	}
+	statsLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Total != ret[j].Total {
+			return ret[i].Total > ret[j].Total
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Reset clears all recorded stats.
+func Reset() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	stats = map[string]*FuncStats{}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tracing": transformer{}},
+			// Set to true to see compilation details
+			Verbose: false,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// We trace the Go parser and scanner to show real-sized packages, but this
+	// could be any package that the recorder does not depend on
+	if pkgPath == "go/parser" || pkgPath == "go/scanner" {
+		return true, nil
+	}
+	// Also any of our packages but the recorder itself which we want shared
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/example/tracing") &&
+		!strings.Contains(pkgPath, "recorder"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v", pkg.PkgPath)
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	// We add "defer __recorder.End(__recorder.Start(<name>))" at the start of
+	// every function body on the same line as the opening brace so we do not
+	// alter line numbers
+	for _, file := range pkg.Syntax {
+		patchedFile := false
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			if funcDecl == nil || funcDecl.Body == nil {
+				continue
+			}
+			funcObj, _ := pkg.TypesInfo.ObjectOf(funcDecl.Name).(*types.Func)
+			if funcObj == nil {
+				continue
+			}
+			res.Patches = append(res.Patches, tracePatch(funcDecl.Body, funcObj.FullName()))
+			// Function literals are named after their function like the runtime does
+			var lits int
+			ast.Inspect(funcDecl.Body, func(n ast.Node) bool {
+				if lit, _ := n.(*ast.FuncLit); lit != nil {
+					lits++
+					res.Patches = append(res.Patches, tracePatch(lit.Body, fmt.Sprintf("%v.func%v", funcObj.FullName(), lits)))
+				}
+				return true
+			})
+			patchedFile = true
+		}
+		if patchedFile {
+			if err := res.AddImport(ctx, file, recorderPkg, "__recorder"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+const recorderPkg = "github.com/cretz/superpose/example/tracing/recorder"
+
+func tracePatch(body *ast.BlockStmt, name string) *superpose.Patch {
+	return &superpose.Patch{
+		Range: superpose.Range{Pos: body.Lbrace + 1},
+		Str:   fmt.Sprintf(" defer __recorder.End(__recorder.Start(%q));", name),
+	}
+}
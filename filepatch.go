@@ -0,0 +1,152 @@
+package superpose
+
+import (
+	"fmt"
+	"go/token"
+)
+
+// FilePatch is a [Patch] with byte offsets in a named file instead of
+// [token.Pos] values, which only mean something with the [token.FileSet] of the
+// process that made them. This is the form to serialize patches in, e.g. to
+// cache transform results or send them between processes.
+type FilePatch struct {
+	// File is the name of the file to patch as in its [token.File], which is the
+	// compiled Go file for the package's syntax.
+	File string `json:"file"`
+
+	// Range is the range of the file to patch. If Length is 0, this patch is an
+	// insert instead of a replace.
+	Range FileRange `json:"range"`
+
+	// Captures is the same as [Patch.Captures] but with ranges of the same file.
+	Captures map[string]FileRange `json:"captures,omitempty"`
+
+	// Str is the same as [Patch.Str].
+	Str string `json:"str"`
+}
+
+// FileRange is a [Range] as a byte offset and length in a file. If Length is 0,
+// it is only the single offset at Offset.
+type FileRange struct {
+	Offset int `json:"offset"`
+	Length int `json:"length,omitempty"`
+}
+
+// NewFilePatch converts the patch to a [FilePatch] with the file set of the
+// package it was made for. The captures must be in the same file as the range.
+func NewFilePatch(fset *token.FileSet, patch *Patch) (*FilePatch, error) {
+	file := fset.File(patch.Range.Pos)
+	if file == nil {
+		return nil, fmt.Errorf("cannot find file for patch")
+	}
+	filePatch := &FilePatch{File: file.Name(), Str: patch.Str}
+	var err error
+	if filePatch.Range, err = newFileRange(file, patch.Range); err != nil {
+		return nil, err
+	}
+	if len(patch.Captures) > 0 {
+		filePatch.Captures = make(map[string]FileRange, len(patch.Captures))
+		for name, r := range patch.Captures {
+			if filePatch.Captures[name], err = newFileRange(file, r); err != nil {
+				return nil, fmt.Errorf("capture %v invalid: %w", name, err)
+			}
+		}
+	}
+	return filePatch, nil
+}
+
+func newFileRange(file *token.File, r Range) (FileRange, error) {
+	if !r.Pos.IsValid() || r.Pos < token.Pos(file.Base()) || int(r.Pos) > file.Base()+file.Size() {
+		return FileRange{}, fmt.Errorf("position %v not in file %v", r.Pos, file.Name())
+	}
+	fileRange := FileRange{Offset: file.Offset(r.Pos)}
+	if r.End.IsValid() {
+		if r.End < r.Pos || int(r.End) > file.Base()+file.Size() {
+			return FileRange{}, fmt.Errorf("end %v not in file %v after position %v", r.End, file.Name(), r.Pos)
+		}
+		fileRange.Length = int(r.End - r.Pos)
+	}
+	return fileRange, nil
+}
+
+// Patch converts this back to a [Patch] for the file of the same name in the
+// file set.
+func (f *FilePatch) Patch(fset *token.FileSet) (*Patch, error) {
+	var file *token.File
+	fset.Iterate(func(tokenFile *token.File) bool {
+		if tokenFile.Name() == f.File {
+			file = tokenFile
+		}
+		return file == nil
+	})
+	if file == nil {
+		return nil, fmt.Errorf("cannot find file %v", f.File)
+	}
+	return f.patchIn(file)
+}
+
+func (f *FilePatch) patchIn(file *token.File) (*Patch, error) {
+	patch := &Patch{Str: f.Str}
+	var err error
+	if patch.Range, err = f.Range.toRange(file); err != nil {
+		return nil, err
+	}
+	if len(f.Captures) > 0 {
+		patch.Captures = make(map[string]Range, len(f.Captures))
+		for name, r := range f.Captures {
+			if patch.Captures[name], err = r.toRange(file); err != nil {
+				return nil, fmt.Errorf("capture %v invalid: %w", name, err)
+			}
+		}
+	}
+	return patch, nil
+}
+
+func (f FileRange) toRange(file *token.File) (Range, error) {
+	if f.Offset < 0 || f.Offset > file.Size() {
+		return Range{}, fmt.Errorf("offset %v out of range", f.Offset)
+	}
+	r := Range{Pos: file.Pos(f.Offset)}
+	if f.Length != 0 {
+		if f.Length < 0 || f.Offset+f.Length > file.Size() {
+			return Range{}, fmt.Errorf("length %v out of range", f.Length)
+		}
+		r.End = file.Pos(f.Offset + f.Length)
+	}
+	return r, nil
+}
+
+// FilePatches converts the patches and replacements of this result to
+// [FilePatch] values with the file set of the package it was made for. The
+// offset patches are included as they are.
+func (t *TransformResult) FilePatches(fset *token.FileSet) ([]*FilePatch, error) {
+	replacementPatches, err := t.replacementPatches(fset)
+	if err != nil {
+		return nil, err
+	}
+	patches := make([]*Patch, 0, len(t.Patches)+len(replacementPatches))
+	patches = append(append(patches, t.Patches...), replacementPatches...)
+	filePatches := make([]*FilePatch, 0, len(patches)+len(t.OffsetPatches))
+	for i, patch := range patches {
+		filePatch, err := NewFilePatch(fset, patch)
+		if err != nil {
+			return nil, fmt.Errorf("patch #%v invalid: %w", i+1, err)
+		}
+		filePatches = append(filePatches, filePatch)
+	}
+	return append(filePatches, t.OffsetPatches...), nil
+}
+
+// Converts the offset patches of this result to patches with the file set of
+// the package it was made for
+func (t *TransformResult) offsetPatches(fset *token.FileSet) ([]*Patch, error) {
+	patches := make([]*Patch, 0, len(t.OffsetPatches))
+	for i, filePatch := range t.OffsetPatches {
+		patch, err := filePatch.Patch(fset)
+		if err != nil {
+			return nil, fmt.Errorf("offset patch #%v invalid: %w", i+1, err)
+		}
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
@@ -3,6 +3,7 @@ module github.com/cretz/superpose
 go 1.19
 
 require (
+	github.com/dave/dst v0.27.3
 	github.com/rogpeppe/go-internal v1.9.0
 	golang.org/x/exp v0.0.0-20221114191408-850992195362
 	golang.org/x/tools v0.3.0
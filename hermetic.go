@@ -0,0 +1,121 @@
+package superpose
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// What a transformer may access while transforming a package in hermetic mode,
+// see [Config.Hermetic]
+type hermeticScope struct {
+	pkgPath string
+	// Absolute dirs files can be read from
+	dirs []string
+
+	lock       sync.Mutex
+	violations []string
+}
+
+// Creates the scope for transforming the package, allowing its dirs and the
+// dir of its module
+func newHermeticScope(pkg *packages.Package) *hermeticScope {
+	h := &hermeticScope{pkgPath: pkg.PkgPath}
+	seen := map[string]bool{}
+	addDir := func(dir string) {
+		if dir == "" {
+			return
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			h.dirs = append(h.dirs, dir)
+		}
+	}
+	for _, files := range [][]string{pkg.GoFiles, pkg.CompiledGoFiles, pkg.OtherFiles} {
+		for _, file := range files {
+			addDir(filepath.Dir(file))
+		}
+	}
+	if pkg.Module != nil {
+		addDir(pkg.Module.Dir)
+	}
+	return h
+}
+
+// Records and gives an error for the access if it is not allowed, or nil if it
+// is. The error is recorded so it fails the transform even if the transformer
+// ignores it.
+func (h *hermeticScope) violation(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	h.lock.Lock()
+	h.violations = append(h.violations, msg)
+	h.lock.Unlock()
+	return fmt.Errorf("%w: %v", ErrHermeticViolation, msg)
+}
+
+func (h *hermeticScope) checkFile(name string) error {
+	file, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	// Resolve symlinks so they cannot point outside the allowed dirs. Files that
+	// do not exist are still checked by their name.
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		file = resolved
+	}
+	for _, dir := range h.dirs {
+		if rel, err := filepath.Rel(dir, file); err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return h.violation("read of %v outside of package %v and its module", name, h.pkgPath)
+}
+
+// Gives an error with every violation during the transform, or nil if there
+// were none
+func (h *hermeticScope) err() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w:\n\t%v", ErrHermeticViolation, strings.Join(h.violations, "\n\t"))
+}
+
+// ReadFile reads the named file like [os.ReadFile]. Transformers should read
+// files through this instead of directly so that in [Config.Hermetic] mode,
+// reading a file outside of the package being transformed and its module fails
+// the transform with [ErrHermeticViolation].
+func (t *TransformContext) ReadFile(name string) ([]byte, error) {
+	if t.hermetic != nil {
+		if err := t.hermetic.checkFile(name); err != nil {
+			return nil, err
+		}
+	}
+	return os.ReadFile(name)
+}
+
+// DialContext connects to the address on the named network like
+// [net.Dialer.DialContext]. Transformers should make network connections
+// through this instead of directly so that in [Config.Hermetic] mode, any
+// connection fails the transform with [ErrHermeticViolation].
+func (t *TransformContext) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if t.hermetic != nil {
+		return nil, t.hermetic.violation("dial of %v %v", network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
@@ -1,6 +1,7 @@
 package superpose
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -30,6 +31,15 @@ func (i *importCfg) removePkgFile(pkgPath string) bool {
 	return false
 }
 
+func (i *importCfg) hasPkgFile(pkgPath string) bool {
+	for _, line := range i.lines {
+		if strings.HasPrefix(line, "packagefile "+pkgPath+"=") {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *importCfg) addPkgFile(pkgPath string, pkgFile string) {
 	// We only add if not already there
 	for _, line := range i.lines {
@@ -40,8 +50,13 @@ func (i *importCfg) addPkgFile(pkgPath string, pkgFile string) {
 	i.lines = append(i.lines, fmt.Sprintf("packagefile %v=%v", pkgPath, pkgFile))
 }
 
-// Only done if not already present
-func (i *importCfg) includePkg(pkgPath string) error {
+// Makes imports of the import path use the package path instead
+func (i *importCfg) addImportMap(importPath string, pkgPath string) {
+	i.lines = append(i.lines, fmt.Sprintf("importmap %v=%v", importPath, pkgPath))
+}
+
+// Only done if not already present. The package is built if it is not yet.
+func (i *importCfg) includePkg(ctx context.Context, pkgPath string) error {
 	// Check that it's not already present
 	for _, line := range i.lines {
 		if strings.HasPrefix(line, "packagefile "+pkgPath+"=") {
@@ -49,7 +64,7 @@ func (i *importCfg) includePkg(pkgPath string) error {
 		}
 	}
 	// Since it's not in there, load the pkg file and add it
-	pkgFile, err := i.s.pkgFile(pkgPath)
+	pkgFile, err := i.s.pkgFile(ctx, pkgPath)
 	if err != nil {
 		return err
 	}
@@ -59,9 +74,9 @@ func (i *importCfg) includePkg(pkgPath string) error {
 
 // If replace is true, removes orig before adding new
 func (i *importCfg) updateDimPkgRefs(d dimPkgRefs, replace bool) error {
-	// We don't care if import cfg is deterministic, so we can loop here
-	for dim, origPkgs := range d {
-		for origPkg := range origPkgs {
+	// Sorted so the import cfg is the same every time
+	for _, dim := range sortedKeys(d) {
+		for _, origPkg := range sortedKeys(d[dim]) {
 			pkgFile, err := i.s.dimDepPkgFile(origPkg, dim)
 			if err != nil {
 				return err
@@ -69,7 +84,14 @@ func (i *importCfg) updateDimPkgRefs(d dimPkgRefs, replace bool) error {
 			if replace {
 				i.removePkgFile(origPkg)
 			}
-			i.addPkgFile(i.s.DimensionPackagePath(origPkg, dim), pkgFile)
+			// Every dimension package path is new, so one that is already present is
+			// either another package in the build or another dimension package
+			dimPkgPath := i.s.DimensionPackagePath(origPkg, dim)
+			if dimPkgPath == origPkg || i.hasPkgFile(dimPkgPath) {
+				return fmt.Errorf("package path %v of %v in dimension %v collides with another package",
+					dimPkgPath, origPkg, dim)
+			}
+			i.addPkgFile(dimPkgPath, pkgFile)
 		}
 	}
 	return nil
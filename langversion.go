@@ -0,0 +1,166 @@
+package superpose
+
+import (
+	"go/ast"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Syntax that requires at least a certain Go language version
+type versionedSyntax struct {
+	minor int
+	desc  string
+}
+
+var (
+	syntaxTypeAlias        = versionedSyntax{9, "type aliases"}
+	syntaxNumberLiteral    = versionedSyntax{13, "binary, octal, or hex float literals or digit separators"}
+	syntaxTypeParams       = versionedSyntax{18, "type parameters"}
+	syntaxTypeConstraints  = versionedSyntax{18, "type constraint unions or approximations"}
+	syntaxGenericTypeAlias = versionedSyntax{24, "generic type aliases"}
+)
+
+// Gives the minor version of a "go1.N" version, ignoring any patch or
+// prerelease suffix
+func goVersionMinor(version string) (int, bool) {
+	rest := strings.TrimPrefix(version, "go1.")
+	if rest == version {
+		return 0, false
+	}
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	minor, err := strconv.Atoi(rest[:end])
+	return minor, err == nil
+}
+
+// Gives the language version of the file for the package language version. As
+// of Go 1.21, a "//go:build" constraint requiring a newer Go version upgrades
+// the language version of the file.
+func fileLangVersion(lang string, file *ast.File) string {
+	if minor, ok := goVersionMinor(lang); !ok || minor < 21 {
+		return lang
+	}
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if !constraint.IsGoBuild(comment.Text) {
+				continue
+			}
+			if expr, err := constraint.Parse(comment.Text); err == nil {
+				return maxGoVersion(lang, constraintGoVersion(expr))
+			}
+			return lang
+		}
+	}
+	return lang
+}
+
+// Gives the minimum Go version the constraint requires, or empty if none. This
+// is the same as constraint.GoVersion from newer Go versions.
+func constraintGoVersion(expr constraint.Expr) string {
+	switch expr := expr.(type) {
+	case *constraint.TagExpr:
+		if _, ok := goVersionMinor(expr.Tag); ok {
+			return expr.Tag
+		}
+	case *constraint.AndExpr:
+		// Both must hold, so the higher
+		return maxGoVersion(constraintGoVersion(expr.X), constraintGoVersion(expr.Y))
+	case *constraint.OrExpr:
+		// Either may hold, so the lower, or none if either has none
+		x, y := constraintGoVersion(expr.X), constraintGoVersion(expr.Y)
+		if x == "" || y == "" {
+			return ""
+		} else if maxGoVersion(x, y) == x {
+			return y
+		}
+		return x
+	}
+	return ""
+}
+
+func maxGoVersion(x, y string) string {
+	xMinor, _ := goVersionMinor(x)
+	yMinor, _ := goVersionMinor(y)
+	if x == "" || yMinor > xMinor {
+		return y
+	}
+	return x
+}
+
+// Counts the versioned syntax used in the file
+func countVersionedSyntax(file *ast.File) map[versionedSyntax]int {
+	counts := map[versionedSyntax]int{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BasicLit:
+			if n.Kind == token.INT || n.Kind == token.FLOAT || n.Kind == token.IMAG {
+				lit := strings.ToLower(n.Value)
+				if strings.Contains(lit, "_") || strings.HasPrefix(lit, "0b") || strings.HasPrefix(lit, "0o") ||
+					(strings.HasPrefix(lit, "0x") && strings.Contains(lit, "p")) {
+					counts[syntaxNumberLiteral]++
+				}
+			}
+		case *ast.FuncType:
+			if n.TypeParams != nil {
+				counts[syntaxTypeParams]++
+			}
+		case *ast.TypeSpec:
+			switch {
+			case n.Assign.IsValid() && n.TypeParams != nil:
+				counts[syntaxGenericTypeAlias]++
+			case n.Assign.IsValid():
+				counts[syntaxTypeAlias]++
+			case n.TypeParams != nil:
+				counts[syntaxTypeParams]++
+			}
+		case *ast.InterfaceType:
+			for _, field := range n.Methods.List {
+				switch typ := field.Type.(type) {
+				case *ast.BinaryExpr:
+					counts[syntaxTypeConstraints]++
+				case *ast.UnaryExpr:
+					if typ.Op == token.TILDE {
+						counts[syntaxTypeConstraints]++
+					}
+				}
+			}
+		}
+		return true
+	})
+	return counts
+}
+
+// Returns the syntax the patched file adds over the original that is newer than
+// the language version of the original, or nil if none. Patched files that do
+// not parse are left for the compiler to report.
+func newerPatchedSyntax(lang string, origFile *ast.File, patchedFileName string, patched []byte) *versionedSyntax {
+	minor, ok := goVersionMinor(fileLangVersion(lang, origFile))
+	if !ok {
+		return nil
+	}
+	patchedFile, err := parser.ParseFile(token.NewFileSet(), patchedFileName, patched, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+	origCounts := countVersionedSyntax(origFile)
+	var newest *versionedSyntax
+	for syntax, count := range countVersionedSyntax(patchedFile) {
+		if syntax.minor <= minor || count <= origCounts[syntax] {
+			continue
+		}
+		// Map order is random, so ties are broken by description
+		if newest == nil || syntax.minor > newest.minor || (syntax.minor == newest.minor && syntax.desc < newest.desc) {
+			syntax := syntax
+			newest = &syntax
+		}
+	}
+	return newest
+}
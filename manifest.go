@@ -0,0 +1,317 @@
+package superpose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Starts the comment in a manifest Go file that has the manifest as JSON
+const manifestCommentPrefix = "/*superpose:manifest\n"
+
+// Manifest records the dimension references in code and the version of the
+// transformer they were written for. It is written as a Go file, usually by
+// "go generate" running the toolexec executable with the "manifest" command.
+// Whenever the package with the file is compiled, the manifest is checked
+// against the transformer and the references in code so any drift fails the
+// build early with a clear error. See [Superpose.GenerateManifest].
+type Manifest struct {
+	// Version is the [Config.Version] of the transformer.
+	Version string `json:"version"`
+	// Patterns are the package patterns scanned for references, relative to the
+	// directory of the manifest file.
+	Patterns []string `json:"patterns"`
+	// Dimensions are the dimensions referenced, sorted.
+	Dimensions []string `json:"dimensions"`
+	// References are every dimension reference, sorted by package then var.
+	References []*ManifestReference `json:"references"`
+}
+
+// ManifestReference is a var with a "//dim:ref" comment.
+type ManifestReference struct {
+	// PkgPath is the package of the var. This has a "_test" suffix for vars in
+	// external test packages.
+	PkgPath string `json:"pkgPath"`
+	// Var is the name of the var.
+	Var string `json:"var"`
+	// Dimension is the dimension referenced.
+	Dimension string `json:"dimension"`
+	// Func is the bridge function referenced, or "<in>" for a bool var that is
+	// set to whether the code is in the dimension.
+	Func string `json:"func"`
+}
+
+func (r *ManifestReference) String() string {
+	return fmt.Sprintf("%v.%v //%v:%v", r.PkgPath, r.Var, r.Dimension, r.Func)
+}
+
+// GenerateManifest scans the packages matching the given patterns, relative to
+// the given directory, for references to this transformer's dimensions and
+// returns the manifest for them. Every Go file in the package directories is
+// scanned regardless of build constraints, including test files.
+func (s *Superpose) GenerateManifest(ctx context.Context, dir string, pkgPatterns ...string) (*Manifest, error) {
+	if err := s.ensureFactoryTransformers(); err != nil {
+		return nil, err
+	}
+	refs, err := s.scanDimensionRefs(ctx, dir, pkgPatterns, s.Dimensions())
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{
+		Version:    s.Config.Version,
+		Patterns:   pkgPatterns,
+		Dimensions: []string{},
+		References: refs,
+	}
+	dims := map[string]bool{}
+	for _, ref := range refs {
+		if !dims[ref.Dimension] {
+			dims[ref.Dimension] = true
+			manifest.Dimensions = append(manifest.Dimensions, ref.Dimension)
+		}
+	}
+	sort.Strings(manifest.Dimensions)
+	return manifest, nil
+}
+
+// WriteGoFile writes the manifest as a generated Go file for the given package
+// name.
+func (m *Manifest) WriteGoFile(w io.Writer, pkgName string) error {
+	// Escaping HTML would make "<in>" unreadable
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	} else if bytes.Contains(buf.Bytes(), []byte("*/")) {
+		return fmt.Errorf("manifest cannot contain */")
+	}
+	_, err := fmt.Fprintf(w, "// Code generated by superpose manifest; DO NOT EDIT.\n\npackage %v\n\n%v%s*/\n",
+		pkgName, manifestCommentPrefix, buf.Bytes())
+	return err
+}
+
+// CheckManifest checks the manifest in the given Go file against this
+// transformer and the dimension references currently in code. An error
+// describing the first difference found is returned if the manifest is out of
+// date. This is done automatically whenever the package with the file is
+// compiled.
+func (s *Superpose) CheckManifest(ctx context.Context, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	manifest, err := parseManifest(b)
+	if err != nil {
+		return fmt.Errorf("failed parsing manifest in %v: %w", file, err)
+	} else if manifest == nil {
+		return fmt.Errorf("no manifest in %v", file)
+	}
+	return s.checkManifest(ctx, file, manifest)
+}
+
+// Gives nil if there is no manifest
+func parseManifest(b []byte) (*Manifest, error) {
+	start := bytes.Index(b, []byte(manifestCommentPrefix))
+	if start < 0 {
+		return nil, nil
+	}
+	start += len(manifestCommentPrefix)
+	end := bytes.Index(b[start:], []byte("*/"))
+	if end < 0 {
+		return nil, fmt.Errorf("manifest comment not closed")
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(b[start:start+end], &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (s *Superpose) checkManifest(ctx context.Context, file string, manifest *Manifest) error {
+	if manifest.Version != s.Config.Version {
+		return fmt.Errorf("manifest %v was generated for transformer version %q, but the transformer version is %q, "+
+			"rerun go generate", file, manifest.Version, s.Config.Version)
+	}
+	for _, dim := range manifest.Dimensions {
+		if s.Config.Transformers[dim] == nil {
+			return fmt.Errorf("manifest %v references dimension %v, but the transformer does not have it", file, dim)
+		}
+	}
+	refs, err := s.scanDimensionRefs(ctx, filepath.Dir(file), manifest.Patterns, s.Dimensions())
+	if err != nil {
+		return fmt.Errorf("failed scanning dimension references for manifest %v: %w", file, err)
+	}
+	inCode := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		inCode[ref.String()] = true
+	}
+	inManifest := make(map[string]bool, len(manifest.References))
+	for _, ref := range manifest.References {
+		inManifest[ref.String()] = true
+		if !inCode[ref.String()] {
+			return fmt.Errorf("dimension reference %v in manifest %v is no longer in code, rerun go generate", ref, file)
+		}
+	}
+	for _, ref := range refs {
+		if !inManifest[ref.String()] {
+			return fmt.Errorf("dimension reference %v is not in manifest %v, rerun go generate", ref, file)
+		}
+	}
+	return nil
+}
+
+// Checks the manifests in the Go files being compiled, if any
+func (s *Superpose) checkCompileManifests(ctx context.Context) error {
+	for _, goFile := range sortedKeys(s.flags.goFileIndexes) {
+		b, err := os.ReadFile(goFile)
+		if err != nil {
+			return err
+		}
+		if manifest, err := parseManifest(b); err != nil {
+			return fmt.Errorf("failed parsing manifest in %v: %w", goFile, err)
+		} else if manifest != nil {
+			s.Debugf("Checking manifest in %v", goFile)
+			if err := s.checkManifest(ctx, goFile, manifest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Scans every Go file of the packages for references to the given dimensions
+func (s *Superpose) scanDimensionRefs(
+	ctx context.Context,
+	dir string,
+	pkgPatterns []string,
+	dims []string,
+) ([]*ManifestReference, error) {
+	args := append([]string{"list", "-e",
+		"-json=ImportPath,Name,Dir,GoFiles,CgoFiles,TestGoFiles,XTestGoFiles,IgnoredGoFiles"}, pkgPatterns...)
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing packages: %w. Output: %s", err, stderr.Bytes())
+	}
+	dimSet := make(map[string]bool, len(dims))
+	for _, dim := range dims {
+		dimSet[dim] = true
+	}
+	refs := []*ManifestReference{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var pkg struct {
+			ImportPath, Name, Dir                                        string
+			GoFiles, CgoFiles, TestGoFiles, XTestGoFiles, IgnoredGoFiles []string
+		}
+		if err := dec.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("failed decoding package list: %w", err)
+		}
+		var files []string
+		for _, fileSet := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles, pkg.XTestGoFiles, pkg.IgnoredGoFiles} {
+			files = append(files, fileSet...)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			fileRefs, err := scanFileDimensionRefs(filepath.Join(pkg.Dir, file), pkg.ImportPath, pkg.Name, dimSet)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, fileRefs...)
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		if refs[i].PkgPath != refs[j].PkgPath {
+			return refs[i].PkgPath < refs[j].PkgPath
+		}
+		return refs[i].Var < refs[j].Var
+	})
+	return refs, nil
+}
+
+func scanFileDimensionRefs(file, pkgPath, pkgName string, dims map[string]bool) ([]*ManifestReference, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// Like bridges, only parse files that appear to reference a dimension
+	found := false
+	for dim := range dims {
+		if bytes.Contains(b, []byte("//"+dim+":")) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	parsed, err := parser.ParseFile(token.NewFileSet(), file, b, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %v: %w", file, err)
+	}
+	// Files of the external test package are in the same dir
+	if strings.HasSuffix(parsed.Name.Name, "_test") && !strings.HasSuffix(pkgName, "_test") {
+		pkgPath += "_test"
+	}
+	var refs []*ManifestReference
+	for _, decl := range parsed.Decls {
+		decl, _ := decl.(*ast.GenDecl)
+		if decl == nil || decl.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range decl.Specs {
+			spec, _ := spec.(*ast.ValueSpec)
+			dim, ref, ok := dimensionRef(spec)
+			if !ok || !dims[dim] {
+				continue
+			}
+			for _, name := range spec.Names {
+				refs = append(refs, &ManifestReference{PkgPath: pkgPath, Var: name.Name, Dimension: dim, Func: ref})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// Writes the manifest file for the "manifest" command of [RunMain]
+func (s *Superpose) writeManifestFile(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	outFile := flags.String("o", "superpose_manifest.go",
+		"Go file to write, the directory of which the package patterns are relative to")
+	pkgName := flags.String("package", os.Getenv("GOPACKAGE"),
+		"package name of the Go file, defaults to GOPACKAGE set by go generate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if *pkgName == "" {
+		return fmt.Errorf("no package name, run via go generate or set -package")
+	}
+	pkgPatterns := flags.Args()
+	if len(pkgPatterns) == 0 {
+		pkgPatterns = []string{"./..."}
+	}
+	manifest, err := s.GenerateManifest(ctx, filepath.Dir(*outFile), pkgPatterns...)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := manifest.WriteGoFile(&buf, *pkgName); err != nil {
+		return err
+	}
+	return os.WriteFile(*outFile, buf.Bytes(), 0666)
+}
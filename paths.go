@@ -0,0 +1,36 @@
+package superpose
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Returns the form of the file path to compare with other paths of the same
+// file. The go command, go list, and the compiler do not always spell a file
+// the same way. Symlinks are resolved, which on Windows also expands 8.3 short
+// names, e.g. in a user's temp dir. On Windows, the long path prefix is removed
+// and the path is case folded since the file system is case insensitive. This
+// is only for comparison, the original path must still be used everywhere
+// else.
+func comparablePath(path string) string {
+	if runtime.GOOS == "windows" {
+		if strings.HasPrefix(path, `\\?\UNC\`) {
+			path = `\\` + path[len(`\\?\UNC\`):]
+		} else {
+			path = strings.TrimPrefix(path, `\\?\`)
+		}
+	}
+	path = filepath.Clean(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	// Files that do not exist are compared by their name
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
@@ -0,0 +1,57 @@
+// Package boundary is used by code patched with the recipes package to recover
+// panics at the boundary of a dimension. It must not be transformed.
+package boundary
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// PanicError is a panic recovered at a dimension boundary.
+type PanicError struct {
+	// Dimension is the dimension the panic occurred in.
+	Dimension string
+	// Func is the full name of the function the panic was recovered in.
+	Func string
+	// Value is the value the panic was started with.
+	Value any
+	// Stack is the stack trace of the panic with dimension package suffixes
+	// removed from function names.
+	Stack string
+}
+
+// Error implements error.
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic in %v in dimension %v: %v", p.Func, p.Dimension, p.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// Recover recovers a panic and converts it to a *PanicError. If errPtr is
+// non-nil, it is set to the error. Otherwise the error is panicked with. A
+// panic that is already a *PanicError, for example from a nested boundary, is
+// not converted again. This must be deferred directly.
+func Recover(dimension, fn string, errPtr *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err, _ := v.(*PanicError)
+	if err == nil {
+		err = &PanicError{
+			Dimension: dimension,
+			Func:      fn,
+			Value:     v,
+			Stack:     strings.ReplaceAll(string(debug.Stack()), "__"+dimension+".", "."),
+		}
+	}
+	if errPtr == nil {
+		panic(err)
+	}
+	*errPtr = err
+}
@@ -0,0 +1,160 @@
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// RedirectCalls returns a result that redirects every call of the function or
+// method with the full name from as returned by [types.Func.FullName], e.g.
+// "time.Now" or "(*bytes.Buffer).WriteString", to the package-level function
+// with the package path and name to, e.g. "example.com/myhooks.Now". For
+// methods, the receiver is given as the first argument, so a call like
+// "b.WriteString(s)" becomes one like "myhooks.WriteString(b, s)" where the
+// function takes the receiver type as its first parameter. Embedded fields and
+// the address or value of the receiver are made explicit as needed, and method
+// expressions and interface methods are redirected the same way. Unlike
+// [RedirectFuncs], references that are not called are left as they are.
+//
+// The result has the patches for every file with a redirected call, including
+// the import of the package redirected to, and that package with its
+// dependencies in IncludeDependencyPackages. Merge it into the transformer's
+// result. Since redirecting may remove the only use of an import, an insert that
+// references each redirected function or method expression is added to the end
+// of each file. Use [MergeInserts] if other inserts may be at the same
+// positions.
+func RedirectCalls(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	from, to string,
+) (*superpose.TransformResult, error) {
+	toPkg, toName, ok := splitFuncName(to)
+	if !ok {
+		return nil, fmt.Errorf("invalid function to redirect calls to: %v", to)
+	}
+	res := &superpose.TransformResult{}
+	alias := "__calls_" + identSafe(to)
+	qualified := alias + "." + toName
+	for _, file := range pkg.Syntax {
+		var patches []*superpose.Patch
+		keepUsed := map[string]struct{}{}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, _ := n.(*ast.CallExpr)
+			if call == nil {
+				return true
+			}
+			// Type arguments of generic functions are kept
+			fun := unparen(call.Fun)
+			switch index := fun.(type) {
+			case *ast.IndexExpr:
+				fun = index.X
+			case *ast.IndexListExpr:
+				fun = index.X
+			}
+			switch fun := fun.(type) {
+			case *ast.Ident:
+				if fn, _ := pkg.TypesInfo.Uses[fun].(*types.Func); fn != nil && fn.Origin().FullName() == from {
+					patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(fun), Str: qualified})
+				}
+			case *ast.SelectorExpr:
+				fn, _ := pkg.TypesInfo.Uses[fun.Sel].(*types.Func)
+				if fn == nil || fn.Origin().FullName() != from {
+					break
+				}
+				pkgIdent, _ := fun.X.(*ast.Ident)
+				_, isQualified := pkg.TypesInfo.Uses[pkgIdent].(*types.PkgName)
+				sel := pkg.TypesInfo.Selections[fun]
+				if isQualified || (sel != nil && sel.Kind() == types.MethodExpr) {
+					// Qualified functions and method expressions already have the
+					// receiver as the first argument
+					patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(fun), Str: qualified})
+					if fn.Type().(*types.Signature).TypeParams().Len() == 0 {
+						keepUsed["var _ = "+types.ExprString(fun)] = struct{}{}
+					}
+				} else if sel != nil && sel.Kind() == types.MethodVal {
+					patches = append(patches, redirectMethodCall(pkg, call, fun, sel, qualified)...)
+				}
+			}
+			return true
+		})
+		if len(patches) == 0 {
+			continue
+		}
+		if len(keepUsed) > 0 {
+			uses := make([]string, 0, len(keepUsed))
+			for use := range keepUsed {
+				uses = append(uses, use)
+			}
+			sort.Strings(uses)
+			patches = append(patches, &superpose.Patch{
+				Range: superpose.Range{Pos: file.End()},
+				Str:   "; " + strings.Join(uses, "; "),
+			})
+		}
+		if err := res.AddImport(ctx, file, toPkg, alias); err != nil {
+			return nil, err
+		}
+		res.Patches = append(res.Patches, patches...)
+	}
+	res.Patches = MergeInserts(res.Patches)
+	return res, nil
+}
+
+// Patches a call like "x.M(args)" into "to(x, args)" where x has any embedded
+// fields selected and is addressed or dereferenced to match the receiver. Only
+// the text around the receiver and arguments is patched so calls within them
+// can still be redirected.
+func redirectMethodCall(
+	pkg *superpose.TransformPackage,
+	call *ast.CallExpr,
+	fun *ast.SelectorExpr,
+	sel *types.Selection,
+	to string,
+) []*superpose.Patch {
+	// Walk embedded fields to the type the method is selected on
+	var path strings.Builder
+	recvType := pkg.TypesInfo.TypeOf(fun.X)
+	indices := sel.Index()
+	for _, index := range indices[:len(indices)-1] {
+		typ := recvType
+		if ptr, _ := typ.Underlying().(*types.Pointer); ptr != nil {
+			typ = ptr.Elem()
+		}
+		field := typ.Underlying().(*types.Struct).Field(index)
+		path.WriteString("." + field.Name())
+		recvType = field.Type()
+	}
+	_, isPtr := recvType.Underlying().(*types.Pointer)
+	var wantPtr bool
+	if recv := sel.Obj().(*types.Func).Type().(*types.Signature).Recv(); recv != nil {
+		_, wantPtr = recv.Type().(*types.Pointer)
+	}
+	prefix, suffix := "", path.String()
+	if _, isIface := recvType.Underlying().(*types.Interface); !isIface && wantPtr && !isPtr {
+		prefix, suffix = "&(", suffix+")"
+	} else if !isIface && !wantPtr && isPtr {
+		prefix, suffix = "(*", suffix+")"
+	}
+	if len(call.Args) > 0 {
+		suffix += ", "
+	}
+	return []*superpose.Patch{
+		{Range: superpose.Range{Pos: fun.X.Pos()}, Str: to + "(" + prefix},
+		{Range: superpose.Range{Pos: fun.X.End(), End: call.Lparen + 1}, Str: suffix},
+	}
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, _ := expr.(*ast.ParenExpr)
+		if paren == nil {
+			return expr
+		}
+		expr = paren.X
+	}
+}
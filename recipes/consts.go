@@ -0,0 +1,86 @@
+package recipes
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// InlineConstants returns patches that replace every qualified reference to a
+// constant of another package in the package with the constant's value as type
+// checked, for constants for which include returns true, or all of them if
+// include is nil. Constants of named types and complex constants are left as
+// is. Typed constants are converted to their type, e.g. runtime.GOOS becomes
+// string("linux").
+//
+// Packages the dimension does not apply to are compiled for the build, so when
+// simulating another platform via [superpose.Config.DimensionEnv], constants
+// like os.PathSeparator or runtime.GOOS have the build's values during
+// compilation but the simulated platform's values during type checking.
+// Inlining them gives the package the simulated platform's values.
+//
+// Inlining may remove the only use of an import, see [RemoveUnusedImports].
+func InlineConstants(pkg *superpose.TransformPackage, include func(c *types.Const) bool) []*superpose.Patch {
+	var patches []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, _ := n.(*ast.SelectorExpr)
+			if sel == nil {
+				return true
+			}
+			pkgIdent, _ := sel.X.(*ast.Ident)
+			if pkgIdent == nil {
+				return true
+			} else if _, isPkg := pkg.TypesInfo.Uses[pkgIdent].(*types.PkgName); !isPkg {
+				return true
+			}
+			constObj, _ := pkg.TypesInfo.Uses[sel.Sel].(*types.Const)
+			if constObj == nil || (include != nil && !include(constObj)) {
+				return false
+			}
+			if lit, ok := constLiteral(constObj); ok {
+				patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(sel), Str: lit})
+			}
+			return false
+		})
+	}
+	return patches
+}
+
+// Returns a Go expression of the constant's value and type
+func constLiteral(c *types.Const) (string, bool) {
+	basic, _ := c.Type().(*types.Basic)
+	if basic == nil {
+		return "", false
+	}
+	var lit string
+	switch val := c.Val(); val.Kind() {
+	case constant.Bool, constant.String:
+		lit = val.ExactString()
+	case constant.Int:
+		lit = val.ExactString()
+		if basic.Kind() == types.UntypedRune {
+			r, ok := constant.Int64Val(val)
+			if !ok {
+				return "", false
+			}
+			lit = strconv.QuoteRune(rune(r))
+		}
+	case constant.Float:
+		// Exact floats may be fractions which are exact when divided as constants
+		lit = val.ExactString()
+		if num, den, ok := strings.Cut(lit, "/"); ok {
+			lit = "(" + num + ".0/" + den + ")"
+		}
+	default:
+		return "", false
+	}
+	if basic.Info()&types.IsUntyped == 0 {
+		lit = basic.Name() + "(" + lit + ")"
+	}
+	return lit, true
+}
@@ -0,0 +1,266 @@
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// FindFunc returns the function declaration in the package with the given full
+// name as returned by [types.Func.FullName], e.g. "time.Now" or
+// "(*time.Timer).Stop". Returns nil if not found.
+func FindFunc(pkg *superpose.TransformPackage, fullName string) *ast.FuncDecl {
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			if funcDecl == nil {
+				continue
+			}
+			if funcObj, _ := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func); funcObj != nil &&
+				funcObj.FullName() == fullName {
+				return funcDecl
+			}
+		}
+	}
+	return nil
+}
+
+// FuncParamNames returns the receiver name if there is a receiver followed by
+// the name of each parameter. Unnamed receivers and parameters are empty
+// strings.
+func FuncParamNames(decl *ast.FuncDecl) []string {
+	var names []string
+	for _, fields := range []*ast.FieldList{decl.Recv, decl.Type.Params} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			if len(field.Names) == 0 {
+				names = append(names, "")
+			}
+			for _, name := range field.Names {
+				names = append(names, name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// ReplaceFuncBody returns a patch that runs the given semicolon-delimited
+// statements instead of the function body. The statements must end with a
+// terminating statement like a return, otherwise the original body is run after
+// them. The original body is left in place, unreachable, so that everything it
+// references, like imports, is still used.
+//
+// Functions without a body, like those implemented by the runtime, are given
+// one. See [superpose.ReplaceFuncBody] to replace the original body instead.
+func ReplaceFuncBody(decl *ast.FuncDecl, stmts string) *superpose.Patch {
+	if decl.Body == nil {
+		return &superpose.Patch{Range: superpose.Range{Pos: decl.Type.End()}, Str: " { " + stmts + " }"}
+	}
+	return PrependStatements(decl.Body, stmts)
+}
+
+// StubFunc returns patches that make the function run the given
+// semicolon-delimited statements, which may be empty, and then return zero
+// values. Unnamed and blank results are given names so a bare return can be used
+// without knowing the result types.
+func StubFunc(decl *ast.FuncDecl, stmts string) []*superpose.Patch {
+	patches, resultsClose, _ := nameResults(decl)
+	body := "return"
+	if strings.TrimSpace(stmts) != "" {
+		body = stmts + "; return"
+	}
+	if decl.Body == nil {
+		// The results close and new body are at the same position
+		str := " { " + body + " }"
+		if resultsClose != nil {
+			str = resultsClose.Str + str
+		}
+		patches = append(patches, &superpose.Patch{Range: superpose.Range{Pos: decl.Type.End()}, Str: str})
+	} else {
+		if resultsClose != nil {
+			patches = append(patches, resultsClose)
+		}
+		patches = append(patches, PrependStatements(decl.Body, body))
+	}
+	return patches
+}
+
+// DropFuncBody returns patches like [StubFunc] except the original body is
+// removed instead of left unreachable, so nothing it references has to exist.
+// This is needed when the body references things that do not exist where the
+// package is compiled, e.g. when simulating another platform via
+// [superpose.Config.DimensionEnv]. The lines of the body are kept as empty lines.
+//
+// Removing the body may remove the only use of an import, see
+// [RemoveUnusedImports].
+func DropFuncBody(pkg *superpose.TransformPackage, decl *ast.FuncDecl, stmts string) []*superpose.Patch {
+	if decl.Body == nil {
+		return StubFunc(decl, stmts)
+	}
+	patches, resultsClose, _ := nameResults(decl)
+	if resultsClose != nil {
+		patches = append(patches, resultsClose)
+	}
+	body := "return"
+	if strings.TrimSpace(stmts) != "" {
+		body = stmts + "; return"
+	}
+	lines := pkg.Fset.Position(decl.Body.Rbrace).Line - pkg.Fset.Position(decl.Body.Lbrace).Line
+	return append(patches, &superpose.Patch{
+		Range: superpose.RangeOf(decl.Body),
+		Str:   "{ " + body + strings.Repeat("\n", lines) + " }",
+	})
+}
+
+// Returns patches that name unnamed or blank results "__r<N>" so they can be
+// referenced, an insert at the end of the function type that closes the results
+// if they were not in parentheses, and the names of all results.
+func nameResults(decl *ast.FuncDecl) (patches []*superpose.Patch, resultsClose *superpose.Patch, names []string) {
+	results := decl.Type.Results
+	if results == nil {
+		return nil, nil, nil
+	}
+	for _, field := range results.List {
+		// A result list with unnamed results has exactly one type per field
+		if len(field.Names) == 0 {
+			str := fmt.Sprintf("__r%v ", len(names))
+			// A single result may not be in parentheses
+			if !results.Opening.IsValid() {
+				str = "(" + str
+				resultsClose = &superpose.Patch{Range: superpose.Range{Pos: decl.Type.End()}, Str: ")"}
+			}
+			patches = append(patches, &superpose.Patch{Range: superpose.Range{Pos: field.Type.Pos()}, Str: str})
+			names = append(names, fmt.Sprintf("__r%v", len(names)))
+			continue
+		}
+		for _, name := range field.Names {
+			if name.Name == "_" {
+				patches = append(patches, &superpose.Patch{
+					Range: superpose.RangeOf(name),
+					Str:   fmt.Sprintf("__r%v", len(names)),
+				})
+				names = append(names, fmt.Sprintf("__r%v", len(names)))
+			} else {
+				names = append(names, name.Name)
+			}
+		}
+	}
+	return patches, resultsClose, names
+}
+
+// StubPackage returns patches that stub every function and method with a body
+// in the package using [StubFunc]. If stmts is non-nil, it is called for each
+// function to get the statements to run before returning. Package variable
+// initializers are not altered.
+func StubPackage(pkg *superpose.TransformPackage, stmts func(fn *types.Func) string) []*superpose.Patch {
+	var patches []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			// Functions without bodies may be implemented in assembly, so we leave
+			// those alone
+			if funcDecl == nil || funcDecl.Body == nil {
+				continue
+			}
+			var funcStmts string
+			if stmts != nil {
+				if funcObj, _ := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func); funcObj != nil {
+					funcStmts = stmts(funcObj)
+				}
+			}
+			patches = append(patches, StubFunc(funcDecl, funcStmts)...)
+		}
+	}
+	return patches
+}
+
+// RedirectFuncs returns patches that replace every reference to a package-level
+// function in the package, including calls, with another expression. The
+// redirects are keyed by full function name as returned by
+// [types.Func.FullName] with the replacement expression as the value, e.g.
+// "time.Now" to "__clock.Now". The replacement must have the same type as the
+// function. Methods are not supported.
+//
+// Since redirecting may remove the only use of an import, an insert that
+// references an original function of each import is added to the end of each
+// file. Use [MergeInserts] if other inserts may be at the end of the file.
+func RedirectFuncs(pkg *superpose.TransformPackage, redirects map[string]string) []*superpose.Patch {
+	var patches []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		patches = append(patches, redirectRefsInFile(pkg, file, redirects, nil)...)
+	}
+	return patches
+}
+
+// Redirects function references to the expressions and variable references to
+// dereferenced calls of the accessors
+func redirectRefsInFile(
+	pkg *superpose.TransformPackage,
+	file *ast.File,
+	funcRedirects map[string]string,
+	varAccessors map[string]string,
+) []*superpose.Patch {
+	var patches []*superpose.Patch
+	// Returns the replacement and whether the object can be referenced without
+	// instantiation
+	redirect := func(ident *ast.Ident) (to string, plain bool, ok bool) {
+		switch obj := pkg.TypesInfo.Uses[ident].(type) {
+		case *types.Func:
+			sig := obj.Type().(*types.Signature)
+			if sig.Recv() == nil {
+				to, ok = funcRedirects[obj.FullName()]
+				plain = sig.TypeParams().Len() == 0
+			}
+		case *types.Var:
+			if obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope() {
+				if to, ok = varAccessors[obj.Pkg().Path()+"."+obj.Name()]; ok {
+					to, plain = "(*"+to+"())", true
+				}
+			}
+		}
+		return
+	}
+	// Keyed by import qualifier, value is a name redirected that can be
+	// referenced
+	importUses := map[string]string{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			// Only qualified identifiers, other selectors are methods or fields
+			if pkgIdent, _ := n.X.(*ast.Ident); pkgIdent != nil {
+				if _, isPkg := pkg.TypesInfo.Uses[pkgIdent].(*types.PkgName); isPkg {
+					if to, plain, ok := redirect(n.Sel); ok {
+						patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(n), Str: to})
+						if plain {
+							importUses[pkgIdent.Name] = n.Sel.Name
+						}
+					}
+					return false
+				}
+			}
+		case *ast.Ident:
+			if to, _, ok := redirect(n); ok {
+				patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(n), Str: to})
+			}
+		}
+		return true
+	})
+	if len(importUses) > 0 {
+		uses := make([]string, 0, len(importUses))
+		for qualifier, name := range importUses {
+			uses = append(uses, "var _ = "+qualifier+"."+name)
+		}
+		sort.Strings(uses)
+		patches = append(patches, &superpose.Patch{
+			Range: superpose.Range{Pos: file.End()},
+			Str:   "; " + strings.Join(uses, "; "),
+		})
+	}
+	return patches
+}
@@ -0,0 +1,129 @@
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/cretz/superpose"
+)
+
+// InitFunc is an init function of a package.
+type InitFunc struct {
+	// Decl is the declaration of the init function.
+	Decl *ast.FuncDecl
+
+	// File is the file the init function is in.
+	File *ast.File
+
+	// Position is the position of the declaration.
+	Position token.Position
+
+	// Index is the 0-based index of the init function in the order they are run
+	// normally.
+	Index int
+
+	// Name is the name the init function is renamed to by [InterceptInits]. It
+	// can be called or referenced as a function value by that name.
+	Name string
+}
+
+// InitFuncs returns the init functions of the package in the order they are run
+// normally, which is the order of the files then the order in each file.
+func InitFuncs(pkg *superpose.TransformPackage) []*InitFunc {
+	var inits []*InitFunc
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			if funcDecl == nil || funcDecl.Recv != nil || funcDecl.Name.Name != "init" || funcDecl.Body == nil {
+				continue
+			}
+			inits = append(inits, &InitFunc{
+				Decl:     funcDecl,
+				File:     file,
+				Position: pkg.Fset.Position(funcDecl.Pos()),
+				Index:    len(inits),
+				Name:     fmt.Sprintf("__init%v", len(inits)),
+			})
+		}
+	}
+	return inits
+}
+
+// SuppressInits returns patches that make the init functions of the package
+// that suppress returns true for do nothing.
+func SuppressInits(pkg *superpose.TransformPackage, suppress func(init *InitFunc) bool) []*superpose.Patch {
+	var patches []*superpose.Patch
+	for _, init := range InitFuncs(pkg) {
+		if suppress(init) {
+			patches = append(patches, PrependStatements(init.Decl.Body, "return"))
+		}
+	}
+	return patches
+}
+
+// InterceptInits returns patches that rename every init function of the package
+// to [InitFunc.Name] and add a single init function that runs the
+// semicolon-delimited statements returned by stmts instead. The stmts function
+// is given the init functions in the order they are run normally. The
+// statements can call them in any order, skip them, or wrap them. For example,
+// to run them all in reverse order:
+//
+//	recipes.InterceptInits(pkg, func(inits []*recipes.InitFunc) string {
+//		var calls []string
+//		for i := len(inits) - 1; i >= 0; i-- {
+//			calls = append(calls, inits[i].Name+"()")
+//		}
+//		return strings.Join(calls, "; ")
+//	})
+//
+// Like all init functions, the new one runs after all package variables are
+// initialized. It is added to the end of the first file of the package.
+func InterceptInits(
+	pkg *superpose.TransformPackage,
+	stmts func(inits []*InitFunc) string,
+) ([]*superpose.Patch, error) {
+	inits := InitFuncs(pkg)
+	var patches []*superpose.Patch
+	for _, init := range inits {
+		patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(init.Decl.Name), Str: init.Name})
+	}
+	if initStmts := stmts(inits); initStmts != "" {
+		initHook, err := InitHook(pkg, initStmts)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, initHook)
+	}
+	return patches, nil
+}
+
+// References returns true if anything in the node references any of the
+// functions or package variables with the given full names, e.g. "net.Dial" or
+// "os.Args". Functions are named as returned by [types.Func.FullName]. This can
+// be used to find init functions with certain side effects.
+func References(pkg *superpose.TransformPackage, node ast.Node, fullNames ...string) bool {
+	names := make(map[string]bool, len(fullNames))
+	for _, fullName := range fullNames {
+		names[fullName] = true
+	}
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		ident, _ := n.(*ast.Ident)
+		if ident == nil {
+			return true
+		}
+		switch obj := pkg.TypesInfo.Uses[ident].(type) {
+		case *types.Func:
+			found = names[obj.FullName()]
+		case *types.Var:
+			found = obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope() && names[obj.Pkg().Path()+"."+obj.Name()]
+		}
+		return true
+	})
+	return found
+}
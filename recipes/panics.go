@@ -0,0 +1,69 @@
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+
+	"github.com/cretz/superpose"
+)
+
+// BoundaryPkg is the package used by code patched with [RecoverBoundary].
+const BoundaryPkg = "github.com/cretz/superpose/recipes/boundary"
+
+// RecoverBoundary returns a result with patches that add a panic boundary to
+// every exported function and method of the package with a body for which
+// include returns true, or all of them if include is nil. The result's patches
+// and dependency packages can be appended to another result.
+//
+// A panic inside the boundary is recovered and converted to a
+// *boundary.PanicError which has the panic value and a stack trace without
+// dimension package suffixes. If the last result of the function is an error,
+// it is set to the panic error and the function returns normally. Otherwise,
+// the panic error is panicked with so the caller in the main dimension can
+// recover it as a value of a type that is the same in every dimension.
+//
+// Since exported functions calling other exported functions have nested
+// boundaries, panics are only converted once. But callers inside the dimension
+// also get errors instead of panics for functions returning errors.
+func RecoverBoundary(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	include func(fn *types.Func) bool,
+) (*superpose.TransformResult, error) {
+	res := &superpose.TransformResult{}
+	errorType := types.Universe.Lookup("error").Type()
+	for _, file := range pkg.Syntax {
+		patchedFile := false
+		for _, decl := range file.Decls {
+			funcDecl, _ := decl.(*ast.FuncDecl)
+			if funcDecl == nil || funcDecl.Body == nil || !funcDecl.Name.IsExported() {
+				continue
+			}
+			funcObj, _ := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func)
+			if funcObj == nil || (include != nil && !include(funcObj)) {
+				continue
+			}
+			// Set the error result if there is one
+			errPtr := "nil"
+			if results := funcObj.Type().(*types.Signature).Results(); results.Len() > 0 &&
+				types.Identical(results.At(results.Len()-1).Type(), errorType) {
+				namePatches, resultsClose, names := nameResults(funcDecl)
+				res.Patches = append(res.Patches, namePatches...)
+				if resultsClose != nil {
+					res.Patches = append(res.Patches, resultsClose)
+				}
+				errPtr = "&" + names[len(names)-1]
+			}
+			res.Patches = append(res.Patches, PrependStatements(funcDecl.Body,
+				fmt.Sprintf("defer __boundary.Recover(%q, %q, %v)", ctx.Dimension, funcObj.FullName(), errPtr)))
+			patchedFile = true
+		}
+		if patchedFile {
+			if err := res.AddImport(ctx, file, BoundaryPkg, "__boundary"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,170 @@
+// Package recipes contains reusable patch builders for common transformations.
+//
+// Every builder here avoids altering line numbers of the original code. Many
+// builders return inserts, which are patches with no end. Since patches cannot
+// overlap, inserts at the same position must be combined with [MergeInserts]
+// before they are returned in a [superpose.TransformResult].
+//
+// Builders that add references to other packages expect the caller to add the
+// import with [superpose.TransformResult.AddImport], which also includes the
+// package and its dependencies in the build.
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// RemoveUnusedImports returns patches that replace every import in the package
+// that would no longer be used once the given patches are applied with a blank
+// import of "unsafe". This also removes imports of packages that do not exist
+// where the package is compiled. An import is considered used if a reference
+// to it is not inside a replacement or if any patch text in the file contains
+// its name followed by a dot. Blank and dot imports are never removed.
+//
+// Imports of packages the dimension applies to cannot be replaced since
+// Superpose replaces their import paths. Instead, an insert that references a
+// member of the package is added to the end of the file. Use [MergeInserts] if
+// other inserts may be at the end of the file.
+func RemoveUnusedImports(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+	patches []*superpose.Patch,
+) ([]*superpose.Patch, error) {
+	// Collect the positions of all references to imports
+	refs := map[*types.PkgName][]token.Pos{}
+	for ident, obj := range pkg.TypesInfo.Uses {
+		if pkgName, _ := obj.(*types.PkgName); pkgName != nil {
+			refs[pkgName] = append(refs[pkgName], ident.Pos())
+		}
+	}
+	used := func(file *ast.File, pkgName *types.PkgName) bool {
+		for _, patch := range patches {
+			if patch.Range.Pos >= file.FileStart && patch.Range.Pos <= file.FileEnd &&
+				strings.Contains(patch.Str, pkgName.Name()+".") {
+				return true
+			}
+		}
+	RefLoop:
+		for _, pos := range refs[pkgName] {
+			for _, patch := range patches {
+				if patch.Range.End.IsValid() && patch.Range.Contains(pos) {
+					continue RefLoop
+				}
+			}
+			return true
+		}
+		return false
+	}
+	transformer := ctx.Superpose.Config.Transformers[ctx.Dimension]
+	var removals []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		for _, spec := range file.Imports {
+			obj := pkg.TypesInfo.Implicits[spec]
+			if spec.Name != nil {
+				obj = pkg.TypesInfo.Defs[spec.Name]
+			}
+			pkgName, _ := obj.(*types.PkgName)
+			if pkgName == nil || pkgName.Name() == "_" || pkgName.Name() == "." || used(file, pkgName) {
+				continue
+			}
+			pkgPath := pkgName.Imported().Path()
+			if applies, err := transformer.AppliesToPackage(ctx, pkgPath); err != nil {
+				return nil, err
+			} else if !applies {
+				removals = append(removals, &superpose.Patch{Range: superpose.RangeOf(spec), Str: `_ "unsafe"`})
+			} else if member := referenceableMember(pkgName.Imported()); member == "" {
+				return nil, fmt.Errorf("import of %v in %v has no member to keep it used", pkgPath, pkg.PkgPath)
+			} else {
+				removals = append(removals, &superpose.Patch{
+					Range: superpose.Range{Pos: file.End()},
+					Str:   "; var _ = " + pkgName.Name() + "." + member,
+				})
+			}
+		}
+	}
+	return removals, nil
+}
+
+// Returns the first exported package-level function, variable, or constant in
+// the package that can be referenced without instantiation, or empty if none.
+func referenceableMember(pkg *types.Package) string {
+	// Names are sorted
+	for _, name := range pkg.Scope().Names() {
+		switch obj := pkg.Scope().Lookup(name).(type) {
+		case *types.Func:
+			if obj.Exported() && obj.Type().(*types.Signature).TypeParams().Len() == 0 {
+				return name
+			}
+		case *types.Var, *types.Const:
+			if obj.Exported() {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// PrependStatements returns an insert that runs the given semicolon-delimited
+// statements at the start of the block, e.g. a function body.
+func PrependStatements(block *ast.BlockStmt, stmts string) *superpose.Patch {
+	return &superpose.Patch{Range: superpose.Range{Pos: block.Lbrace + 1}, Str: " " + stmts + ";"}
+}
+
+// InitHook returns an insert that adds an init function running the given
+// semicolon-delimited statements to the end of the first file of the package.
+// Like all init functions, it runs after all package variables are initialized.
+func InitHook(pkg *superpose.TransformPackage, stmts string) (*superpose.Patch, error) {
+	if len(pkg.Syntax) == 0 {
+		return nil, fmt.Errorf("package %v has no files", pkg.PkgPath)
+	}
+	return &superpose.Patch{
+		Range: superpose.Range{Pos: pkg.Syntax[0].End()},
+		Str:   "; func init() { " + stmts + " }",
+	}, nil
+}
+
+// ExcludeOverlapping returns the patches that do not overlap any of the others,
+// e.g. patches inside a function body replaced with [DropFuncBody]. The given
+// slice is not altered.
+func ExcludeOverlapping(patches []*superpose.Patch, others []*superpose.Patch) []*superpose.Patch {
+	ret := make([]*superpose.Patch, 0, len(patches))
+	for _, patch := range patches {
+		overlaps := false
+		for _, other := range others {
+			if overlaps = patch.Range.Overlaps(&other.Range); overlaps {
+				break
+			}
+		}
+		if !overlaps {
+			ret = append(ret, patch)
+		}
+	}
+	return ret
+}
+
+// MergeInserts combines inserts at the same position into a single insert whose
+// text is the text of each in the order given. Patches that are not inserts or
+// have captures are returned unchanged. The given slice is not altered.
+func MergeInserts(patches []*superpose.Patch) []*superpose.Patch {
+	ret := make([]*superpose.Patch, 0, len(patches))
+	inserts := map[token.Pos]*superpose.Patch{}
+	for _, patch := range patches {
+		if patch.Range.End.IsValid() || len(patch.Captures) > 0 {
+			ret = append(ret, patch)
+		} else if existing := inserts[patch.Range.Pos]; existing != nil {
+			existing.Str += patch.Str
+		} else {
+			// Copy so we don't mutate the original when merging
+			patch := *patch
+			inserts[patch.Range.Pos] = &patch
+			ret = append(ret, &patch)
+		}
+	}
+	return ret
+}
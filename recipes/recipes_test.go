@@ -0,0 +1,621 @@
+package recipes_test
+
+import (
+	"context"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestImportAndInitHook(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+var X = 1
+`})
+	s, err := superpose.New(superpose.Config{
+		Version: "test",
+		Transformers: map[string]superpose.Transformer{
+			"dim": recipes.NewRedirectTransformer(nil, func(string) bool { return false }),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &superpose.TransformContext{Context: context.Background(), Superpose: s, Dimension: "dim"}
+	initHook, err := recipes.InitHook(pkg, `X = len(strings.Repeat("a", 5))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res superpose.TransformResult
+	if err := res.AddImport(ctx, pkg.Syntax[0], "strings", "strings"); err != nil {
+		t.Fatal(err)
+	} else if err := res.AddImport(ctx, pkg.Syntax[0], "fmt", "__fmt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.IncludeDependencyPackages["fmt"]; !ok {
+		t.Fatalf("expected fmt dependency, got %v", res.IncludeDependencyPackages)
+	}
+	patches := recipes.MergeInserts(append(res.Patches,
+		initHook,
+		// The init hook uses strings, but this makes fmt used
+		&superpose.Patch{Range: superpose.Range{Pos: pkg.Syntax[0].End()}, Str: "; var _ = __fmt.Sprint"},
+	))
+	if len(patches) != 2 {
+		t.Fatalf("expected 2 patches, got %v", len(patches))
+	}
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p; import __fmt "fmt"; import strings "strings"
+
+var X = 1; func init() { X = len(strings.Repeat("a", 5)) }; var _ = __fmt.Sprint
+`})
+}
+
+func TestReplaceFuncBody(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+type T struct{ v int }
+
+func (t *T) Add(a, _ int, b int) int {
+	return t.v + a + b
+}
+`})
+	decl := recipes.FindFunc(pkg, "(*p.T).Add")
+	if decl == nil {
+		t.Fatal("function not found")
+	}
+	names := recipes.FuncParamNames(decl)
+	if expected := []string{"t", "a", "_", "b"}; !reflect.DeepEqual(expected, names) {
+		t.Fatalf("expected names %v, got %v", expected, names)
+	}
+	patch := recipes.ReplaceFuncBody(decl, "return "+names[0]+".v * "+names[1])
+	expectPatched(t, pkg, []*superpose.Patch{patch}, map[string]string{"a.go": `package p
+
+type T struct{ v int }
+
+func (t *T) Add(a, _ int, b int) int { return t.v * a;
+	return t.v + a + b
+}
+`})
+}
+
+func TestStubPackage(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import "os"
+
+func A() int { return len(os.Args) }
+
+func B(s string) (int, error) {
+	_, err := os.Stat(s)
+	return 0, err
+}
+
+func C() (n int) { n = 5; return }
+
+type T struct{}
+
+func (T) D() { os.Exit(1) }
+`})
+	patches := recipes.StubPackage(pkg, func(fn *types.Func) string {
+		if fn.Name() == "D" {
+			return ""
+		}
+		return `println("stubbed ` + fn.FullName() + `")`
+	})
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+import "os"
+
+func A() (__r0 int) { println("stubbed p.A"); return; return len(os.Args) }
+
+func B(s string) (__r0 int, __r1 error) { println("stubbed p.B"); return;
+	_, err := os.Stat(s)
+	return 0, err
+}
+
+func C() (n int) { println("stubbed p.C"); return; n = 5; return }
+
+type T struct{}
+
+func (T) D() { return; os.Exit(1) }
+`})
+}
+
+func TestRedirectFuncs(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import "strings"
+
+var upper = strings.ToUpper
+
+func Upper(s string) string { return strings.ToUpper(s) + upper(s) + trim(s) }
+
+func trim(s string) string { return s }
+
+type T struct{}
+
+func (T) trim(s string) string { return s }
+
+func UseMethod(t T) string { return t.trim("a") }
+`})
+	patches := recipes.RedirectFuncs(pkg, map[string]string{
+		"strings.ToUpper": "strings.ToLower",
+		"p.trim":          "strings.TrimSpace",
+	})
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+import "strings"
+
+var upper = strings.ToLower
+
+func Upper(s string) string { return strings.ToLower(s) + upper(s) + strings.TrimSpace(s) }
+
+func trim(s string) string { return s }
+
+type T struct{}
+
+func (T) trim(s string) string { return s }
+
+func UseMethod(t T) string { return t.trim("a") }; var _ = strings.ToUpper
+`})
+}
+
+func TestRewriteRules(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import (
+	"bytes"
+	str "strings"
+)
+
+func A(s string, b []byte) (string, []byte, bool) {
+	return str.Replace(s+"{{", "a", "b", -1), bytes.Replace(b, b, nil, -1), len(s) == len(s)
+}
+
+func B(n int) bool { return (n) == n }
+`})
+	patches, err := recipes.RewriteRules(pkg, []*recipes.RewriteRule{
+		{
+			Pattern:     "strings.Replace(s, o, n, -1)",
+			Replacement: `str.ReplaceAll(s, o, n+"{{")`,
+			Imports:     map[string]string{"str": "strings"},
+			Types:       map[string]string{"s": "string"},
+		},
+		{
+			Pattern:     "x == x",
+			Replacement: "!false",
+			Where: func(m *recipes.RewriteMatch) bool {
+				_, isCall := m.Wildcards["x"].(*ast.CallExpr)
+				return isCall
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+import (
+	"bytes"
+	str "strings"
+)
+
+func A(s string, b []byte) (string, []byte, bool) {
+	return str.ReplaceAll(s+"{{", "a", "b"+"{{"), bytes.Replace(b, b, nil, -1), (!false)
+}
+
+func B(n int) bool { return (n) == n }; var _ = str.Replace
+`})
+}
+
+func TestRedirectCalls(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import (
+	"fmt"
+	"strings"
+)
+
+type T struct{ strings.Builder }
+
+func A(b strings.Builder, p *strings.Builder, t *T, s fmt.Stringer) []string {
+	f := b.String
+	return []string{b.String(), p.String(), t.String(), (*strings.Builder).String(p), s.String(), f()}
+}
+`})
+	s, err := superpose.New(superpose.Config{
+		Version: "test",
+		Transformers: map[string]superpose.Transformer{
+			"dim": recipes.NewRedirectTransformer(nil, func(string) bool { return false }),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &superpose.TransformContext{Context: context.Background(), Superpose: s, Dimension: "dim"}
+	res, err := recipes.RedirectCalls(ctx, pkg, "(*strings.Builder).String", "fmt.Sprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.IncludeDependencyPackages["fmt"]; !ok {
+		t.Fatalf("expected fmt dependency, got %v", res.IncludeDependencyPackages)
+	}
+	expectPatched(t, pkg, res.Patches, map[string]string{"a.go": `package p
+
+import (
+	"fmt"
+	"strings"
+); import __calls_fmt_Sprint "fmt"
+
+type T struct{ strings.Builder }
+
+func A(b strings.Builder, p *strings.Builder, t *T, s fmt.Stringer) []string {
+	f := b.String
+	return []string{__calls_fmt_Sprint.Sprint(&(b)), __calls_fmt_Sprint.Sprint(p), ` +
+		`__calls_fmt_Sprint.Sprint(&(t.Builder)), __calls_fmt_Sprint.Sprint(p), s.String(), f()}
+}; var _ = (*strings.Builder).String
+`})
+}
+
+func TestLocalizeVars(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{
+		"a.go": `package p
+
+import (
+	"os"
+	"strconv"
+)
+
+func A() []string { os.Args = append(os.Args, strconv.Itoa(strconv.IntSize)); return os.Args }
+`,
+		"b.go": `package p
+
+import myos "os"
+
+func B() []string { return myos.Args }
+`,
+	})
+	patches := recipes.LocalizeVars(pkg, "os.Args", "strconv.IntSize")
+	expectPatched(t, pkg, patches, map[string]string{
+		"a.go": `package p
+
+import (
+	"os"
+	"strconv"
+)
+
+func A() []string { __local_os_Args = append(__local_os_Args, strconv.Itoa(strconv.IntSize)); return __local_os_Args }; var __local_os_Args = os.Args
+`,
+		"b.go": `package p
+
+import myos "os"
+
+func B() []string { return __local_os_Args }; var _ = myos.Args
+`,
+	})
+}
+
+func TestLocalizeVarsWithInit(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import "os"
+
+func A() []string { return os.Args }
+`})
+	patches := recipes.LocalizeVarsWithInit(pkg, map[string]string{"os.Args": `[]string{"local"}`})
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+import "os"
+
+func A() []string { return __local_os_Args }; var __local_os_Args = os.Args; func init() { __local_os_Args = []string{"local"} }
+`})
+}
+
+func TestRedirectVars(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import "os"
+
+var args []string
+
+func argsPtr() *[]string { return &args }
+
+func A() []string { os.Args = append(os.Args, "a"); return os.Args[1:] }
+`})
+	patches := recipes.RedirectVars(pkg, map[string]string{"os.Args": "argsPtr"})
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+import "os"
+
+var args []string
+
+func argsPtr() *[]string { return &args }
+
+func A() []string { (*argsPtr()) = append((*argsPtr()), "a"); return (*argsPtr())[1:] }; var _ = os.Args
+`})
+}
+
+func TestInterceptInits(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{
+		"a.go": `package p
+
+import "net"
+
+var Order []string
+
+func init() { Order = append(Order, "a1") }
+
+func init() {
+	net.Dial("tcp", "127.0.0.1:1")
+}
+`,
+		"b.go": `package p
+
+func init() { Order = append(Order, "b1") }
+`,
+	})
+	// Skip the init that dials, run the rest in reverse, and wrap the last
+	var dialing []int
+	patches, err := recipes.InterceptInits(pkg, func(inits []*recipes.InitFunc) string {
+		if len(inits) != 3 || filepath.Base(inits[2].Position.Filename) != "b.go" {
+			t.Fatalf("unexpected inits %v", inits)
+		}
+		var stmts []string
+		for i := len(inits) - 1; i >= 0; i-- {
+			if recipes.References(pkg, inits[i].Decl, "net.Dial") {
+				dialing = append(dialing, i)
+			} else if i == 0 {
+				stmts = append(stmts, "func(f func()) { f() }("+inits[i].Name+")")
+			} else {
+				stmts = append(stmts, inits[i].Name+"()")
+			}
+		}
+		return strings.Join(stmts, "; ")
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual([]int{1}, dialing) {
+		t.Fatalf("expected dialing init at index 1, got %v", dialing)
+	}
+	expectPatched(t, pkg, patches, map[string]string{
+		"a.go": `package p
+
+import "net"
+
+var Order []string
+
+func __init0() { Order = append(Order, "a1") }
+
+func __init1() {
+	net.Dial("tcp", "127.0.0.1:1")
+}; func init() { __init2(); func(f func()) { f() }(__init0) }
+`,
+		"b.go": `package p
+
+func __init2() { Order = append(Order, "b1") }
+`,
+	})
+
+	// Suppress instead
+	patches = recipes.SuppressInits(pkg, func(init *recipes.InitFunc) bool {
+		return recipes.References(pkg, init.Decl, "net.Dial")
+	})
+	expectPatched(t, pkg, patches, map[string]string{
+		"a.go": `package p
+
+import "net"
+
+var Order []string
+
+func init() { Order = append(Order, "a1") }
+
+func init() { return;
+	net.Dial("tcp", "127.0.0.1:1")
+}
+`,
+		"b.go": `package p
+
+func init() { Order = append(Order, "b1") }
+`,
+	})
+}
+
+func TestSimulatePlatform(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+import (
+	"math"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const Max = math.MaxUint8
+
+func Consts() (rune, int, string, time.Duration) { return utf8.RuneError, utf8.UTFMax, runtime.GOOS, time.Second }
+
+func Upper(s string) string {
+	return strings.ToUpper(s) + string(rune(math.MaxInt8))
+}
+`})
+	s, err := superpose.New(superpose.Config{
+		Version: "test",
+		Transformers: map[string]superpose.Transformer{
+			"dim": recipes.NewRedirectTransformer(nil, func(string) bool { return false }),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &superpose.TransformContext{Context: context.Background(), Superpose: s, Dimension: "dim"}
+	drops := recipes.DropFuncBody(pkg, recipes.FindFunc(pkg, "p.Upper"), "")
+	patches := append(drops, recipes.ExcludeOverlapping(recipes.InlineConstants(pkg, nil), drops)...)
+	removals, err := recipes.RemoveUnusedImports(ctx, pkg, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPatched(t, pkg, append(patches, removals...), map[string]string{"a.go": `package p
+
+import (
+	_ "unsafe"
+	_ "unsafe"
+	_ "unsafe"
+	"time"
+	_ "unsafe"
+)
+
+const Max = 255
+
+func Consts() (rune, int, string, time.Duration) { return '�', 4, string("` + runtime.GOOS + `"), time.Second }
+
+func Upper(s string) (__r0 string) { return
+
+ }
+`})
+}
+
+func TestTemplatePatch(t *testing.T) {
+	pkg := loadPackage(t, map[string]string{"a.go": `package p
+
+func f(m map[string]int) map[string]int { return m }
+
+func keys(m map[string]int) (ks []string) { return }
+
+func Sum(m map[string]int) (n int) {
+	for k, v := range f(m) {
+		n += v + len(k)
+	}
+	return
+}
+`})
+	var rang *ast.RangeStmt
+	ast.Inspect(recipes.FindFunc(pkg, "p.Sum"), func(n ast.Node) bool {
+		if n, _ := n.(*ast.RangeStmt); n != nil {
+			rang = n
+		}
+		return rang == nil
+	})
+	// The key, range expression, and body are left in place, so things inside
+	// them can still be patched
+	tmpl := "for _, {{.key}} := range keys({{.x}}) { {{.value}} := {{.x}}[{{.key}}]{{.body}}"
+	patches, err := superpose.TemplatePatch(rang, tmpl, map[string]superpose.Range{
+		"key":   superpose.RangeOf(rang.Key),
+		"value": superpose.RangeOf(rang.Value),
+		"x":     superpose.RangeOf(rang.X),
+		"body":  {Pos: rang.Body.Lbrace + 1, End: rang.Body.End()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(patches) != 3 {
+		t.Fatalf("expected 3 patches, got %v", len(patches))
+	}
+	body := rang.Body.List[0].(*ast.AssignStmt)
+	patches = append(patches,
+		superpose.WrapWithPatch(rang.X.(*ast.CallExpr).Args[0], "f(", ")"),
+		superpose.WrapWithPatch(body.Rhs[0].(*ast.BinaryExpr).Y, "2*", ""),
+	)
+	expectPatched(t, pkg, patches, map[string]string{"a.go": `package p
+
+func f(m map[string]int) map[string]int { return m }
+
+func keys(m map[string]int) (ks []string) { return }
+
+func Sum(m map[string]int) (n int) {
+	for _, k := range keys(f(f(m))) { v := f(m)[k]
+		n += v + 2*len(k)
+	}
+	return
+}
+`})
+}
+
+// Loads a package of the given files named "p" from a temp dir
+func loadPackage(t *testing.T, files map[string]string) *superpose.TransformPackage {
+	dir := t.TempDir()
+	fset := token.NewFileSet()
+	var fileNames []string
+	for name := range files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+	var syntax []*ast.File
+	for _, name := range fileNames {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := parser.ParseFile(fset, fileName, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syntax = append(syntax, file)
+	}
+	typesInfo := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Implicits:  map[ast.Node]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+	}
+	typesPkg, err := (&types.Config{Importer: importer.Default()}).Check("p", fset, syntax, typesInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &superpose.TransformPackage{Package: &packages.Package{
+		ID:        "p",
+		Name:      "p",
+		PkgPath:   "p",
+		Fset:      fset,
+		Syntax:    syntax,
+		Types:     typesPkg,
+		TypesInfo: typesInfo,
+	}}
+}
+
+// Applies the patches and confirms the results, that the line count is the same,
+// and that the patched package still type checks
+func expectPatched(t *testing.T, pkg *superpose.TransformPackage, patches []*superpose.Patch, expected map[string]string) {
+	patched, err := superpose.ApplyPatches(pkg.Fset, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var syntax []*ast.File
+	for _, file := range pkg.Syntax {
+		fileName := pkg.Fset.File(file.Pos()).Name()
+		orig, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, ok := patched[fileName]
+		if !ok {
+			src = orig
+		}
+		if expected := expected[filepath.Base(fileName)]; expected != string(src) {
+			t.Fatalf("expected %v to be:\n%s\nbut was:\n%s", filepath.Base(fileName), expected, src)
+		} else if strings.Count(string(orig), "\n") != strings.Count(string(src), "\n") {
+			t.Fatalf("line count changed in %v", filepath.Base(fileName))
+		}
+		file, err := parser.ParseFile(fset, fileName, src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syntax = append(syntax, file)
+	}
+	if _, err := (&types.Config{Importer: importer.Default()}).Check("p", fset, syntax, nil); err != nil {
+		t.Fatalf("patched package failed type check: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package recipes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// RedirectTransformer is a [superpose.Transformer] that redirects every
+// reference to some functions, including calls, to functions in other
+// packages, and every reference to some package variables to accessor functions
+// in other packages. It adds the imports and includes the dependency packages
+// needed.
+type RedirectTransformer struct {
+	// Redirects are keyed by the full name of the function to redirect as
+	// returned by [types.Func.FullName], e.g. "time.Now", with the value as the
+	// package path and name of the package-level function to redirect to, e.g.
+	// "example.com/myhooks.Now". The function redirected to must have an
+	// identical signature. Methods are not supported.
+	Redirects map[string]string
+
+	// VarAccessors are keyed by the package path and name of the variable to
+	// redirect, e.g. "os.Args", with the value as the package path and name of
+	// the package-level accessor function, e.g. "example.com/myhooks.Args". The
+	// accessor function must take no parameters and return a pointer to the
+	// same type as the variable. See [RedirectVars].
+	VarAccessors map[string]string
+
+	// AppliesTo returns whether references in the package are redirected. The
+	// packages redirected to never apply since they need to be able to call the
+	// original functions. Required.
+	AppliesTo func(pkgPath string) bool
+}
+
+var _ superpose.Transformer = &RedirectTransformer{}
+
+// NewRedirectTransformer creates a [RedirectTransformer].
+func NewRedirectTransformer(redirects map[string]string, appliesTo func(pkgPath string) bool) *RedirectTransformer {
+	return &RedirectTransformer{Redirects: redirects, AppliesTo: appliesTo}
+}
+
+// AppliesToPackage implements [superpose.Transformer.AppliesToPackage].
+func (r *RedirectTransformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	for _, targets := range []map[string]string{r.Redirects, r.VarAccessors} {
+		for _, to := range targets {
+			if toPkg, _, _ := splitFuncName(to); toPkg == pkgPath {
+				return false, nil
+			}
+		}
+	}
+	return r.AppliesTo(pkgPath), nil
+}
+
+// Transform implements [superpose.Transformer.Transform].
+func (r *RedirectTransformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Give each package redirected to an alias, sorted for determinism
+	aliases := map[string]string{}
+	for _, targets := range []map[string]string{r.Redirects, r.VarAccessors} {
+		for _, to := range targets {
+			toPkg, _, ok := splitFuncName(to)
+			if !ok {
+				return nil, fmt.Errorf("invalid redirect target %v", to)
+			}
+			aliases[toPkg] = ""
+		}
+	}
+	toPkgs := make([]string, 0, len(aliases))
+	for toPkg := range aliases {
+		toPkgs = append(toPkgs, toPkg)
+	}
+	sort.Strings(toPkgs)
+	for i, toPkg := range toPkgs {
+		aliases[toPkg] = fmt.Sprintf("__redirect%v", i+1)
+	}
+	toExprs := func(targets map[string]string) map[string]string {
+		exprs := make(map[string]string, len(targets))
+		for from, to := range targets {
+			toPkg, toName, _ := splitFuncName(to)
+			exprs[from] = aliases[toPkg] + "." + toName
+		}
+		return exprs
+	}
+	funcExprs, varExprs := toExprs(r.Redirects), toExprs(r.VarAccessors)
+
+	// Redirect and add imports only for the packages used in each file
+	res := &superpose.TransformResult{AddLineDirectives: true, LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		patches := redirectRefsInFile(pkg, file, funcExprs, varExprs)
+		if len(patches) == 0 {
+			continue
+		}
+		for _, toPkg := range toPkgs {
+			if patchesUseAlias(patches, aliases[toPkg]) {
+				if err := res.AddImport(ctx, file, toPkg, aliases[toPkg]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		res.Patches = append(res.Patches, patches...)
+	}
+	res.Patches = MergeInserts(res.Patches)
+	return res, nil
+}
+
+func patchesUseAlias(patches []*superpose.Patch, alias string) bool {
+	for _, patch := range patches {
+		if strings.HasPrefix(patch.Str, alias+".") || strings.HasPrefix(patch.Str, "(*"+alias+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits "<pkg>.<name>" where the package path may contain dots
+func splitFuncName(fullName string) (pkgPath, name string, ok bool) {
+	dot := strings.LastIndex(fullName, ".")
+	if dot <= 0 || dot < strings.LastIndex(fullName, "/") {
+		return "", "", false
+	}
+	return fullName[:dot], fullName[dot+1:], true
+}
@@ -0,0 +1,469 @@
+package recipes
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// RewriteRule is a declarative rewrite of expressions like "gofmt -r", but
+// aware of packages and types. See [RewriteRules].
+type RewriteRule struct {
+	// Pattern is the Go expression to match, e.g. "strings.Replace(s, o, n, -1)".
+	// Like "gofmt -r", identifiers of a single lowercase letter are wildcards
+	// matching any expression, which must be the same expression each time the
+	// wildcard appears. A selector of a package name, e.g. "time.Now", matches
+	// references to that package-level name of the package regardless of the
+	// name the package is imported as. Everything else must match exactly,
+	// ignoring parentheses around what is matched.
+	Pattern string
+
+	// Replacement is the Go expression each match is replaced with. It can use
+	// the wildcards of the pattern to reference what they matched, e.g.
+	// "strings.ReplaceAll(s, o, n)".
+	Replacement string
+
+	// Imports are the import paths of the packages named in the pattern and
+	// replacement keyed by package name, only needed when the path is not the
+	// name, e.g. "filepath" to "path/filepath".
+	Imports map[string]string
+
+	// Types constrains wildcards to expressions of a type, keyed by wildcard
+	// with the type as given by [types.TypeString] with full package paths, e.g.
+	// "string" or "*bytes.Buffer".
+	Types map[string]string
+
+	// Where, if set, is called for each match that satisfies Types and the
+	// match is only rewritten if it returns true.
+	Where func(match *RewriteMatch) bool
+}
+
+// RewriteMatch is an expression matched by a [RewriteRule].
+type RewriteMatch struct {
+	// File is the file of the expression.
+	File *ast.File
+	// Expr is the expression matched by the pattern.
+	Expr ast.Expr
+	// Wildcards are the expressions the wildcards of the pattern matched.
+	Wildcards map[string]ast.Expr
+}
+
+// RewriteRules returns patches that replace every expression in the package
+// matching the pattern of a rule with its replacement. When more than one rule
+// matches, the first is used. Matches are not nested, so expressions within a
+// match, including within what its wildcards matched, are not rewritten.
+//
+// Package names in replacements are written as given, so the files must import
+// the packages by those names. [RewriteTransformer] adds the imports instead.
+//
+// Since rewriting may remove the only use of an import, an insert that
+// references what each matched package name referenced is added to the end of
+// each file. Use [MergeInserts] if other inserts may be at the end of the file.
+func RewriteRules(pkg *superpose.TransformPackage, rules []*RewriteRule) ([]*superpose.Patch, error) {
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	var patches []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		filePatches, _ := rewriteFile(pkg, file, compiled, nil)
+		patches = append(patches, filePatches...)
+	}
+	return patches, nil
+}
+
+type compiledRewriteRule struct {
+	*RewriteRule
+	pattern ast.Expr
+	// Replacement split around the wildcards and package names in it
+	parts []rewritePart
+	// Whether the replacement needs parentheses wherever it is put
+	parens bool
+}
+
+// Text, wildcard, or package path of a package name in a replacement
+type rewritePart struct {
+	text, wildcard, pkgPath string
+}
+
+func compileRewriteRules(rules []*RewriteRule) ([]*compiledRewriteRule, error) {
+	compiled := make([]*compiledRewriteRule, len(rules))
+	for i, rule := range rules {
+		c := &compiledRewriteRule{RewriteRule: rule}
+		compiled[i] = c
+		var err error
+		if c.pattern, err = parser.ParseExpr(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		} else if ident, _ := c.pattern.(*ast.Ident); ident != nil && isRewriteWildcard(ident.Name) {
+			return nil, fmt.Errorf("pattern %q cannot be only a wildcard", rule.Pattern)
+		}
+		wildcards := map[string]bool{}
+		ast.Inspect(c.pattern, func(n ast.Node) bool {
+			if ident, _ := n.(*ast.Ident); ident != nil && isRewriteWildcard(ident.Name) {
+				wildcards[ident.Name] = true
+			}
+			return true
+		})
+		for wildcard := range rule.Types {
+			if !wildcards[wildcard] {
+				return nil, fmt.Errorf("type constraint for %v not a wildcard of pattern %q", wildcard, rule.Pattern)
+			}
+		}
+
+		// Split the replacement on its wildcards and package names
+		fset := token.NewFileSet()
+		replacement, err := parser.ParseExprFrom(fset, "", rule.Replacement, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replacement %q: %w", rule.Replacement, err)
+		}
+		type ref struct {
+			ident *ast.Ident
+			part  rewritePart
+		}
+		var refs []ref
+		ast.Inspect(replacement, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.SelectorExpr:
+				if pkgIdent, _ := n.X.(*ast.Ident); pkgIdent != nil && !isRewriteWildcard(pkgIdent.Name) {
+					refs = append(refs, ref{pkgIdent, rewritePart{text: pkgIdent.Name, pkgPath: rule.importPath(pkgIdent.Name)}})
+					return false
+				}
+			case *ast.Ident:
+				if isRewriteWildcard(n.Name) {
+					if !wildcards[n.Name] {
+						err = fmt.Errorf("replacement %q uses %v which is not a wildcard of the pattern", rule.Replacement, n.Name)
+					}
+					refs = append(refs, ref{n, rewritePart{wildcard: n.Name}})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		// The file base is 1
+		offset := 0
+		for _, ref := range refs {
+			start := int(ref.ident.Pos()) - 1
+			c.parts = append(c.parts, rewritePart{text: rule.Replacement[offset:start]}, ref.part)
+			offset = int(ref.ident.End()) - 1
+		}
+		c.parts = append(c.parts, rewritePart{text: rule.Replacement[offset:]})
+		switch replacement.(type) {
+		case *ast.BinaryExpr, *ast.UnaryExpr, *ast.StarExpr, *ast.KeyValueExpr:
+			c.parens = true
+		}
+	}
+	return compiled, nil
+}
+
+func (r *RewriteRule) importPath(pkgName string) string {
+	if pkgPath := r.Imports[pkgName]; pkgPath != "" {
+		return pkgPath
+	}
+	return pkgName
+}
+
+func isRewriteWildcard(name string) bool {
+	return len(name) == 1 && name[0] >= 'a' && name[0] <= 'z'
+}
+
+// Gives the patches for the rules in the file and the paths of the packages the
+// replacements reference. If aliases is nil, the package names of the rules are
+// used, otherwise it has the name to use for each package path.
+func rewriteFile(
+	pkg *superpose.TransformPackage,
+	file *ast.File,
+	rules []*compiledRewriteRule,
+	aliases map[string]string,
+) (patches []*superpose.Patch, pkgPaths map[string]struct{}) {
+	pkgPaths = map[string]struct{}{}
+	importUses := map[string]string{}
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.GenDecl:
+			return n.Tok != token.IMPORT
+		case *ast.Ident:
+			// Declared names are not expressions to rewrite
+			if pkg.TypesInfo.Defs[n] != nil {
+				return false
+			}
+		}
+		expr, _ := n.(ast.Expr)
+		if expr == nil {
+			return true
+		}
+		for _, rule := range rules {
+			m := &rewriteMatcher{pkg: pkg, rule: rule, wildcards: map[string]ast.Expr{}, importUses: map[string]string{}}
+			if !m.match(reflect.ValueOf(rule.pattern), reflect.ValueOf(expr)) || !m.satisfiesConstraints(file, expr) {
+				continue
+			}
+			patches = append(patches, rule.patch(expr, m.wildcards, aliases, pkgPaths))
+			for qualifier, name := range m.importUses {
+				importUses[qualifier] = name
+			}
+			return false
+		}
+		// The selected name is not an expression on its own
+		if sel, _ := n.(*ast.SelectorExpr); sel != nil {
+			ast.Inspect(sel.X, visit)
+			return false
+		}
+		return true
+	}
+	ast.Inspect(file, visit)
+	if len(importUses) > 0 {
+		uses := make([]string, 0, len(importUses))
+		for qualifier, name := range importUses {
+			uses = append(uses, "var _ = "+qualifier+"."+name)
+		}
+		sort.Strings(uses)
+		patches = append(patches, &superpose.Patch{
+			Range: superpose.Range{Pos: file.End()},
+			Str:   "; " + strings.Join(uses, "; "),
+		})
+	}
+	return patches, pkgPaths
+}
+
+func (r *compiledRewriteRule) patch(
+	expr ast.Expr,
+	wildcards map[string]ast.Expr,
+	aliases map[string]string,
+	pkgPaths map[string]struct{},
+) *superpose.Patch {
+	patch := &superpose.Patch{Range: superpose.RangeOf(expr)}
+	var str strings.Builder
+	if r.parens {
+		str.WriteString("(")
+	}
+	for _, part := range r.parts {
+		switch {
+		case part.wildcard != "":
+			if patch.Captures == nil {
+				patch.Captures = map[string]superpose.Range{}
+			}
+			patch.Captures[part.wildcard] = superpose.RangeOf(wildcards[part.wildcard])
+			str.WriteString("{{." + part.wildcard + "}}")
+		case part.pkgPath != "":
+			pkgPaths[part.pkgPath] = struct{}{}
+			if alias, ok := aliases[part.pkgPath]; ok {
+				str.WriteString(alias)
+			} else {
+				str.WriteString(part.text)
+			}
+		default:
+			// Literal braces cannot be left in a template
+			str.WriteString(strings.ReplaceAll(part.text, "{{", `{{"{{"}}`))
+		}
+	}
+	if r.parens {
+		str.WriteString(")")
+	}
+	patch.Str = str.String()
+	return patch
+}
+
+// Structurally matches AST nodes like "gofmt -r", but with package names
+// resolved
+type rewriteMatcher struct {
+	pkg       *superpose.TransformPackage
+	rule      *compiledRewriteRule
+	wildcards map[string]ast.Expr
+	// Names referenced by each package qualifier matched
+	importUses map[string]string
+	// Whether the pattern is source to compare as is, without wildcards
+	exact bool
+}
+
+var (
+	rewriteIdentType    = reflect.TypeOf((*ast.Ident)(nil))
+	rewriteSelectorType = reflect.TypeOf((*ast.SelectorExpr)(nil))
+	rewriteParenType    = reflect.TypeOf((*ast.ParenExpr)(nil))
+	rewriteCallType     = reflect.TypeOf((*ast.CallExpr)(nil))
+	rewriteObjectType   = reflect.TypeOf((*ast.Object)(nil))
+	rewritePosType      = reflect.TypeOf(token.NoPos)
+)
+
+func (m *rewriteMatcher) match(pattern, val reflect.Value) bool {
+	if !pattern.IsValid() || !val.IsValid() {
+		return !pattern.IsValid() && !val.IsValid()
+	}
+	// Parentheses in the source are ignored
+	if val.Type() == rewriteParenType && pattern.Type() != rewriteParenType && !val.IsNil() {
+		return m.match(pattern, reflect.ValueOf(val.Interface().(*ast.ParenExpr).X))
+	}
+	switch pattern.Type() {
+	case rewriteIdentType:
+		p, _ := pattern.Interface().(*ast.Ident)
+		if p != nil && !m.exact && isRewriteWildcard(p.Name) {
+			// Wildcards match any expression, the same each time
+			v, _ := val.Interface().(ast.Expr)
+			if v == nil || reflect.ValueOf(v).IsNil() {
+				return false
+			} else if prev := m.wildcards[p.Name]; prev != nil {
+				return (&rewriteMatcher{exact: true}).match(reflect.ValueOf(prev), reflect.ValueOf(v))
+			}
+			m.wildcards[p.Name] = v
+			return true
+		}
+		v, _ := val.Interface().(*ast.Ident)
+		return val.Type() == rewriteIdentType && (p == nil) == (v == nil) && (p == nil || p.Name == v.Name)
+	case rewriteSelectorType:
+		// A selector of a package name matches any reference to the same object
+		p, _ := pattern.Interface().(*ast.SelectorExpr)
+		if pkgIdent, _ := p.X.(*ast.Ident); pkgIdent != nil && !isRewriteWildcard(pkgIdent.Name) && !m.exact {
+			v, _ := val.Interface().(*ast.SelectorExpr)
+			if val.Type() != rewriteSelectorType || v == nil {
+				return false
+			}
+			vIdent, _ := v.X.(*ast.Ident)
+			if vIdent == nil {
+				return false
+			}
+			pkgName, _ := m.pkg.TypesInfo.Uses[vIdent].(*types.PkgName)
+			if pkgName == nil || pkgName.Imported().Path() != m.rule.importPath(pkgIdent.Name) ||
+				!m.match(reflect.ValueOf(p.Sel), reflect.ValueOf(v.Sel)) {
+				return false
+			}
+			m.importUses[vIdent.Name] = v.Sel.Name
+			return true
+		}
+	case rewriteObjectType, rewritePosType:
+		return true
+	case rewriteCallType:
+		// Calls with and without "..." differ only by position
+		p, _ := pattern.Interface().(*ast.CallExpr)
+		v, _ := val.Interface().(*ast.CallExpr)
+		if val.Type() != rewriteCallType || p == nil || v == nil || p.Ellipsis.IsValid() != v.Ellipsis.IsValid() {
+			return false
+		}
+	}
+	if pattern.Type() != val.Type() {
+		return false
+	}
+	p, v := reflect.Indirect(pattern), reflect.Indirect(val)
+	if !p.IsValid() || !v.IsValid() {
+		return !p.IsValid() && !v.IsValid()
+	}
+	switch p.Kind() {
+	case reflect.Slice:
+		if p.Len() != v.Len() {
+			return false
+		}
+		for i := 0; i < p.Len(); i++ {
+			if !m.match(p.Index(i), v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < p.NumField(); i++ {
+			if !m.match(p.Field(i), v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Interface:
+		return m.match(p.Elem(), v.Elem())
+	}
+	return p.Interface() == v.Interface()
+}
+
+func (m *rewriteMatcher) satisfiesConstraints(file *ast.File, expr ast.Expr) bool {
+	for wildcard, typ := range m.rule.Types {
+		t := m.pkg.TypesInfo.TypeOf(m.wildcards[wildcard])
+		if t == nil || types.TypeString(t, nil) != typ {
+			return false
+		}
+	}
+	return m.rule.Where == nil || m.rule.Where(&RewriteMatch{File: file, Expr: expr, Wildcards: m.wildcards})
+}
+
+// RewriteTransformer is a [superpose.Transformer] that rewrites expressions
+// with [RewriteRules]. It adds the imports of the packages replacements
+// reference and includes the dependency packages needed.
+type RewriteTransformer struct {
+	// Rules are the rules to rewrite with, see [RewriteRules].
+	Rules []*RewriteRule
+
+	// AppliesTo returns whether expressions in the package are rewritten. The
+	// packages replacements reference never apply so they can be used as they
+	// are. Required.
+	AppliesTo func(pkgPath string) bool
+}
+
+var _ superpose.Transformer = &RewriteTransformer{}
+
+// NewRewriteTransformer creates a [RewriteTransformer].
+func NewRewriteTransformer(rules []*RewriteRule, appliesTo func(pkgPath string) bool) *RewriteTransformer {
+	return &RewriteTransformer{Rules: rules, AppliesTo: appliesTo}
+}
+
+// AppliesToPackage implements [superpose.Transformer.AppliesToPackage].
+func (r *RewriteTransformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	compiled, err := compileRewriteRules(r.Rules)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range compiled {
+		for _, part := range rule.parts {
+			if part.pkgPath == pkgPath {
+				return false, nil
+			}
+		}
+	}
+	return r.AppliesTo(pkgPath), nil
+}
+
+// Transform implements [superpose.Transformer.Transform].
+func (r *RewriteTransformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	compiled, err := compileRewriteRules(r.Rules)
+	if err != nil {
+		return nil, err
+	}
+	// Give each package of the replacements an alias, sorted for determinism
+	aliases := map[string]string{}
+	for _, rule := range compiled {
+		for _, part := range rule.parts {
+			if part.pkgPath != "" {
+				aliases[part.pkgPath] = ""
+			}
+		}
+	}
+	toPkgs := make([]string, 0, len(aliases))
+	for toPkg := range aliases {
+		toPkgs = append(toPkgs, toPkg)
+	}
+	sort.Strings(toPkgs)
+	for i, toPkg := range toPkgs {
+		aliases[toPkg] = fmt.Sprintf("__rewrite%v", i+1)
+	}
+
+	// Rewrite and add imports only for the packages used in each file
+	res := &superpose.TransformResult{AddLineDirectives: true, LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		patches, pkgPaths := rewriteFile(pkg, file, compiled, aliases)
+		for _, toPkg := range toPkgs {
+			if _, ok := pkgPaths[toPkg]; ok {
+				if err := res.AddImport(ctx, file, toPkg, aliases[toPkg]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		res.Patches = append(res.Patches, patches...)
+	}
+	res.Patches = MergeInserts(res.Patches)
+	return res, nil
+}
@@ -0,0 +1,133 @@
+package recipes
+
+import (
+	"go/ast"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+// LocalizeVars returns patches that make the given package variables of other
+// packages local to the dimension for the package. Variables are given by
+// package path and name, e.g. "os.Args" or "net/http.DefaultClient".
+//
+// Packages the dimension does not apply to are shared with code outside of the
+// dimension, and so are their variables. This declares a copy of each variable
+// that is initialized to the value of the original and replaces every qualified
+// reference in the package with a reference to the copy. The copy is shallow,
+// so values the variable points to are still shared. Each copy is declared at
+// the end of the first file referencing it. Dot-imported variables are not
+// supported.
+//
+// Variables of the package itself do not need to be localized since the package
+// is already compiled separately for the dimension.
+func LocalizeVars(pkg *superpose.TransformPackage, vars ...string) []*superpose.Patch {
+	inits := make(map[string]string, len(vars))
+	for _, v := range vars {
+		inits[v] = ""
+	}
+	return LocalizeVarsWithInit(pkg, inits)
+}
+
+// LocalizeVarsWithInit is [LocalizeVars] with variables keyed by name and the
+// value as an expression each copy is set to in an init function. If the
+// expression is empty, the copy is left as a copy of the original. The
+// expression is evaluated in the file the copy is declared in, so any imports
+// it needs must be added to that file. Since init functions run after all
+// package variables are initialized, other package variables that reference a
+// copy in their initializer see the original value.
+//
+// This is useful for variables whose values are mutable, like maps, where even
+// a copy would share state with the original.
+func LocalizeVarsWithInit(pkg *superpose.TransformPackage, inits map[string]string) []*superpose.Patch {
+	var patches []*superpose.Patch
+	declared := map[string]bool{}
+	for _, file := range pkg.Syntax {
+		fileDecls := map[string]string{}
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, _ := n.(*ast.SelectorExpr)
+			if sel == nil {
+				return true
+			}
+			pkgIdent, _ := sel.X.(*ast.Ident)
+			if pkgIdent == nil {
+				return true
+			} else if _, isPkg := pkg.TypesInfo.Uses[pkgIdent].(*types.PkgName); !isPkg {
+				return true
+			}
+			varObj, _ := pkg.TypesInfo.Uses[sel.Sel].(*types.Var)
+			if varObj == nil || varObj.Pkg() == nil {
+				return false
+			}
+			fullName := varObj.Pkg().Path() + "." + varObj.Name()
+			init, ok := inits[fullName]
+			if !ok {
+				return false
+			}
+			local := LocalVarName(fullName)
+			patches = append(patches, &superpose.Patch{Range: superpose.RangeOf(sel), Str: local})
+			// The declaration uses the same qualifier as the reference since we know
+			// the import is present in this file. Other files reference the original
+			// in a blank var in case it was the only use of the import.
+			if !declared[fullName] {
+				declared[fullName] = true
+				fileDecls[fullName] = "var " + local + " = " + pkgIdent.Name + "." + sel.Sel.Name
+				if init != "" {
+					fileDecls[fullName] += "; func init() { " + local + " = " + init + " }"
+				}
+			} else if fileDecls[fullName] == "" {
+				fileDecls[fullName] = "var _ = " + pkgIdent.Name + "." + sel.Sel.Name
+			}
+			return false
+		})
+		if len(fileDecls) > 0 {
+			decls := make([]string, 0, len(fileDecls))
+			for _, decl := range fileDecls {
+				decls = append(decls, decl)
+			}
+			sort.Strings(decls)
+			patches = append(patches, &superpose.Patch{
+				Range: superpose.Range{Pos: file.End()},
+				Str:   "; " + strings.Join(decls, "; "),
+			})
+		}
+	}
+	return patches
+}
+
+// LocalVarName returns the name of the local copy of the given package variable
+// used by [LocalizeVars].
+func LocalVarName(fullName string) string {
+	return "__local_" + identSafe(fullName)
+}
+
+// Replaces every character not valid in an identifier with an underscore
+func identSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// RedirectVars returns patches that replace every reference to a package
+// variable in the package with a dereferenced call of an accessor. The accessors
+// are keyed by variable package path and name, e.g. "os.Args", with an
+// expression for a function returning a pointer to the same type as the
+// variable, e.g. "__hooks.Args". A reference like "os.Args" then becomes
+// "(*__hooks.Args())" which can be read, assigned, and addressed the same way.
+//
+// This allows the accessor to decide which value each reference uses, for
+// example one per dimension or per goroutine. Like [RedirectFuncs], an insert
+// that references the original variable of each import is added to the end of
+// each file.
+func RedirectVars(pkg *superpose.TransformPackage, accessors map[string]string) []*superpose.Patch {
+	var patches []*superpose.Patch
+	for _, file := range pkg.Syntax {
+		patches = append(patches, redirectRefsInFile(pkg, file, nil, accessors)...)
+	}
+	return patches
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package superpose
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// Subprocesses can only be sandboxed on Linux, see [Config.Hermetic]
+func sandboxCommand(cmd *exec.Cmd) error {
+	return fmt.Errorf("hermetic mode cannot sandbox subprocess transformers on %v", runtime.GOOS)
+}
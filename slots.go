@@ -0,0 +1,76 @@
+package superpose
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+// Lock files for compile slots are in this directory of the system temp dir so
+// they are shared by every build on the machine
+const compileSlotDirName = "superpose-compile-slots"
+
+// Blocks until one of the compile slots shared across processes is locked, see
+// [Config.MaxConcurrentCompiles]. The result unlocks it.
+func (s *Superpose) acquireCompileSlot(ctx context.Context) (release func(), err error) {
+	limit := s.Config.MaxConcurrentCompiles
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	dir := filepath.Join(os.TempDir(), compileSlotDirName)
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, fmt.Errorf("failed creating compile slot dir: %w", err)
+	}
+
+	// File locks cannot be tried without blocking, so every slot is waited on at
+	// once and the first one locked is kept. The rest are unlocked as soon as
+	// they are locked or when this process exits.
+	var lock sync.Mutex
+	done := false
+	acquired := make(chan func(), 1)
+	errCh := make(chan error, limit)
+	for i := 0; i < limit; i++ {
+		go func(path string) {
+			unlock, err := lockedfile.MutexAt(path).Lock()
+			if err != nil {
+				errCh <- fmt.Errorf("failed locking compile slot %v: %w", path, err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if done {
+				unlock()
+				return
+			}
+			done = true
+			acquired <- unlock
+		}(filepath.Join(dir, "slot-"+strconv.Itoa(i)))
+	}
+	start := time.Now()
+	select {
+	case unlock := <-acquired:
+		if waited := time.Since(start); waited > time.Second {
+			s.Debugf("Waited %v for a compile slot", waited.Round(time.Millisecond))
+		}
+		return unlock, nil
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Give up, unlocking a slot that may have just been locked
+	lock.Lock()
+	done = true
+	lock.Unlock()
+	select {
+	case unlock := <-acquired:
+		unlock()
+	default:
+	}
+	return nil, err
+}
@@ -0,0 +1,159 @@
+package superpose
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Module path of the module in Config.SourceOutputDir when it has no go.mod yet
+const defaultSourceModulePath = "superpose.local/dimensions"
+
+// Writes the Go files the package was compiled from in the dimension to
+// Config.SourceOutputDir. Imports of the given original packages or their
+// dimension packages are rewritten to the dimension packages in the module.
+func (s *Superpose) writeDimensionSource(ctx *TransformContext, goFiles []string, origPkgs []string) error {
+	// Files cgo generates reference symbols only the go command provides
+	for _, goFile := range goFiles {
+		if strings.HasPrefix(filepath.Base(goFile), "_cgo_") {
+			s.Debugf("Not writing source of %v in dimension %v since it uses cgo", s.pkgPath, ctx.Dimension)
+			return nil
+		}
+	}
+	modulePath, err := s.sourceModulePath()
+	if err != nil {
+		return err
+	}
+	rewrites := make(map[string]string, len(origPkgs)*2)
+	for _, origPkg := range origPkgs {
+		dimPkgPath := s.DimensionPackagePath(origPkg, ctx.Dimension)
+		rewrites[origPkg] = modulePath + "/" + dimPkgPath
+		rewrites[dimPkgPath] = modulePath + "/" + dimPkgPath
+	}
+	// External test packages must be in the dir of the package they test
+	dir := filepath.Join(s.Config.SourceOutputDir,
+		filepath.FromSlash(s.DimensionPackagePath(s.pkgLoadPath(), ctx.Dimension)))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Files replaced by the overlay are named by the original file
+	origFiles := make(map[string]string, len(s.flags.overlay))
+	for origFile, replacement := range s.flags.overlay {
+		origFiles[replacement] = origFile
+	}
+	for _, goFile := range goFiles {
+		b, err := os.ReadFile(goFile)
+		if err != nil {
+			return err
+		}
+		if b, err = rewriteImports(goFile, b, rewrites); err != nil {
+			return err
+		}
+		name := filepath.Base(goFile)
+		if origFile, ok := origFiles[goFile]; ok {
+			name = filepath.Base(origFile)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, name), b); err != nil {
+			return err
+		}
+	}
+	s.Debugf("Wrote source of %v in dimension %v to %v", s.pkgPath, ctx.Dimension, dir)
+	return nil
+}
+
+// Gives the module path of the go.mod in Config.SourceOutputDir, creating it if
+// not present
+func (s *Superpose) sourceModulePath() (string, error) {
+	if err := os.MkdirAll(s.Config.SourceOutputDir, 0777); err != nil {
+		return "", err
+	}
+	goMod := filepath.Join(s.Config.SourceOutputDir, "go.mod")
+	content := "module " + defaultSourceModulePath + "\n"
+	// The language version of the module applies to every package, so the
+	// version of the compiler is used
+	if parts := strings.SplitN(strings.TrimPrefix(s.flags.goVersion, "go"), ".", 3); len(parts) >= 2 {
+		content += "\ngo " + parts[0] + "." + parts[1] + "\n"
+	}
+	// Other compiles may be creating it at the same time, so it is linked into
+	// place which fails if it exists
+	tmp, err := os.CreateTemp(s.Config.SourceOutputDir, "go.mod-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.WriteString(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), goMod)
+	}
+	os.Remove(tmp.Name())
+	if err == nil {
+		return defaultSourceModulePath, nil
+	} else if !errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("failed creating %v: %w", goMod, err)
+	}
+	b, err := os.ReadFile(goMod)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "module" {
+			if modulePath, err := strconv.Unquote(fields[1]); err == nil {
+				return modulePath, nil
+			}
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no module path in %v", goMod)
+}
+
+// Gives the file with import paths in the rewrites map replaced by their value
+func rewriteImports(goFile string, b []byte, rewrites map[string]string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, goFile, b, parser.ImportsOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %v: %w", goFile, err)
+	}
+	// Replace from the end so earlier offsets stay the same
+	for i := len(file.Imports) - 1; i >= 0; i-- {
+		lit := file.Imports[i].Path
+		pkgPath, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return nil, err
+		}
+		rewrite, ok := rewrites[pkgPath]
+		if !ok {
+			continue
+		}
+		start, end := fset.Position(lit.Pos()).Offset, fset.Position(lit.End()).Offset
+		b = append(b[:start:start], append([]byte(strconv.Quote(rewrite)), b[end:]...)...)
+	}
+	return b, nil
+}
+
+// Writes to a temp file in the same dir first so concurrent compiles writing
+// the same file, e.g. for a package and its test variant, never see it partly
+// written
+func writeFileAtomic(file string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package superpose
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Runs the function with os.Stdout replaced by a pipe so stray writes to it,
+// e.g. a transformer printing, cannot corrupt what is read from our stdout by Go
+// or by an executable composing this one. Each line of stray output is reported
+// on stderr instead. The function is given the original stdout to write to on
+// purpose.
+func guardStdout(f func(stdout *os.File) error) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed creating stdout guard: %w", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.Printf("Warning, stray write to stdout redirected to stderr: %s", scanner.Bytes())
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Warning, stray write to stdout redirected to stderr was not readable: %v", err)
+		}
+		// Drain whatever could not be scanned so writers never block
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	defer func() {
+		os.Stdout = stdout
+		w.Close()
+		<-done
+		r.Close()
+	}()
+	return f(stdout)
+}
@@ -0,0 +1,555 @@
+package superpose
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// SubprocessTransformer is a [Transformer] that delegates to an external
+// process. This allows transformers to be built and versioned independently of
+// the toolexec executable, and even to be written in other languages.
+//
+// The process is started on first use with the current working directory. It
+// receives newline-delimited JSON [SubprocessRequest] values on stdin and must
+// write a newline-delimited JSON [SubprocessResponse] to stdout for each, in
+// order. Only one request is sent at a time. Stderr of the process is the
+// stderr of the toolexec executable. Stdin is closed when Superpose is done, at
+// which point the process is expected to exit.
+//
+// Since packages transformed in a dimension are cached by [Config.Version], the
+// version should change whenever the process's transformations change.
+//
+// Go transformers can be run as a process with [ServeSubprocess].
+type SubprocessTransformer struct {
+	// Command is the executable and its arguments. Required.
+	Command []string
+
+	// Env is additional environment variables in "key=value" form for the
+	// process.
+	Env []string
+
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	enc    *json.Encoder
+	dec    *json.Decoder
+	lastID uint64
+	// Keyed by dimension then package path
+	applies map[string]map[string]bool
+}
+
+var _ Transformer = &SubprocessTransformer{}
+
+// NewSubprocessTransformer creates a [SubprocessTransformer] for the given
+// command.
+func NewSubprocessTransformer(command ...string) *SubprocessTransformer {
+	return &SubprocessTransformer{Command: command}
+}
+
+// SubprocessRequest is a request to a subprocess transformer. Exactly one of
+// the request fields besides ID is set.
+type SubprocessRequest struct {
+	// ID is a unique, increasing number for the request that must be on the
+	// response.
+	ID uint64 `json:"id"`
+
+	AppliesToPackage *SubprocessAppliesToPackageRequest `json:"appliesToPackage,omitempty"`
+	Transform        *SubprocessTransformRequest        `json:"transform,omitempty"`
+}
+
+// SubprocessAppliesToPackageRequest is the request form of
+// [Transformer.AppliesToPackage]. Responses are cached for the life of the
+// process.
+type SubprocessAppliesToPackageRequest struct {
+	Dimension string `json:"dimension"`
+	PkgPath   string `json:"pkgPath"`
+}
+
+// SubprocessTransformRequest is the request form of [Transformer.Transform].
+type SubprocessTransformRequest struct {
+	Dimension string `json:"dimension"`
+	PkgPath   string `json:"pkgPath"`
+	// PackageID is the ID of the package as given by "go list". This is
+	// different than the package path for test variants of packages.
+	PackageID string `json:"packageID"`
+	// PackageName is the name of the package.
+	PackageName string `json:"packageName"`
+	// GoFiles are absolute paths of the Go files being compiled. Patches can only
+	// reference these files.
+	GoFiles []string `json:"goFiles"`
+	// BuildTags are the comma-delimited build tags of the build if any.
+	BuildTags string `json:"buildTags,omitempty"`
+	// DimensionBuildTags are the comma-delimited build tags the package is loaded
+	// with for the dimension if any. This is BuildTags unless altered by
+	// [Config.DimensionBuildTags].
+	DimensionBuildTags string `json:"dimensionBuildTags,omitempty"`
+	// DimensionEnv are additional environment variables in "KEY=value" form the
+	// package is loaded with for the dimension if any. See [Config.DimensionEnv].
+	DimensionEnv []string `json:"dimensionEnv,omitempty"`
+	// Overlay are the absolute paths of replacement files keyed by the original
+	// files they replace from the go command's -overlay, if any. The package is
+	// loaded with the replacements.
+	Overlay map[string]string `json:"overlay,omitempty"`
+	// LangVersion is the Go language version the package is compiled with, if
+	// any. See [TransformPackage.LangVersion].
+	LangVersion string `json:"langVersion,omitempty"`
+	// GoVersion is the version of Go compiling the package, if any.
+	GoVersion string `json:"goVersion,omitempty"`
+	// OutputFile is the path of the original compiled archive of the package.
+	// See [TransformContext.OutputFile].
+	OutputFile string `json:"outputFile,omitempty"`
+	// DimensionOutputFile is the path of the archive the package is compiled to
+	// in the dimension. See [TransformContext.DimensionOutputFile].
+	DimensionOutputFile string `json:"dimensionOutputFile,omitempty"`
+	// ForTest is true if this package is being compiled for a test.
+	ForTest bool `json:"forTest,omitempty"`
+	// Verbose is true if the toolexec executable is in verbose mode.
+	Verbose bool `json:"verbose,omitempty"`
+	// Hermetic is true if the toolexec executable is in hermetic mode, see
+	// [Config.Hermetic].
+	Hermetic bool `json:"hermetic,omitempty"`
+}
+
+// SubprocessResponse is a response from a subprocess transformer. If Error is
+// empty, the response field corresponding to the request must be set.
+type SubprocessResponse struct {
+	// ID is the ID of the request this is for.
+	ID uint64 `json:"id"`
+
+	// Error is set if the request failed.
+	Error string `json:"error,omitempty"`
+
+	AppliesToPackage *SubprocessAppliesToPackageResponse `json:"appliesToPackage,omitempty"`
+	Transform        *SubprocessTransformResponse        `json:"transform,omitempty"`
+}
+
+// SubprocessAppliesToPackageResponse is the response to
+// [SubprocessAppliesToPackageRequest].
+type SubprocessAppliesToPackageResponse struct {
+	Applies bool `json:"applies"`
+}
+
+// SubprocessTransformResponse is the response to [SubprocessTransformRequest].
+// It is the same as [TransformResult] except patches use file offsets.
+type SubprocessTransformResponse struct {
+	Patches                   []*SubprocessPatch `json:"patches,omitempty"`
+	IncludeDependencyPackages []string           `json:"includeDependencyPackages,omitempty"`
+	AddFiles                  map[string][]byte  `json:"addFiles,omitempty"`
+	ExcludeFiles              []string           `json:"excludeFiles,omitempty"`
+	ReplaceFiles              map[string][]byte  `json:"replaceFiles,omitempty"`
+	AddLineDirectives         bool               `json:"addLineDirectives,omitempty"`
+	LogPatchedFiles           bool               `json:"logPatchedFiles,omitempty"`
+}
+
+// SubprocessPatch is a [Patch] to one of the Go files of a transform request.
+type SubprocessPatch struct {
+	// File is the Go file to patch. It must be one of the files in the request.
+	File     string                     `json:"file"`
+	Range    SubprocessRange            `json:"range"`
+	Captures map[string]SubprocessRange `json:"captures,omitempty"`
+	Str      string                     `json:"str"`
+}
+
+// SubprocessRange is a [Range] of byte offsets in a file. If End is 0/unset,
+// it is only the single offset at Offset.
+type SubprocessRange struct {
+	Offset int `json:"offset"`
+	End    int `json:"end,omitempty"`
+}
+
+// AppliesToPackage implements [Transformer.AppliesToPackage].
+func (s *SubprocessTransformer) AppliesToPackage(ctx *TransformContext, pkgPath string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if applies, ok := s.applies[ctx.Dimension][pkgPath]; ok {
+		return applies, nil
+	}
+	resp, err := s.request(ctx, &SubprocessRequest{
+		AppliesToPackage: &SubprocessAppliesToPackageRequest{Dimension: ctx.Dimension, PkgPath: pkgPath},
+	})
+	if err != nil {
+		return false, err
+	} else if resp.AppliesToPackage == nil {
+		return false, fmt.Errorf("subprocess missing applies to package response")
+	}
+	if s.applies == nil {
+		s.applies = map[string]map[string]bool{}
+	}
+	if s.applies[ctx.Dimension] == nil {
+		s.applies[ctx.Dimension] = map[string]bool{}
+	}
+	s.applies[ctx.Dimension][pkgPath] = resp.AppliesToPackage.Applies
+	return resp.AppliesToPackage.Applies, nil
+}
+
+// Transform implements [Transformer.Transform].
+func (s *SubprocessTransformer) Transform(ctx *TransformContext, pkg *TransformPackage) (*TransformResult, error) {
+	// Collect the files by name so patches can be converted to positions
+	files := make(map[string]*token.File, len(pkg.Syntax))
+	req := &SubprocessTransformRequest{
+		Dimension:           ctx.Dimension,
+		PkgPath:             pkg.PkgPath,
+		PackageID:           pkg.ID,
+		PackageName:         pkg.Name,
+		BuildTags:           ctx.Superpose.buildTags,
+		DimensionBuildTags:  ctx.Superpose.DimensionBuildTags(ctx.Dimension),
+		DimensionEnv:        ctx.Superpose.Config.DimensionEnv[ctx.Dimension],
+		Overlay:             ctx.Superpose.flags.overlay,
+		LangVersion:         pkg.LangVersion,
+		GoVersion:           pkg.GoVersion,
+		OutputFile:          ctx.OutputFile,
+		DimensionOutputFile: ctx.DimensionOutputFile,
+		ForTest:             ctx.Superpose.pkgForTest,
+		Verbose:             ctx.Superpose.Config.Verbose,
+		Hermetic:            ctx.Superpose.Config.Hermetic,
+	}
+	for _, file := range pkg.Syntax {
+		tokenFile := pkg.Fset.File(file.Pos())
+		files[tokenFile.Name()] = tokenFile
+		req.GoFiles = append(req.GoFiles, tokenFile.Name())
+	}
+
+	s.lock.Lock()
+	resp, err := s.request(ctx, &SubprocessRequest{Transform: req})
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	} else if resp.Transform == nil {
+		return nil, fmt.Errorf("subprocess missing transform response")
+	}
+
+	// Convert the response
+	res := &TransformResult{
+		AddFiles:          resp.Transform.AddFiles,
+		AddLineDirectives: resp.Transform.AddLineDirectives,
+		LogPatchedFiles:   resp.Transform.LogPatchedFiles,
+	}
+	if len(resp.Transform.IncludeDependencyPackages) > 0 {
+		res.IncludeDependencyPackages = make(map[string]struct{}, len(resp.Transform.IncludeDependencyPackages))
+		for _, depPkg := range resp.Transform.IncludeDependencyPackages {
+			res.IncludeDependencyPackages[depPkg] = struct{}{}
+		}
+	}
+	for _, file := range resp.Transform.ExcludeFiles {
+		if files[file] == nil {
+			return nil, fmt.Errorf("subprocess excluded unknown file %v", file)
+		} else if res.ExcludeFiles == nil {
+			res.ExcludeFiles = make(map[string]struct{}, len(resp.Transform.ExcludeFiles))
+		}
+		res.ExcludeFiles[file] = struct{}{}
+	}
+	for file := range resp.Transform.ReplaceFiles {
+		if files[file] == nil {
+			return nil, fmt.Errorf("subprocess replaced unknown file %v", file)
+		}
+	}
+	res.ReplaceFiles = resp.Transform.ReplaceFiles
+	for i, subPatch := range resp.Transform.Patches {
+		file := files[subPatch.File]
+		if file == nil {
+			return nil, fmt.Errorf("subprocess patch #%v references unknown file %v", i+1, subPatch.File)
+		}
+		filePatch := &FilePatch{File: subPatch.File, Range: subPatch.Range.fileRange(), Str: subPatch.Str}
+		if len(subPatch.Captures) > 0 {
+			filePatch.Captures = make(map[string]FileRange, len(subPatch.Captures))
+			for name, subRange := range subPatch.Captures {
+				filePatch.Captures[name] = subRange.fileRange()
+			}
+		}
+		patch, err := filePatch.patchIn(file)
+		if err != nil {
+			return nil, fmt.Errorf("subprocess patch #%v invalid: %w", i+1, err)
+		}
+		res.Patches = append(res.Patches, patch)
+	}
+	return res, nil
+}
+
+func (s SubprocessRange) fileRange() FileRange {
+	if s.End == 0 {
+		return FileRange{Offset: s.Offset}
+	}
+	// An end before the offset is a negative length, which is rejected
+	return FileRange{Offset: s.Offset, Length: s.End - s.Offset}
+}
+
+func newSubprocessRange(f FileRange) SubprocessRange {
+	if f.Length == 0 {
+		return SubprocessRange{Offset: f.Offset}
+	}
+	return SubprocessRange{Offset: f.Offset, End: f.Offset + f.Length}
+}
+
+// Close closes the process's stdin and waits for it to exit. This is called
+// automatically by Superpose when done.
+func (s *SubprocessTransformer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cmd == nil {
+		return nil
+	}
+	cmd := s.cmd
+	s.cmd = nil
+	s.stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("subprocess %v failed: %w", s.Command[0], err)
+	}
+	return nil
+}
+
+// Expects lock to be held
+func (s *SubprocessTransformer) request(ctx *TransformContext, req *SubprocessRequest) (*SubprocessResponse, error) {
+	if err := s.start(ctx.Superpose.Config.Hermetic); err != nil {
+		return nil, err
+	}
+	s.lastID++
+	req.ID = s.lastID
+	if err := s.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("failed sending request to subprocess %v: %w", s.Command[0], err)
+	}
+	var resp SubprocessResponse
+	if err := s.dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed reading response from subprocess %v: %w", s.Command[0], err)
+	} else if resp.ID != req.ID {
+		return nil, fmt.Errorf("subprocess %v responded with ID %v, expected %v", s.Command[0], resp.ID, req.ID)
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("subprocess %v failed: %v", s.Command[0], resp.Error)
+	}
+	return &resp, nil
+}
+
+// Expects lock to be held
+// Starts the process if not already started, without network access if
+// hermetic
+func (s *SubprocessTransformer) start(hermetic bool) error {
+	if s.cmd != nil {
+		return nil
+	} else if len(s.Command) == 0 {
+		return fmt.Errorf("subprocess command required")
+	}
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if hermetic {
+		if err := sandboxCommand(cmd); err != nil {
+			return err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		if hermetic {
+			return fmt.Errorf("failed starting subprocess %v in new user and network namespaces for hermetic mode: %w",
+				s.Command[0], err)
+		}
+		return fmt.Errorf("failed starting subprocess %v: %w", s.Command[0], err)
+	}
+	s.cmd, s.stdin = cmd, stdin
+	s.enc, s.dec = json.NewEncoder(stdin), json.NewDecoder(bufio.NewReader(stdout))
+	return nil
+}
+
+// RunSubprocessMain runs [ServeSubprocess] with stdin and stdout, exiting
+// with a non-zero code on failure. This is meant to be the only call in main of
+// an executable used as the command of a [SubprocessTransformer].
+func RunSubprocessMain(ctx context.Context, transformer Transformer) {
+	// Stdout is the protocol, so it is guarded against stray writes
+	err := guardStdout(func(stdout *os.File) error { return ServeSubprocess(ctx, transformer, os.Stdin, stdout) })
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ServeSubprocess handles [SubprocessRequest] values from r with the given
+// transformer and writes [SubprocessResponse] values to w until r is closed.
+// Packages for transform requests are loaded the same way Superpose loads them.
+//
+// The [TransformContext.Superpose] given to the transformer is only for
+// logging, most other calls will not work as expected.
+func ServeSubprocess(ctx context.Context, transformer Transformer, r io.Reader, w io.Writer) error {
+	dec, enc := json.NewDecoder(bufio.NewReader(r)), json.NewEncoder(w)
+	for {
+		var req SubprocessRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed reading request: %w", err)
+		}
+		resp := &SubprocessResponse{ID: req.ID}
+		var err error
+		switch {
+		case req.AppliesToPackage != nil:
+			resp.AppliesToPackage, err = serveAppliesToPackage(ctx, transformer, req.AppliesToPackage)
+		case req.Transform != nil:
+			resp.Transform, err = serveTransform(ctx, transformer, req.Transform)
+		default:
+			err = fmt.Errorf("unknown request")
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("failed writing response: %w", err)
+		}
+	}
+}
+
+func serveAppliesToPackage(
+	ctx context.Context,
+	transformer Transformer,
+	req *SubprocessAppliesToPackageRequest,
+) (*SubprocessAppliesToPackageResponse, error) {
+	s := &Superpose{}
+	applies, err := transformer.AppliesToPackage(
+		&TransformContext{Context: ctx, Superpose: s, Dimension: req.Dimension},
+		req.PkgPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SubprocessAppliesToPackageResponse{Applies: applies}, nil
+}
+
+func serveTransform(
+	ctx context.Context,
+	transformer Transformer,
+	req *SubprocessTransformRequest,
+) (*SubprocessTransformResponse, error) {
+	s := &Superpose{
+		Config:     Config{Verbose: req.Verbose, Hermetic: req.Hermetic},
+		buildTags:  req.BuildTags,
+		pkgForTest: req.ForTest,
+	}
+
+	// Load the package
+	packagesLogf := s.Debugf
+	if !s.Config.Verbose {
+		packagesLogf = nil
+	}
+	var buildFlags []string
+	if req.DimensionBuildTags != "" {
+		buildFlags = append(buildFlags, "-tags", req.DimensionBuildTags)
+	}
+	// Later values take precedence
+	var loadEnv []string
+	if len(req.DimensionEnv) > 0 {
+		loadEnv = append(os.Environ(), req.DimensionEnv...)
+	}
+	overlay, err := readOverlay(req.Overlay)
+	if err != nil {
+		return nil, err
+	}
+	// External test packages are loaded via the package under test
+	loadPath := req.PkgPath
+	testOf, _ := externalTestOf(req.PackageID)
+	if testOf != "" {
+		loadPath = testOf
+	}
+	pkgs, err := packages.Load(
+		&packages.Config{
+			Context:    ctx,
+			Env:        loadEnv,
+			Mode:       transformLoadMode,
+			Logf:       packagesLogf,
+			Tests:      s.pkgForTest,
+			BuildFlags: buildFlags,
+			Overlay:    overlay,
+		},
+		loadPath,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading package %v: %w", req.PkgPath, err)
+	}
+	var pkg *packages.Package
+	for _, maybePkg := range pkgs {
+		if maybePkg.ID == req.PackageID {
+			pkg = maybePkg
+			break
+		}
+	}
+	if pkg == nil {
+		return nil, fmt.Errorf("package %v not found", req.PackageID)
+	} else if len(pkg.Errors) > 0 {
+		return nil, fmt.Errorf("failed loading package %v: %v", req.PackageID, pkg.Errors[0])
+	}
+
+	// Transform
+	tctx := &TransformContext{
+		Context:             ctx,
+		Superpose:           s,
+		Dimension:           req.Dimension,
+		OutputFile:          req.OutputFile,
+		DimensionOutputFile: req.DimensionOutputFile,
+	}
+	if req.Hermetic {
+		tctx.hermetic = newHermeticScope(pkg)
+	}
+	res, err := transformer.Transform(
+		tctx,
+		&TransformPackage{
+			Package:        pkg,
+			LangVersion:    req.LangVersion,
+			GoVersion:      req.GoVersion,
+			ExternalTestOf: testOf,
+			overlay:        overlay,
+		},
+	)
+	// Violations fail the transform even if the transformer ignored them
+	if tctx.hermetic != nil {
+		if hermeticErr := tctx.hermetic.err(); hermeticErr != nil {
+			err = hermeticErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	filePatches, err := res.FilePatches(pkg.Fset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert the result
+	resp := &SubprocessTransformResponse{
+		AddFiles:          res.AddFiles,
+		ReplaceFiles:      res.ReplaceFiles,
+		AddLineDirectives: res.AddLineDirectives,
+		LogPatchedFiles:   res.LogPatchedFiles,
+	}
+	for depPkg := range res.IncludeDependencyPackages {
+		resp.IncludeDependencyPackages = append(resp.IncludeDependencyPackages, depPkg)
+	}
+	for file := range res.ExcludeFiles {
+		resp.ExcludeFiles = append(resp.ExcludeFiles, file)
+	}
+	for _, filePatch := range filePatches {
+		subPatch := &SubprocessPatch{
+			File:  filePatch.File,
+			Range: newSubprocessRange(filePatch.Range),
+			Str:   filePatch.Str,
+		}
+		if len(filePatch.Captures) > 0 {
+			subPatch.Captures = make(map[string]SubprocessRange, len(filePatch.Captures))
+			for name, r := range filePatch.Captures {
+				subPatch.Captures[name] = newSubprocessRange(r)
+			}
+		}
+		resp.Patches = append(resp.Patches, subPatch)
+	}
+	return resp, nil
+}
@@ -6,18 +6,27 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/cretz/superpose/buildinfo"
 	"github.com/rogpeppe/go-internal/cache"
+	"golang.org/x/tools/go/packages"
 )
 
 // Config is configuration for a [Superpose] instance.
@@ -37,24 +46,223 @@ type Config struct {
 
 	// Transformers are the set of transformers keyed by dimension name.
 	//
-	// At least one required.
+	// At least one transformer or transformer factory required.
 	Transformers map[string]Transformer
 
-	// Verbose, if true, will log many details during compilation.
+	// TransformerFactories are factories for transformers keyed by dimension
+	// name. Each is called once flags are parsed and the created transformer is
+	// added to Transformers. The dimension name cannot also be in Transformers.
+	//
+	// The options for each factory start as the options in TransformerOptions for
+	// the dimension. If a JSON file of options keyed by dimension name is given
+	// via the "-config" flag, any options present there replace those. Then, if
+	// given, the "-<dimension>.packages" flag of comma-delimited packages
+	// replaces the packages and the "-<dimension>.features" flag of
+	// comma-delimited features enables those features or disables them if
+	// prefixed with "-".
+	//
+	// Since options can alter the transformed code, a hash of all options is
+	// appended to Version.
+	TransformerFactories map[string]TransformerFactory
+
+	// TransformerOptions are the default options for TransformerFactories keyed
+	// by dimension name.
+	TransformerOptions map[string]TransformerOptions
+
+	// DimensionBuildTags are build tags keyed by dimension name that change which
+	// files of applicable packages are compiled in the dimension. Each tag is
+	// added to the build tags of the build, or removed from them if prefixed with
+	// "-". For example, adding "purego" to a dimension that applies to a package
+	// with assembly compiles its pure Go implementation in the dimension, so
+	// both implementations can be compared in the same binary.
+	//
+	// Only the files of packages the dimension applies to are reselected, the
+	// packages they depend on are still those of the build. Packages that have
+	// assembly or cgo files under the dimension's build tags are not supported.
+	// Since Go only knows about the files in the build, changing a file that is
+	// only compiled in the dimension does not invalidate the cached package, so
+	// the build must be forced (i.e. "-a" with ForceTransform).
+	DimensionBuildTags map[string][]string
+
+	// DimensionEnv are environment variables in "KEY=value" form keyed by
+	// dimension name that are set when loading the packages the dimension
+	// applies to. This is usually used to set GOOS and/or GOARCH to simulate
+	// another platform's implementation of packages, in which case the files are
+	// selected and the packages are type checked as if building for that
+	// platform.
+	//
+	// Like DimensionBuildTags, only the files of applicable packages are
+	// reselected and the caching caveats apply. The packages are still compiled
+	// for the build's platform against dependencies built for it, so
+	// transformers must patch away anything that only exists on the simulated
+	// platform. The recipes package has helpers for this, e.g. to inline
+	// constants whose values differ by platform.
+	DimensionEnv map[string][]string
+
+	// DimensionPathFunc, if set, returns the package path of the given original
+	// package path in the given dimension. The default appends "__" and the
+	// dimension name to the original path. The result must be a valid import path
+	// that is the same every time it is called with the same values and is unique
+	// for every package and dimension. A path that is the same as the original or
+	// a package already in the build fails compilation.
+	//
+	// The path is used for imports of dimension packages, so it appears in
+	// compiler diagnostics, stack traces, and type names. The crossdim and
+	// recipes/boundary packages assume the default. Since the path is not part of
+	// cache keys, Version must change whenever this changes.
+	DimensionPathFunc func(origPkg, dimension string) string
+
+	// ToolNameFunc, if set, returns the name of the Go tool at the given path,
+	// which is the first argument given to the toolexec. The default is
+	// [DefaultToolName]. Only tools named "compile" and "link" are intercepted,
+	// all others are run unaltered. This can be set for toolchains whose tools
+	// are not at their usual names, e.g. vendored toolchains that add a suffix.
+	//
+	// Only the gc toolchain is supported. A build fails if its "compile" or
+	// "link" tool does not report its version the way the gc tools do.
+	ToolNameFunc func(toolPath string) string
+
+	// ToolCommandHook, if set, is called with every compile and link command
+	// right before it is run, after Superpose has made all of its changes. This
+	// includes the compile of each package in each dimension and the compile or
+	// link Go asked for. The hook can alter the arguments, e.g. to add compiler
+	// flags only for packages in dimensions, or record the commands for audit.
+	// Flags must be added before the Go files of a compile, e.g. right after the
+	// executable. An error fails the build.
+	//
+	// The arguments are not part of cache keys, so Version must change whenever
+	// the hook's changes change.
+	ToolCommandHook func(cmd *ToolCommand) error
+
+	// Verbose, if true, will log many details during compilation. Overridden by
+	// SUPERPOSE_VERBOSE, see [Superpose.RunMain]. Identical lines are only
+	// logged once per tool invocation.
 	Verbose bool
 
+	// VerboseSummary, if true, will log a single line for each compile or link
+	// that compiles, takes from cache, or links dimension packages. It is meant
+	// to be used without Verbose on large builds. Overridden by
+	// SUPERPOSE_VERBOSE_SUMMARY, see [Superpose.RunMain].
+	VerboseSummary bool
+
 	// RetainTempDir, if true, will not delete the temporary directory on
-	// completion. Otherwise, the temporary directory is deleted each run.
+	// completion. Otherwise, the temporary directory is deleted each run, as are
+	// those over a day old that were left by killed processes. Overridden by
+	// SUPERPOSE_RETAIN_TEMP_DIR, see [Superpose.RunMain].
 	RetainTempDir bool
 
 	// BuildCacheDir is the cache directory to use for caching build output. The
-	// default is [os.UserCacheDir]()/superpose-build.
+	// default is [os.UserCacheDir]()/superpose-build. Overridden by
+	// SUPERPOSE_BUILD_CACHE_DIR, see [Superpose.RunMain].
 	BuildCacheDir string
 
 	// ForceTransform, if true, will always transform and compile dimension
 	// packages even if they are already cached. Note, this still uses/updates the
-	// cache, it just doesn't skip if already cached.
+	// cache, it just doesn't skip if already cached. Overridden by
+	// SUPERPOSE_FORCE_TRANSFORM, see [Superpose.RunMain].
 	ForceTransform bool
+
+	// AuditDimensionUsage, if true, fails linking a binary when a dimension is
+	// not referenced by any bridge function var or "<in>" bool var in the
+	// binary's packages, or when a package compiled in a dimension is not
+	// imported in the dimension, directly or indirectly, by a package that
+	// references it. Either usually means a transformer's AppliesToPackage gives
+	// the wrong packages or references are missing. Packages of the binary that
+	// a dimension applies to are listed and their source is scanned, so this
+	// makes linking slower. Overridden by SUPERPOSE_AUDIT_DIMENSION_USAGE, see
+	// [Superpose.RunMain].
+	AuditDimensionUsage bool
+
+	// CheckPackageMutation, if true, fails transforming a package when the
+	// transformer mutated the syntax of the package. Packages are loaded once
+	// and shared by the dimensions that use the same build tags and environment,
+	// so a mutation silently changes what later transformers are given. The
+	// syntax is fingerprinted before and after each transform, so this makes
+	// compiling slower and is meant for developing transformers. Overridden by
+	// SUPERPOSE_CHECK_PACKAGE_MUTATION, see [Superpose.RunMain].
+	CheckPackageMutation bool
+
+	// MaxConcurrentCompiles, if greater than 0, is the most dimension packages
+	// compiled at once across all toolexec processes on the machine. Go already
+	// runs as many compiles at once as there are CPUs, so each one also
+	// compiling dimension packages can oversubscribe the machine. Processes wait
+	// for one of this many lock files in the system temp dir before compiling a
+	// dimension package. Processes with different values share the same lock
+	// files, so the lowest value effectively applies to those. The default of 0
+	// is no limit. Overridden by SUPERPOSE_MAX_CONCURRENT_COMPILES, see
+	// [Superpose.RunMain].
+	MaxConcurrentCompiles int
+
+	// TransformTimeout, if greater than 0, is the longest a single call to
+	// [Transformer.Transform] may take. A transformer that takes longer fails
+	// the compile with a [TransformError] wrapping [ErrTransformTimeout] that
+	// names the package and dimension and has the stack of the goroutine the
+	// transformer is running on, so a transformer stuck in a loop does not hang
+	// the build. The context given to the transformer is also canceled at the
+	// timeout. The default of 0 is no timeout. Overridden by
+	// SUPERPOSE_TRANSFORM_TIMEOUT, as accepted by [time.ParseDuration], see
+	// [Superpose.RunMain].
+	TransformTimeout time.Duration
+
+	// Hermetic, if true, fails transforming a package when the transformer reads
+	// a file outside of the package's directory and its module or makes a
+	// network connection. This is meant for reviewing transformers from
+	// elsewhere. Go cannot intercept calls within the process, so it only
+	// applies to what transformers access through [TransformContext.ReadFile]
+	// and [TransformContext.DialContext]. [SubprocessTransformer] processes,
+	// including composed toolexecs, are also run without network access on
+	// Linux using new user and network namespaces, and cannot be run at all in
+	// this mode elsewhere. Overridden by SUPERPOSE_HERMETIC, see
+	// [Superpose.RunMain].
+	Hermetic bool
+
+	// StaticBridge, if true, sets bridge function vars with static initializers
+	// patched into their declarations instead of in a generated init function.
+	// The linker then drops vars that are never referenced along with the
+	// dimension functions only they reference, so unused bridges do not keep
+	// dimension code in the binary. The patched files are compiled in place of
+	// the originals with the same positions. Vars whose values are converted
+	// with the crossdim package are still set in an init function. Overridden by
+	// SUPERPOSE_STATIC_BRIDGE, see [Superpose.RunMain].
+	StaticBridge bool
+
+	// SourceOutputDir, if set, is a directory each package compiled in a
+	// dimension is also written to as Go source, so the dimension code can be
+	// reviewed or built without toolexec. The directory is a module with the
+	// module path from its go.mod, which is created with the module path
+	// "superpose.local/dimensions" if not present. Each package is written to the
+	// directory of its dimension package path, see
+	// [Superpose.DimensionPackagePath], with imports of dimension packages
+	// rewritten to those in the module.
+	//
+	// Other imports are left as is, so the module is meant to be built in a
+	// workspace with the modules of the original packages, e.g. after
+	// "go work use" of the directory. Dimension packages that import internal
+	// packages of other modules, e.g. of the standard library, cannot be built
+	// there. Packages that use cgo are not written. Files are overwritten but
+	// never removed.
+	//
+	// Dimension packages are always compiled instead of taken from the build
+	// cache when this is set, but the go command does not run the compiler for
+	// packages it has cached, so build with "-a" to write every package.
+	// Overridden by SUPERPOSE_SOURCE_OUTPUT_DIR, see [Superpose.RunMain].
+	SourceOutputDir string
+
+	// ComposedToolexecs are other Superpose toolexec executables, each followed
+	// by any toolexec flags for it, whose dimensions are also compiled by this
+	// one. Go only accepts a single "-toolexec", so this lets transformers that
+	// are built and versioned separately be used in the same build.
+	//
+	// Once flags are parsed, each executable is run with the "describe" command
+	// for its dimensions, version, and dimension build tags and environment. Its
+	// dimensions are then added to Transformers as a [SubprocessTransformer] that
+	// runs it with the "serve" command. Everything else, e.g. compiling, updating
+	// the importcfg, and caching, is done by this executable, so the
+	// DimensionPathFunc, ToolNameFunc, and ToolCommandHook of this config apply
+	// to all dimensions. A dimension cannot be in more than one executable.
+	//
+	// The versions of the executables are appended to Version.
+	ComposedToolexecs [][]string
 }
 
 // Superpose is an instance of the currently running toolexec.
@@ -65,10 +273,25 @@ type Superpose struct {
 	Config Config
 
 	buildTags   string
+	overlayFile string
 	pkgPath     string
 	pkgForTest  bool
+	// For an external test package, the package it tests
+	pkgTestOf   string
 	origCLIArgs []string
 	tool        string
+	// Toolexec flags before the tool
+	toolexecFlags []string
+	// Whether this is the toolexec executable, i.e. run via RunMain
+	runningToolexec bool
+	// The real stdout while os.Stdout is guarded in RunMain, use toolStdout()
+	stdout *os.File
+	// Packages compiled in dimensions by this instance
+	compiledArtifacts []*DimensionArtifact
+	// From SUPERPOSE_DISABLE
+	disabled bool
+	// From RunMainConfig.AdditionalFlags, keyed by name
+	additionalFlags map[string]flag.Value
 	// Only properly set after we know we're at the compile step
 	flags compileFlags
 	hash  hash.Hash
@@ -76,15 +299,27 @@ type Superpose struct {
 	_buildCache *cache.Cache
 	// Lazy, use depPkgActionIDs()
 	_depPkgActionIDs map[string][]byte
+	// Lazy per package, use dependencyPackages()
+	_dependencyPackages     map[string][]string
+	_dependencyPackagesLock sync.Mutex
 	// Lazy, use UseTempDir()
 	_tempDir string
+	// Debug lines already logged, up to maxDebugLines, and how many repeats of
+	// them were not
+	debugLines      map[string]struct{}
+	debugSuppressed int
+	debugLock       sync.Mutex
+	// Parts of the line logged for Config.VerboseSummary, use summarizef()
+	summary []string
 }
 
 // RunMainConfig is configuration for [RunMain].
 type RunMainConfig struct {
 	// AdditionalFlags, if set, are additional flags that can be passed to this
 	// toolexec. They are removed from the upstream arguments. This flag set is
-	// mutated internally to add superpose-specific flags.
+	// mutated internally to add superpose-specific flags. Transformers can get
+	// the parsed values with [FlagValue]. Since the values can change transformed
+	// code, they are part of the version.
 	AdditionalFlags *flag.FlagSet
 
 	// AfterFlagParse, if set, called once toolexec flags have been parsed. This
@@ -106,123 +341,604 @@ func RunMain(ctx context.Context, config Config, runConfig RunMainConfig) {
 func New(config Config) (*Superpose, error) {
 	if config.Version == "" {
 		return nil, fmt.Errorf("version required")
-	} else if len(config.Transformers) == 0 {
+	} else if len(config.Transformers) == 0 && len(config.TransformerFactories) == 0 &&
+		len(config.ComposedToolexecs) == 0 {
 		return nil, fmt.Errorf("at least one transformer required")
 	} else if sha256.Size != cache.HashSize {
 		return nil, fmt.Errorf("cache library no longer uses expected hash size")
 	}
-	s := &Superpose{
-		Config:  config,
-		pkgPath: os.Getenv("TOOLEXEC_IMPORTPATH"),
-		hash:    sha256.New(),
+	for dim := range config.TransformerFactories {
+		if _, ok := config.Transformers[dim]; ok {
+			return nil, fmt.Errorf("dimension %v has both a transformer and a transformer factory", dim)
+		}
+	}
+	for dim := range config.DimensionBuildTags {
+		_, isTransformer := config.Transformers[dim]
+		if _, isFactory := config.TransformerFactories[dim]; !isTransformer && !isFactory {
+			return nil, fmt.Errorf("build tags given for unknown dimension %v", dim)
+		}
+	}
+	for dim, env := range config.DimensionEnv {
+		_, isTransformer := config.Transformers[dim]
+		if _, isFactory := config.TransformerFactories[dim]; !isTransformer && !isFactory {
+			return nil, fmt.Errorf("environment given for unknown dimension %v", dim)
+		}
+		for _, kv := range env {
+			if !strings.Contains(kv, "=") {
+				return nil, fmt.Errorf("environment variable %q for dimension %v not in KEY=value form", kv, dim)
+			}
+		}
+	}
+	s := &Superpose{Config: config, hash: sha256.New()}
+	if err := s.setImportPath(os.Getenv("TOOLEXEC_IMPORTPATH")); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
+
+func (s *Superpose) setImportPath(importPath string) error {
+	s.pkgPath, s.pkgForTest = importPath, false
 	// The import path may be "foo [foo.test]" for tests, so we check that here.
 	// We have confirmed with Go impl that import paths cannot contain spaces.
 	spaceIndex := strings.Index(s.pkgPath, " ")
 	if spaceIndex > 0 {
 		if !strings.HasSuffix(s.pkgPath, ".test]") {
-			return nil, fmt.Errorf("assuming test because space in package path, but got %v", s.pkgPath)
+			return fmt.Errorf("assuming test because space in package path, but got %v", s.pkgPath)
 		}
 		s.pkgPath = s.pkgPath[:spaceIndex]
 		s.pkgForTest = true
+		s.pkgTestOf, _ = externalTestOf(importPath)
 	}
-	return s, nil
+	return nil
+}
+
+// Gives the package under test if the import path or package ID is for an
+// external test package, i.e. "foo_test [foo.test]". The external test package
+// cannot be loaded or listed by its own path, only via the package it tests.
+func externalTestOf(importPath string) (string, bool) {
+	spaceIndex := strings.Index(importPath, " ")
+	if spaceIndex < 0 {
+		return "", false
+	}
+	testOf := strings.TrimSuffix(strings.TrimPrefix(importPath[spaceIndex+1:], "["), ".test]")
+	if importPath[:spaceIndex] != testOf+"_test" {
+		return "", false
+	}
+	return testOf, true
+}
+
+// Gives the path to load or list the package by
+func (s *Superpose) pkgLoadPath() string {
+	if s.pkgTestOf != "" {
+		return s.pkgTestOf
+	}
+	return s.pkgPath
 }
 
 // RunMain runs this Superpose tool for the given args and config.
+//
+// Since build scripts may not allow changing the toolexec flags, the following
+// environment variables, if set, override the config. Boolean values are any
+// accepted by [strconv.ParseBool].
+//
+//   - SUPERPOSE_VERBOSE - Overrides [Config.Verbose]. The "-verbose" flag still
+//     enables it.
+//   - SUPERPOSE_VERBOSE_SUMMARY - Overrides [Config.VerboseSummary].
+//   - SUPERPOSE_BUILD_CACHE_DIR - Overrides [Config.BuildCacheDir].
+//   - SUPERPOSE_RETAIN_TEMP_DIR - Overrides [Config.RetainTempDir].
+//   - SUPERPOSE_FORCE_TRANSFORM - Overrides [Config.ForceTransform].
+//   - SUPERPOSE_AUDIT_DIMENSION_USAGE - Overrides [Config.AuditDimensionUsage].
+//   - SUPERPOSE_CHECK_PACKAGE_MUTATION - Overrides
+//     [Config.CheckPackageMutation].
+//   - SUPERPOSE_MAX_CONCURRENT_COMPILES - Overrides
+//     [Config.MaxConcurrentCompiles].
+//   - SUPERPOSE_TRANSFORM_TIMEOUT - Overrides [Config.TransformTimeout].
+//   - SUPERPOSE_HERMETIC - Overrides [Config.Hermetic].
+//   - SUPERPOSE_STATIC_BRIDGE - Overrides [Config.StaticBridge].
+//   - SUPERPOSE_SOURCE_OUTPUT_DIR - Overrides [Config.SourceOutputDir].
+//   - SUPERPOSE_DISABLE - If true, every tool is run unaltered as if there were
+//     no toolexec. No dimensions are compiled, so bridge variables are nil.
+//
+// Stdout is replaced while running since Go reads it from tools, so anything
+// else written to it, e.g. a transformer printing, is logged to stderr as a
+// warning instead.
+//
+// Interrupting or terminating the process cancels the context instead of
+// exiting immediately, so the tool being run is stopped and the temporary
+// directory is still removed.
 func (s *Superpose) RunMain(ctx context.Context, args []string, config RunMainConfig) error {
-	// Cleanup the cache on complete if it's present (meaning it was used)
-	defer func() {
-		if s._buildCache != nil {
-			s._buildCache.Trim()
-		}
-	}()
-
-	// Remove temp dir if present on complete and we're not retaining
-	defer func() {
-		if !s.Config.RetainTempDir && s._tempDir != "" {
-			if err := os.RemoveAll(s._tempDir); err != nil {
-				log.Printf("Warning, unable to remove temp dir %v", s._tempDir)
-			}
-		}
-	}()
+	defer s.Close()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Go reads the tool's stdout, as do executables composing this one, so it is
+	// guarded against stray writes, e.g. by transformers, and only written to on
+	// purpose
+	return guardStdout(func(stdout *os.File) error {
+		s.stdout = stdout
+		return s.runMain(ctx, args, config)
+	})
+}
 
+func (s *Superpose) runMain(ctx context.Context, args []string, config RunMainConfig) error {
 	// Set original args
 	s.origCLIArgs = args
+	s.runningToolexec = true
+
+	// Apply environment variables before flags so flags take precedence
+	if err := s.applyEnv(); err != nil {
+		return err
+	}
 
 	// Parse pre-tool args
 	var err error
-	if args, err = s.parseToolexecArgs(config, args); err != nil {
+	if args, err = s.parseToolexecArgs(ctx, config, args); err != nil {
 		return err
 	}
 
-	// Get import path and tool exe
-	_, s.tool = filepath.Split(args[0])
-	if runtime.GOOS == "windows" {
-		s.tool = strings.TrimSuffix(s.tool, ".exe")
+	// The doctor, artifacts, and manifest commands are run directly instead of by
+	// Go, as are the describe and serve commands used by other executables that
+	// compose this one
+	switch args[0] {
+	case "doctor":
+		return s.Doctor(ctx, s.stdout, args[1:]...)
+	case "artifacts":
+		return s.writeDimensionArtifacts(ctx, s.stdout, args[1:])
+	case "manifest":
+		return s.writeManifestFile(ctx, args[1:])
+	case "describe":
+		return s.writeComposedDescription(s.stdout)
+	case "serve":
+		return ServeSubprocess(ctx, &composedServer{s}, os.Stdin, s.stdout)
+	}
+
+	// Prepare and run the tool
+	inv, err := s.prepareTool(ctx, args)
+	if err != nil {
+		return err
+	} else if inv.Output != "" {
+		fmt.Fprintln(s.stdout, inv.Output)
+		return nil
 	}
+	if err := runTool(ctx, inv.Args, s.stdout); err != nil && ctx.Err() != nil {
+		return fmt.Errorf("interrupted running %v: %w", s.tool, err)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ToolInvocation is an invocation of a Go tool prepared by
+// [Superpose.PrepareTool].
+type ToolInvocation struct {
+	// Args are the tool executable and its arguments to run, which may have been
+	// altered.
+	Args []string
+
+	// Output, if not empty, is what the tool would print to stdout. The tool
+	// should not be run if this is set. This is set for Go's "-V=full" version
+	// check.
+	Output string
+
+	// Artifacts are the packages that were compiled in dimensions and put in the
+	// build cache while preparing, if any.
+	Artifacts []*DimensionArtifact
+}
+
+// ToolCommand is a compile or link command given to [Config.ToolCommandHook].
+type ToolCommand struct {
+	// Tool is "compile" or "link".
+	Tool string
+
+	// PkgPath is the original path of the package being compiled or linked.
+	PkgPath string
+
+	// Dimension is the dimension the package is being compiled in, or empty for
+	// the command Go asked for.
+	Dimension string
+
+	// OutputFile is the archive or executable the command writes, i.e. its "-o"
+	// when the hook is called. For a compile in a dimension, this is the same as
+	// [TransformContext.DimensionOutputFile]. Changing this does not change the
+	// args.
+	OutputFile string
+
+	// Args are the tool executable and its arguments. The hook can change them.
+	Args []string
+}
+
+// Gives the args to run after the hook, if any
+func (s *Superpose) hookToolCommand(dim string, args []string) ([]string, error) {
+	if s.Config.ToolCommandHook == nil {
+		return args, nil
+	}
+	cmd := &ToolCommand{Tool: s.tool, PkgPath: s.pkgPath, Dimension: dim, Args: args}
+	for i := 1; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			cmd.OutputFile = args[i+1]
+			break
+		}
+	}
+	if err := s.Config.ToolCommandHook(cmd); err != nil {
+		return nil, fmt.Errorf("tool command hook failed for %v of %v: %w", s.tool, s.pkgPath, err)
+	}
+	return cmd.Args, nil
+}
+
+// PrepareTool does everything [Superpose.RunMain] does to run a Go tool except
+// running it, instead returning the invocation to run. This lets other build
+// systems and tests use Superpose directly instead of via a toolexec
+// executable. The args are those given to a toolexec executable, i.e. any
+// toolexec flags followed by the tool executable and its arguments. The import
+// path is what Go sets as TOOLEXEC_IMPORTPATH for the tool, if anything.
+//
+// Like with toolexec, each instance is for a single tool invocation. Preparing
+// may still run tools, e.g. the compiler to compile packages in dimensions and
+// the tool itself for the version check. [Superpose.Close] must be called after
+// the invocation is run since it may reference temporary files.
+func (s *Superpose) PrepareTool(
+	ctx context.Context,
+	importPath string,
+	args []string,
+	config RunMainConfig,
+) (*ToolInvocation, error) {
+	if err := s.setImportPath(importPath); err != nil {
+		return nil, err
+	}
+	s.origCLIArgs = args
+	if err := s.applyEnv(); err != nil {
+		return nil, err
+	}
+	args, err := s.parseToolexecArgs(ctx, config, args)
+	if err != nil {
+		return nil, err
+	}
+	return s.prepareTool(ctx, args)
+}
+
+// Close cleans up this instance by closing transformers that implement
+// [io.Closer], removing the temporary directory unless [Config.RetainTempDir]
+// is set, and trimming the build cache. Failures are logged as warnings.
+// [Superpose.RunMain] calls this on completion.
+func (s *Superpose) Close() {
+	// Close transformers that need closing
+	for _, dim := range s.Dimensions() {
+		if closer, ok := s.Config.Transformers[dim].(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Warning, unable to close transformer for dimension %v: %v", dim, err)
+			}
+		}
+	}
+
+	// Remove temp dir if present and we're not retaining
+	if !s.Config.RetainTempDir && s._tempDir != "" {
+		if err := os.RemoveAll(s._tempDir); err != nil {
+			log.Printf("Warning, unable to remove temp dir %v", s._tempDir)
+		}
+	}
+
+	// Trim the cache if it's present (meaning it was used)
+	if s._buildCache != nil {
+		s._buildCache.Trim()
+	}
+
+	if s.debugSuppressed > 0 {
+		debugLog.Printf("Suppressed %v repeated debug lines", s.debugSuppressed)
+	}
+}
+
+// Expects the args to be after the toolexec flags
+func (s *Superpose) prepareTool(ctx context.Context, args []string) (*ToolInvocation, error) {
+	// When disabled, every tool including the version check is run unaltered, so
+	// the build is the same as one without toolexec
+	if s.disabled {
+		return &ToolInvocation{Args: args}, nil
+	}
+
+	// Get tool name
+	s.tool = s.toolName(args[0])
 
 	// Go uses -V=full at first, so handle just that
 	if len(args) == 2 && args[1] == "-V=full" {
-		return s.toolexecVersionFull(s.tool, args)
+		output, err := s.toolexecVersionFull(s.tool, args)
+		if err != nil {
+			return nil, err
+		}
+		return &ToolInvocation{Args: args, Output: output}, nil
 	}
 
 	// Henceforth, we expect a package
 	if s.pkgPath == "" {
-		return fmt.Errorf("no TOOLEXEC_IMPORTPATH env var")
+		return nil, fmt.Errorf("no TOOLEXEC_IMPORTPATH env var")
 	}
 
-	s.Debugf("Intercepting toolexec with import path %q and args: %v", os.Getenv("TOOLEXEC_IMPORTPATH"), args)
+	s.Debugf("Intercepting toolexec with import path %q and args: %v", s.pkgPath, args)
 	switch s.tool {
 	case "compile":
 		var err error
 		if args, err = s.onCompile(ctx, args); err != nil {
-			return err
+			return nil, err
 		}
 		s.Debugf("Updated compile args to %v", args)
 	case "link":
-		if err := s.onLink(ctx, args); err != nil {
-			return err
+		var err error
+		if args, err = s.onLink(ctx, args); err != nil {
+			return nil, err
 		}
+		s.Debugf("Updated link args to %v", args)
 	default:
 		s.Debugf("No interception needed for tool %v", s.tool)
+		return &ToolInvocation{Args: args}, nil
+	}
+	if len(s.summary) > 0 {
+		debugLog.Printf("Superpose %v of %v: %v", s.tool, s.pkgPath, strings.Join(s.summary, ", "))
 	}
+	args, err := s.hookToolCommand("", args)
+	if err != nil {
+		return nil, err
+	}
+	return &ToolInvocation{Args: args, Artifacts: s.compiledArtifacts}, nil
+}
 
-	// Run the command
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
+func runTool(ctx context.Context, args []string, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+// Overrides config from SUPERPOSE_* environment variables that are set. See
+// [Superpose.RunMain].
+func (s *Superpose) applyEnv() error {
+	boolVars := []struct {
+		name  string
+		field *bool
+	}{
+		{"SUPERPOSE_VERBOSE", &s.Config.Verbose},
+		{"SUPERPOSE_VERBOSE_SUMMARY", &s.Config.VerboseSummary},
+		{"SUPERPOSE_RETAIN_TEMP_DIR", &s.Config.RetainTempDir},
+		{"SUPERPOSE_FORCE_TRANSFORM", &s.Config.ForceTransform},
+		{"SUPERPOSE_AUDIT_DIMENSION_USAGE", &s.Config.AuditDimensionUsage},
+		{"SUPERPOSE_CHECK_PACKAGE_MUTATION", &s.Config.CheckPackageMutation},
+		{"SUPERPOSE_HERMETIC", &s.Config.Hermetic},
+		{"SUPERPOSE_STATIC_BRIDGE", &s.Config.StaticBridge},
+		{"SUPERPOSE_DISABLE", &s.disabled},
+	}
+	for _, boolVar := range boolVars {
+		if v := os.Getenv(boolVar.name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %v environment variable value %q, expected boolean", boolVar.name, v)
+			}
+			*boolVar.field = b
+		}
+	}
+	if dir := os.Getenv("SUPERPOSE_BUILD_CACHE_DIR"); dir != "" {
+		s.Config.BuildCacheDir = dir
+	}
+	if dir := os.Getenv("SUPERPOSE_SOURCE_OUTPUT_DIR"); dir != "" {
+		s.Config.SourceOutputDir = dir
+	}
+	if v := os.Getenv("SUPERPOSE_MAX_CONCURRENT_COMPILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid SUPERPOSE_MAX_CONCURRENT_COMPILES environment variable value %q, expected integer", v)
+		}
+		s.Config.MaxConcurrentCompiles = n
+	}
+	if v := os.Getenv("SUPERPOSE_TRANSFORM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SUPERPOSE_TRANSFORM_TIMEOUT environment variable value %q, expected duration", v)
+		}
+		s.Config.TransformTimeout = d
+	}
+	return nil
+}
+
 // UseTempDir returns the temporary directory for use during this process. The
 // temporary directory is usually deleted at the end of the run. The temporary
 // is lazily created when this is first called, hence the error result.
 func (s *Superpose) UseTempDir() (string, error) {
 	if s._tempDir == "" {
+		if !s.Config.RetainTempDir {
+			s.removeStaleTempDirs()
+		}
 		var err error
-		if s._tempDir, err = os.MkdirTemp("", "superpose-build-"); err != nil {
+		if s._tempDir, err = os.MkdirTemp("", tempDirPrefix); err != nil {
 			return "", err
 		}
 	}
 	return s._tempDir, nil
 }
 
-// Debugf logs a debug statement if verbose config is set.
+const tempDirPrefix = "superpose-build-"
+
+// Temp dirs older than this are assumed to be left by processes that were
+// killed before they could remove them, e.g. by the OOM killer
+const staleTempDirAge = 24 * time.Hour
+
+// Looking for stale temp dirs is throttled to this interval across processes
+// via the mod time of a marker file
+const staleTempDirCheckInterval = time.Hour
+
+func (s *Superpose) removeStaleTempDirs() {
+	tempDir := os.TempDir()
+	marker := filepath.Join(tempDir, tempDirPrefix+"stale-check")
+	if info, err := os.Stat(marker); err == nil && time.Since(info.ModTime()) < staleTempDirCheckInterval {
+		return
+	}
+	now := time.Now()
+	if err := os.WriteFile(marker, nil, 0666); err != nil {
+		s.Debugf("Unable to write stale temp dir marker %v: %v", marker, err)
+		return
+	} else if err := os.Chtimes(marker, now, now); err != nil {
+		s.Debugf("Unable to update stale temp dir marker %v: %v", marker, err)
+		return
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		s.Debugf("Unable to read temp dir %v: %v", tempDir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < staleTempDirAge {
+			continue
+		}
+		dir := filepath.Join(tempDir, entry.Name())
+		s.Debugf("Removing stale temp dir %v", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning, unable to remove stale temp dir %v: %v", dir, err)
+		}
+	}
+}
+
+// Dimensions returns the dimension names of all transformers in sorted order.
+// Anything derived from the transformers is computed in this order so builds
+// are the same across runs and machines.
+func (s *Superpose) Dimensions() []string {
+	return sortedKeys(s.Config.Transformers)
+}
+
+// BuildTags returns the comma-delimited build tags of the build, if any.
+func (s *Superpose) BuildTags() string {
+	return s.buildTags
+}
+
+// DimensionBuildTags returns the comma-delimited build tags that applicable
+// packages are compiled with in the given dimension. This is
+// [Superpose.BuildTags] altered by [Config.DimensionBuildTags].
+func (s *Superpose) DimensionBuildTags(dim string) string {
+	alterations := s.Config.DimensionBuildTags[dim]
+	if len(alterations) == 0 {
+		return s.buildTags
+	}
+	// Build tags can be comma or space delimited
+	tags := strings.FieldsFunc(s.buildTags, func(r rune) bool { return r == ',' || r == ' ' })
+	for _, alteration := range alterations {
+		tag := strings.TrimPrefix(alteration, "-")
+		n := 0
+		for _, existing := range tags {
+			if existing != tag {
+				tags[n] = existing
+				n++
+			}
+		}
+		tags = tags[:n]
+		if tag == alteration {
+			tags = append(tags, tag)
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+// Debugf logs a debug statement to stderr if verbose config is set. This never
+// writes to stdout, even if the standard logger's output has been changed.
 func (s *Superpose) Debugf(f string, v ...interface{}) {
-	if s.Config.Verbose {
-		log.Printf(f, v...)
+	if !s.Config.Verbose {
+		return
+	}
+	// Transformers often log the same line for every package they are asked
+	// about, so repeats are only counted and reported on close. Once enough
+	// lines are remembered, new ones are logged without being remembered.
+	line := fmt.Sprintf(f, v...)
+	s.debugLock.Lock()
+	defer s.debugLock.Unlock()
+	if _, logged := s.debugLines[line]; logged {
+		s.debugSuppressed++
+		return
+	}
+	if s.debugLines == nil {
+		s.debugLines = map[string]struct{}{}
+	}
+	if len(s.debugLines) < maxDebugLines {
+		s.debugLines[line] = struct{}{}
+	}
+	debugLog.Print(line)
+}
+
+// Most distinct debug lines remembered to suppress repeats of
+const maxDebugLines = 10000
+
+// Adds to the single line logged for the tool if Config.VerboseSummary is set
+func (s *Superpose) summarizef(f string, v ...interface{}) {
+	if s.Config.VerboseSummary {
+		s.debugLock.Lock()
+		defer s.debugLock.Unlock()
+		s.summary = append(s.summary, fmt.Sprintf(f, v...))
+	}
+}
+
+var debugLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// Stdout for tools run while preparing, which is the real stdout when guarded
+func (s *Superpose) toolStdout() io.Writer {
+	if s.stdout != nil {
+		return s.stdout
+	}
+	return os.Stdout
+}
+
+// DefaultToolName is the default for [Config.ToolNameFunc]. It is the file name
+// of the given path without an ".exe" extension on Windows.
+func DefaultToolName(toolPath string) string {
+	_, name := filepath.Split(toolPath)
+	if runtime.GOOS == "windows" {
+		name = strings.TrimSuffix(name, ".exe")
+	}
+	return name
+}
+
+// FlagValue returns the value of the flag with the given name in
+// [RunMainConfig.AdditionalFlags] as parsed from the toolexec arguments, or its
+// default if not given. This is how transformers are configured per build,
+// e.g. with ctx.Superpose in [Transformer.Transform]. The value is the result
+// of [flag.Getter.Get], which is the same type as the flag's variable for the
+// flag package's flag types, or the string form of the value if the flag is
+// not a [flag.Getter]. The result is false if there is no such flag or its
+// value is not a T.
+//
+// Values are only available in the process running [Superpose.RunMain], not
+// in subprocess transformers.
+func FlagValue[T any](s *Superpose, name string) (value T, ok bool) {
+	f := s.additionalFlags[name]
+	if f == nil {
+		return value, false
+	}
+	var v interface{} = f.String()
+	if getter, _ := f.(flag.Getter); getter != nil {
+		v = getter.Get()
+	}
+	value, ok = v.(T)
+	return
+}
+
+func (s *Superpose) toolName(toolPath string) string {
+	if s.Config.ToolNameFunc != nil {
+		return s.Config.ToolNameFunc(toolPath)
 	}
+	return DefaultToolName(toolPath)
 }
 
 // DimensionPackagePath returns the fully qualified package path for the given
-// package path in the given dimension.
+// package path in the given dimension. See [Config.DimensionPathFunc].
 func (s *Superpose) DimensionPackagePath(origPkg string, dimension string) string {
-	// Just delimit with two underscores for now
+	if s.Config.DimensionPathFunc != nil {
+		return s.Config.DimensionPathFunc(origPkg, dimension)
+	}
+	// Just delimit with two underscores by default
 	return origPkg + "__" + dimension
 }
 
-func (s *Superpose) parseToolexecArgs(runConfig RunMainConfig, args []string) (toolArgs []string, err error) {
+func (s *Superpose) parseToolexecArgs(
+	ctx context.Context,
+	runConfig RunMainConfig,
+	args []string,
+) (toolArgs []string, err error) {
 	// If there is not a flag set, create one
 	flags := runConfig.AdditionalFlags
 	if flags == nil {
@@ -231,12 +947,34 @@ func (s *Superpose) parseToolexecArgs(runConfig RunMainConfig, args []string) (t
 		return nil, fmt.Errorf("verbose flag reserved for internal use")
 	} else if flags.Lookup("buildtags") != nil {
 		return nil, fmt.Errorf("buildtags flag reserved for internal use")
+	} else if flags.Lookup("overlay") != nil {
+		return nil, fmt.Errorf("overlay flag reserved for internal use")
+	} else if flags.Lookup("config") != nil {
+		return nil, fmt.Errorf("config flag reserved for internal use")
 	}
 
-	// Accept `-verbose` and `-buildtags`
+	// Keep the additional flags before we add ours
+	s.additionalFlags = map[string]flag.Value{}
+	flags.VisitAll(func(f *flag.Flag) { s.additionalFlags[f.Name] = f.Value })
+
+	// Accept `-verbose`, `-buildtags`, `-overlay`, `-config`, and options for
+	// each factory
 	var verbose bool
 	flags.BoolVar(&verbose, "verbose", false, "verbose toolexec output")
 	flags.StringVar(&s.buildTags, "buildtags", "", "build tags")
+	flags.StringVar(&s.overlayFile, "overlay", "", "overlay file given to the go command")
+	var configFile string
+	flags.StringVar(&configFile, "config", "", "JSON file of transformer options keyed by dimension")
+	factoryFlags := make(map[string]*transformerOptionsFlags, len(s.Config.TransformerFactories))
+	for dim := range s.Config.TransformerFactories {
+		if flags.Lookup(dim+".packages") != nil || flags.Lookup(dim+".features") != nil {
+			return nil, fmt.Errorf("options flags for dimension %v reserved for internal use", dim)
+		}
+		factoryFlags[dim] = &transformerOptionsFlags{}
+		flags.Var(&factoryFlags[dim].packages, dim+".packages", "comma-delimited packages for dimension "+dim)
+		flags.Var(&factoryFlags[dim].features, dim+".features",
+			"comma-delimited features to enable, or disable if prefixed with -, for dimension "+dim)
+	}
 
 	// Find first arg that is not one of our toolexec flags
 	toolArgIndex := 0
@@ -262,34 +1000,167 @@ func (s *Superpose) parseToolexecArgs(runConfig RunMainConfig, args []string) (t
 		}
 	}
 	if toolArgIndex >= len(args) {
-		return nil, fmt.Errorf("no tool name found")
+		return nil, ErrNotToolexec
 	}
 
 	// Parse the flags
 	if err := flags.Parse(args[:toolArgIndex]); err != nil {
 		return nil, fmt.Errorf("failed parsing pre-tool toolexec flags: %w", err)
 	}
+	s.toolexecFlags = args[:toolArgIndex]
 
 	// Set internal flags
 	if verbose {
 		s.Config.Verbose = true
 	}
 
+	// Additional flag values are part of the version since they can change
+	// transformed code
+	if len(s.additionalFlags) > 0 {
+		s.hash.Reset()
+		for _, name := range sortedKeys(s.additionalFlags) {
+			fmt.Fprintf(s.hash, "%v=%q\n", name, s.additionalFlags[name].String())
+		}
+		s.Config.Version += "/" + base64.RawURLEncoding.EncodeToString(s.hash.Sum(nil)[:15])
+	}
+
 	// Run post-processor if present
 	if runConfig.AfterFlagParse != nil {
 		if err := runConfig.AfterFlagParse(&s.Config); err != nil {
 			return nil, err
 		}
 	}
+
+	// Create transformers from factories and composed toolexecs, which are unused
+	// if disabled
+	if s.disabled {
+		return args[toolArgIndex:], nil
+	} else if err := s.createFactoryTransformers(configFile, factoryFlags); err != nil {
+		return nil, err
+	} else if err := s.composeToolexecs(ctx); err != nil {
+		return nil, err
+	}
 	return args[toolArgIndex:], nil
 }
 
+func (s *Superpose) createFactoryTransformers(
+	configFile string,
+	factoryFlags map[string]*transformerOptionsFlags,
+) error {
+	if len(s.Config.TransformerFactories) == 0 {
+		if configFile != "" {
+			return fmt.Errorf("config file given, but there are no transformer factories")
+		}
+		return nil
+	}
+
+	// Load options from the config file
+	var fileOptions map[string]TransformerOptions
+	if configFile != "" {
+		b, err := os.ReadFile(configFile)
+		if err != nil {
+			return fmt.Errorf("failed reading config file: %w", err)
+		} else if err := json.Unmarshal(b, &fileOptions); err != nil {
+			return fmt.Errorf("failed parsing config file %v: %w", configFile, err)
+		}
+		for dim := range fileOptions {
+			if s.Config.TransformerFactories[dim] == nil {
+				return fmt.Errorf("config file %v has options for unknown dimension %v", configFile, dim)
+			}
+		}
+	}
+
+	// Build options and create each transformer. We copy the transformer map
+	// since it may be shared with the caller.
+	transformers := make(map[string]Transformer, len(s.Config.Transformers)+len(s.Config.TransformerFactories))
+	for dim, t := range s.Config.Transformers {
+		transformers[dim] = t
+	}
+	allOptions := make(map[string]TransformerOptions, len(s.Config.TransformerFactories))
+	for dim, factory := range s.Config.TransformerFactories {
+		options := s.Config.TransformerOptions[dim]
+		if fileOpts, ok := fileOptions[dim]; ok {
+			options = fileOpts
+		}
+		if flags := factoryFlags[dim]; flags != nil {
+			flags.apply(&options)
+		}
+		s.Debugf("Creating transformer for dimension %v with options %+v", dim, options)
+		t, err := factory(options)
+		if err != nil {
+			return fmt.Errorf("failed creating transformer for dimension %v: %w", dim, err)
+		}
+		transformers[dim] = t
+		allOptions[dim] = options
+	}
+	s.Config.Transformers = transformers
+
+	// Options are part of the version since they can change transformed code.
+	// JSON of maps is in sorted key order so this is deterministic.
+	b, err := json.Marshal(allOptions)
+	if err != nil {
+		return err
+	}
+	s.hash.Reset()
+	s.hash.Write(b)
+	s.Config.Version += "/" + base64.RawURLEncoding.EncodeToString(s.hash.Sum(nil)[:15])
+	return nil
+}
+
+type transformerOptionsFlags struct {
+	packages commaListFlag
+	features commaListFlag
+}
+
+func (t *transformerOptionsFlags) apply(options *TransformerOptions) {
+	if t.packages != nil {
+		options.Packages = t.packages
+	}
+	if len(t.features) > 0 {
+		// Copy the features since they may be shared with the config
+		features := make(map[string]bool, len(options.Features)+len(t.features))
+		for feature, enabled := range options.Features {
+			features[feature] = enabled
+		}
+		for _, feature := range t.features {
+			if strings.HasPrefix(feature, "-") {
+				features[strings.TrimPrefix(feature, "-")] = false
+			} else {
+				features[feature] = true
+			}
+		}
+		options.Features = features
+	}
+}
+
+// Flag value of comma-delimited values. Can be set multiple times to append.
+type commaListFlag []string
+
+func (c *commaListFlag) String() string { return strings.Join(*c, ",") }
+
+func (c *commaListFlag) Set(v string) error {
+	if *c == nil {
+		*c = []string{}
+	}
+	for _, piece := range strings.Split(v, ",") {
+		if piece = strings.TrimSpace(piece); piece != "" {
+			*c = append(*c, piece)
+		}
+	}
+	return nil
+}
+
 func (s *Superpose) onCompile(ctx context.Context, args []string) (newArgs []string, err error) {
 	// Parse flags
 	if err := s.flags.parse(args); err != nil {
 		return nil, err
 	}
 
+	// Check manifests before anything else so drift is reported first
+	if err := s.checkCompileManifests(ctx); err != nil {
+		return nil, err
+	}
+
 	// Compile dimensions
 	if err := s.compileDimensions(ctx); err != nil {
 		return nil, err
@@ -301,15 +1172,30 @@ func (s *Superpose) onCompile(ctx context.Context, args []string) (newArgs []str
 		return args, err
 	}
 
-	// Now that we know there is a bridge file, copy all the args and add bridge
-	// file to the end
+	// Now that we know there is a bridge file, copy all the args, replace files
+	// with static bridge vars, and add bridge file to the end
 	newArgs = make([]string, len(args)+1)
 	copy(newArgs, args)
 	newArgs[len(newArgs)-1] = bridgeFile.fileName
+	for goFile, patchedFile := range bridgeFile.patchedGoFiles {
+		newArgs[s.flags.goFileIndexes[goFile]] = patchedFile
+	}
+	// Put our rewrites before the existing ones since the first match is used
+	if len(bridgeFile.trimPathRewrites) > 0 {
+		trimPathRewrites := bridgeFile.trimPathRewrites
+		if newArgs[s.flags.trimPathIndex] != "" {
+			trimPathRewrites = append(trimPathRewrites, newArgs[s.flags.trimPathIndex])
+		}
+		newArgs[s.flags.trimPathIndex] = strings.Join(trimPathRewrites, ";")
+	}
 
 	// Update import cfg to include the dimension package references
 	if importCfg, err := s.loadImportCfg(newArgs[s.flags.importCfgIndex]); err != nil {
 		return nil, fmt.Errorf("failed loading import cfg for bridge: %w", err)
+	} else if bridgeFile.usesCrossDim && !importCfg.hasPkgFile(crossDimPkg) {
+		// We can't include it ourselves because the linker wouldn't know about it
+		return nil, fmt.Errorf("bridge functions in package %v convert values across dimensions, "+
+			"so the package must import %v", s.pkgPath, crossDimPkg)
 	} else if err := importCfg.updateDimPkgRefs(bridgeFile.dimPkgRefs, false); err != nil {
 		return nil, fmt.Errorf("failed updating dim package refs in bridge import cfg: %w", err)
 	} else if err := importCfg.writeFile(newArgs[s.flags.importCfgIndex]); err != nil {
@@ -322,7 +1208,7 @@ func (s *Superpose) onCompile(ctx context.Context, args []string) (newArgs []str
 	return newArgs, nil
 }
 
-func (s *Superpose) onLink(ctx context.Context, args []string) error {
+func (s *Superpose) onLink(ctx context.Context, args []string) ([]string, error) {
 	// Go over every package file in the import cfg and add entries for every
 	// missing dimension reference.
 
@@ -335,52 +1221,66 @@ func (s *Superpose) onLink(ctx context.Context, args []string) error {
 		}
 	}
 	if importCfgFile == "" {
-		return fmt.Errorf("no import cfg file for link")
+		return nil, fmt.Errorf("no import cfg file for link")
 	}
 	importCfg, err := s.loadImportCfg(importCfgFile)
 	if err != nil {
-		return fmt.Errorf("failed loading link import cfg: %w", err)
+		return nil, fmt.Errorf("failed loading link import cfg: %w", err)
 	}
 
-	// Walk every line, collecting dimension equivalents
-	dimPkgRefs := dimPkgRefs{}
+	// Collect the packages, then whether each dimension applies to them
+	var origPkgPaths []string
 	for _, line := range importCfg.lines {
 		if !strings.HasPrefix(line, "packagefile ") {
 			continue
 		}
-		origPkgPath := strings.TrimPrefix(line[:strings.Index(line, "=")], "packagefile ")
-		// Do not include the ".test" special package
-		// TODO(cretz): What if there's a legit ".test" package?
-		if strings.HasSuffix(origPkgPath, ".test") {
+		origPkgPath, pkgFile, _ := strings.Cut(strings.TrimPrefix(line, "packagefile "), "=")
+		// Do not include the main package Go generates for a test binary, which is
+		// the package file the link is given
+		if pkgFile == args[len(args)-1] && strings.HasSuffix(origPkgPath, ".test") {
 			continue
 		}
-		for dim, t := range s.Config.Transformers {
-			// Confirm applies
-			applies, err := t.AppliesToPackage(
-				&TransformContext{Context: ctx, Superpose: s, Dimension: dim}, origPkgPath)
-			if err != nil {
-				return fmt.Errorf("failed determining whether package %v applies during link: %w", origPkgPath, err)
-			} else if !applies {
+		origPkgPaths = append(origPkgPaths, origPkgPath)
+	}
+	dimApplies := make(map[string][]bool, len(s.Config.Transformers))
+	for _, dim := range s.Dimensions() {
+		if dimApplies[dim], err = s.appliesToPackages(ctx, dim, origPkgPaths); err != nil {
+			return nil, fmt.Errorf("failed determining which packages dimension %v applies to during link: %w", dim, err)
+		}
+	}
+	if s.Config.AuditDimensionUsage {
+		if err := s.auditDimensionUsage(ctx, origPkgPaths, dimApplies); err != nil {
+			return nil, err
+		}
+	}
+
+	// Walk every package, collecting dimension equivalents
+	dimPkgRefs := dimPkgRefs{}
+	info := &buildinfo.Info{Version: s.Config.Version, Packages: map[string][]string{}}
+	for i, origPkgPath := range origPkgPaths {
+		for _, dim := range s.Dimensions() {
+			if !dimApplies[dim][i] {
 				continue
 			}
 
 			// Load metadata for the package
 			actionID, err := s.dimDepPkgActionID(origPkgPath, dim)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			metadata, err := s.getDimPkgMetadata(actionID)
 			if err != nil {
-				return fmt.Errorf("failed getting metadata for package %v in dimension %v: %w", origPkgPath, dim, err)
+				return nil, fmt.Errorf("failed getting metadata for package %v in dimension %v: %w", origPkgPath, dim, err)
 			}
 
-			// Add the reference to import cfg
+			// Add the reference to import cfg and build info
 			dimPkgRefs.addRef(origPkgPath, dim)
+			info.Packages[origPkgPath] = append(info.Packages[origPkgPath], dim)
 
 			// Include dependent packages
 			for _, depPkg := range metadata.IncludeDependencyPackages {
-				if err := importCfg.includePkg(depPkg); err != nil {
-					return fmt.Errorf("failed including dependent %v package for package %v in dimension %v: %w",
+				if err := importCfg.includePkg(ctx, depPkg); err != nil {
+					return nil, fmt.Errorf("failed including dependent %v package for package %v in dimension %v: %w",
 						depPkg, origPkgPath, dim, err)
 				}
 			}
@@ -390,11 +1290,68 @@ func (s *Superpose) onLink(ctx context.Context, args []string) error {
 	// If there are any dimension references, update import cfg
 	if len(dimPkgRefs) > 0 {
 		if err := importCfg.updateDimPkgRefs(dimPkgRefs, false); err != nil {
-			return fmt.Errorf("failed updating dim package refs for link: %w", err)
+			return nil, fmt.Errorf("failed updating dim package refs for link: %w", err)
+		} else if err := importCfg.writeFile(importCfgFile); err != nil {
+			return nil, err
+		}
+		linked := 0
+		for _, pkgDims := range info.Packages {
+			linked += len(pkgDims)
 		}
-		return importCfg.writeFile(importCfgFile)
+		s.summarizef("linked %v dimension packages", linked)
 	}
-	return nil
+
+	// Set the build info if the binary has the package, including in the
+	// dimension equivalents of it
+	if importCfg.hasPkgFile(buildInfoPkgPath) {
+		dims := map[string]struct{}{}
+		for _, pkgDims := range info.Packages {
+			for _, dim := range pkgDims {
+				dims[dim] = struct{}{}
+			}
+		}
+		info.Dimensions = sortedKeys(dims)
+		b, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		buildInfoArgs := []string{"-X", buildInfoPkgPath + ".encoded=" + string(b)}
+		for _, dim := range info.Packages[buildInfoPkgPath] {
+			buildInfoArgs = append(buildInfoArgs,
+				"-X", s.DimensionPackagePath(buildInfoPkgPath, dim)+".encoded="+string(b))
+		}
+		// Flags must be before the main package file
+		args = append(append([]string{args[0]}, buildInfoArgs...), args[1:]...)
+	}
+	return args, nil
+}
+
+const buildInfoPkgPath = "github.com/cretz/superpose/buildinfo"
+
+// Uses the batch form if the dimension's transformer is a BatchTransformer
+func (s *Superpose) appliesToPackages(ctx context.Context, dim string, pkgPaths []string) ([]bool, error) {
+	transformer := s.Config.Transformers[dim]
+	tctx := &TransformContext{Context: ctx, Superpose: s, Dimension: dim}
+	if batch, ok := transformer.(BatchTransformer); ok {
+		applies, err := batch.AppliesToPackages(tctx, pkgPaths)
+		if err != nil {
+			return nil, &TransformError{Dimension: dim, Err: err}
+		} else if len(applies) != len(pkgPaths) {
+			return nil, &TransformError{
+				Dimension: dim,
+				Err:       fmt.Errorf("got %v results for %v packages", len(applies), len(pkgPaths)),
+			}
+		}
+		return applies, nil
+	}
+	applies := make([]bool, len(pkgPaths))
+	for i, pkgPath := range pkgPaths {
+		var err error
+		if applies[i], err = transformer.AppliesToPackage(tctx, pkgPath); err != nil {
+			return nil, &TransformError{PkgPath: pkgPath, Dimension: dim, Err: err}
+		}
+	}
+	return applies, nil
 }
 
 func (s *Superpose) dimDepPkgActionID(origPkg string, dim string) ([]byte, error) {
@@ -434,22 +1391,127 @@ func (s *Superpose) dimDepPkgFile(origPkg string, dim string) (string, error) {
 	// from the package build ID
 	file, _, err := cache.GetFile(s.buildActionIDToCacheActionID(actionID))
 	if err != nil {
-		return "", fmt.Errorf("failed getting action ID for pkg %v in dimension %v: %w", origPkg, dim, err)
+		return "", fmt.Errorf("package %v in dimension %v %w: %v", origPkg, dim, ErrNotCached, err)
+	}
+	// The metadata is put in cache after the package, so the package is not
+	// complete without it, e.g. if compilation was interrupted in between
+	if _, err := s.getDimPkgMetadata(actionID); err != nil {
+		return "", fmt.Errorf("failed getting metadata for pkg %v in dimension %v: %w", origPkg, dim, err)
 	}
 	return file, nil
 }
 
-// Errors or gives string file, never empty string with no error
-func (s *Superpose) pkgFile(pkgPath string) (string, error) {
-	args := []string{"list", "-f", "{{.Export}}", "-export"}
+// Gives the "-toolexec" value that runs this executable with the same toolexec
+// flags
+func (s *Superpose) toolexecCommandLine() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed getting executable: %w", err)
+	}
+	// The go command splits on spaces, but allows fields to be single or double
+	// quoted without escapes
+	fields := append([]string{exePath}, s.toolexecFlags...)
+	for i, field := range fields {
+		if !strings.ContainsAny(field, " \t\n\r'\"") {
+			continue
+		} else if !strings.Contains(field, "'") {
+			fields[i] = "'" + field + "'"
+		} else if !strings.Contains(field, "\"") {
+			fields[i] = "\"" + field + "\""
+		} else {
+			return "", fmt.Errorf("toolexec argument %v cannot have both single and double quotes", field)
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// Flags for "go list" so it gives the same action IDs as the build
+func (s *Superpose) goListFlags() []string {
+	var flags []string
+	if s.buildTags != "" {
+		flags = append(flags, "-tags", s.buildTags)
+	}
+	if s.overlayFile != "" {
+		flags = append(flags, "-overlay", s.overlayFile)
+	}
+	return flags
+}
+
+// Gives the package and all of its transitive dependencies, except unsafe which
+// has no compiled form, for TransformResult.IncludeDependencyPackages. Cached
+// since transformers usually add the same imports for every package. Included
+// packages are built for the build, not the dimension, so they are loaded with
+// the build's tags and environment instead of Config.DimensionBuildTags or
+// Config.DimensionEnv.
+func (s *Superpose) dependencyPackages(ctx context.Context, pkgPath string) ([]string, error) {
+	s._dependencyPackagesLock.Lock()
+	defer s._dependencyPackagesLock.Unlock()
+	if deps, ok := s._dependencyPackages[pkgPath]; ok {
+		return deps, nil
+	}
+	var buildFlags []string
 	if s.buildTags != "" {
-		args = append(args, "-tags", s.buildTags)
+		buildFlags = append(buildFlags, "-tags", s.buildTags)
 	}
-	args = append(args, pkgPath)
-	cmd := exec.Command("go", args...)
-	b, err := cmd.CombinedOutput()
+	pkgs, err := packages.Load(
+		&packages.Config{
+			Context:    ctx,
+			Mode:       packages.NeedName | packages.NeedImports | packages.NeedDeps,
+			BuildFlags: buildFlags,
+		},
+		pkgPath,
+	)
 	if err != nil {
-		return "", fmt.Errorf("failed getting export for %v: %w. Output: %s", pkgPath, err, b)
+		return nil, fmt.Errorf("failed loading dependencies of %v: %w", pkgPath, err)
+	}
+	var deps []string
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if len(pkg.Errors) > 0 && err == nil {
+			err = fmt.Errorf("failed loading dependency package %v: %v", pkg.PkgPath, pkg.Errors[0])
+		} else if pkg.PkgPath != "unsafe" {
+			deps = append(deps, pkg.PkgPath)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(deps)
+	if s._dependencyPackages == nil {
+		s._dependencyPackages = map[string][]string{}
+	}
+	s._dependencyPackages[pkgPath] = deps
+	return deps, nil
+}
+
+// Set on the go command that builds a package transformers include to the
+// package path, so the toolexec in that build does not start builds of its own
+const includingDependencyEnv = "SUPERPOSE_INCLUDING_DEPENDENCY"
+
+// Gives the package file of a package transformers include, building it if it
+// is not built yet. When running as the toolexec executable, the package is
+// built with this executable as the toolexec the same way the build would
+// compile it. Errors or gives string file, never empty string with no error.
+func (s *Superpose) pkgFile(ctx context.Context, pkgPath string) (string, error) {
+	args := append([]string{"list", "-f", "{{.Export}}", "-export"}, s.goListFlags()...)
+	cmd := exec.CommandContext(ctx, "go")
+	// Builds of included packages only use this toolexec one level deep, since a
+	// package in that build may include the same package
+	if s.runningToolexec && os.Getenv(includingDependencyEnv) == "" {
+		toolexec, err := s.toolexecCommandLine()
+		if err != nil {
+			return "", err
+		}
+		s.Debugf("Building dependency package %v if needed with toolexec %v", pkgPath, toolexec)
+		args = append(args, "-toolexec", toolexec)
+		cmd.Env = append(os.Environ(), includingDependencyEnv+"="+pkgPath)
+	}
+	cmd.Args = append(cmd.Args, append(args, pkgPath)...)
+	// Only stdout has the file, the toolexec may log to stderr
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed getting export for %v: %w. Output: %s", pkgPath, err, stderr.Bytes())
 	}
 	ret := strings.TrimSpace(string(b))
 	if ret == "" {
@@ -469,7 +1531,7 @@ func (s *Superpose) getDimPkgMetadata(actionID []byte) (*dimPkgMetadata, error)
 	}
 	b, _, err := cache.GetBytes(s.dimPkgMetadataCacheID(actionID))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("metadata %w: %v", ErrNotCached, err)
 	}
 	var metadata dimPkgMetadata
 	if err := json.Unmarshal(b, &metadata); err != nil {
@@ -509,14 +1571,9 @@ func (s *Superpose) buildActionIDToCacheActionID(buildActionID []byte) (cacheAct
 
 func (s *Superpose) buildCache() (*cache.Cache, error) {
 	if s._buildCache == nil {
-		// Use subdir of user cache dir if not set
-		cacheDir := s.Config.BuildCacheDir
-		if cacheDir == "" {
-			userCacheDir, err := os.UserCacheDir()
-			if err != nil {
-				return nil, fmt.Errorf("failed getting user cache dir: %w", err)
-			}
-			cacheDir = filepath.Join(userCacheDir, "superpose-build")
+		cacheDir, err := s.buildCacheDir()
+		if err != nil {
+			return nil, err
 		}
 		// Create the dir if not present
 		if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
@@ -524,7 +1581,6 @@ func (s *Superpose) buildCache() (*cache.Cache, error) {
 				return nil, fmt.Errorf("failed creating cache dir: %w", err)
 			}
 		}
-		var err error
 		if s._buildCache, err = cache.Open(cacheDir); err != nil {
 			return nil, fmt.Errorf("failed opening build cache at %v: %w", cacheDir, err)
 		}
@@ -532,128 +1588,171 @@ func (s *Superpose) buildCache() (*cache.Cache, error) {
 	return s._buildCache, nil
 }
 
+func (s *Superpose) buildCacheDir() (string, error) {
+	if s.Config.BuildCacheDir != "" {
+		return s.Config.BuildCacheDir, nil
+	}
+	// Use subdir of user cache dir if not set
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed getting user cache dir: %w", err)
+	}
+	return filepath.Join(userCacheDir, "superpose-build"), nil
+}
+
+// Gives the action IDs of this package and every package in its import config
+// keyed by package path. They are read from the build ID Go gives the compiler
+// and the build IDs Go puts in each compiled package, so they are always those
+// of the build, even for test variants and packages of files given on the
+// command line, without asking "go list".
 func (s *Superpose) depPkgActionIDs() (map[string][]byte, error) {
 	if s._depPkgActionIDs == nil {
-		// Use "go list" to get action IDs for this package and every dependency.
-		// During compile, pkgPath is a legit package path, but during link
-		// sometimes it is not (sometimes it "command-line-arguments" or the test
-		// package). So during link we use importcfg to know dependents.
-		// TODO(cretz): Why not change to always using importcfg?
-		args := []string{"list", "-f", "{{.ImportPath}}|{{.BuildID}}", "-export"}
-		if s.buildTags != "" {
-			args = append(args, "-tags", s.buildTags)
-		}
-		if s.pkgPath != "command-line-arguments" {
-			pkgPath, forTest := s.pkgPath, s.pkgForTest
-			if strings.HasSuffix(pkgPath, ".test") {
-				pkgPath, forTest = strings.TrimSuffix(pkgPath, ".test"), true
-			}
-			if forTest {
-				args = append(args, "-test")
-			}
-			args = append(args, "-deps", pkgPath)
-		} else {
-			// We want to ignore missing packages here since link has some
-			// dependencies that are not real packages
-			args = append(args, "-e")
-			// TODO(cretz): Cache since this is reused by link
-			// TODO(cretz): Or better yet, just rework this code
-			var importCfgFile string
-			for i, arg := range s.origCLIArgs {
-				if arg == "-importcfg" {
-					importCfgFile = s.origCLIArgs[i+1]
-					break
-				}
-			}
-			if importCfgFile == "" {
-				return nil, fmt.Errorf("no import cfg file for link")
-			}
-			importCfg, err := s.loadImportCfg(importCfgFile)
-			if err != nil {
-				return nil, fmt.Errorf("failed loading link import cfg: %w", err)
-			}
-			for _, line := range importCfg.lines {
-				if !strings.HasPrefix(line, "packagefile ") {
-					continue
-				}
-				pkgPath := strings.TrimPrefix(line[:strings.Index(line, "=")], "packagefile ")
-				args = append(args, pkgPath)
+		var importCfgFile string
+		for i, arg := range s.origCLIArgs {
+			if arg == "-importcfg" && i+1 < len(s.origCLIArgs) {
+				importCfgFile = s.origCLIArgs[i+1]
+				break
 			}
 		}
-
-		s.Debugf("Getting dependent package action IDs via go command with args %v", args)
-		cmd := exec.Command("go", args...)
-		b, err := cmd.CombinedOutput()
+		if importCfgFile == "" {
+			return nil, fmt.Errorf("no import cfg file for %v", s.tool)
+		}
+		importCfg, err := s.loadImportCfg(importCfgFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed listing packages: %w. Output: %s", err, b)
-		}
-		// Go over each line, breaking out the action ID and the package path
-		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
-		pkgActionIDs := make(map[string][]byte, len(lines))
-		for _, line := range lines {
-			lastPipe := strings.LastIndex(line, "|")
-			if lastPipe < 0 {
-				return nil, fmt.Errorf("invalid list line: %v", line)
-			}
-			afterPipeSlash := strings.Index(line[lastPipe:], "/")
-			// If there is no slash, there is no action ID
-			if afterPipeSlash < 0 {
+			return nil, fmt.Errorf("failed loading %v import cfg: %w", s.tool, err)
+		}
+		pkgActionIDs := map[string][]byte{}
+		for _, line := range importCfg.lines {
+			if !strings.HasPrefix(line, "packagefile ") {
 				continue
 			}
-			afterPipeSlash += lastPipe
-			pkgActionID, err := base64.RawURLEncoding.DecodeString(line[lastPipe+1 : afterPipeSlash])
-			if err != nil {
-				return nil, fmt.Errorf("invalid action ID: %w, list line: %v", err, line)
+			pkgPath, pkgFile, _ := strings.Cut(strings.TrimPrefix(line, "packagefile "), "=")
+			if pkgActionIDs[pkgPath], err = readPkgFileActionID(pkgFile); err != nil {
+				return nil, fmt.Errorf("failed reading action ID of package %v: %w", pkgPath, err)
 			}
-			pkgPath := line[:lastPipe]
-			// The pkg path may be in the form of "foo [foo.test]", so we must remove
-			// the bracketed part
-			spaceIndex := strings.Index(pkgPath, " ")
-			if spaceIndex > 0 {
-				if !strings.HasSuffix(pkgPath, ".test]") {
-					return nil, fmt.Errorf("assuming test because space in package path, but got %v", pkgPath)
-				}
-				pkgPath = pkgPath[:spaceIndex]
+		}
+		// The package being compiled is not compiled yet, but Go gives its build ID
+		if s.tool == "compile" {
+			if pkgActionIDs[s.pkgPath], err = parseBuildIDActionID(s.flags.args[s.flags.buildIDIndex]); err != nil {
+				return nil, fmt.Errorf("invalid compile build ID: %w", err)
 			}
-			pkgActionIDs[pkgPath] = pkgActionID
 		}
+		s.Debugf("Read action IDs of %v packages from import cfg %v", len(pkgActionIDs), importCfgFile)
 		s._depPkgActionIDs = pkgActionIDs
 	}
 	return s._depPkgActionIDs, nil
 }
 
-func (s *Superpose) toolexecVersionFull(tool string, args []string) error {
+// Reads the action ID of the build ID the compiler puts in the header of the
+// package file, i.e. the same build ID "go list -export" gives for the package.
+// Files whose header does not have it where expected, e.g. from a future Go, are
+// given to "go tool buildid" instead.
+func readPkgFileActionID(file string) ([]byte, error) {
+	buildID, err := readPkgFileHeaderBuildID(file)
+	if err != nil {
+		return nil, err
+	} else if buildID == "" {
+		cmd := exec.Command("go", "tool", "buildid", file)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed getting build ID of %v: %w. Output: %s", file, err, stderr.Bytes())
+		}
+		buildID = strings.TrimSpace(string(b))
+	}
+	return parseBuildIDActionID(buildID)
+}
+
+// Gives the build ID in the header of a package archive or object file, or
+// empty if it is not in a known place
+func readPkgFileHeaderBuildID(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// The header is at the start of an object file and of the first entry of an
+	// archive, which is well within this size
+	b := make([]byte, 1024)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	b = b[:n]
+	if !bytes.HasPrefix(b, []byte("!<arch>\n")) && !bytes.HasPrefix(b, []byte("go object ")) {
+		return "", nil
+	}
+	const buildIDPrefix = "\nbuild id \""
+	start := bytes.Index(b, []byte(buildIDPrefix))
+	if start < 0 {
+		return "", nil
+	}
+	start += len(buildIDPrefix) - 1
+	end := bytes.Index(b[start+1:], []byte("\"\n"))
+	if end < 0 {
+		return "", nil
+	}
+	buildID, err := strconv.Unquote(string(b[start : start+end+2]))
+	if err != nil {
+		return "", fmt.Errorf("invalid build ID in header of %v: %w", file, err)
+	}
+	return buildID, nil
+}
+
+// Gives the decoded action ID of a slash-delimited build ID
+func parseBuildIDActionID(buildID string) ([]byte, error) {
+	actionID, _, ok := strings.Cut(buildID, "/")
+	if !ok {
+		return nil, fmt.Errorf("no action ID in build ID %v", buildID)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(actionID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid action ID in build ID %v: %w", buildID, err)
+	}
+	return b, nil
+}
+
+func (s *Superpose) toolexecVersionFull(tool string, args []string) (string, error) {
 	// Go build uses the results of this to know whether to recompile. This is
 	// usually to Go compiler version. We add the user version and our version to
 	// this. Some of this code taken from Garble.
 
 	// Get Go's tool ID
 	goOutLine, goToolID, err := loadGoToolID(tool, args)
-	if err != nil {
-		return err
+	if errors.Is(err, errUnrecognizedToolVersion) && tool != "compile" && tool != "link" {
+		// Tools we don't intercept are run unaltered, so their version can be too
+		s.Debugf("Passing through unrecognized version of tool %v: %v", tool, goOutLine)
+		return goOutLine, nil
+	} else if errors.Is(err, errUnrecognizedToolVersion) {
+		return "", fmt.Errorf("%w, only the gc toolchain's compile and link tools are supported: %v", ErrUnsupportedTool, err)
+	} else if err != nil {
+		return "", err
 	}
 
 	// Get this exe's content ID
 	exeContentID, err := LoadCurrentExeContentID()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Build a hash of slash-delimited Go tool ID + this executable's content ID +
-	// user version
-	// TODO(cretz): What about additional flags here?
+	// user version (which includes factory options and additional flags)
 	s.hash.Reset()
 	s.hash.Write(goToolID)
 	s.hash.Write([]byte("/superpose/"))
 	s.hash.Write([]byte(exeContentID))
 	s.hash.Write([]byte("/"))
 	s.hash.Write([]byte(s.Config.Version))
+	// Static bridge vars change how the original packages are compiled
+	if s.Config.StaticBridge {
+		s.hash.Write([]byte("/static-bridge"))
+	}
 	// Go only allows a certain size
 	contentID := base64.RawURLEncoding.EncodeToString(s.hash.Sum(nil)[:15])
 
 	// Append content ID as end of fake build ID
-	fmt.Printf("%s +superpose buildID=_/_/_/%s\n", goOutLine, contentID)
-	return nil
+	return fmt.Sprintf("%s +superpose buildID=_/_/_/%s", goOutLine, contentID), nil
 }
 
 type compileFlags struct {
@@ -661,6 +1760,15 @@ type compileFlags struct {
 	args                                                               []string
 	outputIndex, trimPathIndex, pkgIndex, buildIDIndex, importCfgIndex int
 	goFileIndexes                                                      map[string]int
+	// Language version from -lang and Go version from -goversion, either empty
+	// if not given
+	lang, goVersion string
+	// Replacement Go files from the go command's -overlay keyed by original file
+	overlay map[string]string
+	// Lazy, use overlayContents()
+	_overlayContents map[string][]byte
+	// Lazy, use goFileArg() and overlayReplacement(), keyed by comparablePath
+	_comparableGoFiles, _comparableOverlay map[string]string
 }
 
 func (c *compileFlags) parse(args []string) error {
@@ -680,7 +1788,21 @@ func (c *compileFlags) parse(args []string) error {
 			c.buildIDIndex = i + 1
 		case "-importcfg":
 			c.importCfgIndex = i + 1
+		case "-lang":
+			if i+1 < len(args) {
+				c.lang = args[i+1]
+			}
+		case "-goversion":
+			if i+1 < len(args) {
+				c.goVersion = args[i+1]
+			}
 		default:
+			// The go command gives -lang in "=" form, so support both forms for these
+			if strings.HasPrefix(arg, "-lang=") {
+				c.lang = strings.TrimPrefix(arg, "-lang=")
+			} else if strings.HasPrefix(arg, "-goversion=") {
+				c.goVersion = strings.TrimPrefix(arg, "-goversion=")
+			}
 			// Even if not a file but happens to have this suffix, harmless to store
 			// in map anyways
 			if strings.HasSuffix(arg, ".go") {
@@ -701,9 +1823,135 @@ func (c *compileFlags) parse(args []string) error {
 	case c.importCfgIndex == 0:
 		return fmt.Errorf("missing -importcfg")
 	}
+	c.parseOverlay()
 	return nil
 }
 
+// The go command does not give the compiler its -overlay. Instead, it gives the
+// replacement of each Go file and adds a -trimpath rewrite from the replacement
+// to the original file in the rewritten package dir. The package dir is the
+// absolute dir unless -trimpath was given to the go command, in which case
+// there is also a rewrite from the absolute dir to it.
+func (c *compileFlags) parseOverlay() {
+	c.overlay = map[string]string{}
+	// Keyed by rewritten dir, value is the absolute dir
+	dirs := map[string]string{}
+	var fileRewrites [][2]string
+	for _, rewrite := range strings.Split(c.args[c.trimPathIndex], ";") {
+		i := strings.LastIndex(rewrite, "=>")
+		if i < 0 || i+len("=>") == len(rewrite) {
+			continue
+		}
+		from, to := rewrite[:i], rewrite[i+len("=>"):]
+		if _, ok := c.goFileArg(from); ok {
+			fileRewrites = append(fileRewrites, [2]string{from, to})
+		} else {
+			dirs[filepath.Clean(filepath.FromSlash(to))] = from
+		}
+	}
+	for _, rewrite := range fileRewrites {
+		origDir := filepath.Dir(rewrite[1])
+		if dir, ok := dirs[origDir]; ok {
+			origDir = dir
+		}
+		c.overlay[filepath.Join(origDir, filepath.Base(rewrite[1]))] = rewrite[0]
+	}
+}
+
+// Index of the Go file in the compile args, which is its replacement if it is
+// in the overlay
+func (c *compileFlags) goFileIndex(file string) (int, bool) {
+	if replacement, ok := c.overlayReplacement(file); ok {
+		file = replacement
+	}
+	goFile, ok := c.goFileArg(file)
+	if !ok {
+		return 0, false
+	}
+	return c.goFileIndexes[goFile], true
+}
+
+// Go file in the compile args for the given file, which may be spelled
+// differently than the go command gave it to the compiler, e.g. in another case
+// on Windows
+func (c *compileFlags) goFileArg(file string) (string, bool) {
+	if _, ok := c.goFileIndexes[file]; ok {
+		return file, true
+	}
+	if c._comparableGoFiles == nil {
+		c._comparableGoFiles = make(map[string]string, len(c.goFileIndexes))
+		for goFile := range c.goFileIndexes {
+			c._comparableGoFiles[comparablePath(goFile)] = goFile
+		}
+	}
+	goFile, ok := c._comparableGoFiles[comparablePath(file)]
+	return goFile, ok
+}
+
+// Replacement of the given file in the overlay, if any, where the file may be
+// spelled differently than in the overlay
+func (c *compileFlags) overlayReplacement(file string) (string, bool) {
+	origFile, ok := c.overlayFile(file)
+	return c.overlay[origFile], ok
+}
+
+// Original file in the overlay for the given file, which may be spelled
+// differently than in the overlay
+func (c *compileFlags) overlayFile(file string) (string, bool) {
+	if _, ok := c.overlay[file]; ok || len(c.overlay) == 0 {
+		return file, ok
+	}
+	if c._comparableOverlay == nil {
+		c._comparableOverlay = make(map[string]string, len(c.overlay))
+		for origFile := range c.overlay {
+			c._comparableOverlay[comparablePath(origFile)] = origFile
+		}
+	}
+	origFile, ok := c._comparableOverlay[comparablePath(file)]
+	return origFile, ok
+}
+
+// The given file as the go command spells it for the compiler, e.g. in the
+// unresolved dir of a module behind a symlink, or the file as is if it is not
+// compiled. This is what -trimpath rewrites are for.
+func (c *compileFlags) argSpelling(file string) string {
+	if origFile, ok := c.overlayFile(file); ok {
+		return origFile
+	} else if goFile, ok := c.goFileArg(file); ok {
+		return goFile
+	}
+	return file
+}
+
+// Contents of the replacement Go files keyed by original file
+func (c *compileFlags) overlayContents() (map[string][]byte, error) {
+	if c._overlayContents == nil {
+		contents, err := readOverlay(c.overlay)
+		if err != nil {
+			return nil, err
+		}
+		c._overlayContents = contents
+	}
+	return c._overlayContents, nil
+}
+
+// Reads the replacement files of the given overlay, keeping the same keys
+func readOverlay(overlay map[string]string) (map[string][]byte, error) {
+	contents := make(map[string][]byte, len(overlay))
+	for file, replacement := range overlay {
+		b, err := os.ReadFile(replacement)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading overlay file %v: %w", replacement, err)
+		}
+		contents[file] = b
+	}
+	return contents, nil
+}
+
+var errUnrecognizedToolVersion = errors.New("unrecognized tool version")
+
+// Line is always set if the tool ran, even if the error is
+// errUnrecognizedToolVersion
 func loadGoToolID(tool string, args []string) (line string, b []byte, err error) {
 	// Most of this taken from Garble
 	cmd := exec.Command(args[0], args[1:]...)
@@ -716,9 +1964,10 @@ func loadGoToolID(tool string, args []string) (line string, b []byte, err error)
 	}
 	line = string(bytes.TrimSpace(b))
 	f := strings.Fields(line)
-	if len(f) < 3 || f[0] != tool || f[1] != "version" ||
+	// The gc tools give their own file name which may differ from the tool name
+	if len(f) < 3 || (f[0] != tool && f[0] != DefaultToolName(args[0])) || f[1] != "version" ||
 		(f[2] == "devel" && !strings.HasPrefix(f[len(f)-1], "buildID=")) {
-		return "", nil, fmt.Errorf("%s -V=full: unexpected output:\n\t%s", args[0], line)
+		return line, nil, fmt.Errorf("%w from %s -V=full:\n\t%s", errUnrecognizedToolVersion, args[0], line)
 	}
 	if f[2] == "devel" {
 		// On the development branch, use the content ID part of the build ID.
@@ -770,6 +2019,15 @@ func loadCurrentExeContentID() (string, error) {
 		}
 		return "", err
 	}
-	buildID := string(out)
+	buildID := strings.TrimSpace(string(out))
 	return buildID[strings.LastIndex(buildID, "/")+1:], nil
 }
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,22 +1,90 @@
 package superpose_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/cretz/superpose"
+	"golang.org/x/tools/go/packages"
 )
 
 type test struct {
 	dir       string
 	buildTags []string
+	// Additional flags given to the toolexec
+	toolexecFlags []string
+	// Replacement files keyed by original file, both relative to the test dir
+	overlay map[string]string
+	// Additional environment variables for the go command, e.g. SUPERPOSE_*
+	env []string
+	// Additional flags for the go test command
+	testFlags []string
+	// Run from a symlink to the repo, so the paths the go command gives are not
+	// the resolved ones
+	symlink bool
+	// If set, the go test command is expected to fail with this in its output
+	expectFailure string
+	// If set, called with the output of a successful go test command
+	checkOutput func(t *testing.T, out string)
 }
 
 var tests = []test{
 	{dir: "simple"},
 	{dir: "simple", buildTags: []string{"some_build_tag"}},
+	{dir: "simple", env: []string{"SUPERPOSE_STATIC_BRIDGE=1"}},
+	{dir: "simple", symlink: true},
+	{
+		dir: "simple",
+		env: []string{"SUPERPOSE_VERBOSE=0", "SUPERPOSE_VERBOSE_SUMMARY=1"},
+		// Tools must run to log, so the test result cannot be cached
+		testFlags:   []string{"-count=1"},
+		checkOutput: checkVerboseSummary,
+	},
+	{dir: "addfiles"},
+	{dir: "badpatch", expectFailure: "main_test.go:5:29: invalid syntax at line 5 of the patched file after patch with"},
+	{dir: "audit"},
+	{dir: "batch"},
+	{dir: "boundary"},
+	{dir: "buildinfo"},
+	{dir: "buildtags"},
+	{dir: "chain"},
+	{dir: "compose"},
+	{dir: "copyonly"},
+	{dir: "cover"},
+	{dir: "cover", testFlags: []string{"-cover"}},
+	{dir: "dimpath"},
+	{dir: "external"},
+	{dir: "flags", toolexecFlags: []string{"-greeting=hi", "-repeat=2"}},
+	{dir: "includedep"},
+	{dir: "langversion"},
+	{dir: "linedirective"},
+	{dir: "manifest"},
+	{dir: "offsetpatch"},
+	{dir: "overlay", overlay: map[string]string{"value.go": "testdata/value.go"}},
+	{dir: "redirect"},
+	{dir: "redirect", env: []string{"SUPERPOSE_CHECK_PACKAGE_MUTATION=1", "SUPERPOSE_TRANSFORM_TIMEOUT=5m"}},
+	{dir: "replace"},
+	{dir: "decorate"},
+	{dir: "rewrite"},
+	// The go command does not compile cached packages, so their source would not
+	// be written
+	{dir: "source", testFlags: []string{"-a"}},
+	{dir: "subprocess"},
+	{dir: "subprocess", env: []string{"SUPERPOSE_HERMETIC=1"}},
+	{dir: "toolhook"},
+	{dir: "xtest"},
 }
 
 func TestSuperpose(t *testing.T) {
@@ -31,6 +99,594 @@ func TestSuperpose(t *testing.T) {
 	}
 }
 
+func TestPrepareTool(t *testing.T) {
+	b, err := exec.Command("go", "env", "GOTOOLDIR").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toolDir := strings.TrimSpace(string(b))
+	toolPath := func(tool string) string {
+		if runtime.GOOS == "windows" {
+			tool += ".exe"
+		}
+		return filepath.Join(toolDir, tool)
+	}
+	prepare := func(importPath string, args ...string) *superpose.ToolInvocation {
+		s, err := superpose.New(superpose.Config{
+			Version:      "test",
+			Transformers: map[string]superpose.Transformer{"noop": noopTransformer{}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		inv, err := s.PrepareTool(context.Background(), importPath, args, superpose.RunMainConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv
+	}
+
+	// The version check gives output instead of running the tool
+	inv := prepare("", toolPath("compile"), "-V=full")
+	if !strings.HasPrefix(inv.Output, "compile version ") || !strings.Contains(inv.Output, " +superpose buildID=") {
+		t.Fatalf("unexpected version output %q", inv.Output)
+	}
+
+	// Tools that are not intercepted are unaltered
+	args := []string{toolPath("asm"), "-p", "example.com/foo", "foo.s"}
+	inv = prepare("example.com/foo", args...)
+	if inv.Output != "" || strings.Join(inv.Args, " ") != strings.Join(args, " ") || len(inv.Artifacts) > 0 {
+		t.Fatalf("unexpected invocation %+v", inv)
+	}
+}
+
+func TestDebugf(t *testing.T) {
+	// Debug lines go to the process's stderr, so this test runs itself again to
+	// capture them
+	if os.Getenv("SUPERPOSE_TEST_DEBUGF") == "1" {
+		s, err := superpose.New(superpose.Config{
+			Version:      "test",
+			Transformers: map[string]superpose.Transformer{"noop": noopTransformer{}},
+			Verbose:      true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			s.Debugf("Checking package %v", "example.com/foo")
+			s.Debugf("Checking package %v", "example.com/bar")
+		}
+		s.Close()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDebugf$")
+	cmd.Env = append(os.Environ(), "SUPERPOSE_TEST_DEBUGF=1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed running test again: %v, stderr:\n----\n%s\n----", err, stderr.String())
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		// Remove the date and time
+		if fields := strings.SplitN(line, " ", 3); len(fields) == 3 {
+			lines = append(lines, fields[2])
+		}
+	}
+	expected := []string{
+		"Checking package example.com/foo",
+		"Checking package example.com/bar",
+		"Suppressed 4 repeated debug lines",
+	}
+	if !reflect.DeepEqual(expected, lines) {
+		t.Fatalf("expected debug lines %q, got:\n----\n%s\n----", expected, stderr.String())
+	}
+}
+
+func TestGenerateBridge(t *testing.T) {
+	s, err := superpose.New(superpose.Config{
+		Version:      "test",
+		Transformers: map[string]superpose.Transformer{"dim": pkgTransformer("example.com/foo")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "foo.go", `package foo
+
+type Value int
+
+var DimGreeting func() string //dim:Greeting
+
+var DimDouble func(v Value) Value //dim:Double
+
+var InDim bool //dim:<in>
+
+func Greeting() string { return "hello" }
+
+func Double(v Value) Value { return v * 2 }
+`, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge, err := s.GenerateBridge(context.Background(), "example.com/foo", fset, []*ast.File{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `package foo
+
+import import1 "example.com/foo__dim"
+import import2 "github.com/cretz/superpose/crossdim"
+
+func init() {
+	DimGreeting = import1.Greeting
+	import2.MustBridge(&DimDouble, import1.Double)
+}
+`
+	if string(bridge.Source) != expected {
+		t.Fatalf("expected bridge source:\n%s\nbut was:\n%s", expected, bridge.Source)
+	} else if !bridge.UsesCrossDim || len(bridge.References) != 2 {
+		t.Fatalf("unexpected bridge %+v", bridge)
+	} else if ref := *bridge.References[1]; ref != (superpose.BridgeReference{
+		Var:              "DimDouble",
+		Dimension:        "dim",
+		Func:             "Double",
+		DimensionPkgPath: "example.com/foo__dim",
+		Converted:        true,
+	}) {
+		t.Fatalf("unexpected reference %+v", ref)
+	}
+
+	// Packages the dimension does not apply to cannot reference it
+	if _, err := s.GenerateBridge(context.Background(), "example.com/bar", fset, []*ast.File{file}); err == nil ||
+		!strings.Contains(err.Error(), "not applied") {
+		t.Fatalf("expected not applied error, got %v", err)
+	}
+
+	// Static bridge vars are patched into the file, except those converted
+	s.Config.StaticBridge = true
+	fileName := filepath.Join(t.TempDir(), "foo.go")
+	if err := os.WriteFile(fileName, []byte(`package foo
+
+var DimGreeting func() string //dim:Greeting
+
+var DimDouble func(v Value) Value //dim:Double
+
+func Greeting() string { return "hello" }
+
+func Double(v Value) Value { return v * 2 }
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	staticFile, err := parser.ParseFile(fset, fileName, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge, err = s.GenerateBridge(context.Background(), "example.com/foo", fset, []*ast.File{staticFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `package foo
+
+import import1 "example.com/foo__dim"
+import import2 "github.com/cretz/superpose/crossdim"
+
+func init() {
+	import2.MustBridge(&DimDouble, import1.Double)
+}
+`
+	if string(bridge.Source) != expected {
+		t.Fatalf("expected bridge source:\n%s\nbut was:\n%s", expected, bridge.Source)
+	} else if !bridge.References[0].Static || bridge.References[1].Static {
+		t.Fatalf("unexpected static references %+v", bridge.References)
+	}
+	patched, err := superpose.ApplyPatches(fset, bridge.Patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `package foo; import __superpose_bridge1 "example.com/foo__dim"
+
+var DimGreeting func() string = __superpose_bridge1.Greeting //dim:Greeting
+
+var DimDouble func(v Value) Value //dim:Double
+
+func Greeting() string { return "hello" }
+
+func Double(v Value) Value { return v * 2 }
+`
+	if len(patched) != 1 || string(patched[fileName]) != expected {
+		t.Fatalf("expected patched file:\n%s\nbut was:\n%s", expected, patched[fileName])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, err := superpose.New(superpose.Config{
+		Version:      "test",
+		Transformers: map[string]superpose.Transformer{"dim": errTransformer{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Only flags and no tool is not a toolexec invocation
+	_, err = s.PrepareTool(context.Background(), "", []string{"-verbose"}, superpose.RunMainConfig{})
+	if !errors.Is(err, superpose.ErrNotToolexec) {
+		t.Fatalf("expected not toolexec error, got %v", err)
+	}
+
+	// Transformer failures are transform errors
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "foo.go", `package foo
+
+var DimGreeting func() string //dim:Greeting
+
+func Greeting() string { return "hello" }
+`, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GenerateBridge(context.Background(), "example.com/foo", fset, []*ast.File{file})
+	var transformErr *superpose.TransformError
+	if !errors.As(err, &transformErr) || transformErr.PkgPath != "example.com/foo" || transformErr.Dimension != "dim" ||
+		transformErr.Err.Error() != "transformer failed" {
+		t.Fatalf("expected transform error, got %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var diags superpose.Diagnostics
+	if err := diags.Err(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Each diagnostic is given with its position, if valid
+	diags.Addf(token.Position{}, "first problem in %v", "foo")
+	if err := diags.Err(); err == nil || err.Error() != "first problem in foo" {
+		t.Fatalf("expected single diagnostic error, got %v", err)
+	}
+	diags.Addf(token.Position{Filename: "foo.go", Line: 3, Column: 5}, "second problem")
+	err := error(&superpose.TransformError{PkgPath: "example.com/foo", Dimension: "dim", Err: diags.Err()})
+	const expected = "transformer for dimension dim failed for package example.com/foo: 2 problems:\n" +
+		"\tfirst problem in foo\n\tfoo.go:3:5: second problem"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+	var errDiags superpose.Diagnostics
+	if !errors.As(err, &errDiags) || len(errDiags) != 2 {
+		t.Fatalf("expected diagnostics, got %v", err)
+	}
+}
+
+func TestTransformPackageFiles(t *testing.T) {
+	fset := token.NewFileSet()
+	pkg := &superpose.TransformPackage{Package: &packages.Package{
+		Fset:    fset,
+		GoFiles: []string{"/src/foo.go", "/src/gen.go"},
+	}}
+	for _, file := range []struct{ name, src string }{
+		// Like cgo output which is compiled from the cache instead of the source
+		{"/cache/abc-d", "// Code generated by cmd/cgo; DO NOT EDIT.\n\n//line /src/foo.go:1:1\npackage foo\n"},
+		{"/src/gen.go", "// Code generated by hand; DO NOT EDIT.\n\npackage foo\n"},
+		{"/src/foo.go", "package foo\n"},
+	} {
+		syntax, err := parser.ParseFile(fset, file.name, file.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg.Syntax = append(pkg.Syntax, syntax)
+	}
+	// Compiled files are deliberately not in the same order
+	pkg.CompiledGoFiles = []string{"/src/foo.go", "/src/gen.go", "/cache/abc-d"}
+
+	var actual []superpose.TransformFile
+	for _, file := range pkg.Files() {
+		actual = append(actual, *file)
+	}
+	expected := []superpose.TransformFile{
+		{Syntax: pkg.Syntax[0], CompiledGoFile: "/cache/abc-d", GoFile: "/src/foo.go", Generated: true},
+		{Syntax: pkg.Syntax[1], CompiledGoFile: "/src/gen.go", GoFile: "/src/gen.go", Generated: true},
+		{Syntax: pkg.Syntax[2], CompiledGoFile: "/src/foo.go", GoFile: "/src/foo.go"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+	if file := pkg.File(pkg.Syntax[2]); file == nil || file.CompiledGoFile != "/src/foo.go" {
+		t.Fatalf("unexpected file %+v", file)
+	}
+}
+
+func TestFilePatches(t *testing.T) {
+	fset := token.NewFileSet()
+	// Another file first so positions are not offsets
+	if _, err := parser.ParseFile(fset, "/src/other.go", "package foo\n", 0); err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(fset, "/src/foo.go", "package foo\n\nvar X = 1 + 2\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0].(*ast.BinaryExpr)
+	res := &superpose.TransformResult{
+		Patches: []*superpose.Patch{
+			{Range: superpose.Range{Pos: file.End()}, Str: "; var Y = 3"},
+			superpose.WrapWithPatch(expr.X, "(", ")"),
+		},
+		Replacements: []*superpose.NodeReplacement{{Node: expr.Y, With: []ast.Node{ast.NewIdent("Z")}}},
+	}
+	filePatches, err := res.FilePatches(fset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*superpose.FilePatch{
+		{File: "/src/foo.go", Range: superpose.FileRange{Offset: 26}, Str: "; var Y = 3"},
+		{
+			File:     "/src/foo.go",
+			Range:    superpose.FileRange{Offset: 21, Length: 1},
+			Captures: map[string]superpose.FileRange{"__1__": {Offset: 21, Length: 1}},
+			Str:      "({{.__1__}})",
+		},
+		{File: "/src/foo.go", Range: superpose.FileRange{Offset: 25, Length: 1}, Str: "Z"},
+	}
+	if !reflect.DeepEqual(expected, filePatches) {
+		b, _ := json.Marshal(filePatches)
+		t.Fatalf("unexpected file patches %s", b)
+	}
+
+	// Converting back gives the same positions
+	for i, filePatch := range filePatches[:2] {
+		patch, err := filePatch.Patch(fset)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(res.Patches[i], patch) {
+			t.Fatalf("expected %+v, got %+v", res.Patches[i], patch)
+		}
+	}
+	if _, err := (&superpose.FilePatch{File: "/src/missing.go"}).Patch(fset); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	outOfRange := &superpose.FilePatch{File: "/src/foo.go", Range: superpose.FileRange{Offset: 100}}
+	if _, err := outOfRange.Patch(fset); err == nil {
+		t.Fatal("expected error for offset out of range")
+	}
+}
+
+func TestReplaceFuncBody(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "/src/foo.go", "package foo\n\nfunc A() int {\n\treturn 1\n}\n\nfunc B() int\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := &superpose.TransformPackage{Package: &packages.Package{Fset: fset}}
+	a, b := file.Decls[0].(*ast.FuncDecl), file.Decls[1].(*ast.FuncDecl)
+	patch := superpose.ReplaceFuncBody(pkg, a, "return 2")
+	if patch.Range.Pos != a.Body.Lbrace+1 || patch.Range.End != a.Body.Rbrace || patch.Str != " return 2 /*line :5*/" {
+		t.Fatalf("unexpected patch %+v", patch)
+	}
+	patch = superpose.ReplaceFuncBody(pkg, b, "return 2")
+	if patch.Range.Pos != b.Type.End() || patch.Range.End.IsValid() || patch.Str != " { return 2 }" {
+		t.Fatalf("unexpected patch %+v", patch)
+	}
+}
+
+func TestDeleteNode(t *testing.T) {
+	const src = "package foo\n\nfunc A() int {\n\tprintln(\"a\",\n\t\t\"b\")\n\treturn 1\n}\n"
+	goFile := filepath.Join(t.TempDir(), "foo.go")
+	if err := os.WriteFile(goFile, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, goFile, src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delete the multi-line statement, keeping the return where it was
+	stmt := file.Decls[0].(*ast.FuncDecl).Body.List[0]
+	patched, err := superpose.ApplyPatches(fset, []*superpose.Patch{superpose.DeleteNode(stmt)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = "package foo\n\nfunc A() int {\n\t            \n\t\t    \n\treturn 1\n}\n"
+	if string(patched[goFile]) != expected {
+		t.Fatalf("expected %q, got %q", expected, patched[goFile])
+	}
+}
+
+func TestPatchTemplateFuncs(t *testing.T) {
+	const src = "package foo\n\nvar A = \"b\"\n"
+	goFile := filepath.Join(t.TempDir(), "foo.go")
+	if err := os.WriteFile(goFile, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, goFile, src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the value with the lower-cased var name, quoted
+	spec := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec)
+	patch := &superpose.Patch{
+		Range:    superpose.RangeOf(spec.Values[0]),
+		Captures: map[string]superpose.Range{"name": superpose.RangeOf(spec.Names[0])},
+		Str:      "{{quote (lower .name)}}",
+		Funcs:    map[string]interface{}{"lower": strings.ToLower, "quote": strconv.Quote},
+	}
+	patched, err := superpose.ApplyPatches(fset, []*superpose.Patch{patch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = "package foo\n\nvar A = \"a\"\n"
+	if string(patched[goFile]) != expected {
+		t.Fatalf("expected %q, got %q", expected, patched[goFile])
+	}
+}
+
+func TestDecorate(t *testing.T) {
+	const src = `package foo
+
+// Greet greets.
+func Greet(name string) string {
+	// Say hello
+	return "hello " + name
+}
+
+// Other is moved.
+func Other() []struct{ A int } { return []struct{ A int }{{1}} }
+`
+	goFile := filepath.Join(t.TempDir(), "foo.go")
+	if err := os.WriteFile(goFile, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, goFile, src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := &superpose.TransformPackage{Package: &packages.Package{Fset: fset, Syntax: []*ast.File{file}}}
+	decorated, err := pkg.Decorate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Swap the functions, which keeps their comments
+	decls := decorated.Files[0].Decls
+	decls[0], decls[1] = decls[1], decls[0]
+	patches, err := decorated.Patches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the moved lines are patched
+	if len(patches) != 2 {
+		t.Fatalf("expected 2 patches, got %v", len(patches))
+	}
+	patched, err := superpose.ApplyPatches(fset, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `package foo
+
+// Other is moved.
+func Other() []struct{ A int } { return []struct{ A int }{{1}} }
+
+// Greet greets.
+func Greet(name string) string {
+	// Say hello
+	return "hello " + name
+}
+`
+	if string(patched[goFile]) != expected {
+		t.Fatalf("expected %q, got %q", expected, patched[goFile])
+	}
+}
+
+func TestAddImport(t *testing.T) {
+	s, err := superpose.New(superpose.Config{
+		Version:      "test",
+		Transformers: map[string]superpose.Transformer{"dim": noopTransformer{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := &superpose.TransformContext{Context: context.Background(), Superpose: s, Dimension: "dim"}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "foo.go", "package foo\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &superpose.TransformResult{}
+	for _, pkgPath := range []string{"strings", "sort", "strings"} {
+		if err := res.AddImport(ctx, file, pkgPath, "__"+pkgPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Combined into a single insert after the last import
+	if len(res.Patches) != 1 || res.Patches[0].Range.Pos != file.Decls[0].End() ||
+		res.Patches[0].Str != `; import __sort "sort"; import __strings "strings"` {
+		t.Fatalf("unexpected patches %+v", res.Patches)
+	}
+	// Transitive dependencies included
+	for _, dep := range []string{"strings", "sort", "unicode"} {
+		if _, ok := res.IncludeDependencyPackages[dep]; !ok {
+			t.Fatalf("missing dependency %v in %v", dep, res.IncludeDependencyPackages)
+		}
+	}
+	if _, ok := res.IncludeDependencyPackages["unsafe"]; ok {
+		t.Fatal("unexpected unsafe dependency")
+	}
+}
+
+func TestChainOnCachedPackage(t *testing.T) {
+	var cached []string
+	chain := superpose.ChainTransformers(
+		&cachedTransformer{pkgTransformer: "some/pkg", cached: &cached},
+		pkgTransformer("some/pkg"),
+		&cachedTransformer{pkgTransformer: "other/pkg", cached: &cached},
+		&cachedTransformer{pkgTransformer: "some/pkg", cached: &cached},
+	)
+	ctx := &superpose.TransformContext{Context: context.Background(), Dimension: "some-dim"}
+	if err := chain.OnCachedPackage(ctx, "some/pkg", "some-archive.a"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the cached package transformers that apply are called
+	if expected := []string{"some/pkg some-archive.a", "some/pkg some-archive.a"}; !reflect.DeepEqual(expected, cached) {
+		t.Fatalf("expected %v, got %v", expected, cached)
+	}
+}
+
+type noopTransformer struct{}
+
+func (noopTransformer) AppliesToPackage(*superpose.TransformContext, string) (bool, error) {
+	return false, nil
+}
+
+func (noopTransformer) Transform(
+	*superpose.TransformContext,
+	*superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	return &superpose.TransformResult{}, nil
+}
+
+// Applies only to the package path
+type pkgTransformer string
+
+func (p pkgTransformer) AppliesToPackage(_ *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == string(p), nil
+}
+
+func (pkgTransformer) Transform(
+	*superpose.TransformContext,
+	*superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	return &superpose.TransformResult{}, nil
+}
+
+// Records the cached packages it is told about
+type cachedTransformer struct {
+	pkgTransformer
+	cached *[]string
+}
+
+func (c *cachedTransformer) OnCachedPackage(_ *superpose.TransformContext, pkgPath, archiveFile string) error {
+	*c.cached = append(*c.cached, pkgPath+" "+archiveFile)
+	return nil
+}
+
+// Fails every call
+type errTransformer struct{}
+
+func (errTransformer) AppliesToPackage(*superpose.TransformContext, string) (bool, error) {
+	return false, errors.New("transformer failed")
+}
+
+func (errTransformer) Transform(
+	*superpose.TransformContext,
+	*superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	return nil, errors.New("transformer failed")
+}
+
 var currDir string
 
 func init() {
@@ -43,6 +699,15 @@ func (test *test) run(t *testing.T) {
 	t.Parallel()
 
 	absRootTestDir := filepath.Join(currDir, "tests")
+	if test.symlink {
+		// The tests module replaces the superpose module with its parent dir, so
+		// the whole repo is linked
+		link := filepath.Join(t.TempDir(), "repo")
+		if err := os.Symlink(currDir, link); err != nil {
+			t.Skipf("Cannot create symlink: %v", err)
+		}
+		absRootTestDir = filepath.Join(link, "tests")
+	}
 	absTestDir := filepath.Join(absRootTestDir, test.dir)
 
 	// Compile the transformer to a temporary location
@@ -58,11 +723,34 @@ func (test *test) run(t *testing.T) {
 		t.Fatalf("Failed building transformer: %v, output:\n----\n%s\n----", err, out)
 	}
 
+	// Write the overlay if any, with paths that must be absolute
+	var overlayFile string
+	if len(test.overlay) > 0 {
+		replace := map[string]string{}
+		for orig, replacement := range test.overlay {
+			replace[filepath.Join(absTestDir, orig)] = filepath.Join(absTestDir, replacement)
+		}
+		b, err := json.Marshal(map[string]interface{}{"Replace": replace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlayFile = filepath.Join(t.TempDir(), "overlay.json")
+		if err := os.WriteFile(overlayFile, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	// Run Go test, passing "-v" if it was set
 	toolexec := transformerExe
 	if len(test.buildTags) > 0 {
 		toolexec += " -buildtags " + strings.Join(test.buildTags, ",")
 	}
+	if overlayFile != "" {
+		toolexec += " -overlay " + overlayFile
+	}
+	if len(test.toolexecFlags) > 0 {
+		toolexec += " " + strings.Join(test.toolexecFlags, " ")
+	}
 	args = []string{"test", "-toolexec", toolexec}
 	if testing.Verbose() {
 		args = append(args, "-v")
@@ -70,12 +758,56 @@ func (test *test) run(t *testing.T) {
 	if len(test.buildTags) > 0 {
 		args = append(args, "-tags", strings.Join(test.buildTags, ","))
 	}
+	if overlayFile != "" {
+		args = append(args, "-overlay", overlayFile)
+	}
+	args = append(args, test.testFlags...)
 	t.Logf("Running go with args %v at %v", args, absTestDir)
 	cmd = exec.Command("go", args...)
 	cmd.Dir = absTestDir
-	if out, err := cmd.CombinedOutput(); err != nil {
+	if len(test.env) > 0 {
+		cmd.Env = append(os.Environ(), test.env...)
+	}
+	if out, err := cmd.CombinedOutput(); test.expectFailure != "" {
+		if err == nil || !strings.Contains(string(out), test.expectFailure) {
+			t.Fatalf("Expected sub test to fail with %q, got error %v, output:\n----\n%s\n----",
+				test.expectFailure, err, out)
+		}
+		t.Logf("Go test output:\n----\n%s\n----", out)
+	} else if err != nil {
 		t.Fatalf("Sub test failed: %v, output:\n----\n%s\n----", err, out)
 	} else {
 		t.Logf("Go test output:\n----\n%s\n----", out)
+		if test.checkOutput != nil {
+			test.checkOutput(t, string(out))
+		}
+	}
+}
+
+// Checks there is a single summary line for each tool run with dimension
+// packages and nothing else is logged
+func checkVerboseSummary(t *testing.T, out string) {
+	summaries := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "Suppressed") || strings.Contains(line, "Intercepting toolexec") {
+			t.Fatalf("unexpected verbose line %q", line)
+		} else if i := strings.Index(line, " Superpose "); i >= 0 {
+			// Key by tool and package, e.g. "compile of foo"
+			summaries[strings.SplitN(line[i+len(" Superpose "):], ":", 2)[0]]++
+		}
+	}
+	var compiles, links int
+	for key, count := range summaries {
+		if count != 1 {
+			t.Fatalf("expected 1 summary line for %v, got %v", key, count)
+		}
+		if strings.HasPrefix(key, "compile of ") {
+			compiles++
+		} else if strings.HasPrefix(key, "link of ") {
+			links++
+		}
+	}
+	if compiles == 0 || links == 0 {
+		t.Fatalf("expected compile and link summary lines, got %v", summaries)
 	}
 }
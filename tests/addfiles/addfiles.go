@@ -0,0 +1,13 @@
+package main
+
+import "github.com/cretz/superpose/tests/addfiles/other"
+
+// Value is replaced in the dimension to call a function in an added file.
+func Value() string {
+	return "original"
+}
+
+// OtherWhere makes the other package an import of this package.
+func OtherWhere() string {
+	return other.Where()
+}
@@ -0,0 +1,6 @@
+package main
+
+// Impl is in a file the dimension replaces entirely.
+func Impl() string {
+	return "impl"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-addfiles": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const (
+	thisPkgPath  = "github.com/cretz/superpose/tests/addfiles"
+	otherPkgPath = thisPkgPath + "/other"
+)
+
+// New file for this package that imports both a package new to it and a
+// package in the dimension
+const addedFile = `package main
+
+import (
+	"hash/crc32"
+	"strconv"
+
+	"github.com/cretz/superpose/tests/addfiles/other"
+)
+
+func addedValue() string {
+	return other.Where() + " " + strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte("superpose"))), 10)
+}
+`
+
+// Replacement for the excluded stub file
+const replacedStubFile = `package main
+
+func Platform() string {
+	return "replaced"
+}
+`
+
+// Replacement for the impl file that imports both a package new to this
+// package and a package in the dimension
+const replacedImplFile = `package main
+
+import (
+	"strings"
+
+	"github.com/cretz/superpose/tests/addfiles/other"
+)
+
+func Impl() string {
+	return strings.ToUpper("replaced impl in " + other.Where())
+}
+`
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath || pkgPath == otherPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if pkg.PkgPath == otherPkgPath {
+		decl := recipes.FindFunc(pkg, otherPkgPath+".Where")
+		if decl == nil {
+			return nil, fmt.Errorf("missing Where")
+		}
+		return &superpose.TransformResult{Patches: []*superpose.Patch{recipes.ReplaceFuncBody(decl, `return "dimension"`)}}, nil
+	}
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Value")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Value")
+	}
+	res := &superpose.TransformResult{
+		Patches:      []*superpose.Patch{recipes.ReplaceFuncBody(decl, "return addedValue()")},
+		AddFiles:     map[string][]byte{"zz_added.go": []byte(addedFile), "stub.go": []byte(replacedStubFile)},
+		ExcludeFiles: map[string]struct{}{},
+		ReplaceFiles: map[string][]byte{},
+	}
+	for _, file := range pkg.Files() {
+		switch filepath.Base(file.CompiledGoFile) {
+		case "stub.go":
+			res.ExcludeFiles[file.CompiledGoFile] = struct{}{}
+		case "impl.go":
+			res.ReplaceFiles[file.CompiledGoFile] = []byte(replacedImplFile)
+		}
+	}
+	if len(res.ExcludeFiles) == 0 {
+		return nil, fmt.Errorf("missing stub.go")
+	} else if len(res.ReplaceFiles) == 0 {
+		return nil, fmt.Errorf("missing impl.go")
+	}
+	return res, nil
+}
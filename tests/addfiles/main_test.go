@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallValue() string    { return Value() }
+func CallPlatform() string { return Platform() }
+func CallImpl() string     { return Impl() }
+
+var DimValue func() string    //tests-addfiles:CallValue
+var DimPlatform func() string //tests-addfiles:CallPlatform
+var DimImpl func() string     //tests-addfiles:CallImpl
+
+func TestAddFiles(t *testing.T) {
+	require.Equal(t, "original", Value())
+	// The added file calls the dimension version of the other package and a
+	// package this one did not import
+	require.Equal(t, "dimension 3987348036", DimValue())
+	// The stub file is replaced by an added file of the same name
+	require.Equal(t, "stub", Platform())
+	require.Equal(t, "replaced", DimPlatform())
+	// The impl file is replaced in place
+	require.Equal(t, "impl", Impl())
+	require.Equal(t, "REPLACED IMPL IN DIMENSION", DimImpl())
+}
@@ -0,0 +1,6 @@
+package other
+
+// Where is replaced in the dimension.
+func Where() string {
+	return "original"
+}
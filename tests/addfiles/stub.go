@@ -0,0 +1,6 @@
+package main
+
+// Platform is in a file the dimension excludes and replaces with its own.
+func Platform() string {
+	return "stub"
+}
@@ -0,0 +1,6 @@
+package dep
+
+// Greeting is replaced in the dimension.
+func Greeting() string {
+	return "hello"
+}
@@ -0,0 +1,8 @@
+package main
+
+import "github.com/cretz/superpose/tests/audit/dep"
+
+// Greeting returns the dep greeting.
+func Greeting() string { return dep.Greeting() }
+
+var DimGreeting func() string //tests-audit:Greeting
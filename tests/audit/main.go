@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:             superpose.MustLoadCurrentExeContentID(),
+			Transformers:        map[string]superpose.Transformer{"tests-audit": transformer{}},
+			Verbose:             true,
+			AuditDimensionUsage: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/audit"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	// The dep package is only imported in the dimension by this package, which
+	// references the dimension, so the audit passes
+	return pkgPath == thisPkgPath || pkgPath == thisPkgPath+"/dep", nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if pkg.PkgPath != thisPkgPath+"/dep" {
+		return &superpose.TransformResult{}, nil
+	}
+	// Replace the result of the dep Greeting
+	decl := recipes.FindFunc(pkg, thisPkgPath+"/dep.Greeting")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Greeting")
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected Greeting to have a single return")
+	}
+	return &superpose.TransformResult{
+		Patches: []*superpose.Patch{{Range: superpose.RangeOf(ret.Results[0]), Str: strconv.Quote("audited")}},
+	}, nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditedDimension(t *testing.T) {
+	require.Equal(t, "hello", Greeting())
+	require.Equal(t, "audited", DimGreeting())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-badpatch": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/badpatch"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Replace the body of ReturnString with invalid code, which must fail the
+	// build with the position of this patch
+	res := &superpose.TransformResult{}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if decl, _ := decl.(*ast.FuncDecl); decl != nil && decl.Name.Name == "ReturnString" {
+				res.Patches = append(res.Patches, superpose.ReplaceFuncBody(pkg, decl, `return ("foo"`))
+			}
+		}
+	}
+	return res, nil
+}
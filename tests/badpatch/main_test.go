@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+func ReturnString() string { return "some string" }
+
+var DimReturnString func() string //tests-badpatch:ReturnString
+
+func TestBadPatch(t *testing.T) {
+	t.Fatal("expected the build to fail")
+}
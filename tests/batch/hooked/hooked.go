@@ -0,0 +1,6 @@
+package hooked
+
+// Where is replaced in the dimension.
+func Where() string {
+	return "original"
+}
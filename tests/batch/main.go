@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-batch": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const hookedPkgPath = "github.com/cretz/superpose/tests/batch/hooked"
+
+type transformer struct{}
+
+var _ superpose.BatchTransformer = transformer{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == hookedPkgPath || pkgPath == "github.com/cretz/superpose/tests/batch", nil
+}
+
+func (t transformer) AppliesToPackages(ctx *superpose.TransformContext, pkgPaths []string) ([]bool, error) {
+	ctx.Superpose.Debugf("Checking %v packages in a batch", len(pkgPaths))
+	applies := make([]bool, len(pkgPaths))
+	for i, pkgPath := range pkgPaths {
+		applies[i], _ = t.AppliesToPackage(ctx, pkgPath)
+	}
+	return applies, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if pkg.PkgPath != hookedPkgPath {
+		return &superpose.TransformResult{}, nil
+	}
+	// Replace the result of Where
+	decl := recipes.FindFunc(pkg, hookedPkgPath+".Where")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Where")
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected Where to have a single return")
+	}
+	return &superpose.TransformResult{
+		Patches: []*superpose.Patch{{Range: superpose.RangeOf(ret.Results[0]), Str: `"dimension"`}},
+	}, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cretz/superpose/tests/batch/hooked"
+	"github.com/stretchr/testify/require"
+)
+
+func Where() string { return hooked.Where() }
+
+var DimWhere func() string //tests-batch:Where
+
+func TestBatchTransformer(t *testing.T) {
+	require.Equal(t, "original", Where())
+	require.Equal(t, "dimension", DimWhere())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-boundary": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/boundary"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	res, err := recipes.RecoverBoundary(ctx, pkg, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.LogPatchedFiles = true
+	return res, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/cretz/superpose/recipes/boundary"
+	"github.com/stretchr/testify/require"
+)
+
+func Divide(a, b int) (int, error) { return a / b, nil }
+
+var OtherDivide func(a, b int) (int, error) //tests-boundary:Divide
+
+func MustDivide(a, b int) int { return a / b }
+
+var OtherMustDivide func(a, b int) int //tests-boundary:MustDivide
+
+func TestBoundaryError(t *testing.T) {
+	res, err := OtherDivide(6, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, res)
+
+	_, err = OtherDivide(1, 0)
+	var panicErr *boundary.PanicError
+	require.ErrorAs(t, err, &panicErr)
+	require.Equal(t, "tests-boundary", panicErr.Dimension)
+	require.Equal(t, "github.com/cretz/superpose/tests/boundary.Divide", panicErr.Func)
+	var runtimeErr runtime.Error
+	require.ErrorAs(t, err, &runtimeErr)
+	require.Contains(t, panicErr.Stack, "github.com/cretz/superpose/tests/boundary.Divide(")
+	require.NotContains(t, panicErr.Stack, "__tests-boundary")
+}
+
+func TestBoundaryPanic(t *testing.T) {
+	require.Equal(t, 2, OtherMustDivide(6, 3))
+	defer func() {
+		panicErr, _ := recover().(*boundary.PanicError)
+		require.NotNil(t, panicErr)
+		require.Equal(t, "github.com/cretz/superpose/tests/boundary.MustDivide", panicErr.Func)
+	}()
+	OtherMustDivide(1, 0)
+}
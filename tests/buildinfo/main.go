@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-buildinfo": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/buildinfo"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	*superpose.TransformContext,
+	*superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	return &superpose.TransformResult{}, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cretz/superpose/buildinfo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildInfo(t *testing.T) {
+	info, ok := buildinfo.Read()
+	require.True(t, ok)
+	require.NotEmpty(t, info.Version)
+	require.Equal(t, []string{"tests-buildinfo"}, info.Dimensions)
+	require.Equal(t, map[string][]string{thisPkgPath: {"tests-buildinfo"}}, info.Packages)
+}
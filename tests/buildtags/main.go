@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:            superpose.MustLoadCurrentExeContentID(),
+			Transformers:       map[string]superpose.Transformer{"tests-buildtags": transformer{}},
+			DimensionBuildTags: map[string][]string{"tests-buildtags": {"purego"}},
+			Verbose:            true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/buildtags"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Patch the implementation that is only present with the dimension's tags
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Impl")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Impl")
+	} else if file := filepath.Base(pkg.Fset.Position(decl.Pos()).Filename); file != "impl_purego.go" {
+		return nil, fmt.Errorf("expected Impl in impl_purego.go, got %v", file)
+	}
+	return &superpose.TransformResult{
+		Patches:         []*superpose.Patch{recipes.ReplaceFuncBody(decl, `return "patched purego"`)},
+		LogPatchedFiles: true,
+	}, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallImpl() string { return Impl() }
+
+var PuregoImpl func() string //tests-buildtags:CallImpl
+
+func TestBuildTags(t *testing.T) {
+	require.Equal(t, "default", Impl())
+	require.Equal(t, "patched purego", PuregoImpl())
+}
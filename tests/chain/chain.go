@@ -0,0 +1,19 @@
+package main
+
+import "github.com/cretz/superpose/tests/chain/other"
+
+// Greeting is replaced in the dimension by one chained transformer.
+func Greeting() string {
+	return "hello"
+}
+
+// Farewell is replaced in the dimension by another chained transformer.
+func Farewell() string {
+	return "goodbye"
+}
+
+// Where calls the other package, which is only patched by one of the chained
+// transformers
+func Where() string {
+	return other.Where()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version: superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{
+				"tests-chain": superpose.ChainTransformers(
+					returnTransformer{pkgPath: thisPkgPath, funcName: "Greeting", value: "hello from chain"},
+					returnTransformer{pkgPath: thisPkgPath, funcName: "Farewell", value: "goodbye from chain"},
+					returnTransformer{pkgPath: otherPkgPath, funcName: "Where", value: "dimension"},
+				),
+			},
+			Verbose: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const (
+	thisPkgPath  = "github.com/cretz/superpose/tests/chain"
+	otherPkgPath = thisPkgPath + "/other"
+)
+
+// Replaces the string returned by a single function of a single package
+type returnTransformer struct {
+	pkgPath  string
+	funcName string
+	value    string
+}
+
+func (r returnTransformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == r.pkgPath, nil
+}
+
+func (r returnTransformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	decl := recipes.FindFunc(pkg, r.pkgPath+"."+r.funcName)
+	if decl == nil {
+		return nil, fmt.Errorf("missing %v", r.funcName)
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected %v to have a single return", r.funcName)
+	}
+	return &superpose.TransformResult{
+		Patches: []*superpose.Patch{{Range: superpose.RangeOf(ret.Results[0]), Str: strconv.Quote(r.value)}},
+	}, nil
+}
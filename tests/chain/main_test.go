@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallGreeting() string { return Greeting() }
+func CallFarewell() string { return Farewell() }
+func CallWhere() string    { return Where() }
+
+var DimGreeting func() string //tests-chain:CallGreeting
+var DimFarewell func() string //tests-chain:CallFarewell
+var DimWhere func() string    //tests-chain:CallWhere
+
+func TestChain(t *testing.T) {
+	require.Equal(t, "hello", Greeting())
+	require.Equal(t, "goodbye", Farewell())
+	require.Equal(t, "original", Where())
+	// Each chained transformer patched its own function in the same dimension
+	require.Equal(t, "hello from chain", DimGreeting())
+	require.Equal(t, "goodbye from chain", DimFarewell())
+	require.Equal(t, "dimension", DimWhere())
+}
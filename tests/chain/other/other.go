@@ -0,0 +1,6 @@
+package other
+
+// Where is replaced in the dimension by only one of the chained transformers.
+func Where() string {
+	return "original"
+}
@@ -0,0 +1,6 @@
+package main
+
+// Greeting is replaced in each dimension, including the composed one.
+func Greeting() string {
+	return "hello"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go/ast"
+	"os"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	// This executable is both the toolexec executable and, when given the
+	// "-composed" flag, the other toolexec executable it composes
+	flags := flag.NewFlagSet("superpose-tests-compose", flag.ContinueOnError)
+	composed := flags.Bool("composed", false, "run as the composed toolexec")
+	flags.String("greeting", "hello", "greeting to return in the dimension")
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-compose-outer": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{
+			AdditionalFlags: flags,
+			AfterFlagParse: func(config *superpose.Config) error {
+				if *composed {
+					config.Transformers = map[string]superpose.Transformer{"tests-compose-inner": transformer{}}
+				} else {
+					config.ComposedToolexecs = [][]string{{exe, "-composed", "-greeting=hi"}}
+				}
+				return nil
+			},
+		},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/compose"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// The composed toolexec's transformer is run in it, so it has its own flags
+	greeting, ok := superpose.FlagValue[string](ctx.Superpose, "greeting")
+	if !ok {
+		return nil, fmt.Errorf("missing greeting flag")
+	}
+	// Replace the result of Greeting with the flag value and dimension
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Greeting")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Greeting")
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected Greeting to have a single return")
+	}
+	str := greeting + " from " + ctx.Dimension
+	return &superpose.TransformResult{
+		Patches: []*superpose.Patch{{Range: superpose.RangeOf(ret.Results[0]), Str: strconv.Quote(str)}},
+	}, nil
+}
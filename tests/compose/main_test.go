@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallGreeting() string { return Greeting() }
+
+var OuterGreeting func() string //tests-compose-outer:CallGreeting
+
+var InnerGreeting func() string //tests-compose-inner:CallGreeting
+
+func TestComposedToolexec(t *testing.T) {
+	require.Equal(t, "hello", Greeting())
+	require.Equal(t, "hello from tests-compose-outer", OuterGreeting())
+	require.Equal(t, "hi from tests-compose-inner", InnerGreeting())
+}
@@ -0,0 +1,9 @@
+package dep
+
+import "github.com/cretz/superpose/tests/copyonly/leaf"
+
+// Where is from the leaf package which is only in the dimension if this
+// package's import of it is.
+func Where() string {
+	return leaf.Where()
+}
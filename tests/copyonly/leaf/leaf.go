@@ -0,0 +1,11 @@
+package leaf
+
+var inDimension bool //tests-copyonly:<in>
+
+// Where is "dimension" in the dimension.
+func Where() string {
+	if inDimension {
+		return "dimension"
+	}
+	return "original"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-copyonly": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/copyonly"
+
+type transformer struct{}
+
+var _ superpose.CopyOnlyTransformer = transformer{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath || strings.HasPrefix(pkgPath, thisPkgPath+"/"), nil
+}
+
+// Only the packages this one imports are copy-only
+func (transformer) CopyOnly(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath != thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if pkg.PkgPath != thisPkgPath {
+		return nil, fmt.Errorf("transform called for copy-only package %v", pkg.PkgPath)
+	}
+	return &superpose.TransformResult{}, nil
+}
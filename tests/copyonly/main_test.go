@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cretz/superpose/tests/copyonly/dep"
+	"github.com/stretchr/testify/require"
+)
+
+func Where() string { return dep.Where() }
+
+var DimWhere func() string //tests-copyonly:Where
+
+func TestCopyOnly(t *testing.T) {
+	require.Equal(t, "original", Where())
+	require.Equal(t, "dimension", DimWhere())
+}
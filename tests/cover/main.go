@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-cover": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/cover"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Change ReturnString to return "foo". The go command replaces this file
+	// with an instrumented copy when building with coverage.
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Name.Name != "ReturnString" {
+				continue
+			}
+			res.Patches = append(res.Patches, superpose.ReplaceFuncBody(pkg, decl, `return "foo"`))
+		}
+	}
+	return res, nil
+}
+
+func ReturnString() string { return "some string" }
+
+var OtherReturnString func() string //tests-cover:ReturnString
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCover(t *testing.T) {
+	require.Equal(t, "some string", ReturnString())
+	// Files the go command instruments for coverage are compiled unpatched
+	if testing.CoverMode() != "" {
+		require.Equal(t, "some string", OtherReturnString())
+	} else {
+		require.Equal(t, "foo", OtherReturnString())
+	}
+}
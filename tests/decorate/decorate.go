@@ -0,0 +1,18 @@
+package main
+
+import "runtime"
+
+// Greet has a statement added in the dimension by changing the decorated
+// syntax, which keeps the comments in it.
+func Greet(name string) string {
+	// The greeting is built before it is returned
+	greeting := "hello "
+	return greeting + name
+}
+
+// Line gives the line it is called on, which is the same in the dimension even
+// though Greet above has more lines.
+func Line() int {
+	_, _, line, _ := runtime.Caller(0)
+	return line
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+	"github.com/dave/dst"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-decorate": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/decorate"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Greet")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Greet")
+	}
+	decorated, err := pkg.Decorate()
+	if err != nil {
+		return nil, err
+	}
+	// Add a commented statement before the return
+	body := decorated.Decorator.Dst.Nodes[decl].(*dst.FuncDecl).Body
+	stmt := &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent("greeting")},
+		Tok: token.ADD_ASSIGN,
+		Rhs: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote("from decorated ")}},
+	}
+	stmt.Decs.Before = dst.NewLine
+	stmt.Decs.Start.Append("// Added in the dimension")
+	last := len(body.List) - 1
+	body.List = append(body.List[:last:last], stmt, body.List[last])
+	patches, err := decorated.Patches()
+	if err != nil {
+		return nil, err
+	}
+	return &superpose.TransformResult{Patches: patches, AddLineDirectives: true, LogPatchedFiles: true}, nil
+}
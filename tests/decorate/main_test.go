@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallGreet() string { return Greet("you") }
+func CallLine() int     { return Line() }
+
+var DimGreet func() string //tests-decorate:CallGreet
+var DimLine func() int     //tests-decorate:CallLine
+
+func TestDecorate(t *testing.T) {
+	require.Equal(t, "hello you", Greet("you"))
+	require.Equal(t, "hello from decorated you", DimGreet())
+	// The line directive after the added lines keeps later lines the same
+	require.Equal(t, Line(), DimLine())
+}
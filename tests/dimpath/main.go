@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-dimpath": transformer{}},
+			DimensionPathFunc: func(origPkg, dimension string) string {
+				return "dim/" + dimension + "/" + origPkg
+			},
+			Verbose: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/dimpath"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Nothing to patch, we only check the package paths
+	return &superpose.TransformResult{}, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cretz/superpose/tests/dimpath/named"
+	"github.com/stretchr/testify/require"
+)
+
+func ThingPkgPath() string { return reflect.TypeOf(named.Thing{}).PkgPath() }
+
+var DimThingPkgPath func() string //tests-dimpath:ThingPkgPath
+
+func TestDimensionPathFunc(t *testing.T) {
+	require.Equal(t, "github.com/cretz/superpose/tests/dimpath/named", ThingPkgPath())
+	require.Equal(t, "dim/tests-dimpath/github.com/cretz/superpose/tests/dimpath/named", DimThingPkgPath())
+}
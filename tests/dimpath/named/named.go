@@ -0,0 +1,3 @@
+package named
+
+type Thing struct{}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-external": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+// This applies to a dependency that is only in the read-only module cache
+const difflibPkg = "github.com/pmezard/go-difflib/difflib"
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == difflibPkg || strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/external"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Change the SplitLines function to return the name of its file as seen by
+	// the runtime. We intentionally don't add line directives so the compiler's
+	// own name for the patched file is used.
+	res := &superpose.TransformResult{LogPatchedFiles: true}
+	if pkg.PkgPath != difflibPkg {
+		return res, nil
+	}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			// Add patches if it's the func we want
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Name.Name != "SplitLines" {
+				continue
+			}
+			res.Patches = append(res.Patches,
+				&superpose.Patch{
+					Range: superpose.Range{Pos: file.Name.End()},
+					Str:   `; import __runtime "runtime"`,
+				},
+				&superpose.Patch{
+					Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+					Str:   ` _, __file, _, _ := __runtime.Caller(0); return []string{__file};`,
+				},
+			)
+			res.IncludeDependencyPackages = map[string]struct{}{"runtime": {}}
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find SplitLines")
+}
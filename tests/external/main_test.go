@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/stretchr/testify/require"
+)
+
+func SplitLines(s string) []string { return difflib.SplitLines(s) }
+
+var OtherSplitLines func(s string) []string //tests-external:SplitLines
+
+func TestExternal(t *testing.T) {
+	require.Equal(t, []string{"foo\n", "bar\n"}, SplitLines("foo\nbar"))
+	// The file name must be the same as the original even though the patched file
+	// was not next to the original in the module cache
+	origFunc := runtime.FuncForPC(reflect.ValueOf(difflib.SplitLines).Pointer())
+	origFile, _ := origFunc.FileLine(origFunc.Entry())
+	require.Equal(t, []string{origFile}, OtherSplitLines("foo\nbar"))
+}
@@ -0,0 +1,6 @@
+package main
+
+// Greeting is replaced in the dimension based on the toolexec flags.
+func Greeting() string {
+	return "hello"
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go/ast"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	flags := flag.NewFlagSet("superpose-tests-flags", flag.ContinueOnError)
+	flags.String("greeting", "hello", "greeting to return in the dimension")
+	flags.Int("repeat", 1, "number of times to repeat the greeting")
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-flags": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{AdditionalFlags: flags},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/flags"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	greeting, ok := superpose.FlagValue[string](ctx.Superpose, "greeting")
+	if !ok {
+		return nil, fmt.Errorf("missing greeting flag")
+	}
+	repeat, ok := superpose.FlagValue[int](ctx.Superpose, "repeat")
+	if !ok {
+		return nil, fmt.Errorf("missing repeat flag")
+	}
+	// Replace the result of Greeting with the flag values
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Greeting")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Greeting")
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected Greeting to have a single return")
+	}
+	str := strings.TrimSpace(strings.Repeat(greeting+" ", repeat))
+	return &superpose.TransformResult{
+		Patches: []*superpose.Patch{{Range: superpose.RangeOf(ret.Results[0]), Str: strconv.Quote(str)}},
+	}, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallGreeting() string { return Greeting() }
+
+var DimGreeting func() string //tests-flags:CallGreeting
+
+func TestFlagValues(t *testing.T) {
+	require.Equal(t, "hello", Greeting())
+	require.Equal(t, "hi hi", DimGreeting())
+}
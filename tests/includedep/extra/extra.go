@@ -0,0 +1,5 @@
+// Package extra is only imported by the dimension, so it is not built until it
+// is included.
+package extra
+
+func Greeting() string { return "extra" }
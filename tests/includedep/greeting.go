@@ -0,0 +1,5 @@
+package main
+
+func Greeting() string { return "original" }
+
+var DimGreeting func() string //tests-includedep:Greeting
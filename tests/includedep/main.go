@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+
+	"github.com/cretz/superpose"
+)
+
+const thisPkgPath = "github.com/cretz/superpose/tests/includedep"
+
+// Nothing in the build imports this, including this transformer
+const extraPkgPath = thisPkgPath + "/extra"
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-includedep": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Make Greeting return the extra package's greeting
+	res := &superpose.TransformResult{LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Name.Name != "Greeting" {
+				continue
+			}
+			res.Patches = append(res.Patches,
+				&superpose.Patch{
+					Range: superpose.Range{Pos: file.Name.End()},
+					Str:   fmt.Sprintf("; import __extra %q", extraPkgPath),
+				},
+				&superpose.Patch{
+					Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+					Str:   " return __extra.Greeting();",
+				},
+			)
+			res.IncludeDependencyPackages = map[string]struct{}{extraPkgPath: {}}
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find Greeting")
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncludeDep(t *testing.T) {
+	require.Equal(t, "original", Greeting())
+	require.Equal(t, "extra", DimGreeting())
+}
@@ -0,0 +1,6 @@
+package main
+
+// Lang is replaced in the dimension with the package's language version.
+func Lang() string {
+	return ""
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallLang() string { return Lang() }
+
+var DimLang func() string //tests-langversion:CallLang
+
+func TestLangVersion(t *testing.T) {
+	require.Equal(t, "", Lang())
+	// From the go directive of the tests module without any patch version
+	b, err := exec.Command("go", "list", "-m", "-f", "{{.GoVersion}}").Output()
+	require.NoError(t, err)
+	version := strings.SplitN(strings.TrimSpace(string(b)), ".", 3)
+	require.Equal(t, "go"+version[0]+"."+version[1], DimLang())
+}
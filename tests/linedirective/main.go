@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-linedirective": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/linedirective"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Add statements on new lines to the start of CallerLine, leaving it to
+	// Superpose to restore the lines after them
+	res := &superpose.TransformResult{
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Name.Name != "CallerLine" {
+				continue
+			}
+			res.Patches = append(res.Patches, &superpose.Patch{
+				Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+				Str:   "\n\tadded := 1\n\t_ = added\n",
+			})
+		}
+	}
+	return res, nil
+}
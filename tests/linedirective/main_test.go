@@ -0,0 +1,27 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallerLine() int {
+	_, _, line, _ := runtime.Caller(0)
+	return line
+}
+
+var DimCallerLine func() int //tests-linedirective:CallerLine
+
+func AfterCallerLine() int {
+	_, _, line, _ := runtime.Caller(0)
+	return line
+}
+
+var DimAfterCallerLine func() int //tests-linedirective:AfterCallerLine
+
+func TestLineDirective(t *testing.T) {
+	require.Equal(t, CallerLine(), DimCallerLine())
+	require.Equal(t, AfterCallerLine(), DimAfterCallerLine())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cretz/superpose"
+)
+
+//go:generate go run . manifest
+
+// The version is fixed instead of the executable's content ID so the committed
+// manifest is not out of date every time this is built
+const version = "tests-manifest-v1"
+
+func main() {
+	superpose.RunMain(context.Background(), newConfig(version), superpose.RunMainConfig{})
+}
+
+func newConfig(version string) superpose.Config {
+	return superpose.Config{
+		Version:      version,
+		Transformers: map[string]superpose.Transformer{"tests-manifest": transformer{}},
+		Verbose:      true,
+	}
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == "github.com/cretz/superpose/tests/manifest", nil
+}
+
+func (transformer) Transform(
+	*superpose.TransformContext,
+	*superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	return &superpose.TransformResult{}, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cretz/superpose"
+	"github.com/stretchr/testify/require"
+)
+
+func Greeting() string { return "hello" }
+
+var DimGreeting func() string //tests-manifest:Greeting
+
+var inDimension bool //tests-manifest:<in>
+
+func InDimension() bool { return inDimension }
+
+var DimInDimension func() bool //tests-manifest:InDimension
+
+func TestManifest(t *testing.T) {
+	// The build would have failed if the manifest were out of date
+	require.Equal(t, "hello", DimGreeting())
+	require.False(t, InDimension())
+	require.True(t, DimInDimension())
+
+	// Check it directly too, with a different version
+	s, err := superpose.New(newConfig(version))
+	require.NoError(t, err)
+	require.NoError(t, s.CheckManifest(context.Background(), "superpose_manifest.go"))
+	s, err = superpose.New(newConfig("tests-manifest-v2"))
+	require.NoError(t, err)
+	require.ErrorContains(t, s.CheckManifest(context.Background(), "superpose_manifest.go"),
+		`generated for transformer version "tests-manifest-v1"`)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-offsetpatch": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/offsetpatch"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Change the table of every query in the raw file contents
+	const from, to = "FROM original_table", "FROM dimension_table"
+	res := &superpose.TransformResult{}
+	for _, file := range pkg.Files() {
+		b, err := ctx.ReadFile(file.CompiledGoFile)
+		if err != nil {
+			return nil, err
+		}
+		for offset := 0; ; offset += len(from) {
+			i := bytes.Index(b[offset:], []byte(from))
+			if i < 0 {
+				break
+			}
+			offset += i
+			res.OffsetPatches = append(res.OffsetPatches, &superpose.FilePatch{
+				File:  file.CompiledGoFile,
+				Range: superpose.FileRange{Offset: offset, Length: len(from)},
+				Str:   to,
+			})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Query() string { return "SELECT name FROM original_table WHERE id = ?" }
+
+var DimQuery func() string //tests-offsetpatch:Query
+
+func TestOffsetPatch(t *testing.T) {
+	require.Equal(t, "SELECT name FROM original_table WHERE id = ?", Query())
+	require.Equal(t, "SELECT name FROM dimension_table WHERE id = ?", DimQuery())
+}
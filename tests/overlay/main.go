@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-overlay": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/overlay"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Prefix the result of Value, capturing the expression so it has to be read
+	// from the overlaid file
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Value")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Value")
+	}
+	ret, _ := decl.Body.List[0].(*ast.ReturnStmt)
+	if ret == nil || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("expected Value to have a single return")
+	}
+	return &superpose.TransformResult{
+		Patches:         []*superpose.Patch{superpose.WrapWithPatch(ret.Results[0], `"patched " + `, "")},
+		LogPatchedFiles: true,
+	}, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallValue() string { return Value() }
+
+var DimValue func() string //tests-overlay:CallValue
+
+func TestOverlay(t *testing.T) {
+	require.Equal(t, "overlay", Value())
+	require.Equal(t, "patched overlay", DimValue())
+}
@@ -0,0 +1,6 @@
+package main
+
+// Value is the replacement of value.go via -overlay.
+func Value() string {
+	return "overlay"
+}
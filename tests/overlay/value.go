@@ -0,0 +1,6 @@
+package main
+
+// Value is replaced by testdata/value.go via -overlay.
+func Value() string {
+	return "disk"
+}
@@ -0,0 +1,19 @@
+package hooks
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// ToUpper hex encodes the uppercased string. The hex package is not otherwise
+// a dependency of the test so it has to be included.
+func ToUpper(s string) string {
+	return hex.EncodeToString([]byte(strings.ToUpper(s)))
+}
+
+var args = []string{"hooks"}
+
+// Args is used instead of os.Args so the dimension has its own arguments.
+func Args() *[]string {
+	return &args
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version: superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{
+				"tests-redirect": &recipes.RedirectTransformer{
+					Redirects:    map[string]string{"strings.ToUpper": hooksPkg + ".ToUpper"},
+					VarAccessors: map[string]string{"os.Args": hooksPkg + ".Args"},
+					AppliesTo: func(pkgPath string) bool {
+						return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/redirect")
+					},
+				},
+			},
+			Verbose: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const hooksPkg = "github.com/cretz/superpose/tests/redirect/hooks"
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ToUpper(s string) string {
+	upper := strings.ToUpper
+	return strings.ToUpper(s) + upper(s)
+}
+
+var OtherToUpper func(s string) string //tests-redirect:ToUpper
+
+func AppendArg(arg string) []string {
+	os.Args = append(os.Args, arg)
+	return os.Args
+}
+
+var OtherAppendArg func(arg string) []string //tests-redirect:AppendArg
+
+func TestRedirect(t *testing.T) {
+	require.Equal(t, "FOOFOO", ToUpper("foo"))
+	require.Equal(t, "464f4f464f4f", OtherToUpper("foo"))
+}
+
+func TestRedirectVars(t *testing.T) {
+	origArgs := len(os.Args)
+	require.Equal(t, []string{"hooks", "foo"}, OtherAppendArg("foo"))
+	require.Len(t, os.Args, origArgs)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-replace": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+const thisPkgPath = "github.com/cretz/superpose/tests/replace"
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	decl := recipes.FindFunc(pkg, thisPkgPath+".Greet")
+	if decl == nil {
+		return nil, fmt.Errorf("missing Greet")
+	}
+	// Keep the signature, but replace the body with one that builds the
+	// greeting over several statements and calls a new function
+	greet := *decl
+	greet.Doc = nil
+	greet.Body = &ast.BlockStmt{List: []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("greeting")},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote("hello from replacement ")}},
+		},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("greeting")},
+			Tok: token.ADD_ASSIGN,
+			Rhs: []ast.Expr{ast.NewIdent("name")},
+		},
+		&ast.ReturnStmt{Results: []ast.Expr{
+			&ast.CallExpr{Fun: ast.NewIdent("exclaim"), Args: []ast.Expr{ast.NewIdent("greeting")}},
+		}},
+	}}
+	exclaim := &ast.FuncDecl{
+		Name: ast.NewIdent("exclaim"),
+		Type: &ast.FuncType{
+			Params: &ast.FieldList{List: []*ast.Field{{
+				Names: []*ast.Ident{ast.NewIdent("s")},
+				Type:  ast.NewIdent("string"),
+			}}},
+			Results: &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("string")}}},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{Results: []ast.Expr{
+			&ast.BinaryExpr{X: ast.NewIdent("s"), Op: token.ADD, Y: &ast.BasicLit{Kind: token.STRING, Value: `"!"`}},
+		}}}},
+	}
+	return &superpose.TransformResult{
+		Replacements:      []*superpose.NodeReplacement{{Node: decl, With: []ast.Node{&greet, exclaim}}},
+		AddLineDirectives: true,
+		LogPatchedFiles:   true,
+	}, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func CallGreet() string { return Greet("you") }
+func CallLine() int     { return Line() }
+
+var DimGreet func() string //tests-replace:CallGreet
+var DimLine func() int     //tests-replace:CallLine
+
+func TestReplace(t *testing.T) {
+	require.Equal(t, "hello you", Greet("you"))
+	require.Equal(t, "hello from replacement you!", DimGreet())
+	// The line directive after the replacement keeps later lines the same
+	require.Equal(t, Line(), DimLine())
+}
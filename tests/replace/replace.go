@@ -0,0 +1,16 @@
+package main
+
+import "runtime"
+
+// Greet is replaced in the dimension with a function that has more lines and
+// calls a new function.
+func Greet(name string) string {
+	return "hello " + name
+}
+
+// Line gives the line it is called on, which is the same in the dimension even
+// though the replacement of Greet above has more lines.
+func Line() int {
+	_, _, line, _ := runtime.Caller(0)
+	return line
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cretz/superpose"
+	"github.com/cretz/superpose/recipes"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version: superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{
+				"tests-rewrite": recipes.NewRewriteTransformer(
+					[]*recipes.RewriteRule{{
+						Pattern:     "strings.ToUpper(s)",
+						Replacement: "hex.EncodeToString([]byte(s))",
+						Imports:     map[string]string{"hex": "encoding/hex"},
+						Types:       map[string]string{"s": "string"},
+					}},
+					func(pkgPath string) bool {
+						return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/rewrite")
+					},
+				),
+			},
+			Verbose: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
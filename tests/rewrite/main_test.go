@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ToUpper(s string) string {
+	return strings.ToUpper(s + "!")
+}
+
+var OtherToUpper func(s string) string //tests-rewrite:ToUpper
+
+func TestRewrite(t *testing.T) {
+	require.Equal(t, "FOO!", ToUpper("foo"))
+	require.Equal(t, "666f6f21", OtherToUpper("foo"))
+}
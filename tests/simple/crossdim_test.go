@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cretz/superpose/crossdim"
+	"github.com/cretz/superpose/tests/simple/point"
+	"github.com/stretchr/testify/require"
+)
+
+// Bridge functions with types from transformed packages have their values
+// converted across the dimension boundary
+
+func MovePoint(p point.Point, dx, dy int) point.Point {
+	p.X += dx
+	p.Y += dy
+	p.Tags = append(p.Tags, "moved")
+	return p
+}
+
+var OtherMovePoint func(p point.Point, dx, dy int) point.Point //tests-simple:MovePoint
+
+func PointReturnString(p *point.Point) string { return p.ReturnString() }
+
+var OtherPointReturnString func(p *point.Point) string //tests-simple:PointReturnString
+
+func NewLabeler(label string) point.Labeler { return point.New(0, 0, label) }
+
+var OtherNewLabeler func(label string) point.Labeler //tests-simple:NewLabeler
+
+func TestCrossDimBridge(t *testing.T) {
+	p := point.New(1, 2, "some label")
+	p.Tags = []string{"some tag"}
+	moved := OtherMovePoint(p, 3, 4)
+	require.Equal(t, 4, moved.X)
+	require.Equal(t, 6, moved.Y)
+	require.Equal(t, []string{"some tag", "moved"}, moved.Tags)
+	require.Equal(t, "some label", moved.Label())
+	require.Equal(t, []string{"some tag"}, p.Tags)
+
+	require.Equal(t, "some label", PointReturnString(&p))
+	require.Equal(t, "foo", OtherPointReturnString(&p))
+
+	// Interface values are kept as the dimension's type if they implement the
+	// interface
+	require.Equal(t, "other label", OtherNewLabeler("other label").Label())
+}
+
+// Values can also be passed as interfaces and converted manually
+
+func NewPointAny(x, y int) any {
+	p := point.New(x, y, "cyclic")
+	p.Next = &p
+	return &p
+}
+
+var OtherNewPointAny func(x, y int) any //tests-simple:NewPointAny
+
+func TestCrossDimConvert(t *testing.T) {
+	_, isPoint := OtherNewPointAny(1, 2).(*point.Point)
+	require.False(t, isPoint)
+	p, err := crossdim.Convert[*point.Point](OtherNewPointAny(1, 2))
+	require.NoError(t, err)
+	require.Equal(t, 1, p.X)
+	require.Equal(t, "cyclic", p.Label())
+	require.Same(t, p, p.Next)
+
+	_, err = crossdim.Convert[point.Point]("not a point")
+	require.Error(t, err)
+}
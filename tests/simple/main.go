@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go/ast"
 	"strings"
 
@@ -43,13 +42,7 @@ func (transformer) Transform(
 			if decl == nil || decl.Name.Name != "ReturnString" {
 				continue
 			}
-			res.Patches = append(res.Patches, &superpose.Patch{
-				Range: superpose.Range{Pos: decl.Body.Lbrace + 1, End: decl.Body.Rbrace},
-				Str: fmt.Sprintf(
-					` return "foo" /*line :%v*/`,
-					pkg.Fset.Position(decl.Body.Rbrace).Line,
-				),
-			})
+			res.Patches = append(res.Patches, superpose.ReplaceFuncBody(pkg, decl, `return "foo"`))
 		}
 	}
 	return res, nil
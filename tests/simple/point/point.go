@@ -0,0 +1,16 @@
+package point
+
+type Point struct {
+	X, Y  int
+	Tags  []string
+	Next  *Point
+	label string
+}
+
+func New(x, y int, label string) Point { return Point{X: x, Y: y, label: label} }
+
+func (p Point) Label() string { return p.label }
+
+func (p *Point) ReturnString() string { return p.label }
+
+type Labeler interface{ Label() string }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:         superpose.MustLoadCurrentExeContentID(),
+			Transformers:    map[string]superpose.Transformer{"tests-source": transformer{}},
+			Verbose:         true,
+			SourceOutputDir: filepath.Join(os.TempDir(), "superpose-tests-source"),
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/source"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	// Change Value to return "foo"
+	res := &superpose.TransformResult{AddLineDirectives: true}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if decl, _ := decl.(*ast.FuncDecl); decl != nil && decl.Name.Name == "Value" {
+				res.Patches = append(res.Patches, superpose.ReplaceFuncBody(pkg, decl, `return "foo"`))
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/superpose/tests/source/sub"
+	"github.com/stretchr/testify/require"
+)
+
+func SubValue() string { return sub.SubValue() }
+
+var DimSubValue func() string //tests-source:SubValue
+
+func TestSource(t *testing.T) {
+	require.Equal(t, "sub some string", SubValue())
+	require.Equal(t, "sub foo", DimSubValue())
+
+	// The dimension packages are written as source importing each other from the
+	// written module
+	dir := filepath.Join(os.TempDir(), "superpose-tests-source")
+	const subDir = "github.com/cretz/superpose/tests/source/sub__tests-source"
+	b, err := os.ReadFile(filepath.Join(dir, subDir, "sub.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(b),
+		`import leaf "superpose.local/dimensions/github.com/cretz/superpose/tests/source/sub/leaf__tests-source"`)
+	b, err = os.ReadFile(filepath.Join(dir, "github.com/cretz/superpose/tests/source/sub/leaf__tests-source/leaf.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), `return "foo"`)
+
+	// And they build without toolexec
+	cmd := exec.Command("go", "build", "./"+subDir)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "build output: %s", out)
+}
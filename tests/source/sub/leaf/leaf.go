@@ -0,0 +1,3 @@
+package leaf
+
+func Value() string { return "some string" }
@@ -0,0 +1,5 @@
+package sub
+
+import "github.com/cretz/superpose/tests/source/sub/leaf"
+
+func SubValue() string { return "sub " + leaf.Value() }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"os"
+	"strings"
+
+	"github.com/cretz/superpose"
+)
+
+func main() {
+	// This executable is both the toolexec executable and, when given "serve",
+	// the subprocess it delegates to
+	if len(os.Args) == 2 && os.Args[1] == "serve" {
+		superpose.RunSubprocessMain(context.Background(), transformer{})
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version: superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{
+				"tests-subprocess": superpose.NewSubprocessTransformer(exe, "serve"),
+			},
+			Verbose: true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return strings.HasPrefix(pkgPath, "github.com/cretz/superpose/tests/subprocess"), nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	ctx.Superpose.Debugf("Transforming package %v in subprocess", pkg.ID)
+	// Stdout is the protocol, so this stray print must be kept off of it
+	fmt.Println("Stray print from subprocess transformer")
+	// Reading the package's own files is allowed even in hermetic mode
+	if _, err := ctx.ReadFile(pkg.CompiledGoFiles[0]); err != nil {
+		return nil, err
+	}
+	res := &superpose.TransformResult{AddLineDirectives: true, LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			decl, _ := decl.(*ast.FuncDecl)
+			if decl == nil || decl.Name.Name != "ReturnString" {
+				continue
+			}
+			// Wrap the result which uses captures
+			ret := decl.Body.List[0].(*ast.ReturnStmt)
+			res.Patches = append(res.Patches, superpose.WrapWithPatch(ret.Results[0], `"from subprocess: " + `, ""))
+			return res, nil
+		}
+	}
+	// Variants of the package without the test files do not have the function
+	return res, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ReturnString() string { return "some string" }
+
+var OtherReturnString func() string //tests-subprocess:ReturnString
+
+func TestSubprocess(t *testing.T) {
+	require.Equal(t, "some string", ReturnString())
+	require.Equal(t, "from subprocess: some string", OtherReturnString())
+}
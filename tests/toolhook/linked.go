@@ -0,0 +1,4 @@
+package main
+
+// LinkedValue is set by the tool command hook when linking.
+var LinkedValue string
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cretz/superpose"
+)
+
+const thisPkgPath = "github.com/cretz/superpose/tests/toolhook"
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:         superpose.MustLoadCurrentExeContentID(),
+			Transformers:    map[string]superpose.Transformer{"tests-toolhook": transformer{}},
+			ToolCommandHook: toolCommandHook,
+			Verbose:         true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+// Output files given to the transformer, which runs in the same process as the
+// compile of the package
+var transformOutputFile, transformDimensionOutputFile string
+
+func toolCommandHook(cmd *superpose.ToolCommand) error {
+	switch {
+	case cmd.Tool == "compile" && cmd.Dimension != "":
+		// Confirm the dimension compile has its final package path and the output
+		// file the transformer was told about
+		if !hasArgs(cmd.Args, "-p", cmd.PkgPath+"__"+cmd.Dimension) {
+			return fmt.Errorf("dimension compile of %v missing package path in args %v", cmd.PkgPath, cmd.Args)
+		} else if cmd.OutputFile != transformDimensionOutputFile {
+			return fmt.Errorf("dimension compile output %v, transformer given %v",
+				cmd.OutputFile, transformDimensionOutputFile)
+		}
+	case cmd.Tool == "compile" && cmd.PkgPath == thisPkgPath:
+		// Transformer is not called if the dimension is cached
+		if transformOutputFile != "" && cmd.OutputFile != transformOutputFile {
+			return fmt.Errorf("compile output %v, transformer given %v", cmd.OutputFile, transformOutputFile)
+		}
+	case cmd.Tool == "link":
+		// Set the var in the original package but not the dimension one
+		cmd.Args = append([]string{cmd.Args[0], "-X", thisPkgPath + ".LinkedValue=linked"}, cmd.Args[1:]...)
+	}
+	return nil
+}
+
+func hasArgs(args []string, name, value string) bool {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == name && args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+type transformer struct{}
+
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath, nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if filepath.Base(ctx.OutputFile) != "_pkg_.a" || ctx.DimensionOutputFile == "" {
+		return nil, fmt.Errorf("unexpected output files %q and %q", ctx.OutputFile, ctx.DimensionOutputFile)
+	}
+	transformOutputFile, transformDimensionOutputFile = ctx.OutputFile, ctx.DimensionOutputFile
+	return &superpose.TransformResult{}, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func GetLinkedValue() string { return LinkedValue }
+
+var DimGetLinkedValue func() string //tests-toolhook:GetLinkedValue
+
+func TestToolCommandHook(t *testing.T) {
+	require.Equal(t, "linked", LinkedValue)
+	require.Equal(t, "", DimGetLinkedValue())
+}
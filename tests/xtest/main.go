@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+
+	"github.com/cretz/superpose"
+)
+
+const thisPkgPath = "github.com/cretz/superpose/tests/xtest"
+
+func main() {
+	superpose.RunMain(
+		context.Background(),
+		superpose.Config{
+			Version:      superpose.MustLoadCurrentExeContentID(),
+			Transformers: map[string]superpose.Transformer{"tests-xtest": transformer{}},
+			Verbose:      true,
+		},
+		superpose.RunMainConfig{},
+	)
+}
+
+type transformer struct{}
+
+// Only the external test package, not the package under test
+func (transformer) AppliesToPackage(ctx *superpose.TransformContext, pkgPath string) (bool, error) {
+	return pkgPath == thisPkgPath+"_test", nil
+}
+
+func (transformer) Transform(
+	ctx *superpose.TransformContext,
+	pkg *superpose.TransformPackage,
+) (*superpose.TransformResult, error) {
+	if pkg.ExternalTestOf != thisPkgPath {
+		return nil, fmt.Errorf("expected %v to be external test of %v, got %q", pkg.PkgPath, thisPkgPath, pkg.ExternalTestOf)
+	}
+	// Make Greeting return a different value
+	res := &superpose.TransformResult{LogPatchedFiles: true}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if decl, _ := decl.(*ast.FuncDecl); decl != nil && decl.Name.Name == "Greeting" {
+				res.Patches = append(res.Patches, &superpose.Patch{
+					Range: superpose.Range{Pos: decl.Body.Lbrace + 1},
+					Str:   ` return "transformed";`,
+				})
+				return res, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not find Greeting")
+}
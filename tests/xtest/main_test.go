@@ -0,0 +1,16 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Greeting() string { return "original" }
+
+var DimGreeting func() string //tests-xtest:Greeting
+
+func TestExternalTestPackage(t *testing.T) {
+	require.Equal(t, "original", Greeting())
+	require.Equal(t, "transformed", DimGreeting())
+}
@@ -0,0 +1,85 @@
+package superpose
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// Calls Transform on the transformer, failing if it does not return within
+// [Config.TransformTimeout]. The transformer's context is canceled at the
+// timeout so transformers that check it can stop early.
+func (s *Superpose) transformWithTimeout(
+	ctx *TransformContext,
+	transformer Transformer,
+	pkg *TransformPackage,
+) (*TransformResult, error) {
+	timeout := s.Config.TransformTimeout
+	if timeout <= 0 {
+		return transformer.Transform(ctx, pkg)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx.Context, timeout)
+	defer cancel()
+	ctxCopy := *ctx
+	ctxCopy.Context = timeoutCtx
+
+	type result struct {
+		res *TransformResult
+		err error
+	}
+	// Buffered so the goroutine of a transformer that never returns does not
+	// also block on sending
+	resultCh := make(chan result, 1)
+	goroutineIDCh := make(chan []byte, 1)
+	go func() {
+		goroutineIDCh <- currentGoroutineID()
+		res, err := transformer.Transform(&ctxCopy, pkg)
+		resultCh <- result{res, err}
+	}()
+	goroutineID := <-goroutineIDCh
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.res, r.err
+	case <-timer.C:
+	}
+	// The goroutine cannot be stopped, but we fail with where it is stuck and the
+	// process exits soon after
+	return nil, fmt.Errorf("%w after %v, transformer goroutine stack:\n%s",
+		ErrTransformTimeout, timeout, goroutineStack(goroutineID))
+}
+
+// Gives the ID of the calling goroutine as it appears at the start of its
+// stack, e.g. "goroutine 12 "
+func currentGoroutineID() []byte {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	if i := bytes.IndexByte(buf, '['); i > 0 {
+		return buf[:i]
+	}
+	return buf
+}
+
+// Gives the stack of the goroutine with the given ID prefix from
+// currentGoroutineID, or the stacks of all goroutines if it cannot be found
+func goroutineStack(goroutineID []byte) []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	// Each goroutine's stack starts with its ID and ends with an empty line
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, goroutineID) {
+			return stack
+		}
+	}
+	return buf
+}
@@ -1,24 +1,33 @@
 package superpose
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/token"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
 	"golang.org/x/tools/go/packages"
 )
 
-// Transformer is the interface all dimension transformers must implement.
+// Transformer is the interface all dimension transformers must implement. If a
+// transformer also implements [io.Closer], it is closed when Superpose is done.
 type Transformer interface {
 	// AppliesToPackage is called each time Superpose needs to know whether this
 	// dimension applies to the given package. This should not be an expensive
 	// call since it is called many times by Superpose.
 	//
+	// When building tests, this is also called for the external test package of
+	// a package, i.e. the package path with a "_test" suffix. See
+	// [TransformPackage.ExternalTestOf].
+	//
 	// When false is returned, `Transform`` will not be called for this package.
 	AppliesToPackage(ctx *TransformContext, pkgPath string) (bool, error)
 
@@ -32,6 +41,82 @@ type Transformer interface {
 	Transform(ctx *TransformContext, pkg *TransformPackage) (*TransformResult, error)
 }
 
+// BatchTransformer is a [Transformer] that can determine whether it applies to
+// many packages in a single call. Superpose uses AppliesToPackages instead of
+// AppliesToPackage when it needs to check many packages at once, e.g. every
+// package of a binary when linking.
+type BatchTransformer interface {
+	Transformer
+
+	// AppliesToPackages returns whether this dimension applies to each of the
+	// given packages, in the same order. The result for each package must be the
+	// same as AppliesToPackage gives for it.
+	AppliesToPackages(ctx *TransformContext, pkgPaths []string) ([]bool, error)
+}
+
+// CopyOnlyTransformer is a [Transformer] that can say it has no patches for
+// some of the packages it applies to. Those packages are often only in the
+// dimension so their importers resolve to the same dimension packages. They are
+// still compiled in the dimension, but without loading and type checking them
+// first, which is much faster. Transform is not called for them.
+type CopyOnlyTransformer interface {
+	Transformer
+
+	// CopyOnly returns whether the given package, which this dimension applies
+	// to, needs no patches from Transform. Imports of dimension packages and
+	// "<in>" bool vars are still updated. This is ignored for dimensions with
+	// [Config.DimensionBuildTags] or [Config.DimensionEnv] since their files must
+	// be loaded.
+	CopyOnly(ctx *TransformContext, pkgPath string) (bool, error)
+}
+
+// CachedPackageTransformer is a [Transformer] that is told about packages it
+// applies to that are not compiled in the dimension because they are already in
+// the build cache. [Transformer.Transform] is not called for those packages, so
+// transformers that keep state outside of the build, e.g. an index of what they
+// patched, can use this to keep it up to date.
+type CachedPackageTransformer interface {
+	Transformer
+
+	// OnCachedPackage is called with the path of the package and the path of its
+	// cached archive in the dimension, i.e. [TransformContext.Dimension]. This is
+	// never called when [Config.ForceTransform] is set since packages are always
+	// compiled then.
+	OnCachedPackage(ctx *TransformContext, pkgPath, archiveFile string) error
+}
+
+// TransformerFactory creates a [Transformer] from options. Transformers that are
+// published as libraries usually provide a factory so they can be configured in
+// [Config.TransformerFactories] and by users of the toolexec executable via
+// flags or a config file.
+type TransformerFactory func(options TransformerOptions) (Transformer, error)
+
+// TransformerOptions are options given to a [TransformerFactory].
+type TransformerOptions struct {
+	// Packages are the package paths the transformer should apply to. A path
+	// ending in "/..." also matches all packages beneath it. Transformers are
+	// expected to use [TransformerOptions.MatchesPackage] in AppliesToPackage.
+	Packages []string `json:"packages,omitempty"`
+
+	// Features are transformer-specific feature flags. Features that are not
+	// present are considered disabled.
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// MatchesPackage returns true if the given package path matches any of the
+// packages in these options.
+func (t TransformerOptions) MatchesPackage(pkgPath string) bool {
+	for _, pattern := range t.Packages {
+		if pattern == pkgPath {
+			return true
+		} else if prefix := strings.TrimSuffix(pattern, "/..."); prefix != pattern &&
+			(pkgPath == prefix || strings.HasPrefix(pkgPath, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
 // TransformContext is a dimension-specific context used for transformer calls.
 type TransformContext struct {
 	// Context is the embedded Go context. This context usually just comes from
@@ -43,12 +128,121 @@ type TransformContext struct {
 
 	// Dimension is the current dimension being transformed.
 	Dimension string
+
+	// OutputFile is the path of the original compiled archive (i.e. the "-o" of
+	// the compile) for the package. This is only set when compiling the package
+	// in the dimension, i.e. for [CopyOnlyTransformer.CopyOnly] and
+	// [Transformer.Transform]. Dimensions are compiled before the original
+	// package, so this file is not written yet during transformation.
+	OutputFile string
+
+	// DimensionOutputFile is the path of the archive the package is about to be
+	// compiled to in the dimension before it is moved into the build cache. This
+	// is only set when OutputFile is.
+	DimensionOutputFile string
+
+	// Set when transforming a package in hermetic mode
+	hermetic *hermeticScope
 }
 
-// TransformPackage is the package to transform. This currently just embeds
-// [packages.Package] and should never be mutated.
+// TransformPackage is the package to transform. This embeds
+// [packages.Package] which should never be mutated.
 type TransformPackage struct {
 	*packages.Package
+
+	// LangVersion is the Go language version the package is compiled with, e.g.
+	// "go1.19", which usually comes from the go directive of its module. This is
+	// empty if the compiler was not given one. Patches that add syntax newer than
+	// this fail the build.
+	LangVersion string
+
+	// GoVersion is the version of Go compiling the package, e.g. "go1.21.3", or
+	// empty if the compiler was not given one.
+	GoVersion string
+
+	// ExternalTestOf is the path of the package under test when this is its
+	// external test package, i.e. the "_test" package of a package's black-box
+	// test files. Otherwise this is empty.
+	ExternalTestOf string
+
+	// Contents of files the go command's overlay replaces, keyed by original file
+	overlay map[string][]byte
+}
+
+// TransformFile is a file of a [TransformPackage]. See
+// [TransformPackage.Files].
+type TransformFile struct {
+	// Syntax is the parsed file.
+	Syntax *ast.File
+
+	// CompiledGoFile is the path of the file that is compiled, which is the file
+	// Syntax was parsed from.
+	CompiledGoFile string
+
+	// GoFile is the path of the source file in the package the compiled file is
+	// from. This is the same as CompiledGoFile unless the go command generates
+	// the compiled file during the build, e.g. with cgo. Then this is the source
+	// file it was generated from, or empty if there is none. Files the go command
+	// generates cannot be patched since they are not known until the build.
+	GoFile string
+
+	// Generated is true if the go command generates the compiled file or the
+	// file has a "Code generated ... DO NOT EDIT." comment before the package
+	// clause. Transformers that should only alter hand-written code can skip
+	// these.
+	Generated bool
+}
+
+// Files returns a file for each file of the package syntax, in the same order.
+// Transformers should use this instead of relying on the syntax, GoFiles, and
+// CompiledGoFiles being in the same order, since the go command may add
+// compiled files that are not source files.
+func (t *TransformPackage) Files() []*TransformFile {
+	goFiles := make(map[string]bool, len(t.GoFiles))
+	for _, goFile := range t.GoFiles {
+		goFiles[goFile] = true
+	}
+	files := make([]*TransformFile, 0, len(t.Syntax))
+	for _, syntax := range t.Syntax {
+		file := &TransformFile{Syntax: syntax, CompiledGoFile: t.Fset.File(syntax.Package).Name()}
+		if goFiles[file.CompiledGoFile] {
+			file.GoFile = file.CompiledGoFile
+		} else if src := t.Fset.PositionFor(syntax.Package, true).Filename; goFiles[src] {
+			// Generated files start with a line directive to their source, if any
+			file.GoFile = src
+		}
+		file.Generated = file.GoFile != file.CompiledGoFile || hasGeneratedComment(syntax)
+		files = append(files, file)
+	}
+	return files
+}
+
+// File returns the file for the given syntax of the package, or nil if the
+// syntax is not of the package.
+func (t *TransformPackage) File(syntax *ast.File) *TransformFile {
+	for _, file := range t.Files() {
+		if file.Syntax == syntax {
+			return file
+		}
+	}
+	return nil
+}
+
+var generatedCommentRegexp = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// Same as ast.IsGenerated which is not in our minimum Go version
+func hasGeneratedComment(file *ast.File) bool {
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if generatedCommentRegexp.MatchString(comment.Text) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // TransformResult represents a result of a transform.
@@ -58,19 +252,60 @@ type TransformResult struct {
 	// system does that).
 	Patches []*Patch
 
+	// Replacements are AST nodes to print in place of nodes of the package, which
+	// is usually easier than computing patch ranges for anything but trivial
+	// rewrites. Each is converted to a patch, so they cannot overlap each other
+	// or the patches.
+	Replacements []*NodeReplacement
+
+	// OffsetPatches are patches with byte offsets in a named file instead of
+	// positions, for transformers that work on the raw contents of files, e.g.
+	// to rewrite SQL in string literals or text in comments. Each file must be a
+	// compiled Go file of the package as in [TransformFile.CompiledGoFile], and
+	// offsets are into its contents the package was loaded from. They are
+	// converted with [FilePatch.Patch] and are then the same as Patches.
+	OffsetPatches []*FilePatch
+
 	// IncludeDependencyPackages is a set of packages that should be included on
 	// the transformed code that may not have been included in the original code.
 	// this is important for the Go compiler/linker since they can't otherwise
-	// know ahead of time what the new dependencies are. Since these reference Go
-	// cache during build, these modules should already be built and in the Go
-	// cache.
+	// know ahead of time what the new dependencies are. Packages that are not
+	// built yet are built on demand with this toolexec, but they must be
+	// resolvable from the module being built.
 	IncludeDependencyPackages map[string]struct{}
 
+	// AddFiles are new Go files to compile into the dimension package, keyed by
+	// file name, e.g. for shims or generated registries too large for patches.
+	// Names must end in ".go" and cannot be the name of any file in the package
+	// unless that file is in ExcludeFiles. The files are compiled as given,
+	// except that imports are handled the same as for the package's files: those
+	// the dimension applies to are for the dimension package, which must also be
+	// imported by the package, and others are included like
+	// IncludeDependencyPackages. Build constraints in the files are ignored.
+	AddFiles map[string][]byte
+
+	// ExcludeFiles is a set of files of the package to leave out of the
+	// dimension package, e.g. platform stubs or files replaced by AddFiles. Each
+	// is a compiled Go file as in [TransformFile.CompiledGoFile]. Patches to
+	// excluded files are ignored.
+	ExcludeFiles map[string]struct{}
+
+	// ReplaceFiles are new contents of files of the package, keyed by compiled Go
+	// file as in [TransformFile.CompiledGoFile], e.g. to substitute an
+	// implementation file. Each is compiled in place of the file and, like
+	// AddFiles, as given except for how imports are handled. Superpose does not
+	// patch them either, e.g. for "<in>" bool vars. Patches and replacements
+	// cannot be in a replaced file, and a file cannot be both replaced and in
+	// ExcludeFiles.
+	ReplaceFiles map[string][]byte
+
 	// AddLineDirectives, if true, will add a line directive to the top of each
 	// patched Go file informing the Go compiler that the dimension filename is
 	// actually the original filename. This can help with stack traces and
-	// debugging, but transformers should be careful to not alter line numbers
-	// with their patches.
+	// debugging. A line directive is also added after each patch that changes
+	// the number of lines it replaces, so what follows keeps its original
+	// position. Patches that already end with a line directive, like those of
+	// [ReplaceFuncBody], are left as is.
 	AddLineDirectives bool
 
 	// LogPatchedFiles, if true, does a debug log of fully patched file before
@@ -81,6 +316,85 @@ type TransformResult struct {
 	// LoadMode: packages.LoadMode
 }
 
+// AddImport adds an insert that imports the package with the given alias into
+// the file, and adds the package and all of its transitive dependencies to
+// IncludeDependencyPackages. The import is put on the same line after the last
+// import of the file, or after the package clause if there are none, so line
+// numbers do not change. Nothing is inserted if the file already imports the
+// package with the alias or it was already added, so this can be called for
+// every use. The alias should not conflict with names in the file, e.g. by
+// starting with "__", and the import must be used.
+//
+// Imports added to the same file are combined into a single insert. Other
+// inserts at the same position must be added after this, see
+// recipes.MergeInserts.
+func (t *TransformResult) AddImport(ctx *TransformContext, file *ast.File, pkgPath, alias string) error {
+	pos := file.Name.End()
+	for _, decl := range file.Decls {
+		genDecl, _ := decl.(*ast.GenDecl)
+		if genDecl == nil || genDecl.Tok != token.IMPORT {
+			break
+		}
+		pos = genDecl.End()
+		for _, spec := range genDecl.Specs {
+			spec := spec.(*ast.ImportSpec)
+			if path, _ := strconv.Unquote(spec.Path.Value); path == pkgPath && spec.Name != nil &&
+				spec.Name.Name == alias {
+				return nil
+			}
+		}
+	}
+	str := fmt.Sprintf("; import %v %q", alias, pkgPath)
+	var existing *Patch
+	for _, patch := range t.Patches {
+		if patch.Range.Pos == pos && !patch.Range.End.IsValid() {
+			existing = patch
+			break
+		}
+	}
+	if existing == nil {
+		t.Patches = append(t.Patches, &Patch{Range: Range{Pos: pos}, Str: str})
+	} else if !strings.Contains(existing.Str, str) {
+		// Imports must be before anything else inserted after them
+		existing.Str = str + existing.Str
+	}
+	return t.IncludeDependencies(ctx, pkgPath)
+}
+
+// IncludeDependencies adds the packages and all of their transitive
+// dependencies to IncludeDependencyPackages, e.g. for packages that added files
+// import. AddImport does this for the package it imports. The dependencies are
+// loaded once per process.
+func (t *TransformResult) IncludeDependencies(ctx *TransformContext, pkgPaths ...string) error {
+	for _, pkgPath := range pkgPaths {
+		deps, err := ctx.Superpose.dependencyPackages(ctx, pkgPath)
+		if err != nil {
+			return err
+		}
+		if t.IncludeDependencyPackages == nil {
+			t.IncludeDependencyPackages = make(map[string]struct{}, len(deps))
+		}
+		for _, dep := range deps {
+			t.IncludeDependencyPackages[dep] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// NodeReplacement replaces a node of the package's syntax with printed AST
+// nodes.
+type NodeReplacement struct {
+	// Node is the node in the package's syntax to replace, e.g. an [ast.Decl] or
+	// [ast.Stmt]. Like the rest of the package, it must not be mutated. Instead,
+	// give a modified copy in With, which may reuse unmodified children of Node.
+	Node ast.Node
+
+	// With are the nodes printed in place of Node, one per line. More than one
+	// is only valid for declarations and statements. If empty, Node is removed.
+	// Comments within Node are not kept.
+	With []ast.Node
+}
+
 // Patch represents a patch to a file.
 type Patch struct {
 	// Range represents the range to patch. If `End` is 0/unset, this patch is an
@@ -95,6 +409,20 @@ type Patch struct {
 	// template where the map keys are indices of the `Captures` and the values
 	// the captured strings.
 	Str string
+
+	// Funcs are functions available to the `Str` template in addition to Go's
+	// predefined template functions, e.g. to quote or upper-case a capture.
+	Funcs template.FuncMap
+
+	// Describes what is patched for patches added by Superpose itself, empty
+	// for transformer patches
+	managed string
+	// Whether to add a line directive after the patch if it changes the number
+	// of lines, see TransformResult.AddLineDirectives
+	restoreLine bool
+	// Whether to replace the range with spaces, keeping its whitespace, instead
+	// of Str, see DeleteNode
+	blank bool
 }
 
 // WrapWithPatch creates a patch that adds the lhs and rhs values on either side
@@ -104,6 +432,108 @@ func WrapWithPatch(n ast.Node, lhs, rhs string) *Patch {
 	return &Patch{Range: r, Captures: map[string]Range{"__1__": r}, Str: lhs + "{{.__1__}}" + rhs}
 }
 
+// Gives a patch for each replacement. If line directives are added, a line
+// directive after each replacement restores the original position of what
+// follows since printed nodes rarely have the same lines as the original.
+func (t *TransformResult) replacementPatches(fset *token.FileSet) ([]*Patch, error) {
+	patches := make([]*Patch, 0, len(t.Replacements))
+	for i, replacement := range t.Replacements {
+		if replacement.Node == nil {
+			return nil, fmt.Errorf("replacement #%v has no node", i+1)
+		}
+		file := fset.File(replacement.Node.Pos())
+		if file == nil {
+			return nil, fmt.Errorf("cannot find file for replacement #%v", i+1)
+		}
+		var str strings.Builder
+		for j, node := range replacement.With {
+			if j > 0 {
+				str.WriteString("\n")
+				if _, ok := node.(ast.Decl); ok {
+					str.WriteString("\n")
+				}
+			}
+			if err := format.Node(&str, fset, node); err != nil {
+				return nil, fmt.Errorf("failed printing replacement for %v: %w",
+					fset.Position(replacement.Node.Pos()), err)
+			}
+		}
+		if t.AddLineDirectives {
+			end := fset.Position(replacement.Node.End())
+			fmt.Fprintf(&str, "/*line %v:%v:%v*/", file.Name(), end.Line, end.Column)
+		}
+		patches = append(patches, &Patch{Range: RangeOf(replacement.Node), Str: str.String()})
+	}
+	return patches, nil
+}
+
+// TemplatePatch creates patches that replace the given node with the given
+// template, where "{{.name}}" placeholders reference the children ranges by
+// name. Unlike [WrapWithPatch], children are left in place where possible so
+// they can still be patched by the transformer. Only the text between them is
+// patched, similar to patching the LHS and RHS separately.
+//
+// Placeholders are visited in template order, and a child is left in place if
+// it starts at or after the end of the last one left in place. Otherwise, such
+// as when a child is moved before another or used more than once, it is
+// captured from the original source into the patch instead, so it must not be
+// patched by anything else. Children must be within the node.
+func TemplatePatch(n ast.Node, tmpl string, children map[string]Range) ([]*Patch, error) {
+	nodeRange := RangeOf(n)
+	type placeholder struct {
+		name       string
+		start, end int
+	}
+	var placeholders []placeholder
+	for name, r := range children {
+		if r.Pos < nodeRange.Pos || r.End < r.Pos || r.End > nodeRange.End {
+			return nil, fmt.Errorf("child %v is not within node", name)
+		}
+		str := "{{." + name + "}}"
+		for start := 0; ; {
+			index := strings.Index(tmpl[start:], str)
+			if index < 0 {
+				break
+			}
+			start += index
+			placeholders = append(placeholders, placeholder{name: name, start: start, end: start + len(str)})
+			start += len(str)
+		}
+	}
+	sort.Slice(placeholders, func(i, j int) bool { return placeholders[i].start < placeholders[j].start })
+
+	// Patch the text before each child left in place, capturing the rest
+	var patches []*Patch
+	pos, tmplStart := nodeRange.Pos, 0
+	captures, inPlace := map[string]Range{}, map[string]bool{}
+	for _, p := range placeholders {
+		r := children[p.name]
+		if inPlace[p.name] || r.Pos < pos {
+			captures[p.name] = r
+			continue
+		}
+		inPlace[p.name] = true
+		patches = appendTemplatePatch(patches, Range{Pos: pos, End: r.Pos}, tmpl[tmplStart:p.start], captures)
+		pos, tmplStart, captures = r.End, p.end, map[string]Range{}
+	}
+	return appendTemplatePatch(patches, Range{Pos: pos, End: nodeRange.End}, tmpl[tmplStart:], captures), nil
+}
+
+// Empty ranges are inserts, or nothing if there is no string
+func appendTemplatePatch(patches []*Patch, r Range, str string, captures map[string]Range) []*Patch {
+	if r.Pos == r.End {
+		if str == "" {
+			return patches
+		}
+		r.End = token.NoPos
+	}
+	patch := &Patch{Range: r, Str: str}
+	if len(captures) > 0 {
+		patch.Captures = captures
+	}
+	return append(patches, patch)
+}
+
 // LineResetPatch returns a patch just after the given node end that adds a line
 // directive comment to set the line back to what it was before alteration.
 func (t *TransformPackage) LineResetPatch(n ast.Node) *Patch {
@@ -113,43 +543,102 @@ func (t *TransformPackage) LineResetPatch(n ast.Node) *Patch {
 	}
 }
 
+// ReplaceFuncBody returns a patch that replaces everything between the braces of
+// the function body with the given body. The new body is placed on the line of
+// the opening brace and is followed by a line directive so the closing brace and
+// everything after it keep their original line numbers. Therefore the new body
+// must not contain newlines. Functions without a body, like those implemented by
+// the runtime, are given one.
+func ReplaceFuncBody(pkg *TransformPackage, decl *ast.FuncDecl, body string) *Patch {
+	if decl.Body == nil {
+		return &Patch{Range: Range{Pos: decl.Type.End()}, Str: " { " + body + " }"}
+	}
+	return &Patch{
+		Range: Range{Pos: decl.Body.Lbrace + 1, End: decl.Body.Rbrace},
+		Str:   fmt.Sprintf(" %v /*line :%v*/", body, pkg.Fset.Position(decl.Body.Rbrace).Line),
+	}
+}
+
+// DeleteNode returns a patch that removes the given node. Every character of the
+// node except whitespace is replaced with a space, so everything after it keeps
+// its original line and column without line directives. Comments attached to
+// the node, e.g. the doc of a declaration, are not removed. The code must still
+// be valid without the node, e.g. a statement or declaration.
+func DeleteNode(n ast.Node) *Patch {
+	return &Patch{Range: RangeOf(n), blank: true}
+}
+
 // ApplyPatches applies the given patches to the fileset and returns a map of
 // only affected files and their final contents. Note, this function may reorder
 // the given patches slice.
 func ApplyPatches(fset *token.FileSet, patches []*Patch) (map[string][]byte, error) {
+	files, _, err := applyPatches(fset, patches, nil)
+	return files, err
+}
+
+// Files in the overlay have its contents instead of those on disk. Also gives
+// the applied patches of each file in the order they were applied.
+func applyPatches(
+	fset *token.FileSet,
+	patches []*Patch,
+	overlay map[string][]byte,
+) (map[string][]byte, map[string][]*appliedPatch, error) {
 	// Sort in reverse order
 	sort.Slice(patches, func(i, j int) bool { return patches[i].Range.Pos > patches[j].Range.Pos })
 	// Apply in reverse order, validating range each time
 	files := map[string][]byte{}
+	applied := map[string][]*appliedPatch{}
 	for i, patch := range patches {
 		if !patch.Range.Pos.IsValid() {
-			return nil, fmt.Errorf("patch missing start pos")
+			return nil, nil, fmt.Errorf("patch missing start pos")
 		} else if patch.Range.End.IsValid() && patch.Range.End < patch.Range.Pos {
-			return nil, fmt.Errorf("patch end before start")
+			return nil, nil, fmt.Errorf("patch end before start")
 		}
 		if i > 0 && patches[i-1].Range.Overlaps(&patch.Range) {
-			return nil, fmt.Errorf("patches overlap")
+			return nil, nil, fmt.Errorf("patches overlap")
 		}
-		if err := ApplyPatch(fset, patch, files); err != nil {
-			return nil, err
+		appliedPatch, err := applyPatch(fset, patch, files, overlay)
+		if err != nil {
+			return nil, nil, err
 		}
+		applied[appliedPatch.file] = append(applied[appliedPatch.file], appliedPatch)
 	}
-	return files, nil
+	return files, applied, nil
 }
 
 // ApplyPatch applies a single patch based on the given fileset, and then sets
 // the resulting content in the files map parameter.
 func ApplyPatch(fset *token.FileSet, patch *Patch, files map[string][]byte) error {
+	_, err := applyPatch(fset, patch, files, nil)
+	return err
+}
+
+// A patch as it was applied to a file
+type appliedPatch struct {
+	patch *Patch
+	file  string
+	// Offsets of the patched range in the original file
+	start, end int
+	// What the range was replaced with
+	str string
+}
+
+func applyPatch(
+	fset *token.FileSet,
+	patch *Patch,
+	files map[string][]byte,
+	overlay map[string][]byte,
+) (*appliedPatch, error) {
 	// Load file if not already there
 	file := fset.File(patch.Range.Pos)
 	if file == nil {
-		return fmt.Errorf("cannot find file for patch")
+		return nil, fmt.Errorf("cannot find file for patch")
 	}
 	fileBytes := files[file.Name()]
 	if len(fileBytes) == 0 {
 		var err error
-		if fileBytes, err = os.ReadFile(file.Name()); err != nil {
-			return fmt.Errorf("failed reading file %v: %w", file.Name(), err)
+		if fileBytes, err = readFile(file.Name(), overlay); err != nil {
+			return nil, err
 		}
 		files[file.Name()] = fileBytes
 	}
@@ -157,22 +646,30 @@ func ApplyPatch(fset *token.FileSet, patch *Patch, files map[string][]byte) erro
 	// If str is a template, apply
 	str := patch.Str
 	if strings.Contains(str, "{{") {
-		t, err := template.New("patch").Parse(str)
+		t, err := template.New("patch").Funcs(patch.Funcs).Parse(str)
 		if err != nil {
-			return fmt.Errorf("failed parsing template: %w", err)
+			return nil, fmt.Errorf("failed parsing template: %w", err)
+		}
+		// Captures are from the original file, but patches after this one may have
+		// already been applied to the file bytes
+		origBytes := fileBytes
+		if len(patch.Captures) > 0 {
+			if origBytes, err = readFile(file.Name(), overlay); err != nil {
+				return nil, err
+			}
 		}
 		captureMap := make(map[string]string, len(patch.Captures))
 		for k, capture := range patch.Captures {
 			start := fset.Position(capture.Pos)
 			end := fset.Position(capture.End)
 			if !start.IsValid() || !end.IsValid() || start.Filename != file.Name() || end.Filename != file.Name() {
-				return fmt.Errorf("start or end invalid or in wrong file")
+				return nil, fmt.Errorf("start or end invalid or in wrong file")
 			}
-			captureMap[k] = string(fileBytes[start.Offset:end.Offset])
+			captureMap[k] = string(origBytes[start.Offset:end.Offset])
 		}
 		var bld strings.Builder
 		if err := t.Execute(&bld, captureMap); err != nil {
-			return fmt.Errorf("failed running template: %w", err)
+			return nil, fmt.Errorf("failed running template: %w", err)
 		}
 		str = bld.String()
 	}
@@ -183,8 +680,70 @@ func ApplyPatch(fset *token.FileSet, patch *Patch, files map[string][]byte) erro
 	if patch.Range.End.IsValid() {
 		end = fset.Position(patch.Range.End).Offset
 	}
+	// Everything after the range was not patched yet, so the range is still the
+	// original text
+	if patch.blank {
+		blanked := make([]byte, end-start)
+		for i, b := range fileBytes[start:end] {
+			switch b {
+			case '\n', '\r', '\t':
+				blanked[i] = b
+			default:
+				blanked[i] = ' '
+			}
+		}
+		str = string(blanked)
+	}
+	if patch.restoreLine && strings.Count(str, "\n") != bytes.Count(fileBytes[start:end], []byte("\n")) &&
+		!trailingLineDirective.MatchString(str) {
+		pos := fset.Position(file.Pos(end))
+		str += fmt.Sprintf("/*line %v:%v:%v*/", file.Name(), pos.Line, pos.Column)
+	}
 	files[file.Name()] = append(fileBytes[:start], append([]byte(str), fileBytes[end:]...)...)
-	return nil
+	return &appliedPatch{patch: patch, file: file.Name(), start: start, end: end, str: str}, nil
+}
+
+// Gives the patch whose text is at the offset of the patched file or, if none,
+// the closest patch before it. The applied patches must be those of the file in
+// the order they were applied. Returns nil if no patch is at or before it.
+func patchAtOffset(applied []*appliedPatch, offset int) *appliedPatch {
+	// Patches are applied from the end of the file, so the last applied is the
+	// first in the file and each shifts those after it
+	var found *appliedPatch
+	shift := 0
+	for i := len(applied) - 1; i >= 0; i-- {
+		a := applied[i]
+		if a.start+shift > offset {
+			break
+		}
+		found = a
+		shift += len(a.str) - (a.end - a.start)
+	}
+	return found
+}
+
+var trailingLineDirective = regexp.MustCompile(`/\*line [^*]*\*/\s*$`)
+
+// Reads the file from the overlay if present or from disk otherwise. The result
+// is always a copy that can be altered.
+func readFile(name string, overlay map[string][]byte) ([]byte, error) {
+	if b, ok := overlay[name]; ok {
+		return append([]byte(nil), b...), nil
+	}
+	// The overlay may spell the file differently, e.g. in another case on Windows
+	if len(overlay) > 0 {
+		comparableName := comparablePath(name)
+		for file, b := range overlay {
+			if comparablePath(file) == comparableName {
+				return append([]byte(nil), b...), nil
+			}
+		}
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading file %v: %w", name, err)
+	}
+	return b, nil
 }
 
 // Range is a range of positions in Go source.